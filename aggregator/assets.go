@@ -0,0 +1,185 @@
+package aggregator
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/nkcr/OSIA/images"
+	"github.com/nkcr/OSIA/instagram/types"
+	"github.com/nkcr/OSIA/store"
+)
+
+// maxAssetAttempts is the number of updates during which the image of a media
+// is downloaded before giving up
+const maxAssetAttempts = 5
+
+// downloadAssets downloads the images of the medias whose asset is pending.
+// Images are downloaded concurrently, outside of any transaction, and each
+// media is updated once its image is processed, in the order of the store. A
+// failed download is attempted again by the next updates. Fresh contains the
+// IDs of the medias that have just been fetched from Instagram.
+func (a *InstagramAggregator) downloadAssets(fresh map[string]bool) error {
+	pending, _, err := a.store.List(store.Query{
+		Filter: store.Filter{AssetState: types.AssetPending},
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to list medias: %v", err)
+	}
+
+	urls := make([]string, len(pending))
+	refreshErrs := make([]error, len(pending))
+	refreshes := []task{}
+
+	for i, media := range pending {
+		urls[i] = media.MediaURL
+
+		// the URLs of Instagram expire, a fresh one is needed unless the
+		// media has just been fetched
+		if fresh[media.ID] {
+			continue
+		}
+
+		i := i
+
+		refreshes = append(refreshes, task{host: apiHost, do: func() error {
+			fresh, err := a.api.GetMedia(pending[i].ID)
+			if err != nil {
+				refreshErrs[i] = fmt.Errorf("failed to get media: %v", err)
+				return err
+			}
+
+			// a rate limited attempt may have failed before
+			refreshErrs[i] = nil
+			urls[i] = fresh.MediaURL
+
+			return nil
+		}})
+	}
+
+	a.pool.run(refreshes, func(int, error) {})
+
+	results := make([]asset, len(pending))
+	downloads := make([]task, len(pending))
+
+	for i := range pending {
+		i := i
+
+		downloads[i] = task{host: hostOf(urls[i]), do: func() error {
+			if refreshErrs[i] != nil {
+				results[i] = asset{mediaURL: urls[i], err: refreshErrs[i]}
+				return nil
+			}
+
+			results[i] = a.fetchAsset(pending[i], urls[i])
+
+			return results[i].err
+		}}
+	}
+
+	a.pool.run(downloads, func(i int, _ error) {
+		if err != nil {
+			return
+		}
+
+		err = a.recordAsset(pending[i], results[i])
+		if err != nil {
+			err = fmt.Errorf("failed to record asset of media '%s': %v", pending[i].ID, err)
+		}
+	})
+
+	return err
+}
+
+// asset contains the outcome of the download of a media's image
+type asset struct {
+	mediaURL   string
+	checksum   string
+	metadata   *images.Metadata
+	renditions []types.Rendition
+	// files contains the saved files
+	files []string
+	err   error
+}
+
+// recordAsset saves the outcome of the download of an image with its media
+func (a *InstagramAggregator) recordAsset(media types.Media, result asset) error {
+	if result.err != nil {
+		a.logger.Warn().Err(result.err).Msgf("failed to save image of media '%s'", media.ID)
+	}
+
+	_, err := a.store.Update(media.ID, func(media *types.Media) error {
+		result.apply(media)
+		return nil
+	})
+
+	// the media has been deleted in the meantime
+	if errors.Is(err, store.ErrNotFound) {
+		for _, file := range result.files {
+			os.Remove(file)
+		}
+
+		return nil
+	}
+
+	return err
+}
+
+// fetchAsset downloads the image of a media from the given URL, extracts its
+// metadata and generates its renditions.
+func (a *InstagramAggregator) fetchAsset(media types.Media, mediaURL string) asset {
+	result := asset{mediaURL: mediaURL}
+
+	imagePath := filepath.Join(a.imagesFolder, media.ID+".jpg")
+
+	img, checksum, err := saveImage(result.mediaURL, imagePath, media.MediaType == "VIDEO", a.client)
+	if err != nil {
+		result.err = err
+		return result
+	}
+
+	result.checksum = checksum
+	result.files = append(result.files, imagePath)
+
+	// videos are not decoded
+	if img == nil {
+		return result
+	}
+
+	metadata := images.Analyze(img)
+	result.metadata = &metadata
+	result.renditions = a.render(media.ID, img)
+
+	for _, rendition := range result.renditions {
+		result.files = append(result.files, filepath.Join(a.imagesFolder, rendition.File))
+	}
+
+	return result
+}
+
+// apply updates a media with the outcome of the download of its image
+func (r asset) apply(media *types.Media) {
+	media.MediaURL = r.mediaURL
+	media.AssetAttempts++
+
+	if r.err != nil {
+		media.AssetError = r.err.Error()
+
+		if media.AssetAttempts >= maxAssetAttempts {
+			media.AssetState = types.AssetFailed
+		}
+
+		return
+	}
+
+	media.AssetState = types.AssetOK
+	media.AssetError = ""
+	media.Checksum = r.checksum
+	media.Renditions = r.renditions
+
+	if r.metadata != nil {
+		setMetadata(media, *r.metadata)
+	}
+}
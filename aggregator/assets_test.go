@@ -0,0 +1,196 @@
+package aggregator
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nkcr/OSIA/images"
+	"github.com/nkcr/OSIA/instagram/types"
+	"github.com/nkcr/OSIA/store"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// A failed download is retried by the next update, with a fresh URL.
+func TestDownloadAssetsRetry(t *testing.T) {
+	mediaStore := store.NewMemoryStore()
+
+	instagram := fakeInstagram{
+		medias: types.Medias{
+			Data: []types.Media{{ID: "aa", MediaURL: "https://example.com/expired.jpg"}},
+		},
+	}
+
+	client := imageClient{"https://example.com/fresh.jpg": jpegBody(t, 10, 10)}
+
+	agg := NewInstagramAggregator(mediaStore, instagram, t.TempDir(), client,
+		zerolog.New(io.Discard)).(*InstagramAggregator)
+
+	_, err := agg.updateMedias()
+	require.NoError(t, err)
+
+	media := getMedia(t, mediaStore, "aa")
+	require.Equal(t, types.AssetPending, media.AssetState)
+	require.Equal(t, 1, media.AssetAttempts)
+	require.Equal(t, "invalid image: not an image", media.AssetError)
+
+	agg.api = fakeInstagram{
+		medias: types.Medias{
+			Data: []types.Media{{ID: "aa", MediaURL: "https://example.com/fresh.jpg"}},
+		},
+	}
+
+	added, err := agg.updateMedias()
+	require.NoError(t, err)
+	require.Empty(t, added)
+
+	media = getMedia(t, mediaStore, "aa")
+	require.Equal(t, types.AssetOK, media.AssetState)
+	require.Equal(t, 2, media.AssetAttempts)
+	require.Empty(t, media.AssetError)
+	require.Equal(t, "https://example.com/fresh.jpg", media.MediaURL)
+	require.Equal(t, 10, media.Width)
+}
+
+// Downloads are not attempted again after too many failures.
+func TestDownloadAssetsGiveUp(t *testing.T) {
+	mediaStore := store.NewMemoryStore()
+
+	instagram := fakeInstagram{
+		medias: types.Medias{Data: []types.Media{{ID: "aa"}}},
+	}
+
+	calls := 0
+
+	client := funcClient(func(url string) (*http.Response, error) {
+		calls++
+		return nil, errors.New("fake")
+	})
+
+	agg := NewInstagramAggregator(mediaStore, instagram, t.TempDir(), client,
+		zerolog.New(io.Discard)).(*InstagramAggregator)
+
+	for i := 0; i < maxAssetAttempts+2; i++ {
+		_, err := agg.updateMedias()
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, maxAssetAttempts, calls)
+
+	media := getMedia(t, mediaStore, "aa")
+	require.Equal(t, types.AssetFailed, media.AssetState)
+	require.Equal(t, maxAssetAttempts, media.AssetAttempts)
+	require.Equal(t, "failed to get URL '': fake", media.AssetError)
+}
+
+// The mediaStore is not locked during downloads, and the files of a media deleted in
+// the meantime are removed.
+func TestDownloadAssetsDeleted(t *testing.T) {
+	mediaStore := store.NewMemoryStore()
+
+	instagram := fakeInstagram{
+		medias: types.Medias{Data: []types.Media{{ID: "aa"}}},
+	}
+
+	body := jpegBody(t, 800, 600)
+
+	client := funcClient(func(url string) (*http.Response, error) {
+		_, err := mediaStore.Delete("aa")
+		require.NoError(t, err)
+
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(bytes.NewReader(body)),
+		}, nil
+	})
+
+	imagesFolder := t.TempDir()
+
+	agg := NewInstagramAggregator(mediaStore, instagram, imagesFolder, client,
+		zerolog.New(io.Discard), WithRenditions(images.Rendition{Width: 320})).(*InstagramAggregator)
+
+	_, err := agg.updateMedias()
+	require.NoError(t, err)
+
+	_, err = mediaStore.Get("aa")
+	require.ErrorIs(t, err, store.ErrNotFound)
+
+	entries, err := os.ReadDir(imagesFolder)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+// Images are downloaded concurrently, and rate limits are retried without
+// counting as failed attempts.
+func TestDownloadAssetsConcurrent(t *testing.T) {
+	mediaStore := store.NewMemoryStore()
+
+	medias := types.Medias{}
+
+	for i := 0; i < 10; i++ {
+		medias.Data = append(medias.Data, types.Media{
+			ID:       fmt.Sprintf("m%d", i),
+			MediaURL: fmt.Sprintf("https://cdn%d.example.com/m%d.jpg", i%2, i),
+		})
+	}
+
+	body := jpegBody(t, 10, 10)
+
+	lock := sync.Mutex{}
+	requested := map[string]int{}
+
+	client := funcClient(func(url string) (*http.Response, error) {
+		lock.Lock()
+		requested[url]++
+		count := requested[url]
+		lock.Unlock()
+
+		if url == "https://cdn0.example.com/m4.jpg" && count == 1 {
+			return &http.Response{
+				StatusCode: http.StatusTooManyRequests,
+				Status:     "429 Too Many Requests",
+				Body:       io.NopCloser(bytes.NewReader(nil)),
+			}, nil
+		}
+
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(bytes.NewReader(body)),
+		}, nil
+	})
+
+	agg := NewInstagramAggregator(mediaStore, fakeInstagram{medias: medias}, t.TempDir(), client,
+		zerolog.New(io.Discard), WithConcurrency(4, 2)).(*InstagramAggregator)
+
+	agg.pool.backoff = time.Millisecond
+
+	added, err := agg.updateMedias()
+	require.NoError(t, err)
+	require.Len(t, added, 10)
+
+	for i, media := range added {
+		require.Equal(t, medias.Data[i].ID, media.ID)
+
+		saved := getMedia(t, mediaStore, media.ID)
+		require.Equal(t, types.AssetOK, saved.AssetState, media.ID)
+		require.Equal(t, 1, saved.AssetAttempts, media.ID)
+	}
+
+	require.Equal(t, 2, requested["https://cdn0.example.com/m4.jpg"])
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+type funcClient func(url string) (*http.Response, error)
+
+func (c funcClient) Get(url string) (*http.Response, error) {
+	return c(url)
+}
@@ -0,0 +1,76 @@
+package aggregator
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/nkcr/OSIA/images"
+	"github.com/nkcr/OSIA/instagram/types"
+	"github.com/nkcr/OSIA/store"
+)
+
+// BackfillReport contains the result of a backfill
+type BackfillReport struct {
+	// Updated contains the IDs of the medias whose metadata has been extracted
+	Updated []string
+	// Skipped contains the error of each media whose image can't be read,
+	// such as a missing file, by ID.
+	Skipped map[string]error
+}
+
+// BackfillMetadata extracts the metadata of the images of the medias that don't
+// have any yet, such as those added before OSIA extracted it. Videos are
+// ignored. The database is loaded in memory by OSIA, therefore it must be run
+// while OSIA is stopped.
+func BackfillMetadata(medias store.MediaStore, imagesFolder string) (BackfillReport, error) {
+	report := BackfillReport{
+		Updated: []string{},
+		Skipped: map[string]error{},
+	}
+
+	all, _, err := medias.List(store.Query{})
+	if err != nil {
+		return BackfillReport{}, fmt.Errorf("failed to list medias: %v", err)
+	}
+
+	for _, media := range all {
+		if media.MediaType == "VIDEO" || media.BlurHash != "" {
+			continue
+		}
+
+		// the metadata is extracted once the image is downloaded
+		if media.AssetState == types.AssetPending || media.AssetState == types.AssetFailed {
+			continue
+		}
+
+		img, err := images.Decode(filepath.Join(imagesFolder, media.ID+".jpg"))
+		if errors.Is(err, images.ErrNotImage) {
+			continue
+		}
+
+		if err != nil {
+			report.Skipped[media.ID] = err
+			continue
+		}
+
+		metadata := images.Analyze(img)
+
+		_, err = medias.Update(media.ID, func(media *types.Media) error {
+			setMetadata(media, metadata)
+			return nil
+		})
+
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		}
+
+		if err != nil {
+			return BackfillReport{}, fmt.Errorf("failed to update media: %v", err)
+		}
+
+		report.Updated = append(report.Updated, media.ID)
+	}
+
+	return report, nil
+}
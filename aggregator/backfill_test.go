@@ -0,0 +1,85 @@
+package aggregator
+
+import (
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nkcr/OSIA/instagram/types"
+	"github.com/nkcr/OSIA/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackfillMetadata(t *testing.T) {
+	mediaStore := store.NewMemoryStore()
+
+	imagesFolder := t.TempDir()
+
+	saveJPEG(t, filepath.Join(imagesFolder, "aa.jpg"), 800, 600)
+	saveJPEG(t, filepath.Join(imagesFolder, "cc.jpg"), 100, 100)
+
+	err := os.WriteFile(filepath.Join(imagesFolder, "bb.jpg"), []byte("fake video"), os.ModePerm)
+	require.NoError(t, err)
+
+	setMedias(t, mediaStore,
+		types.Media{ID: "aa", Caption: "first", Hidden: true},
+		types.Media{ID: "bb", MediaType: "VIDEO"},
+		// already done
+		types.Media{ID: "cc", BlurHash: "done"},
+		// the image is missing
+		types.Media{ID: "dd"},
+		// the image is not downloaded yet
+		types.Media{ID: "ff", AssetState: types.AssetPending},
+	)
+
+	report, err := BackfillMetadata(mediaStore, imagesFolder)
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"aa"}, report.Updated)
+	require.Len(t, report.Skipped, 1)
+	require.Error(t, report.Skipped["dd"])
+
+	aa := getMedia(t, mediaStore, "aa")
+
+	// other fields are kept
+	require.Equal(t, "first", aa.Caption)
+	require.True(t, aa.Hidden)
+
+	require.Equal(t, 800, aa.Width)
+	require.Equal(t, 600, aa.Height)
+	require.Equal(t, 1.3333, aa.AspectRatio)
+	require.Equal(t, "#000000", aa.DominantColor)
+	require.Equal(t, "L00000fQfQfQfQfQfQfQfQfQfQfQ", aa.BlurHash)
+
+	require.Equal(t, types.Media{ID: "bb", MediaType: "VIDEO"}, getMedia(t, mediaStore, "bb"))
+	require.Equal(t, types.Media{ID: "cc", BlurHash: "done"}, getMedia(t, mediaStore, "cc"))
+	require.Equal(t, types.Media{ID: "dd"}, getMedia(t, mediaStore, "dd"))
+
+	// it can be run again
+	report, err = BackfillMetadata(mediaStore, imagesFolder)
+	require.NoError(t, err)
+	require.Equal(t, []string{}, report.Updated)
+	require.Len(t, report.Skipped, 1)
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+func saveJPEG(t *testing.T, path string, width, height int) {
+	f, err := os.Create(path)
+	require.NoError(t, err)
+
+	defer f.Close()
+
+	err = jpeg.Encode(f, image.NewRGBA(image.Rect(0, 0, width, height)), nil)
+	require.NoError(t, err)
+}
+
+func getMedia(t *testing.T, mediaStore store.MediaStore, id string) types.Media {
+	media, err := mediaStore.Get(id)
+	require.NoError(t, err)
+
+	return media
+}
@@ -1,20 +1,26 @@
 package aggregator
 
 import (
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"image"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/nkcr/OSIA/events"
+	"github.com/nkcr/OSIA/images"
 	"github.com/nkcr/OSIA/instagram"
 	"github.com/nkcr/OSIA/instagram/types"
+	"github.com/nkcr/OSIA/store"
 	"github.com/rs/zerolog"
-	"github.com/tidwall/buntdb"
 )
 
 // Aggregator defines the primitives required for an Aggregator. An aggregator's
@@ -26,6 +32,34 @@ type Aggregator interface {
 
 	// Stop should stop the periodical update and free resources.
 	Stop()
+
+	// Trigger should run a synchronization immediately and return its report.
+	// Triggers that happen while a synchronization is pending are coalesced
+	// into a single one.
+	Trigger() (Report, error)
+
+	// Reconcile should download again the missing images and remove the files
+	// that belong to no media.
+	Reconcile(deleteOrphans bool) (ReconcileReport, error)
+}
+
+// Report contains the result of a synchronization
+type Report struct {
+	// Added contains the IDs of the medias added by the synchronization
+	Added []string `json:"added"`
+	// Removed contains the IDs of the medias removed by the retention
+	Removed []string `json:"removed,omitempty"`
+	// WouldRemove contains the IDs of the medias that the retention would
+	// remove, in dry run
+	WouldRemove []string  `json:"would_remove,omitempty"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+}
+
+// syncResult is sent to the callers of Trigger
+type syncResult struct {
+	report Report
+	err    error
 }
 
 // HTTPClient defines the primitive needed to perform HTTP queries
@@ -33,20 +67,57 @@ type HTTPClient interface {
 	Get(url string) (resp *http.Response, err error)
 }
 
+// Option defines an option that can be passed when creating a new aggregator
+type Option func(*InstagramAggregator)
+
+// WithPublisher sets the publisher that receives the "media.added" and
+// "sync.completed" events. By default events are not published.
+func WithPublisher(publisher events.Publisher) Option {
+	return func(a *InstagramAggregator) {
+		a.publisher = publisher
+	}
+}
+
+// WithRenditions sets the renditions generated for the image of each new
+// media, such as smaller versions for responsive pages. By default no rendition
+// is generated.
+func WithRenditions(renditions ...images.Rendition) Option {
+	return func(a *InstagramAggregator) {
+		a.renditions = renditions
+	}
+}
+
+// WithConcurrency sets the number of medias and images fetched at once, in
+// total and from the same host. By default 4 are fetched at once, 2 per host.
+func WithConcurrency(workers, perHost int) Option {
+	return func(a *InstagramAggregator) {
+		a.pool = newPool(workers, perHost)
+	}
+}
+
 // NewInstagramAggregator returns a new initialized instagram aggregator.
-func NewInstagramAggregator(db *buntdb.DB, api instagram.InstagramAPI,
-	imagesFolder string, client HTTPClient, logger zerolog.Logger) Aggregator {
+func NewInstagramAggregator(store store.MediaStore, api instagram.InstagramAPI,
+	imagesFolder string, client HTTPClient, logger zerolog.Logger, opts ...Option) Aggregator {
 
 	logger = logger.With().Str("role", "aggregator").Logger()
 
-	return &InstagramAggregator{
-		db:           db,
+	a := &InstagramAggregator{
+		store:        store,
 		api:          api,
 		quit:         make(chan struct{}),
+		triggers:     make(chan struct{}, 1),
 		logger:       logger,
 		imagesFolder: imagesFolder,
+		imageCache:   filepath.Clean(imagesFolder) + "-resized",
 		client:       client,
+		pool:         newPool(4, 2),
+	}
+
+	for _, opt := range opts {
+		opt(a)
 	}
+
+	return a
 }
 
 // InstagramAggregator implements an aggregator that fetches Instagram posts.
@@ -54,16 +125,32 @@ func NewInstagramAggregator(db *buntdb.DB, api instagram.InstagramAPI,
 // - implements aggregator.Aggregator
 type InstagramAggregator struct {
 	sync.Mutex
-	db           *buntdb.DB
+	store        store.MediaStore
 	api          instagram.InstagramAPI
 	logger       zerolog.Logger
 	quit         chan struct{}
 	imagesFolder string
+	imageCache   string
 	client       HTTPClient
+	publisher    events.Publisher
+	renditions   []images.Rendition
+	pool         *pool
+
+	reconcileInterval time.Duration
+	deleteOrphans     bool
+	retention         Retention
+
+	// triggers notifies the aggregator that waiters are pending. Access to
+	// running and waiters must be protected by the lock.
+	triggers chan struct{}
+	running  bool
+	waiters  []chan syncResult
 }
 
 // Start implements aggregator.Aggregator. It should be called only if the
-// aggregator is not already running.
+// aggregator is not already running. An error while periodically updating
+// medias stops the aggregator, while an error from a triggered update is only
+// reported to the callers of Trigger.
 func (a *InstagramAggregator) Start(interval time.Duration) error {
 	a.logger.Info().Msg("aggregator starting")
 
@@ -71,125 +158,384 @@ func (a *InstagramAggregator) Start(interval time.Duration) error {
 
 	defer ticker.Stop()
 
+	// a nil channel disables the periodic reconciliation
+	var reconcile <-chan time.Time
+
+	if a.reconcileInterval > 0 {
+		reconcileTicker := time.NewTicker(a.reconcileInterval)
+		defer reconcileTicker.Stop()
+
+		reconcile = reconcileTicker.C
+	}
+
+	a.Lock()
+	a.running = true
+	a.Unlock()
+
+	defer func() {
+		a.Lock()
+		a.running = false
+		waiters := a.waiters
+		a.waiters = nil
+		a.Unlock()
+
+		for _, waiter := range waiters {
+			waiter <- syncResult{err: fmt.Errorf("aggregator stopped")}
+		}
+	}()
+
 	for {
 		a.logger.Info().Msg("updating media")
 
-		err := a.updateMedias()
+		_, err := a.sync()
 		if err != nil {
 			return fmt.Errorf("failed to update medias: %v", err)
 		}
 
+		if !a.waitTick(ticker, reconcile) {
+			return nil
+		}
+	}
+}
+
+// waitTick waits for the next tick while handling triggered synchronizations
+// and reconciliations. It returns false if the aggregator must stop.
+func (a *InstagramAggregator) waitTick(ticker *time.Ticker, reconcile <-chan time.Time) bool {
+	for {
 		select {
 		case <-a.quit:
-			return nil
+			return false
 		case <-ticker.C:
-			continue
+			return true
+		case <-a.triggers:
+			a.Lock()
+			waiters := a.waiters
+			a.waiters = nil
+			a.Unlock()
+
+			a.logger.Info().Msgf("updating media, triggered by %d caller(s)", len(waiters))
+
+			report, err := a.sync()
+			if err != nil {
+				a.logger.Err(err).Msg("failed to update triggered medias")
+			}
+
+			for _, waiter := range waiters {
+				waiter <- syncResult{report: report, err: err}
+			}
+		case <-reconcile:
+			a.logger.Info().Msg("reconciling images")
+
+			report, err := a.Reconcile(a.deleteOrphans)
+			if err != nil {
+				a.logger.Err(err).Msg("failed to reconcile images")
+				continue
+			}
+
+			a.logger.Info().Msgf("%d media checked, %d missing, %d restored, %d orphan(s)",
+				report.Medias, len(report.Missing), len(report.Restored), len(report.Orphans))
 		}
 	}
 }
 
+// Trigger implements aggregator.Aggregator. It blocks until the
+// synchronization is done. It returns an error if the aggregator is not
+// running.
+func (a *InstagramAggregator) Trigger() (Report, error) {
+	result := make(chan syncResult, 1)
+
+	a.Lock()
+
+	if !a.running {
+		a.Unlock()
+		return Report{}, fmt.Errorf("aggregator not running")
+	}
+
+	a.waiters = append(a.waiters, result)
+	a.Unlock()
+
+	// a notification may already be pending, in which case it will handle us
+	select {
+	case a.triggers <- struct{}{}:
+	default:
+	}
+
+	res := <-result
+
+	return res.report, res.err
+}
+
+// sync updates the medias and returns a report
+func (a *InstagramAggregator) sync() (Report, error) {
+	report := Report{
+		Start: time.Now(),
+	}
+
+	added, err := a.updateMedias()
+	if err != nil {
+		return Report{}, err
+	}
+
+	// failing to enforce the retention doesn't fail the synchronization
+	removed, err := a.enforceRetention()
+	if err != nil {
+		a.logger.Err(err).Msg("failed to enforce retention")
+	}
+
+	if a.retention.DryRun {
+		report.WouldRemove = removed
+	} else {
+		report.Removed = removed
+	}
+
+	report.End = time.Now()
+	report.Added = make([]string, len(added))
+
+	for i, media := range added {
+		report.Added[i] = media.ID
+		a.publish(events.MediaAdded, events.MediaData{ID: media.ID})
+	}
+
+	a.publish(events.SyncCompleted, report)
+
+	return report, nil
+}
+
+// publish publishes an event if a publisher is set. Failing to publish doesn't
+// fail the synchronization.
+func (a *InstagramAggregator) publish(eventType string, data interface{}) {
+	if a.publisher == nil {
+		return
+	}
+
+	err := a.publisher.Publish(eventType, data)
+	if err != nil {
+		a.logger.Warn().Err(err).Msgf("failed to publish '%s'", eventType)
+	}
+}
+
 // updateMedias gets the latest medias from Instagram and saves those that are
-// not yet in the db.
-func (a *InstagramAggregator) updateMedias() error {
+// not yet stored, then downloads their image, and those that are pending
+// from previous updates. It returns the added medias, as saved before their
+// image is downloaded.
+func (a *InstagramAggregator) updateMedias() ([]types.Media, error) {
 	a.logger.Info().Msg("refreshing token")
 	err := a.api.RefreshToken()
 	if err != nil {
-		return fmt.Errorf("failed to refresh token: %v", err)
+		return nil, fmt.Errorf("failed to refresh token: %v", err)
 	}
 
 	medias, err := a.api.GetMedias()
 	if err != nil {
-		return fmt.Errorf("failed to get medias: %v", err)
+		return nil, fmt.Errorf("failed to get medias: %v", err)
 	}
 
 	toAdd := []string{}
 
-	err = a.db.View(func(tx *buntdb.Tx) error {
-		for _, media := range medias.Data {
-			_, err = tx.Get(media.ID)
-			if err != nil {
-				toAdd = append(toAdd, media.ID)
-			}
+	for _, media := range medias.Data {
+		deleted, err := a.store.IsDeleted(media.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check deleted media: %v", err)
 		}
-		return nil
-	})
 
-	if err != nil {
-		return fmt.Errorf("failed to view the db: %v", err)
+		if deleted {
+			continue
+		}
+
+		_, err = a.store.Get(media.ID)
+		if errors.Is(err, store.ErrNotFound) {
+			toAdd = append(toAdd, media.ID)
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to get media: %v", err)
+		}
 	}
 
 	a.logger.Info().Msgf("%d media to add", len(toAdd))
 
 	newMedias := make([]types.Media, len(toAdd))
 
-	for i, id := range toAdd {
-		media, err := a.api.GetMedia(id)
+	tasks := make([]task, len(toAdd))
+
+	for i := range toAdd {
+		i := i
+
+		tasks[i] = task{host: apiHost, do: func() error {
+			var err error
+
+			newMedias[i], err = a.api.GetMedia(toAdd[i])
+			return err
+		}}
+	}
+
+	var fetchErr error
+
+	a.pool.run(tasks, func(i int, err error) {
+		if err != nil && fetchErr == nil {
+			fetchErr = err
+		}
+	})
+
+	if fetchErr != nil {
+		return nil, fmt.Errorf("failed to get media: %v", fetchErr)
+	}
+
+	// medias are saved before their image is downloaded, so that a failed
+	// download doesn't lose them
+	for i := range newMedias {
+		media := &newMedias[i]
+		media.AssetState = types.AssetPending
+
+		if media.Timestamp.Unparsed() != "" {
+			a.logger.Warn().Msgf("invalid timestamp '%s' of media '%s', considered unknown",
+				media.Timestamp.Unparsed(), media.ID)
+		}
+
+		err = a.store.Put(*media)
 		if err != nil {
-			return fmt.Errorf("failed to get media: %v", err)
+			return nil, fmt.Errorf("failed to save media: %v", err)
 		}
 
-		newMedias[i] = media
+		a.logger.Info().Msgf("new media '%s' added", media.ID)
 	}
 
-	err = a.db.Update(func(tx *buntdb.Tx) error {
-		for _, media := range newMedias {
-			buf, err := json.Marshal(media)
-			if err != nil {
-				return fmt.Errorf("failed to marshal media: %v", err)
-			}
+	fresh := map[string]bool{}
+	for _, media := range newMedias {
+		fresh[media.ID] = true
+	}
 
-			_, _, err = tx.Set(media.ID, string(buf), &buntdb.SetOptions{})
-			if err != nil {
-				return fmt.Errorf("failed to set: %v", err)
-			}
+	err = a.downloadAssets(fresh)
+	if err != nil {
+		a.logger.Err(err).Msg("failed to download assets")
+	}
+
+	return newMedias, nil
+}
 
-			a.logger.Info().Msgf("new media '%s' added", media.ID)
+// setMetadata sets the metadata extracted from the image of a media
+func setMetadata(media *types.Media, metadata images.Metadata) {
+	media.Width = metadata.Width
+	media.Height = metadata.Height
+	media.AspectRatio = metadata.AspectRatio
+	media.DominantColor = metadata.DominantColor
+	media.BlurHash = metadata.BlurHash
+}
 
-			imagePath := filepath.Join(a.imagesFolder, media.ID+".jpg")
+// render generates the renditions of a media's image, saved next to it as
+// "<id>-<rendition>.jpg". Renditions that would be bigger than the image are
+// skipped. Failing to generate a rendition doesn't fail the synchronization.
+func (a *InstagramAggregator) render(id string, img image.Image) []types.Rendition {
+	var renditions []types.Rendition
 
-			err = saveImage(media.MediaURL, imagePath, a.client)
-			if err != nil {
-				return fmt.Errorf("failed to save image: %v", err)
-			}
+	for _, rendition := range a.renditions {
+		file := id + "-" + rendition.String() + ".jpg"
+
+		size, ok, err := rendition.Render(img, filepath.Join(a.imagesFolder, file))
+		if err != nil {
+			a.logger.Warn().Err(err).Msgf("failed to render '%s' of media '%s'", rendition, id)
+			continue
 		}
-		return nil
-	})
 
-	if err != nil {
-		return fmt.Errorf("failed to update the db: %v", err)
+		if !ok {
+			continue
+		}
+
+		renditions = append(renditions, types.Rendition{
+			Name:    rendition.String(),
+			File:    file,
+			Width:   size.X,
+			Height:  size.Y,
+			Cropped: rendition.Cropped(),
+		})
 	}
 
-	return nil
+	return renditions
 }
 
 // saveImage downloads an Instagram post's image and saves it locally to be
-// served.
-func saveImage(url, path string, client HTTPClient) error {
+// served. The download is written to a temporary file, which replaces the
+// image only once it is complete and valid, so that a failed download never
+// leaves a truncated image. Images are decoded to be verified, and the decoded
+// image is returned, unless the media is a video. It also returns the SHA-256
+// checksum of the file, hex encoded.
+func saveImage(url, path string, video bool, client HTTPClient) (image.Image, string, error) {
 	resp, err := client.Get(url)
 	if err != nil {
-		return fmt.Errorf("failed to get URL '%s': %v", url, err)
+		return nil, "", fmt.Errorf("failed to get URL '%s': %v", url, err)
 	}
 
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
 		buf, _ := ioutil.ReadAll(resp.Body)
-		return fmt.Errorf("http request failed with status %s: %s", resp.Status, buf)
+
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return nil, "", instagram.NewRateLimitError(resp, buf)
+		}
+
+		return nil, "", fmt.Errorf("http request failed with status %s: %s", resp.Status, buf)
 	}
 
-	file, err := os.Create(path)
+	contentType := resp.Header.Get("Content-Type")
+
+	// the first item of a carousel can be a video
+	if strings.HasPrefix(contentType, "video/") {
+		video = true
+	} else if contentType != "" && (video || !strings.HasPrefix(contentType, "image/")) {
+		return nil, "", fmt.Errorf("unexpected content type: %s", contentType)
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), ".download-*")
 	if err != nil {
-		return fmt.Errorf("failed to create file '%s': %v", path, err)
+		return nil, "", fmt.Errorf("failed to create file: %v", err)
 	}
 
+	defer os.Remove(file.Name())
 	defer file.Close()
 
-	_, err = io.Copy(file, resp.Body)
+	hash := sha256.New()
+
+	n, err := io.Copy(io.MultiWriter(file, hash), resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to copy bytes: %v", err)
+	}
+
+	if n == 0 {
+		return nil, "", fmt.Errorf("empty body")
+	}
+
+	// the length is unknown if it is not positive
+	if resp.ContentLength > 0 && n != resp.ContentLength {
+		return nil, "", fmt.Errorf("truncated body: got %d bytes, expected %d", n, resp.ContentLength)
+	}
+
+	err = file.Sync()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to sync file: %v", err)
+	}
+
+	err = file.Close()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to close file: %v", err)
+	}
+
+	var img image.Image
+
+	if !video {
+		img, err = images.Decode(file.Name())
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid image: %v", err)
+		}
+	}
+
+	err = os.Rename(file.Name(), path)
 	if err != nil {
-		return fmt.Errorf("failed to copy bytes: %v", err)
+		return nil, "", fmt.Errorf("failed to rename file: %v", err)
 	}
 
-	return nil
+	return img, hex.EncodeToString(hash.Sum(nil)), nil
 }
 
 // Stop implements aggregator.Aggregator. It should be called only if the
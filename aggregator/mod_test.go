@@ -2,8 +2,13 @@ package aggregator
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"image"
+	"image/jpeg"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -14,16 +19,17 @@ import (
 	"testing"
 	"time"
 
+	"github.com/nkcr/OSIA/events"
+	"github.com/nkcr/OSIA/images"
 	"github.com/nkcr/OSIA/instagram"
 	"github.com/nkcr/OSIA/instagram/types"
+	"github.com/nkcr/OSIA/store"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/require"
-	"github.com/tidwall/buntdb"
 )
 
 func TestStartFail(t *testing.T) {
-	db, err := buntdb.Open(":memory:")
-	require.NoError(t, err)
+	mediaStore := store.NewMemoryStore()
 
 	instagram := fakeInstagram{
 		refreshErr: errors.New("fake"),
@@ -31,15 +37,14 @@ func TestStartFail(t *testing.T) {
 
 	logger := zerolog.New(io.Discard)
 
-	agg := NewInstagramAggregator(db, instagram, "", nil, logger)
+	agg := NewInstagramAggregator(mediaStore, instagram, "", nil, logger)
 
-	err = agg.Start(time.Second)
+	err := agg.Start(time.Second)
 	require.EqualError(t, err, "failed to update medias: failed to refresh token: fake")
 }
 
 func TestStartStop(t *testing.T) {
-	db, err := buntdb.Open(":memory:")
-	require.NoError(t, err)
+	mediaStore := store.NewMemoryStore()
 
 	instagram := fakeInstagram{}
 
@@ -50,7 +55,7 @@ func TestStartStop(t *testing.T) {
 
 	defer os.RemoveAll(tmpdir)
 
-	agg := NewInstagramAggregator(db, instagram, tmpdir, nil, logger)
+	agg := NewInstagramAggregator(mediaStore, instagram, tmpdir, nil, logger)
 
 	wait := sync.WaitGroup{}
 	wait.Add(1)
@@ -67,6 +72,135 @@ func TestStartStop(t *testing.T) {
 	wait.Wait()
 }
 
+func TestTriggerNotRunning(t *testing.T) {
+	mediaStore := store.NewMemoryStore()
+
+	agg := NewInstagramAggregator(mediaStore, fakeInstagram{}, "", nil, zerolog.New(io.Discard))
+
+	_, err := agg.Trigger()
+	require.EqualError(t, err, "aggregator not running")
+}
+
+func TestTrigger(t *testing.T) {
+	mediaStore := store.NewMemoryStore()
+
+	instagram := &blockingInstagram{
+		fakeInstagram: fakeInstagram{
+			medias: types.Medias{Data: []types.Media{{ID: "aa"}}},
+		},
+	}
+
+	client := fakeClient{
+		body:       jpegBody(t, 10, 10),
+		statusCode: 200,
+	}
+
+	agg := NewInstagramAggregator(mediaStore, instagram, t.TempDir(), client, zerolog.New(io.Discard))
+
+	wait := sync.WaitGroup{}
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+
+		err := agg.Start(time.Hour)
+		require.NoError(t, err)
+	}()
+
+	// the first update is done when the aggregator starts
+	require.Eventually(t, func() bool { return instagram.refreshCount() == 1 }, time.Second, time.Millisecond)
+	waitRunning(t, agg.(*InstagramAggregator))
+
+	report, err := agg.Trigger()
+	require.NoError(t, err)
+	require.Empty(t, report.Added)
+	require.False(t, report.Start.After(report.End))
+	require.Equal(t, 2, instagram.refreshCount())
+
+	// a failing triggered update doesn't stop the aggregator
+	instagram.setRefreshErr(errors.New("fake"))
+
+	_, err = agg.Trigger()
+	require.EqualError(t, err, "failed to refresh token: fake")
+
+	instagram.setRefreshErr(nil)
+
+	_, err = agg.Trigger()
+	require.NoError(t, err)
+
+	agg.Stop()
+	wait.Wait()
+
+	_, err = agg.Trigger()
+	require.EqualError(t, err, "aggregator not running")
+}
+
+// Triggers that arrive while a synchronization is running must be coalesced
+// into the next one.
+func TestTriggerCoalesce(t *testing.T) {
+	mediaStore := store.NewMemoryStore()
+
+	instagram := &blockingInstagram{}
+
+	agg := NewInstagramAggregator(mediaStore, instagram, "", nil, zerolog.New(io.Discard)).(*InstagramAggregator)
+
+	wait := sync.WaitGroup{}
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+
+		err := agg.Start(time.Hour)
+		require.NoError(t, err)
+	}()
+
+	require.Eventually(t, func() bool { return instagram.refreshCount() == 1 }, time.Second, time.Millisecond)
+	waitRunning(t, agg)
+
+	gate := make(chan struct{})
+	instagram.setGate(gate)
+
+	triggers := sync.WaitGroup{}
+
+	triggers.Add(1)
+	go func() {
+		defer triggers.Done()
+
+		_, err := agg.Trigger()
+		require.NoError(t, err)
+	}()
+
+	// the first triggered update is blocked
+	require.Eventually(t, func() bool { return instagram.refreshCount() == 2 }, time.Second, time.Millisecond)
+
+	n := 3
+
+	for i := 0; i < n; i++ {
+		triggers.Add(1)
+		go func() {
+			defer triggers.Done()
+
+			_, err := agg.Trigger()
+			require.NoError(t, err)
+		}()
+	}
+
+	require.Eventually(t, func() bool {
+		agg.Lock()
+		defer agg.Unlock()
+
+		return len(agg.waiters) == n
+	}, time.Second, time.Millisecond)
+
+	instagram.setGate(nil)
+	close(gate)
+
+	triggers.Wait()
+
+	require.Equal(t, 3, instagram.refreshCount())
+
+	agg.Stop()
+	wait.Wait()
+}
+
 func TestUpdateMediasRefreshFail(t *testing.T) {
 	instagram := fakeInstagram{
 		refreshErr: errors.New("fake"),
@@ -76,7 +210,7 @@ func TestUpdateMediasRefreshFail(t *testing.T) {
 		api: instagram,
 	}
 
-	err := agg.updateMedias()
+	_, err := agg.updateMedias()
 	require.EqualError(t, err, "failed to refresh token: fake")
 }
 
@@ -89,7 +223,7 @@ func TestUpdateMediasGetMediasFail(t *testing.T) {
 		api: instagram,
 	}
 
-	err := agg.updateMedias()
+	_, err := agg.updateMedias()
 	require.EqualError(t, err, "failed to get medias: fake")
 }
 
@@ -106,18 +240,19 @@ func TestUpdateMediaGetMediaError(t *testing.T) {
 		mediaErr: errors.New("fake"),
 	}
 
-	db, err := buntdb.Open(":memory:")
-	require.NoError(t, err)
+	mediaStore := store.NewMemoryStore()
 
 	agg := InstagramAggregator{
-		api: instagram,
-		db:  db,
+		api:   instagram,
+		store: mediaStore,
+		pool:  newPool(1, 1),
 	}
 
-	err = agg.updateMedias()
+	_, err := agg.updateMedias()
 	require.EqualError(t, err, "failed to get media: fake")
 }
 
+// A failed download doesn't prevent the medias from being saved.
 func TestUpdateMediaSaveImageError(t *testing.T) {
 	medias := types.Medias{
 		Data: []types.Media{
@@ -130,8 +265,7 @@ func TestUpdateMediaSaveImageError(t *testing.T) {
 		medias: medias,
 	}
 
-	db, err := buntdb.Open(":memory:")
-	require.NoError(t, err)
+	mediaStore := store.NewMemoryStore()
 
 	client := fakeClient{
 		err: errors.New("fake"),
@@ -139,12 +273,21 @@ func TestUpdateMediaSaveImageError(t *testing.T) {
 
 	agg := InstagramAggregator{
 		api:    instagram,
-		db:     db,
+		store:  mediaStore,
 		client: client,
+		pool:   newPool(1, 1),
 	}
 
-	err = agg.updateMedias()
-	require.EqualError(t, err, "failed to update the db: failed to save image: failed to get URL '': fake")
+	added, err := agg.updateMedias()
+	require.NoError(t, err)
+	require.Len(t, added, 2)
+
+	for _, id := range []string{"aa", "bb"} {
+		media := getMedia(t, mediaStore, id)
+		require.Equal(t, types.AssetPending, media.AssetState)
+		require.Equal(t, 1, media.AssetAttempts)
+		require.Equal(t, "failed to get URL '': fake", media.AssetError)
+	}
 }
 
 func TestUpdateMediasSuccess(t *testing.T) {
@@ -159,15 +302,14 @@ func TestUpdateMediasSuccess(t *testing.T) {
 		medias: medias,
 	}
 
-	db, err := buntdb.Open(":memory:")
-	require.NoError(t, err)
+	mediaStore := store.NewMemoryStore()
 
 	tmpdir, err := ioutil.TempDir("", "OSIA")
 	require.NoError(t, err)
 
 	defer os.RemoveAll(tmpdir)
 
-	image := []byte("fake image")
+	image := jpegBody(t, 10, 10)
 	client := fakeClient{
 		body:       image,
 		statusCode: 200,
@@ -175,17 +317,214 @@ func TestUpdateMediasSuccess(t *testing.T) {
 
 	agg := InstagramAggregator{
 		api:          instagram,
-		db:           db,
+		store:        mediaStore,
 		imagesFolder: tmpdir,
 		client:       client,
+		pool:         newPool(1, 1),
 	}
 
-	err = agg.updateMedias()
+	_, err = agg.updateMedias()
 	require.NoError(t, err)
 
 	img, err := os.ReadFile(filepath.Join(tmpdir, "aa.jpg"))
 	require.NoError(t, err)
-	require.Equal(t, "fake image", string(img))
+	require.Equal(t, image, img)
+
+	media := getMedia(t, mediaStore, "aa")
+	require.Equal(t, types.AssetOK, media.AssetState)
+	require.Equal(t, 1, media.AssetAttempts)
+
+	checksum := sha256.Sum256(image)
+	require.Equal(t, hex.EncodeToString(checksum[:]), media.Checksum)
+}
+
+// An invalid timestamp is reported, and the media is saved with an unknown
+// timestamp.
+func TestUpdateMediasInvalidTimestamp(t *testing.T) {
+	var media types.Media
+
+	err := json.Unmarshal([]byte(`{"id":"aa","timestamp":"garbage"}`), &media)
+	require.NoError(t, err)
+
+	instagram := fakeInstagram{
+		medias: types.Medias{Data: []types.Media{media}},
+	}
+
+	mediaStore := store.NewMemoryStore()
+	logs := new(bytes.Buffer)
+
+	agg := InstagramAggregator{
+		api:          instagram,
+		store:        mediaStore,
+		imagesFolder: t.TempDir(),
+		client:       fakeClient{body: jpegBody(t, 10, 10), statusCode: 200},
+		logger:       zerolog.New(logs),
+		pool:         newPool(1, 1),
+	}
+
+	_, err = agg.updateMedias()
+	require.NoError(t, err)
+
+	require.Contains(t, logs.String(), "invalid timestamp 'garbage' of media 'aa'")
+	require.True(t, getMedia(t, mediaStore, "aa").Timestamp.IsZero())
+}
+
+func TestUpdateMediasRenditions(t *testing.T) {
+	instagram := fakeInstagram{
+		medias: types.Medias{
+			Data: []types.Media{
+				{ID: "aa", MediaURL: "https://example.com/aa.jpg"},
+				{ID: "bb", MediaURL: "https://example.com/bb.mp4", MediaType: "VIDEO"},
+			},
+		},
+	}
+
+	mediaStore := store.NewMemoryStore()
+
+	tmpdir := t.TempDir()
+
+	buf := new(bytes.Buffer)
+	err := jpeg.Encode(buf, image.NewRGBA(image.Rect(0, 0, 800, 600)), nil)
+	require.NoError(t, err)
+
+	agg := NewInstagramAggregator(mediaStore, instagram, tmpdir, imageClient{"https://example.com/aa.jpg": buf.Bytes()},
+		zerolog.New(io.Discard), WithRenditions(
+			images.Rendition{Width: 320},
+			images.Rendition{Width: 1080},
+			images.Rendition{Width: 640, Height: 640},
+		)).(*InstagramAggregator)
+
+	added, err := agg.updateMedias()
+	require.NoError(t, err)
+	require.Len(t, added, 2)
+
+	// the renditions are saved with the media
+	aa := getMedia(t, mediaStore, "aa")
+	bb := getMedia(t, mediaStore, "bb")
+
+	// the 1080 rendition would be bigger than the image
+	expected := []types.Rendition{
+		{Name: "320", File: "aa-320.jpg", Width: 320, Height: 240},
+		{Name: "640x640", File: "aa-640x640.jpg", Width: 600, Height: 600, Cropped: true},
+	}
+
+	require.Equal(t, expected, aa.Renditions)
+	require.Nil(t, bb.Renditions)
+
+	// the metadata is extracted from the same image
+	require.Equal(t, 800, aa.Width)
+	require.Equal(t, 600, aa.Height)
+	require.Equal(t, 1.3333, aa.AspectRatio)
+	require.Equal(t, "#000000", aa.DominantColor)
+	require.Equal(t, "L00000fQfQfQfQfQfQfQfQfQfQfQ", aa.BlurHash)
+
+	require.Equal(t, 0, bb.Width)
+	require.Empty(t, bb.BlurHash)
+
+	// videos are not decoded, but have a checksum too
+	require.Len(t, bb.Checksum, 64)
+	require.Equal(t, types.AssetOK, bb.AssetState)
+
+	for _, rendition := range expected {
+		f, err := os.Open(filepath.Join(tmpdir, rendition.File))
+		require.NoError(t, err)
+
+		config, err := jpeg.DecodeConfig(f)
+		f.Close()
+
+		require.NoError(t, err)
+		require.Equal(t, rendition.Width, config.Width)
+		require.Equal(t, rendition.Height, config.Height)
+	}
+
+	require.NoFileExists(t, filepath.Join(tmpdir, "aa-1080.jpg"))
+	require.NoFileExists(t, filepath.Join(tmpdir, "bb-320.jpg"))
+}
+
+func TestSyncPublish(t *testing.T) {
+	instagram := fakeInstagram{
+		medias: types.Medias{
+			Data: []types.Media{{ID: "aa"}},
+		},
+	}
+
+	mediaStore := store.NewMemoryStore()
+
+	publisher := &fakePublisher{}
+
+	client := fakeClient{
+		body:       jpegBody(t, 10, 10),
+		statusCode: 200,
+	}
+
+	agg := NewInstagramAggregator(mediaStore, instagram, t.TempDir(), client,
+		zerolog.New(io.Discard), WithPublisher(publisher)).(*InstagramAggregator)
+
+	_, err := agg.sync()
+	require.NoError(t, err)
+
+	// nothing is added the second time
+	_, err = agg.sync()
+	require.NoError(t, err)
+
+	require.Equal(t, []string{events.MediaAdded, events.SyncCompleted, events.SyncCompleted},
+		publisher.types)
+	require.Equal(t, events.MediaData{ID: "aa"}, publisher.data[0])
+}
+
+// A media deleted by the admin must not be added back.
+func TestUpdateMediasDeleted(t *testing.T) {
+	medias := types.Medias{
+		Data: []types.Media{
+			{ID: "aa"},
+			{ID: "bb"},
+		},
+	}
+
+	instagram := fakeInstagram{
+		medias: medias,
+	}
+
+	mediaStore := store.NewMemoryStore()
+
+	err := mediaStore.Put(types.Media{ID: "aa"})
+	require.NoError(t, err)
+
+	_, err = mediaStore.Delete("aa")
+	require.NoError(t, err)
+
+	tmpdir, err := ioutil.TempDir("", "OSIA")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(tmpdir)
+
+	client := fakeClient{
+		body:       jpegBody(t, 10, 10),
+		statusCode: 200,
+	}
+
+	agg := InstagramAggregator{
+		api:          instagram,
+		store:        mediaStore,
+		imagesFolder: tmpdir,
+		client:       client,
+		pool:         newPool(1, 1),
+	}
+
+	_, err = agg.updateMedias()
+	require.NoError(t, err)
+
+	_, err = os.Stat(filepath.Join(tmpdir, "aa.jpg"))
+	require.True(t, os.IsNotExist(err))
+
+	_, err = os.Stat(filepath.Join(tmpdir, "bb.jpg"))
+	require.NoError(t, err)
+
+	_, err = mediaStore.Get("aa")
+	require.ErrorIs(t, err, store.ErrNotFound)
+
+	_, err = mediaStore.Get("bb")
+	require.NoError(t, err)
 }
 
 func TestSaveImageBadStatusCode(t *testing.T) {
@@ -194,10 +533,106 @@ func TestSaveImageBadStatusCode(t *testing.T) {
 		body:       []byte("fake body"),
 	}
 
-	err := saveImage("", "", client)
+	_, _, err := saveImage("", "", false, client)
 	require.EqualError(t, err, "http request failed with status 500: fake body")
 }
 
+func TestSaveImage(t *testing.T) {
+	body := jpegBody(t, 30, 20)
+	path := filepath.Join(t.TempDir(), "aa.jpg")
+
+	client := fakeClient{
+		statusCode:    200,
+		body:          body,
+		header:        http.Header{"Content-Type": []string{"image/jpeg"}},
+		contentLength: int64(len(body)),
+	}
+
+	img, checksum, err := saveImage("", path, false, client)
+	require.NoError(t, err)
+	require.Equal(t, image.Rect(0, 0, 30, 20), img.Bounds())
+
+	expected := sha256.Sum256(body)
+	require.Equal(t, hex.EncodeToString(expected[:]), checksum)
+
+	saved, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, body, saved)
+
+	// the temporary file is renamed
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestSaveImageVideo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aa.jpg")
+
+	client := fakeClient{
+		statusCode: 200,
+		body:       []byte("fake video"),
+	}
+
+	img, checksum, err := saveImage("", path, true, client)
+	require.NoError(t, err)
+	require.Nil(t, img)
+	require.Len(t, checksum, 64)
+	require.FileExists(t, path)
+
+	// the first item of a carousel can be a video
+	client.header = http.Header{"Content-Type": []string{"video/mp4"}}
+
+	img, _, err = saveImage("", path, false, client)
+	require.NoError(t, err)
+	require.Nil(t, img)
+}
+
+// A failed download must not replace the image.
+func TestSaveImageInvalid(t *testing.T) {
+	body := jpegBody(t, 30, 20)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "aa.jpg")
+
+	err := os.WriteFile(path, []byte("previous"), os.ModePerm)
+	require.NoError(t, err)
+
+	jpegType := http.Header{"Content-Type": []string{"image/jpeg"}}
+
+	table := []struct {
+		client fakeClient
+		video  bool
+		err    string
+	}{
+		{fakeClient{body: body, header: http.Header{"Content-Type": []string{"text/html"}}},
+			false, "unexpected content type: text/html"},
+		{fakeClient{body: body, header: jpegType},
+			true, "unexpected content type: image/jpeg"},
+		{fakeClient{body: body[:100], contentLength: int64(len(body))},
+			false, fmt.Sprintf("truncated body: got 100 bytes, expected %d", len(body))},
+		{fakeClient{body: []byte{}},
+			true, "empty body"},
+		{fakeClient{body: body[:len(body)/2], header: jpegType},
+			false, "invalid image: failed to decode: unexpected EOF"},
+		{fakeClient{body: []byte("fake image")},
+			false, "invalid image: not an image"},
+	}
+
+	for i, entry := range table {
+		entry.client.statusCode = 200
+
+		_, _, err := saveImage("", path, entry.video, entry.client)
+		require.EqualError(t, err, entry.err, i)
+	}
+
+	saved, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "previous", string(saved))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
 // ----------------------------------------------------------------------------
 // Utility functions
 
@@ -227,10 +662,65 @@ func (i fakeInstagram) GetMedia(id string) (types.Media, error) {
 	return types.Media{}, fmt.Errorf("media not found")
 }
 
+// blockingInstagram is a fake Instagram API that counts the number of token
+// refreshes, which happens once per update, and that can block them.
+type blockingInstagram struct {
+	sync.Mutex
+	fakeInstagram
+	refreshes int
+	gate      chan struct{}
+}
+
+func (i *blockingInstagram) RefreshToken() error {
+	i.Lock()
+	i.refreshes++
+	gate := i.gate
+	err := i.refreshErr
+	i.Unlock()
+
+	if gate != nil {
+		<-gate
+	}
+
+	return err
+}
+
+func (i *blockingInstagram) refreshCount() int {
+	i.Lock()
+	defer i.Unlock()
+
+	return i.refreshes
+}
+
+func (i *blockingInstagram) setGate(gate chan struct{}) {
+	i.Lock()
+	defer i.Unlock()
+
+	i.gate = gate
+}
+
+func (i *blockingInstagram) setRefreshErr(err error) {
+	i.Lock()
+	defer i.Unlock()
+
+	i.refreshErr = err
+}
+
+func waitRunning(t *testing.T, agg *InstagramAggregator) {
+	require.Eventually(t, func() bool {
+		agg.Lock()
+		defer agg.Unlock()
+
+		return agg.running
+	}, time.Second, time.Millisecond)
+}
+
 type fakeClient struct {
-	body       []byte
-	err        error
-	statusCode int
+	body          []byte
+	err           error
+	statusCode    int
+	header        http.Header
+	contentLength int64
 }
 
 func (c fakeClient) Get(url string) (resp *http.Response, err error) {
@@ -242,8 +732,47 @@ func (c fakeClient) Get(url string) (resp *http.Response, err error) {
 	body := io.NopCloser(buff)
 
 	return &http.Response{
-		StatusCode: c.statusCode,
-		Status:     strconv.Itoa(c.statusCode),
-		Body:       body,
+		StatusCode:    c.statusCode,
+		Status:        strconv.Itoa(c.statusCode),
+		Header:        c.header,
+		ContentLength: c.contentLength,
+		Body:          body,
 	}, nil
 }
+
+// jpegBody returns a black JPEG image of the given size
+func jpegBody(t *testing.T, width, height int) []byte {
+	buf := new(bytes.Buffer)
+
+	err := jpeg.Encode(buf, image.NewRGBA(image.Rect(0, 0, width, height)), nil)
+	require.NoError(t, err)
+
+	return buf.Bytes()
+}
+
+// imageClient returns the body of each URL, and "fake video" for the others
+type imageClient map[string][]byte
+
+func (c imageClient) Get(url string) (resp *http.Response, err error) {
+	body, ok := c[url]
+	if !ok {
+		body = []byte("fake video")
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(bytes.NewReader(body)),
+	}, nil
+}
+
+type fakePublisher struct {
+	types []string
+	data  []interface{}
+}
+
+func (p *fakePublisher) Publish(eventType string, data interface{}) error {
+	p.types = append(p.types, eventType)
+	p.data = append(p.data, data)
+
+	return nil
+}
@@ -0,0 +1,210 @@
+package aggregator
+
+import (
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/nkcr/OSIA/instagram"
+)
+
+// apiHost is the host of the Instagram API, whose concurrent requests are
+// limited like those of the images.
+const apiHost = "graph.instagram.com"
+
+// task defines a job run by a pool. Host is the host requested by the job.
+type task struct {
+	host string
+	do   func() error
+}
+
+// newPool returns a new initialized pool that runs at most workers tasks at
+// once, and at most perHost tasks of the same host.
+func newPool(workers, perHost int) *pool {
+	if workers < 1 {
+		workers = 1
+	}
+
+	if perHost < 1 {
+		perHost = 1
+	}
+
+	return &pool{
+		workers:    workers,
+		perHost:    perHost,
+		retries:    3,
+		backoff:    time.Second,
+		maxBackoff: time.Minute,
+		hosts:      map[string]*hostLimit{},
+	}
+}
+
+// pool runs tasks concurrently. A task that is rate limited pauses the tasks of
+// its host, for the delay requested by the server or an exponential backoff,
+// and is attempted again.
+type pool struct {
+	workers int
+	perHost int
+	// retries is the number of times a rate limited task is attempted again
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+
+	// lock protects the hosts and their pause
+	lock  sync.Mutex
+	hosts map[string]*hostLimit
+}
+
+// hostLimit limits the concurrent tasks of a host
+type hostLimit struct {
+	slots       chan struct{}
+	pausedUntil time.Time
+	backoff     time.Duration
+}
+
+// run runs the tasks and calls done with the error of each task, in the order
+// of the tasks, as soon as the task and the previous ones are done. Done is
+// called from the calling goroutine, so that the db writes it makes happen in
+// a deterministic order.
+func (p *pool) run(tasks []task, done func(i int, err error)) {
+	type result struct {
+		i   int
+		err error
+	}
+
+	indexes := make(chan int)
+	results := make(chan result)
+
+	workers := p.workers
+	if workers > len(tasks) {
+		workers = len(tasks)
+	}
+
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := range indexes {
+				results <- result{i: i, err: p.do(tasks[i])}
+			}
+		}()
+	}
+
+	go func() {
+		for i := range tasks {
+			indexes <- i
+		}
+
+		close(indexes)
+	}()
+
+	finished := map[int]error{}
+	next := 0
+
+	for next < len(tasks) {
+		res := <-results
+		finished[res.i] = res.err
+
+		for {
+			err, ok := finished[next]
+			if !ok {
+				break
+			}
+
+			delete(finished, next)
+			done(next, err)
+			next++
+		}
+	}
+}
+
+// do runs a task once a slot of its host is free and the host is not paused.
+func (p *pool) do(t task) error {
+	host := p.host(t.host)
+
+	for attempt := 0; ; attempt++ {
+		host.slots <- struct{}{}
+
+		p.lock.Lock()
+		pause := time.Until(host.pausedUntil)
+		p.lock.Unlock()
+
+		time.Sleep(pause)
+
+		err := t.do()
+
+		<-host.slots
+
+		var rateLimit *instagram.RateLimitError
+
+		if !errors.As(err, &rateLimit) {
+			if err == nil {
+				p.lock.Lock()
+				host.backoff = 0
+				p.lock.Unlock()
+			}
+
+			return err
+		}
+
+		if attempt >= p.retries {
+			return err
+		}
+
+		p.pause(host, rateLimit.RetryAfter)
+	}
+}
+
+// host returns the limit of a host, created if needed
+func (p *pool) host(name string) *hostLimit {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	host := p.hosts[name]
+	if host == nil {
+		host = &hostLimit{slots: make(chan struct{}, p.perHost)}
+		p.hosts[name] = host
+	}
+
+	return host
+}
+
+// pause pauses a host after a rate limit. Without a delay requested by the
+// server, the pause doubles each time, up to the maximum backoff.
+func (p *pool) pause(host *hostLimit, retryAfter time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	delay := retryAfter
+
+	if delay <= 0 {
+		host.backoff *= 2
+		if host.backoff == 0 {
+			host.backoff = p.backoff
+		}
+
+		if host.backoff > p.maxBackoff {
+			host.backoff = p.maxBackoff
+		}
+
+		delay = host.backoff
+	}
+
+	if delay > p.maxBackoff {
+		delay = p.maxBackoff
+	}
+
+	until := time.Now().Add(delay)
+	if until.After(host.pausedUntil) {
+		host.pausedUntil = until
+	}
+}
+
+// hostOf returns the host of a URL, or an empty string if it is invalid
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+
+	return u.Host
+}
@@ -0,0 +1,195 @@
+package aggregator
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nkcr/OSIA/instagram"
+	"github.com/stretchr/testify/require"
+)
+
+// Results are reported in the order of the tasks, even if they finish in
+// another order.
+func TestPoolOrder(t *testing.T) {
+	p := newPool(4, 4)
+
+	tasks := make([]task, 8)
+
+	for i := range tasks {
+		i := i
+
+		tasks[i] = task{host: "a", do: func() error {
+			time.Sleep(time.Duration(len(tasks)-i) * 5 * time.Millisecond)
+			return fmt.Errorf("task %d", i)
+		}}
+	}
+
+	order := []int{}
+
+	p.run(tasks, func(i int, err error) {
+		require.EqualError(t, err, fmt.Sprintf("task %d", i))
+		order = append(order, i)
+	})
+
+	require.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7}, order)
+
+	// nothing to do
+	p.run(nil, func(int, error) { t.Fail() })
+}
+
+func TestPoolLimits(t *testing.T) {
+	p := newPool(3, 2)
+
+	lock := sync.Mutex{}
+	running := map[string]int{}
+	maxRunning := map[string]int{}
+
+	tasks := []task{}
+
+	for i := 0; i < 12; i++ {
+		host := []string{"a", "b"}[i%2]
+
+		tasks = append(tasks, task{host: host, do: func() error {
+			lock.Lock()
+			running[host]++
+			running["total"]++
+
+			for _, key := range []string{host, "total"} {
+				if running[key] > maxRunning[key] {
+					maxRunning[key] = running[key]
+				}
+			}
+			lock.Unlock()
+
+			time.Sleep(10 * time.Millisecond)
+
+			lock.Lock()
+			running[host]--
+			running["total"]--
+			lock.Unlock()
+
+			return nil
+		}})
+	}
+
+	p.run(tasks, func(i int, err error) {
+		require.NoError(t, err)
+	})
+
+	require.LessOrEqual(t, maxRunning["a"], 2)
+	require.LessOrEqual(t, maxRunning["b"], 2)
+	require.LessOrEqual(t, maxRunning["total"], 3)
+	require.Greater(t, maxRunning["total"], 1)
+}
+
+// A rate limited task pauses its host, and is attempted again.
+func TestPoolRateLimit(t *testing.T) {
+	p := newPool(2, 1)
+	p.backoff = 20 * time.Millisecond
+
+	attempts := 0
+	var otherDone time.Time
+
+	tasks := []task{
+		{host: "a", do: func() error {
+			attempts++
+			if attempts < 3 {
+				return fmt.Errorf("wrapped: %w", &instagram.RateLimitError{})
+			}
+
+			return nil
+		}},
+		{host: "b", do: func() error {
+			otherDone = time.Now()
+			return nil
+		}},
+	}
+
+	start := time.Now()
+	errs := make([]error, len(tasks))
+
+	p.run(tasks, func(i int, err error) {
+		errs[i] = err
+	})
+
+	require.Equal(t, []error{nil, nil}, errs)
+	require.Equal(t, 3, attempts)
+
+	// 20ms then 40ms
+	require.GreaterOrEqual(t, time.Since(start), 60*time.Millisecond)
+
+	// other hosts are not paused
+	require.Less(t, otherDone.Sub(start), 20*time.Millisecond)
+
+	// the backoff is reset after a success
+	require.Equal(t, time.Duration(0), p.host("a").backoff)
+}
+
+func TestPoolRateLimitGiveUp(t *testing.T) {
+	p := newPool(1, 1)
+	p.backoff = time.Millisecond
+	p.maxBackoff = 5 * time.Millisecond
+
+	attempts := 0
+
+	tasks := []task{{host: "a", do: func() error {
+		attempts++
+
+		// the delay requested by the server is capped
+		return &instagram.RateLimitError{RetryAfter: time.Hour}
+	}}}
+
+	var err error
+
+	p.run(tasks, func(i int, e error) {
+		err = e
+	})
+
+	var rateLimit *instagram.RateLimitError
+
+	require.True(t, errors.As(err, &rateLimit))
+	require.Equal(t, p.retries+1, attempts)
+
+	// other errors are not retried
+	attempts = 0
+
+	tasks = []task{{host: "a", do: func() error {
+		attempts++
+		return errors.New("fake")
+	}}}
+
+	p.run(tasks, func(i int, e error) {
+		err = e
+	})
+
+	require.EqualError(t, err, "fake")
+	require.Equal(t, 1, attempts)
+}
+
+func TestPoolPause(t *testing.T) {
+	p := newPool(1, 1)
+	p.backoff = time.Second
+	p.maxBackoff = 3 * time.Second
+
+	host := p.host("a")
+
+	for _, expected := range []time.Duration{1, 2, 3, 3} {
+		p.pause(host, 0)
+		require.Equal(t, expected*time.Second, host.backoff)
+	}
+
+	require.WithinDuration(t, time.Now().Add(3*time.Second), host.pausedUntil, time.Second)
+
+	// a shorter delay doesn't shorten the pause
+	p.pause(host, time.Millisecond)
+	require.WithinDuration(t, time.Now().Add(3*time.Second), host.pausedUntil, time.Second)
+}
+
+func TestHostOf(t *testing.T) {
+	require.Equal(t, "scontent.cdninstagram.com", hostOf("https://scontent.cdninstagram.com/v/a.jpg?x=1"))
+	require.Equal(t, "", hostOf(""))
+	require.Equal(t, "", hostOf("://bad"))
+}
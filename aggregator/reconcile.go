@@ -0,0 +1,195 @@
+package aggregator
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nkcr/OSIA/instagram/types"
+	"github.com/nkcr/OSIA/store"
+)
+
+// quarantineSuffix is appended to the images folder to get the folder where
+// orphaned files are moved
+const quarantineSuffix = "-orphans"
+
+// precompressedExts are the extensions of the precompressed versions of a file,
+// saved next to it to be served to the clients that accept them. They belong
+// to the media of the file.
+var precompressedExts = []string{".br", ".gz"}
+
+// ReconcileReport contains the result of a reconciliation
+type ReconcileReport struct {
+	// Medias is the number of medias checked
+	Medias int `json:"medias"`
+	// Missing contains the IDs of the medias whose image, or one of its
+	// renditions, was missing
+	Missing []string `json:"missing"`
+	// Restored contains the IDs of the missing medias whose image has been
+	// downloaded again
+	Restored []string `json:"restored"`
+	// Orphans contains the names of the files that belong to no media
+	Orphans []string `json:"orphans"`
+	// Quarantine is the folder where orphans have been moved, empty if they
+	// have been deleted
+	Quarantine string `json:"quarantine,omitempty"`
+}
+
+// WithReconcile sets the interval at which the images folder is reconciled
+// with the medias, see Reconcile. By default it is not done periodically.
+func WithReconcile(interval time.Duration, deleteOrphans bool) Option {
+	return func(a *InstagramAggregator) {
+		a.reconcileInterval = interval
+		a.deleteOrphans = deleteOrphans
+	}
+}
+
+// Reconcile implements aggregator.Aggregator. The images of the medias that are
+// missing, or whose download failed, are downloaded again, with a fresh URL.
+// Files that belong to no media are moved to "<imagesfolder>-orphans", or
+// deleted. It must not run during a synchronization, it is therefore either
+// run periodically by the aggregator, or while the aggregator is not started.
+func (a *InstagramAggregator) Reconcile(deleteOrphans bool) (ReconcileReport, error) {
+	report := ReconcileReport{
+		Missing:  []string{},
+		Restored: []string{},
+		Orphans:  []string{},
+	}
+
+	medias, _, err := a.store.List(store.Query{})
+	if err != nil {
+		return ReconcileReport{}, fmt.Errorf("failed to list medias: %v", err)
+	}
+
+	report.Medias = len(medias)
+
+	for _, media := range medias {
+		// the image of a pending media is not expected yet
+		if media.AssetState == types.AssetPending {
+			continue
+		}
+
+		if media.AssetState == types.AssetFailed || !a.filesExist(mediaFiles(media)) {
+			report.Missing = append(report.Missing, media.ID)
+		}
+	}
+
+	for _, id := range report.Missing {
+		_, err = a.store.Update(id, func(media *types.Media) error {
+			media.AssetState = types.AssetPending
+			media.AssetAttempts = 0
+			media.AssetError = ""
+
+			return nil
+		})
+
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return ReconcileReport{}, fmt.Errorf("failed to update media: %v", err)
+		}
+	}
+
+	err = a.downloadAssets(nil)
+	if err != nil {
+		return ReconcileReport{}, fmt.Errorf("failed to download assets: %v", err)
+	}
+
+	// renditions may have been generated again
+	files := map[string]bool{}
+	states := map[string]string{}
+
+	medias, _, err = a.store.List(store.Query{})
+	if err != nil {
+		return ReconcileReport{}, fmt.Errorf("failed to list medias: %v", err)
+	}
+
+	for _, media := range medias {
+		states[media.ID] = media.AssetState
+
+		for _, file := range mediaFiles(media) {
+			files[file] = true
+		}
+	}
+
+	for _, id := range report.Missing {
+		if states[id] == types.AssetOK {
+			report.Restored = append(report.Restored, id)
+		}
+	}
+
+	entries, err := os.ReadDir(a.imagesFolder)
+	if err != nil {
+		return ReconcileReport{}, fmt.Errorf("failed to read images folder: %v", err)
+	}
+
+	if !deleteOrphans {
+		report.Quarantine = filepath.Clean(a.imagesFolder) + quarantineSuffix
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || files[entry.Name()] || files[uncompressedName(entry.Name())] {
+			continue
+		}
+
+		report.Orphans = append(report.Orphans, entry.Name())
+
+		err = removeOrphan(filepath.Join(a.imagesFolder, entry.Name()), report.Quarantine)
+		if err != nil {
+			return ReconcileReport{}, fmt.Errorf("failed to remove orphan: %v", err)
+		}
+	}
+
+	return report, nil
+}
+
+// filesExist returns true if all the files exist in the images folder
+func (a *InstagramAggregator) filesExist(files []string) bool {
+	for _, file := range files {
+		_, err := os.Stat(filepath.Join(a.imagesFolder, file))
+		if err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// mediaFiles returns the name of the files of a media, in the images folder
+func mediaFiles(media types.Media) []string {
+	files := []string{media.ID + ".jpg"}
+
+	for _, rendition := range media.Renditions {
+		files = append(files, rendition.File)
+	}
+
+	return files
+}
+
+// uncompressedName returns the name of the file of which a file is the
+// precompressed version, or an empty name.
+func uncompressedName(name string) string {
+	for _, ext := range precompressedExts {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext)
+		}
+	}
+
+	return ""
+}
+
+// removeOrphan moves a file to the quarantine folder, or deletes it if the
+// folder is empty.
+func removeOrphan(path, quarantine string) error {
+	if quarantine == "" {
+		return os.Remove(path)
+	}
+
+	err := os.MkdirAll(quarantine, 0744)
+	if err != nil {
+		return fmt.Errorf("failed to create quarantine: %v", err)
+	}
+
+	return os.Rename(path, filepath.Join(quarantine, filepath.Base(path)))
+}
@@ -0,0 +1,164 @@
+package aggregator
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nkcr/OSIA/instagram/types"
+	"github.com/nkcr/OSIA/store"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// Missing images are downloaded again with a fresh URL, and orphaned files are
+// moved to the quarantine.
+func TestReconcile(t *testing.T) {
+	mediaStore := store.NewMemoryStore()
+
+	setMedias(t, mediaStore,
+		types.Media{ID: "aa", AssetState: types.AssetOK,
+			Renditions: []types.Rendition{{Name: "320", File: "aa-320.jpg"}}},
+		types.Media{ID: "bb", AssetState: types.AssetOK, MediaURL: "https://example.com/expired.jpg"},
+		types.Media{ID: "cc", AssetState: types.AssetFailed, AssetAttempts: maxAssetAttempts},
+		// stored before the asset state existed
+		types.Media{ID: "dd"},
+	)
+
+	imagesFolder := filepath.Join(t.TempDir(), "images")
+
+	err := os.Mkdir(imagesFolder, 0744)
+	require.NoError(t, err)
+
+	err = os.Mkdir(filepath.Join(imagesFolder, "folder"), 0744)
+	require.NoError(t, err)
+
+	for _, name := range []string{"aa.jpg", "aa-320.jpg", "dd.jpg", "zz.jpg", ".download-123",
+		"aa.jpg.gz", "aa-320.jpg.br", "zz.jpg.gz"} {
+		saveJPEG(t, filepath.Join(imagesFolder, name), 10, 10)
+	}
+
+	instagram := fakeInstagram{
+		medias: types.Medias{
+			Data: []types.Media{
+				{ID: "bb", MediaURL: "https://example.com/bb.jpg"},
+				{ID: "cc", MediaURL: "https://example.com/cc.jpg"},
+			},
+		},
+	}
+
+	client := imageClient{"https://example.com/bb.jpg": jpegBody(t, 30, 20)}
+
+	agg := NewInstagramAggregator(mediaStore, instagram, imagesFolder, client,
+		zerolog.New(io.Discard)).(*InstagramAggregator)
+
+	report, err := agg.Reconcile(false)
+	require.NoError(t, err)
+
+	require.Equal(t, ReconcileReport{
+		Medias:     4,
+		Missing:    []string{"cc", "bb"},
+		Restored:   []string{"bb"},
+		Orphans:    []string{".download-123", "zz.jpg", "zz.jpg.gz"},
+		Quarantine: imagesFolder + quarantineSuffix,
+	}, report)
+
+	media := getMedia(t, mediaStore, "bb")
+	require.Equal(t, types.AssetOK, media.AssetState)
+	require.Equal(t, "https://example.com/bb.jpg", media.MediaURL)
+	require.Equal(t, 30, media.Width)
+	require.FileExists(t, filepath.Join(imagesFolder, "bb.jpg"))
+
+	media = getMedia(t, mediaStore, "cc")
+	require.Equal(t, types.AssetPending, media.AssetState)
+	require.Equal(t, 1, media.AssetAttempts)
+
+	require.NoFileExists(t, filepath.Join(imagesFolder, "zz.jpg"))
+	require.FileExists(t, filepath.Join(imagesFolder+quarantineSuffix, "zz.jpg"))
+	require.FileExists(t, filepath.Join(imagesFolder+quarantineSuffix, ".download-123"))
+	require.DirExists(t, filepath.Join(imagesFolder, "folder"))
+
+	// precompressed versions belong to the media of their file
+	require.FileExists(t, filepath.Join(imagesFolder, "aa.jpg.gz"))
+	require.FileExists(t, filepath.Join(imagesFolder, "aa-320.jpg.br"))
+	require.FileExists(t, filepath.Join(imagesFolder+quarantineSuffix, "zz.jpg.gz"))
+}
+
+func TestReconcileDelete(t *testing.T) {
+	mediaStore := store.NewMemoryStore()
+
+	setMedias(t, mediaStore, types.Media{ID: "aa", AssetState: types.AssetOK})
+
+	imagesFolder := t.TempDir()
+
+	saveJPEG(t, filepath.Join(imagesFolder, "aa.jpg"), 10, 10)
+	saveJPEG(t, filepath.Join(imagesFolder, "zz.jpg"), 10, 10)
+
+	agg := NewInstagramAggregator(mediaStore, fakeInstagram{}, imagesFolder, imageClient{},
+		zerolog.New(io.Discard)).(*InstagramAggregator)
+
+	report, err := agg.Reconcile(true)
+	require.NoError(t, err)
+
+	require.Equal(t, ReconcileReport{
+		Medias:   1,
+		Missing:  []string{},
+		Restored: []string{},
+		Orphans:  []string{"zz.jpg"},
+	}, report)
+
+	entries, err := os.ReadDir(imagesFolder)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "aa.jpg", entries[0].Name())
+
+	require.NoDirExists(t, imagesFolder+quarantineSuffix)
+}
+
+func TestReconcileNoFolder(t *testing.T) {
+	mediaStore := store.NewMemoryStore()
+
+	agg := NewInstagramAggregator(mediaStore, fakeInstagram{}, filepath.Join(t.TempDir(), "images"),
+		imageClient{}, zerolog.New(io.Discard)).(*InstagramAggregator)
+
+	_, err := agg.Reconcile(false)
+	require.Regexp(t, "^failed to read images folder: ", err)
+}
+
+// The aggregator reconciles the images folder periodically.
+func TestStartReconcile(t *testing.T) {
+	mediaStore := store.NewMemoryStore()
+
+	imagesFolder := t.TempDir()
+	saveJPEG(t, filepath.Join(imagesFolder, "zz.jpg"), 10, 10)
+
+	agg := NewInstagramAggregator(mediaStore, fakeInstagram{}, imagesFolder, imageClient{},
+		zerolog.New(io.Discard), WithReconcile(time.Millisecond, true))
+
+	done := make(chan error)
+
+	go func() {
+		done <- agg.Start(time.Hour)
+	}()
+
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(imagesFolder, "zz.jpg"))
+		return os.IsNotExist(err)
+	}, time.Second, time.Millisecond)
+
+	agg.Stop()
+
+	require.NoError(t, <-done)
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+func setMedias(t *testing.T, mediaStore store.MediaStore, medias ...types.Media) {
+	for _, media := range medias {
+		err := mediaStore.Put(media)
+		require.NoError(t, err)
+	}
+}
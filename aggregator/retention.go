@@ -0,0 +1,260 @@
+package aggregator
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nkcr/OSIA/events"
+	"github.com/nkcr/OSIA/instagram/types"
+	"github.com/nkcr/OSIA/store"
+)
+
+// Retention defines the medias kept by the aggregator. The most recent medias
+// are kept until one of the limits is reached, the older ones are removed. A
+// zero limit disables it. Pinned medias are always kept and don't count.
+type Retention struct {
+	// MaxMedias is the number of medias kept
+	MaxMedias int
+	// MaxAge is the age after which medias are removed
+	MaxAge time.Duration
+	// MaxBytes is the total size of the files of the kept medias
+	MaxBytes int64
+	// DryRun only logs the medias that would be removed
+	DryRun bool
+}
+
+// retentionMark is the duration during which a media removed by the retention
+// is marked as deleted, so that it is not added back. Instagram only lists the
+// recent medias, which keeps the marks from piling up. A media still listed
+// after it is added back and removed again.
+const retentionMark = 365 * 24 * time.Hour
+
+// enabled returns true if at least one limit is set
+func (r Retention) enabled() bool {
+	return r.MaxMedias > 0 || r.MaxAge > 0 || r.MaxBytes > 0
+}
+
+// WithRetention sets the retention enforced after each synchronization. By
+// default all medias are kept.
+func WithRetention(retention Retention) Option {
+	return func(a *InstagramAggregator) {
+		a.retention = retention
+	}
+}
+
+// WithImageCache sets the folder where the HTTP API caches the resized images,
+// whose files are removed with their media. By default it is the images folder
+// followed by "-resized".
+func WithImageCache(folder string) Option {
+	return func(a *InstagramAggregator) {
+		if folder != "" {
+			a.imageCache = folder
+		}
+	}
+}
+
+// retained is a media considered by the retention
+type retained struct {
+	media     types.Media
+	published time.Time
+	size      int64
+}
+
+// enforceRetention removes the medias that exceed the retention, with their
+// files. It returns the IDs of the removed medias, or of the medias that would
+// be removed in dry run.
+func (a *InstagramAggregator) enforceRetention() ([]string, error) {
+	if !a.retention.enabled() {
+		return nil, nil
+	}
+
+	unpinned, _, err := a.store.List(store.Query{Filter: store.Filter{Unpinned: true}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list medias: %v", err)
+	}
+
+	medias := make([]retained, len(unpinned))
+
+	for i, media := range unpinned {
+		medias[i] = retained{
+			media:     media,
+			published: media.Timestamp.Time,
+			size:      a.filesSize(mediaFiles(media)),
+		}
+	}
+
+	// medias without timestamp come last, so that the limits on the number
+	// and the size remove them first
+	sort.SliceStable(medias, func(i, j int) bool {
+		if medias[i].published.IsZero() || medias[j].published.IsZero() {
+			return !medias[i].published.IsZero() && medias[j].published.IsZero()
+		}
+
+		return medias[i].published.After(medias[j].published)
+	})
+
+	removed := []types.Media{}
+	wouldRemove := []string{}
+	now := time.Now()
+
+	// once the number or the size is reached, the next medias are removed as
+	// well, so that the kept ones are the most recent
+	limit := ""
+	kept := 0
+
+	var size int64
+
+	for _, m := range medias {
+		reason := limit
+
+		switch {
+		case reason != "":
+		case a.retention.MaxMedias > 0 && kept >= a.retention.MaxMedias:
+			limit = fmt.Sprintf("more than %d medias", a.retention.MaxMedias)
+			reason = limit
+		// the age of medias without timestamp is unknown
+		case a.retention.MaxAge > 0 && !m.published.IsZero() && now.Sub(m.published) > a.retention.MaxAge:
+			reason = fmt.Sprintf("older than %s", a.retention.MaxAge)
+		case a.retention.MaxBytes > 0 && size+m.size > a.retention.MaxBytes:
+			limit = fmt.Sprintf("more than %d bytes", a.retention.MaxBytes)
+			reason = limit
+		}
+
+		if reason == "" {
+			kept++
+			size += m.size
+
+			continue
+		}
+
+		removed = append(removed, m.media)
+
+		if a.retention.DryRun {
+			wouldRemove = append(wouldRemove, m.media.ID)
+			a.logger.Info().Msgf("media '%s' would be removed: %s", m.media.ID, reason)
+		}
+	}
+
+	if a.retention.DryRun {
+		return wouldRemove, nil
+	}
+
+	if len(removed) == 0 {
+		return nil, nil
+	}
+
+	ids := []string{}
+	resized := a.resizedFiles()
+
+	for _, media := range removed {
+		// the media is marked as deleted so that it is not added back
+		_, err = a.store.DeleteFor(media.ID, retentionMark)
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		}
+
+		if err != nil {
+			return ids, fmt.Errorf("failed to delete media: %v", err)
+		}
+
+		ids = append(ids, media.ID)
+
+		for _, path := range a.filePaths(media, resized) {
+			err = os.Remove(path)
+			if err != nil && !os.IsNotExist(err) {
+				a.logger.Warn().Err(err).Msgf("failed to remove file of media '%s'", media.ID)
+			}
+		}
+
+		a.logger.Info().Msgf("media '%s' removed by the retention", media.ID)
+		a.publish(events.MediaDeleted, events.MediaData{ID: media.ID})
+	}
+
+	return ids, nil
+}
+
+// filesSize returns the total size of the files that exist in the images
+// folder
+func (a *InstagramAggregator) filesSize(files []string) int64 {
+	var size int64
+
+	for _, file := range files {
+		info, err := os.Stat(filepath.Join(a.imagesFolder, file))
+		if err == nil {
+			size += info.Size()
+		}
+	}
+
+	return size
+}
+
+// filePaths returns the paths of the files of a media: its files in the images
+// folder, their precompressed versions, and their resized versions among the
+// files of the image cache.
+func (a *InstagramAggregator) filePaths(media types.Media, resized []string) []string {
+	paths := []string{}
+
+	for _, file := range mediaFiles(media) {
+		paths = append(paths, filepath.Join(a.imagesFolder, file))
+
+		for _, ext := range precompressedExts {
+			paths = append(paths, filepath.Join(a.imagesFolder, file+ext))
+		}
+
+		for _, name := range resized {
+			if isResized(name, file) {
+				paths = append(paths, filepath.Join(a.imageCache, name))
+			}
+		}
+	}
+
+	return paths
+}
+
+// resizedFiles returns the names of the files in the image cache, none if it
+// doesn't exist.
+func (a *InstagramAggregator) resizedFiles() []string {
+	entries, err := os.ReadDir(a.imageCache)
+	if err != nil {
+		return nil
+	}
+
+	names := []string{}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+
+	return names
+}
+
+// isResized returns true if a file of the image cache is a resized version of
+// a file, which the HTTP API names "<name>-<width><ext>", in any format.
+func isResized(name, file string) bool {
+	prefix := strings.TrimSuffix(file, filepath.Ext(file)) + "-"
+	if !strings.HasPrefix(name, prefix) {
+		return false
+	}
+
+	rest := strings.TrimPrefix(name, prefix)
+	width := strings.TrimSuffix(rest, filepath.Ext(rest))
+
+	if width == "" {
+		return false
+	}
+
+	for _, c := range width {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
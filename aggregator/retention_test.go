@@ -0,0 +1,288 @@
+package aggregator
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nkcr/OSIA/events"
+	"github.com/nkcr/OSIA/instagram/types"
+	"github.com/nkcr/OSIA/store"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetentionDisabled(t *testing.T) {
+	mediaStore := store.NewMemoryStore()
+
+	setMedias(t, mediaStore, types.Media{ID: "aa", Timestamp: ago(24 * time.Hour)})
+
+	agg := NewInstagramAggregator(mediaStore, fakeInstagram{}, t.TempDir(), nil,
+		zerolog.New(io.Discard)).(*InstagramAggregator)
+
+	removed, err := agg.enforceRetention()
+	require.NoError(t, err)
+	require.Empty(t, removed)
+
+	getMedia(t, mediaStore, "aa")
+}
+
+func TestRetentionMaxMedias(t *testing.T) {
+	mediaStore, imagesFolder := retentionFixture(t)
+
+	publisher := &fakePublisher{}
+
+	agg := NewInstagramAggregator(mediaStore, fakeInstagram{}, imagesFolder, nil,
+		zerolog.New(io.Discard), WithPublisher(publisher),
+		WithRetention(Retention{MaxMedias: 2})).(*InstagramAggregator)
+
+	removed, err := agg.enforceRetention()
+	require.NoError(t, err)
+	require.Equal(t, []string{"cc", "ee"}, removed)
+
+	requireKept(t, mediaStore, imagesFolder, "aa", "bb", "dd")
+	requireRemoved(t, mediaStore, imagesFolder, "cc", "ee")
+
+	require.FileExists(t, filepath.Join(imagesFolder, "aa-320.jpg"))
+	require.NoFileExists(t, filepath.Join(imagesFolder, "cc-320.jpg"))
+
+	require.Equal(t, []string{events.MediaDeleted, events.MediaDeleted}, publisher.types)
+	require.Equal(t, events.MediaData{ID: "cc"}, publisher.data[0])
+}
+
+// The precompressed and resized versions of the files of removed medias are
+// removed too.
+func TestRetentionFiles(t *testing.T) {
+	mediaStore, imagesFolder := retentionFixture(t)
+
+	imageCache := filepath.Join(t.TempDir(), "resized")
+
+	err := os.Mkdir(imageCache, 0744)
+	require.NoError(t, err)
+
+	for _, name := range []string{"aa.jpg.gz", "cc.jpg.gz", "cc-320.jpg.br"} {
+		saveJPEG(t, filepath.Join(imagesFolder, name), 10, 10)
+	}
+
+	for _, name := range []string{"aa-150.jpg", "cc-150.jpg", "cc-480.webp", "cc-320-150.jpg", "cc-other.jpg"} {
+		saveJPEG(t, filepath.Join(imageCache, name), 10, 10)
+	}
+
+	agg := NewInstagramAggregator(mediaStore, fakeInstagram{}, imagesFolder, nil,
+		zerolog.New(io.Discard), WithImageCache(imageCache),
+		WithRetention(Retention{MaxMedias: 2})).(*InstagramAggregator)
+
+	removed, err := agg.enforceRetention()
+	require.NoError(t, err)
+	require.Equal(t, []string{"cc", "ee"}, removed)
+
+	require.FileExists(t, filepath.Join(imagesFolder, "aa.jpg.gz"))
+	require.NoFileExists(t, filepath.Join(imagesFolder, "cc.jpg.gz"))
+	require.NoFileExists(t, filepath.Join(imagesFolder, "cc-320.jpg.br"))
+
+	entries, err := os.ReadDir(imageCache)
+	require.NoError(t, err)
+
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+
+	require.Equal(t, []string{"aa-150.jpg", "cc-other.jpg"}, names)
+}
+
+// Medias removed by the retention are marked as deleted for a while only, so
+// that the marks don't pile up.
+func TestRetentionMarkExpires(t *testing.T) {
+	mediaStore, imagesFolder := retentionFixture(t)
+	expiry := &expiryStore{MediaStore: mediaStore}
+
+	agg := NewInstagramAggregator(expiry, fakeInstagram{}, imagesFolder, nil,
+		zerolog.New(io.Discard), WithRetention(Retention{MaxMedias: 2})).(*InstagramAggregator)
+
+	_, err := agg.enforceRetention()
+	require.NoError(t, err)
+
+	require.Equal(t, map[string]time.Duration{"cc": retentionMark, "ee": retentionMark}, expiry.ttls)
+}
+
+func TestRetentionMaxAge(t *testing.T) {
+	mediaStore, imagesFolder := retentionFixture(t)
+
+	agg := NewInstagramAggregator(mediaStore, fakeInstagram{}, imagesFolder, nil,
+		zerolog.New(io.Discard), WithRetention(Retention{MaxAge: 36 * time.Hour})).(*InstagramAggregator)
+
+	removed, err := agg.enforceRetention()
+	require.NoError(t, err)
+	require.Equal(t, []string{"bb", "cc"}, removed)
+
+	// "ee" has no timestamp, its age is unknown
+	requireKept(t, mediaStore, imagesFolder, "aa", "dd", "ee")
+	requireRemoved(t, mediaStore, imagesFolder, "bb", "cc")
+}
+
+// Medias without timestamp are never too old, but come after the others for
+// the other limits.
+func TestRetentionUnknownTimestamp(t *testing.T) {
+	mediaStore := store.NewMemoryStore()
+
+	setMedias(t, mediaStore,
+		types.Media{ID: "aa"},
+		types.Media{ID: "bb", Timestamp: ago(72 * time.Hour)},
+		types.Media{ID: "cc"},
+		types.Media{ID: "dd", Timestamp: ago(time.Hour)},
+	)
+
+	agg := NewInstagramAggregator(mediaStore, fakeInstagram{}, t.TempDir(), nil,
+		zerolog.New(io.Discard), WithRetention(Retention{MaxAge: 36 * time.Hour})).(*InstagramAggregator)
+
+	removed, err := agg.enforceRetention()
+	require.NoError(t, err)
+	require.Equal(t, []string{"bb"}, removed)
+
+	agg.retention.MaxMedias = 2
+
+	removed, err = agg.enforceRetention()
+	require.NoError(t, err)
+	require.Equal(t, []string{"aa"}, removed)
+
+	getMedia(t, mediaStore, "dd")
+}
+
+func TestRetentionMaxBytes(t *testing.T) {
+	mediaStore, imagesFolder := retentionFixture(t)
+
+	// all the files have the same size, "aa" has a rendition
+	info, err := os.Stat(filepath.Join(imagesFolder, "bb.jpg"))
+	require.NoError(t, err)
+
+	agg := NewInstagramAggregator(mediaStore, fakeInstagram{}, imagesFolder, nil,
+		zerolog.New(io.Discard), WithRetention(Retention{MaxBytes: info.Size() * 3})).(*InstagramAggregator)
+
+	removed, err := agg.enforceRetention()
+	require.NoError(t, err)
+	require.Equal(t, []string{"cc", "ee"}, removed)
+
+	requireKept(t, mediaStore, imagesFolder, "aa", "bb", "dd")
+}
+
+func TestRetentionDryRun(t *testing.T) {
+	mediaStore, imagesFolder := retentionFixture(t)
+
+	agg := NewInstagramAggregator(mediaStore, fakeInstagram{}, imagesFolder, nil,
+		zerolog.New(io.Discard), WithRetention(Retention{MaxMedias: 1, DryRun: true})).(*InstagramAggregator)
+
+	removed, err := agg.enforceRetention()
+	require.NoError(t, err)
+	require.Equal(t, []string{"bb", "cc", "ee"}, removed)
+
+	requireKept(t, mediaStore, imagesFolder, "aa", "bb", "cc", "dd", "ee")
+
+	report, err := agg.sync()
+	require.NoError(t, err)
+	require.Empty(t, report.Removed)
+	require.Equal(t, []string{"bb", "cc", "ee"}, report.WouldRemove)
+}
+
+// The retention is enforced after each synchronization, and removed medias are
+// not added back.
+func TestSyncRetention(t *testing.T) {
+	mediaStore := store.NewMemoryStore()
+
+	instagram := fakeInstagram{
+		medias: types.Medias{
+			Data: []types.Media{
+				{ID: "aa", Timestamp: ago(time.Hour)},
+				{ID: "bb", Timestamp: ago(2 * time.Hour)},
+			},
+		},
+	}
+
+	client := fakeClient{
+		body:       jpegBody(t, 10, 10),
+		statusCode: 200,
+	}
+
+	agg := NewInstagramAggregator(mediaStore, instagram, t.TempDir(), client,
+		zerolog.New(io.Discard), WithRetention(Retention{MaxMedias: 1})).(*InstagramAggregator)
+
+	report, err := agg.sync()
+	require.NoError(t, err)
+	require.Equal(t, []string{"aa", "bb"}, report.Added)
+	require.Equal(t, []string{"bb"}, report.Removed)
+
+	report, err = agg.sync()
+	require.NoError(t, err)
+	require.Empty(t, report.Added)
+	require.Empty(t, report.Removed)
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+// retentionFixture saves medias from the most recent to the oldest: "aa" with
+// a rendition, "bb", "cc", and "ee" without timestamp. "dd" is old but pinned.
+func retentionFixture(t *testing.T) (store.MediaStore, string) {
+	mediaStore := store.NewMemoryStore()
+
+	setMedias(t, mediaStore,
+		types.Media{ID: "aa", Timestamp: ago(time.Hour),
+			Renditions: []types.Rendition{{Name: "320", File: "aa-320.jpg"}}},
+		types.Media{ID: "bb", Timestamp: ago(48 * time.Hour)},
+		types.Media{ID: "cc", Timestamp: ago(72 * time.Hour),
+			Renditions: []types.Rendition{{Name: "320", File: "cc-320.jpg"}}},
+		types.Media{ID: "dd", Timestamp: ago(96 * time.Hour), Pinned: true},
+		types.Media{ID: "ee"},
+	)
+
+	imagesFolder := t.TempDir()
+
+	for _, name := range []string{"aa", "aa-320", "bb", "cc", "cc-320", "dd", "ee"} {
+		saveJPEG(t, filepath.Join(imagesFolder, name+".jpg"), 10, 10)
+	}
+
+	return mediaStore, imagesFolder
+}
+
+func requireKept(t *testing.T, mediaStore store.MediaStore, imagesFolder string, ids ...string) {
+	for _, id := range ids {
+		getMedia(t, mediaStore, id)
+		require.FileExists(t, filepath.Join(imagesFolder, id+".jpg"))
+	}
+}
+
+func requireRemoved(t *testing.T, mediaStore store.MediaStore, imagesFolder string, ids ...string) {
+	for _, id := range ids {
+		_, err := mediaStore.Get(id)
+		require.ErrorIs(t, err, store.ErrNotFound)
+
+		deleted, err := mediaStore.IsDeleted(id)
+		require.NoError(t, err)
+		require.True(t, deleted)
+
+		_, err = os.Stat(filepath.Join(imagesFolder, id+".jpg"))
+		require.True(t, os.IsNotExist(err))
+	}
+}
+
+// expiryStore records the durations of the deleted marks that expire
+type expiryStore struct {
+	store.MediaStore
+	ttls map[string]time.Duration
+}
+
+func (s *expiryStore) DeleteFor(id string, ttl time.Duration) (types.Media, error) {
+	if s.ttls == nil {
+		s.ttls = map[string]time.Duration{}
+	}
+
+	s.ttls[id] = ttl
+
+	return s.MediaStore.DeleteFor(id, ttl)
+}
+
+func ago(d time.Duration) types.Timestamp {
+	return types.NewTimestamp(time.Now().Add(-d))
+}
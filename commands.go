@@ -0,0 +1,449 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nkcr/OSIA/aggregator"
+	"github.com/nkcr/OSIA/httpapi"
+	"github.com/nkcr/OSIA/images"
+	"github.com/nkcr/OSIA/instagram"
+	"github.com/nkcr/OSIA/store"
+	"github.com/rs/zerolog"
+	"github.com/tidwall/buntdb"
+)
+
+// apiKeyCommand defines the "apikey" command, which manages the API keys of
+// the admin API. The database is loaded in memory by OSIA, therefore those
+// commands must be run while OSIA is stopped.
+type apiKeyCommand struct {
+	Create apiKeyCreateCommand `command:"create" description:"Creates a new API key and prints it. The key can't be displayed again."`
+	List   apiKeyListCommand   `command:"list" description:"Lists the API keys."`
+	Revoke apiKeyRevokeCommand `command:"revoke" description:"Revokes an API key."`
+}
+
+// newAPIKeyCommand returns a new initialized apikey command. Arguments are
+// populated by the parser before a command is executed.
+func newAPIKeyCommand(args *args) *apiKeyCommand {
+	return &apiKeyCommand{
+		Create: apiKeyCreateCommand{args: args},
+		List:   apiKeyListCommand{args: args},
+		Revoke: apiKeyRevokeCommand{args: args},
+	}
+}
+
+type apiKeyCreateCommand struct {
+	args *args
+
+	Positional struct {
+		Name string `positional-arg-name:"name" description:"Unique name of the key."`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// Execute implements flags.Commander
+func (c *apiKeyCreateCommand) Execute([]string) error {
+	return withDB(c.args.DBFilePath, func(db *buntdb.DB) error {
+		key, err := httpapi.CreateAPIKey(db, c.Positional.Name)
+		if err != nil {
+			return fmt.Errorf("failed to create key: %v", err)
+		}
+
+		fmt.Println(key)
+
+		return nil
+	})
+}
+
+type apiKeyListCommand struct {
+	args *args
+}
+
+// Execute implements flags.Commander
+func (c *apiKeyListCommand) Execute([]string) error {
+	return withDB(c.args.DBFilePath, func(db *buntdb.DB) error {
+		keys, err := httpapi.ListAPIKeys(db)
+		if err != nil {
+			return fmt.Errorf("failed to list keys: %v", err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tCREATED")
+
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s\t%s\n", key.Name, key.Created)
+		}
+
+		return w.Flush()
+	})
+}
+
+type apiKeyRevokeCommand struct {
+	args *args
+
+	Positional struct {
+		Name string `positional-arg-name:"name" description:"Name of the key to revoke."`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// Execute implements flags.Commander
+func (c *apiKeyRevokeCommand) Execute([]string) error {
+	return withDB(c.args.DBFilePath, func(db *buntdb.DB) error {
+		err := httpapi.RevokeAPIKey(db, c.Positional.Name)
+		if err != nil {
+			return fmt.Errorf("failed to revoke key: %v", err)
+		}
+
+		fmt.Printf("key '%s' revoked\n", c.Positional.Name)
+
+		return nil
+	})
+}
+
+// syncCommand defines the "sync" command, which asks a running OSIA to
+// synchronize now.
+type syncCommand struct {
+	args *args
+
+	URL     string        `long:"url" description:"URL of the running OSIA. By default it uses the listen address."`
+	Key     string        `long:"key" env:"OSIA_API_KEY" required:"yes" description:"API key of the admin API."`
+	Timeout time.Duration `long:"timeout" default:"5m" description:"Maximum time to wait for the synchronization."`
+}
+
+// Execute implements flags.Commander
+func (c *syncCommand) Execute([]string) error {
+	base := c.URL
+	if base == "" {
+		host, port, err := net.SplitHostPort(c.args.HTTPListen)
+		if err != nil {
+			return fmt.Errorf("failed to parse listen address: %v", err)
+		}
+
+		if host == "" || host == "0.0.0.0" || host == "::" {
+			host = "127.0.0.1"
+		}
+
+		base = "http://" + net.JoinHostPort(host, port)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(base, "/")+"/admin/api/sync", nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+c.Key)
+
+	client := http.Client{Timeout: c.Timeout}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to sync: %v", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		buf, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("sync failed with status %s: %s", resp.Status, strings.TrimSpace(string(buf)))
+	}
+
+	var report aggregator.Report
+
+	err = json.NewDecoder(resp.Body).Decode(&report)
+	if err != nil {
+		return fmt.Errorf("failed to decode report: %v", err)
+	}
+
+	fmt.Printf("sync done in %s, %d media added\n", report.End.Sub(report.Start), len(report.Added))
+
+	for _, id := range report.Added {
+		fmt.Println(" -", id)
+	}
+
+	if len(report.Removed) != 0 {
+		fmt.Printf("%d media removed by the retention\n", len(report.Removed))
+
+		for _, id := range report.Removed {
+			fmt.Println(" -", id)
+		}
+	}
+
+	if len(report.WouldRemove) != 0 {
+		fmt.Printf("%d media would be removed by the retention (dry run)\n", len(report.WouldRemove))
+
+		for _, id := range report.WouldRemove {
+			fmt.Println(" -", id)
+		}
+	}
+
+	return nil
+}
+
+// backfillCommand defines the "backfill" command, which extracts the metadata
+// of the images stored before OSIA extracted it. It must be run while OSIA is
+// stopped.
+type backfillCommand struct {
+	args *args
+}
+
+// Execute implements flags.Commander
+func (c *backfillCommand) Execute([]string) error {
+	imagesFolder, err := c.args.imagesFolder()
+	if err != nil {
+		return err
+	}
+
+	return withMediaStore(c.args, func(mediaStore store.MediaStore) error {
+		report, err := aggregator.BackfillMetadata(mediaStore, imagesFolder)
+		if err != nil {
+			return fmt.Errorf("failed to backfill: %v", err)
+		}
+
+		fmt.Printf("%d media updated, %d skipped\n", len(report.Updated), len(report.Skipped))
+
+		skipped := make([]string, 0, len(report.Skipped))
+		for id := range report.Skipped {
+			skipped = append(skipped, id)
+		}
+
+		sort.Strings(skipped)
+
+		for _, id := range skipped {
+			fmt.Printf(" - %s: %v\n", id, report.Skipped[id])
+		}
+
+		return nil
+	})
+}
+
+// reconcileCommand defines the "reconcile" command, which downloads again the
+// missing images and removes the files that belong to no media. It must be run
+// while OSIA is stopped.
+type reconcileCommand struct {
+	args *args
+
+	Delete bool `long:"delete" description:"Deletes the orphaned files instead of moving them."`
+}
+
+// Execute implements flags.Commander
+func (c *reconcileCommand) Execute([]string) error {
+	token := os.Getenv(tokenKey)
+	if token == "" {
+		return fmt.Errorf("please set the %s variable", tokenKey)
+	}
+
+	imagesFolder, err := c.args.imagesFolder()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(imagesFolder, 0744)
+	if err != nil {
+		return fmt.Errorf("failed to create images folder: %v", err)
+	}
+
+	renditions, err := c.args.renditions()
+	if err != nil {
+		return err
+	}
+
+	logger := zerolog.New(logout).Level(zerolog.WarnLevel).With().Timestamp().Logger()
+
+	return withMediaStore(c.args, func(mediaStore store.MediaStore) error {
+		api := instagram.NewHTTPAPI(token, http.DefaultClient)
+
+		agg := aggregator.NewInstagramAggregator(mediaStore, api, imagesFolder, http.DefaultClient, logger,
+			aggregator.WithRenditions(renditions...),
+			aggregator.WithConcurrency(c.args.FetchWorkers, c.args.FetchPerHost))
+
+		report, err := agg.Reconcile(c.Delete)
+		if err != nil {
+			return fmt.Errorf("failed to reconcile: %v", err)
+		}
+
+		fmt.Printf("%d media checked, %d missing, %d restored\n",
+			report.Medias, len(report.Missing), len(report.Restored))
+
+		restored := map[string]bool{}
+		for _, id := range report.Restored {
+			restored[id] = true
+		}
+
+		for _, id := range report.Missing {
+			if !restored[id] {
+				fmt.Printf(" - %s: not restored\n", id)
+			}
+		}
+
+		if report.Quarantine != "" {
+			fmt.Printf("%d orphan(s) moved to %s\n", len(report.Orphans), report.Quarantine)
+		} else {
+			fmt.Printf("%d orphan(s) deleted\n", len(report.Orphans))
+		}
+
+		for _, name := range report.Orphans {
+			fmt.Println(" -", name)
+		}
+
+		return nil
+	})
+}
+
+// migrateCommand defines the "migrate" command, which copies the posts of the
+// buntdb database into the SQLite database. It must be run while OSIA is
+// stopped.
+type migrateCommand struct {
+	args *args
+}
+
+// Execute implements flags.Commander
+func (c *migrateCommand) Execute([]string) error {
+	// opening the database would create an empty one
+	_, err := os.Stat(c.args.DBFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to find db: %v", err)
+	}
+
+	return withDB(c.args.DBFilePath, func(db *buntdb.DB) error {
+		sqliteStore, err := openSQLiteStore(c.args.SQLitePath)
+		if err != nil {
+			return err
+		}
+
+		defer sqliteStore.Close()
+
+		report, err := store.Copy(sqliteStore, store.NewBuntStore(db))
+		if err != nil {
+			return fmt.Errorf("failed to migrate: %v", err)
+		}
+
+		fmt.Printf("%d media and %d deleted media copied to %s\n",
+			report.Medias, report.Deleted, c.args.SQLitePath)
+
+		return nil
+	})
+}
+
+// imagesFolder returns the images folder, which is $HOME/.OSIA/images by
+// default.
+func (a *args) imagesFolder() (string, error) {
+	if a.ImagesFolder != "" {
+		return a.ImagesFolder, nil
+	}
+
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home dir: %v", err)
+	}
+
+	return filepath.Join(homeDir, ".OSIA", "images"), nil
+}
+
+// renditions returns the parsed renditions. "none" is ignored.
+func (a *args) renditions() ([]images.Rendition, error) {
+	renditions := []images.Rendition{}
+
+	for _, spec := range a.Renditions {
+		if spec == "none" {
+			continue
+		}
+
+		rendition, err := images.ParseRendition(spec)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse renditions: %v", err)
+		}
+
+		renditions = append(renditions, rendition)
+	}
+
+	return renditions, nil
+}
+
+// mediaStore returns the media store selected by the arguments, and a function
+// that closes it. The buntdb store uses the provided database.
+func (a *args) mediaStore(db *buntdb.DB) (store.MediaStore, func() error, error) {
+	if a.Store != "sqlite" {
+		return store.NewBuntStore(db), func() error { return nil }, nil
+	}
+
+	sqliteStore, err := openSQLiteStore(a.SQLitePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return sqliteStore, sqliteStore.Close, nil
+}
+
+// openSQLiteStore opens the SQLite database, which is created with its folder
+// if it doesn't exist.
+func openSQLiteStore(path string) (*store.SQLiteStore, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0744)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sqlite dir: %v", err)
+	}
+
+	sqliteStore, err := store.NewSQLiteStore(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite store: %v", err)
+	}
+
+	return sqliteStore, nil
+}
+
+// withMediaStore opens the media store selected by the arguments, calls the
+// function, and closes the store.
+func withMediaStore(a *args, f func(mediaStore store.MediaStore) error) error {
+	return withDB(a.DBFilePath, func(db *buntdb.DB) error {
+		mediaStore, closeStore, err := a.mediaStore(db)
+		if err != nil {
+			return err
+		}
+
+		defer closeStore()
+
+		return f(mediaStore)
+	})
+}
+
+// withDB opens the database, calls the function, and closes the database. The
+// database is created if it doesn't exist.
+func withDB(path string, f func(db *buntdb.DB) error) error {
+	db, migration, err := openDB(path)
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	if migration.Backup != "" {
+		fmt.Printf("database migrated from version %d to %d, saved before in %s\n",
+			migration.From, migration.To, migration.Backup)
+	}
+
+	return f(db)
+}
+
+// openDB opens the database and upgrades its schema. The database is created
+// if it doesn't exist.
+func openDB(path string) (*buntdb.DB, store.BuntMigration, error) {
+	db, err := buntdb.Open(path)
+	if err != nil {
+		return nil, store.BuntMigration{}, fmt.Errorf("failed to open db '%s': %v", path, err)
+	}
+
+	migration, err := store.MigrateBunt(db, path)
+	if err != nil {
+		db.Close()
+		return nil, migration, fmt.Errorf("failed to migrate db '%s': %v", path, err)
+	}
+
+	return db, migration, nil
+}
@@ -0,0 +1,205 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Types of the events published by OSIA
+const (
+	MediaAdded    = "media.added"
+	MediaUpdated  = "media.updated"
+	MediaDeleted  = "media.deleted"
+	SyncCompleted = "sync.completed"
+)
+
+// DefaultHistorySize is the number of events kept by default to let
+// subscribers resume after a disconnection.
+const DefaultHistorySize = 100
+
+// subscriptionBuffer is the number of events a subscriber can lag behind
+// before being dropped.
+const subscriptionBuffer = 64
+
+// Event defines an event published on the bus
+type Event struct {
+	// ID is incremented for each event, starting after the time the bus was
+	// created in nanoseconds, so that IDs keep increasing across restarts.
+	ID   uint64
+	Type string
+	Data json.RawMessage
+	Time time.Time
+}
+
+// MediaData is the data of the media events
+type MediaData struct {
+	ID string `json:"id"`
+}
+
+// Publisher defines the primitive needed to publish events
+type Publisher interface {
+	Publish(eventType string, data interface{}) error
+}
+
+// Publishers publishes the events to several publishers. All the publishers are
+// called even if some fail.
+//
+// - implements events.Publisher
+type Publishers []Publisher
+
+// Publish implements events.Publisher. It returns the first error, if any.
+func (p Publishers) Publish(eventType string, data interface{}) error {
+	var res error
+
+	for _, publisher := range p {
+		err := publisher.Publish(eventType, data)
+		if err != nil && res == nil {
+			res = err
+		}
+	}
+
+	return res
+}
+
+// NewBus returns a new initialized bus that keeps the given number of past
+// events.
+func NewBus(historySize int) *Bus {
+	return &Bus{
+		lastID:      uint64(time.Now().UnixNano()),
+		historySize: historySize,
+		subs:        map[*Subscription]struct{}{},
+	}
+}
+
+// Bus is an in-process event bus. Subscribers receive the events published
+// after they subscribed, and can get the past events still in the history.
+//
+// - implements events.Publisher
+type Bus struct {
+	sync.Mutex
+	lastID      uint64
+	history     []Event
+	historySize int
+	subs        map[*Subscription]struct{}
+	closed      bool
+}
+
+// Subscription receives the events of a bus
+type Subscription struct {
+	bus *Bus
+	c   chan Event
+}
+
+// Events returns the channel of events. It is closed when the subscriber
+// lags too far behind, or when the subscription or the bus is closed.
+func (s *Subscription) Events() <-chan Event {
+	return s.c
+}
+
+// Close stops the subscription
+func (s *Subscription) Close() {
+	s.bus.Lock()
+	defer s.bus.Unlock()
+
+	s.bus.remove(s)
+}
+
+// Publish implements events.Publisher. It never blocks: subscribers that lag
+// behind are dropped, they can resume from the history.
+func (b *Bus) Publish(eventType string, data interface{}) error {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal data: %v", err)
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.closed {
+		return fmt.Errorf("bus closed")
+	}
+
+	b.lastID++
+
+	event := Event{
+		ID:   b.lastID,
+		Type: eventType,
+		Data: buf,
+		Time: time.Now(),
+	}
+
+	b.history = append(b.history, event)
+	if len(b.history) > b.historySize {
+		b.history = b.history[len(b.history)-b.historySize:]
+	}
+
+	for sub := range b.subs {
+		select {
+		case sub.c <- event:
+		default:
+			b.remove(sub)
+		}
+	}
+
+	return nil
+}
+
+// Subscribe returns a new subscription, and the events of the history that
+// come after lastID. A lastID from before a restart replays the whole history,
+// while a lastID of 0, or one greater than the last ID, doesn't replay any
+// event.
+func (b *Bus) Subscribe(lastID uint64) (*Subscription, []Event) {
+	b.Lock()
+	defer b.Unlock()
+
+	sub := &Subscription{
+		bus: b,
+		c:   make(chan Event, subscriptionBuffer),
+	}
+
+	if b.closed {
+		close(sub.c)
+		return sub, nil
+	}
+
+	b.subs[sub] = struct{}{}
+
+	missed := []Event{}
+
+	if lastID == 0 || lastID > b.lastID {
+		return sub, missed
+	}
+
+	for _, event := range b.history {
+		if event.ID > lastID {
+			missed = append(missed, event)
+		}
+	}
+
+	return sub, missed
+}
+
+// Close closes all the subscriptions. Events can't be published afterwards.
+func (b *Bus) Close() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.closed = true
+
+	for sub := range b.subs {
+		b.remove(sub)
+	}
+}
+
+// remove closes a subscription. The lock must be held.
+func (b *Bus) remove(sub *Subscription) {
+	_, ok := b.subs[sub]
+	if !ok {
+		return
+	}
+
+	delete(b.subs, sub)
+	close(sub.c)
+}
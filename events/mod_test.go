@@ -0,0 +1,141 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBusPublish(t *testing.T) {
+	bus := NewBus(DefaultHistorySize)
+
+	sub, missed := bus.Subscribe(0)
+	require.Len(t, missed, 0)
+
+	err := bus.Publish(MediaAdded, MediaData{ID: "a"})
+	require.NoError(t, err)
+
+	event := <-sub.Events()
+	require.Greater(t, event.ID, uint64(0))
+	require.Equal(t, MediaAdded, event.Type)
+	require.JSONEq(t, `{"id": "a"}`, string(event.Data))
+
+	err = bus.Publish(MediaAdded, func() {})
+	require.Error(t, err)
+
+	sub.Close()
+
+	_, ok := <-sub.Events()
+	require.False(t, ok)
+
+	// closing twice is fine
+	sub.Close()
+}
+
+func TestBusResume(t *testing.T) {
+	bus := NewBus(3)
+	first := bus.lastID + 1
+
+	for _, id := range []string{"a", "b", "c", "d"} {
+		err := bus.Publish(MediaAdded, MediaData{ID: id})
+		require.NoError(t, err)
+	}
+
+	_, missed := bus.Subscribe(first + 1)
+	require.Len(t, missed, 2)
+	require.Equal(t, first+2, missed[0].ID)
+	require.Equal(t, first+3, missed[1].ID)
+
+	// 0 doesn't replay any event
+	_, missed = bus.Subscribe(0)
+	require.Len(t, missed, 0)
+
+	// the first event is no longer in the history
+	_, missed = bus.Subscribe(first)
+	require.Len(t, missed, 3)
+
+	// an ID from the future is unknown
+	_, missed = bus.Subscribe(first + 100)
+	require.Len(t, missed, 0)
+}
+
+// IDs keep increasing after a restart, so that an ID from a previous bus
+// replays the events of the new one.
+func TestBusRestart(t *testing.T) {
+	previous := NewBus(DefaultHistorySize)
+
+	err := previous.Publish(MediaAdded, MediaData{ID: "a"})
+	require.NoError(t, err)
+
+	previous.Close()
+
+	bus := NewBus(DefaultHistorySize)
+
+	err = bus.Publish(MediaAdded, MediaData{ID: "b"})
+	require.NoError(t, err)
+
+	_, missed := bus.Subscribe(previous.lastID)
+	require.Len(t, missed, 1)
+	require.Greater(t, missed[0].ID, previous.lastID)
+	require.JSONEq(t, `{"id": "b"}`, string(missed[0].Data))
+}
+
+func TestBusSlowSubscriber(t *testing.T) {
+	bus := NewBus(DefaultHistorySize)
+
+	slow, _ := bus.Subscribe(0)
+
+	for i := 0; i <= subscriptionBuffer; i++ {
+		err := bus.Publish(SyncCompleted, nil)
+		require.NoError(t, err)
+	}
+
+	// the buffered events are still delivered before the channel is closed
+	for i := 0; i < subscriptionBuffer; i++ {
+		_, ok := <-slow.Events()
+		require.True(t, ok)
+	}
+
+	_, ok := <-slow.Events()
+	require.False(t, ok)
+}
+
+func TestBusClose(t *testing.T) {
+	bus := NewBus(DefaultHistorySize)
+
+	sub, _ := bus.Subscribe(0)
+
+	bus.Close()
+
+	_, ok := <-sub.Events()
+	require.False(t, ok)
+
+	err := bus.Publish(SyncCompleted, nil)
+	require.EqualError(t, err, "bus closed")
+
+	sub, _ = bus.Subscribe(0)
+
+	_, ok = <-sub.Events()
+	require.False(t, ok)
+}
+
+func TestPublishers(t *testing.T) {
+	first := NewBus(DefaultHistorySize)
+	second := NewBus(DefaultHistorySize)
+
+	second.Close()
+
+	sub, _ := first.Subscribe(0)
+
+	publishers := Publishers{second, first}
+
+	// the first bus gets the event even if the second one fails
+	err := publishers.Publish(MediaAdded, MediaData{ID: "a"})
+	require.EqualError(t, err, "bus closed")
+
+	event := <-sub.Events()
+	require.Equal(t, MediaAdded, event.Type)
+
+	err = Publishers{}.Publish(MediaAdded, nil)
+	require.NoError(t, err)
+}
@@ -0,0 +1,386 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nkcr/OSIA/aggregator"
+	"github.com/nkcr/OSIA/events"
+	"github.com/nkcr/OSIA/instagram/types"
+	"github.com/nkcr/OSIA/store"
+	"github.com/tidwall/buntdb"
+)
+
+// adminPrefix is the path prefix of the admin API
+const adminPrefix = "/admin/api"
+
+// syncTimeout is the maximum time to write the response of a synchronization
+const syncTimeout = 5 * time.Minute
+
+// Syncer defines the primitive needed to trigger an immediate synchronization
+// from the admin API.
+type Syncer interface {
+	Trigger() (aggregator.Report, error)
+}
+
+// WithSyncer sets the syncer used by the admin API to trigger a
+// synchronization. The sync endpoint is not available without a syncer.
+func WithSyncer(syncer Syncer) Option {
+	return func(c *config) {
+		c.syncer = syncer
+	}
+}
+
+// authenticated is a utility function that only lets requests with a valid
+// bearer API key through.
+func authenticated(db *buntdb.DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth := r.Header.Get("Authorization")
+
+			const prefix = "Bearer "
+
+			if len(auth) <= len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="osia"`)
+				http.Error(w, "missing bearer token", http.StatusUnauthorized)
+				return
+			}
+
+			_, ok := checkAPIKey(db, strings.TrimSpace(auth[len(prefix):]))
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="osia", error="invalid_token"`)
+				http.Error(w, "invalid bearer token", http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// adminAPI returns an HTTP handler that serves the admin API, which allows to
+// moderate medias. It expects the following routes, relative to /admin/api:
+//
+//	GET    /medias               lists all medias, including hidden ones
+//	PUT    /medias/order         sets the order of pinned medias
+//	DELETE /medias/<id>          deletes a media, it won't be added back
+//	POST   /medias/<id>/hide     hides a media
+//	POST   /medias/<id>/unhide   shows a hidden media
+//	POST   /medias/<id>/pin      pins a media on top of the others
+//	POST   /medias/<id>/unpin    unpins a media
+//	POST   /sync                 triggers an immediate synchronization
+//	GET    /webhooks             lists the webhooks
+//	POST   /webhooks             creates a webhook
+//	GET    /webhooks/deliveries  lists the most recent deliveries
+//	DELETE /webhooks/<id>        deletes a webhook
+func adminAPI(mediaStore store.MediaStore, db *buntdb.DB, imagesFolder string, syncer Syncer, publisher events.Publisher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, adminPrefix), "/")
+		segments := strings.Split(path, "/")
+
+		switch {
+		case path == "sync":
+			if !allowMethod(w, r, http.MethodPost) {
+				return
+			}
+
+			// a synchronization can take longer than the server's write timeout
+			rc := http.NewResponseController(w)
+			rc.SetWriteDeadline(time.Now().Add(syncTimeout))
+
+			syncMedias(w, syncer)
+
+		case path == "medias":
+			if !allowMethod(w, r, http.MethodGet) {
+				return
+			}
+
+			listAllMedias(w, mediaStore)
+
+		case path == "medias/order":
+			if !allowMethod(w, r, http.MethodPut) {
+				return
+			}
+
+			orderMedias(w, r, mediaStore, publisher)
+
+		case len(segments) == 2 && segments[0] == "medias":
+			if !allowMethod(w, r, http.MethodDelete) {
+				return
+			}
+
+			deleteMedia(w, mediaStore, publisher, imagesFolder, segments[1])
+
+		case len(segments) == 3 && segments[0] == "medias":
+			if !allowMethod(w, r, http.MethodPost) {
+				return
+			}
+
+			moderateMedia(w, mediaStore, publisher, segments[1], segments[2])
+
+		case path == "webhooks":
+			switch r.Method {
+			case http.MethodGet:
+				listWebhooks(w, db)
+			case http.MethodPost:
+				createWebhook(w, r, db)
+			default:
+				w.Header().Set("Allow", "GET, POST")
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			}
+
+		case path == "webhooks/deliveries":
+			if !allowMethod(w, r, http.MethodGet) {
+				return
+			}
+
+			listDeliveries(w, r, db)
+
+		case len(segments) == 2 && segments[0] == "webhooks":
+			if !allowMethod(w, r, http.MethodDelete) {
+				return
+			}
+
+			deleteWebhook(w, db, segments[1])
+
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// listAllMedias writes all the medias, sorted by timestamp
+func listAllMedias(w http.ResponseWriter, mediaStore store.MediaStore) {
+	medias, _, err := mediaStore.List(store.Query{})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list medias: %v", err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, medias)
+}
+
+// moderateMedia applies a moderation action on a media
+func moderateMedia(w http.ResponseWriter, mediaStore store.MediaStore, publisher events.Publisher, id, action string) {
+	var update func(media *types.Media) error
+
+	switch action {
+	case "hide":
+		update = func(media *types.Media) error {
+			media.Hidden = true
+			return nil
+		}
+	case "unhide":
+		update = func(media *types.Media) error {
+			media.Hidden = false
+			return nil
+		}
+	case "pin":
+		pinned, _, err := mediaStore.List(store.Query{Filter: store.Filter{Pinned: true}})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to list medias: %v", err),
+				http.StatusInternalServerError)
+			return
+		}
+
+		last := 0
+
+		for _, other := range pinned {
+			if other.Position > last {
+				last = other.Position
+			}
+		}
+
+		update = func(media *types.Media) error {
+			if media.Pinned {
+				return nil
+			}
+
+			media.Pinned = true
+			media.Position = last + 1
+
+			return nil
+		}
+	case "unpin":
+		update = func(media *types.Media) error {
+			media.Pinned = false
+			media.Position = 0
+			return nil
+		}
+	default:
+		http.Error(w, "unknown action: "+action, http.StatusNotFound)
+		return
+	}
+
+	media, err := mediaStore.Update(id, update)
+
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, fmt.Sprintf("media '%s' not found", id), http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to update media: %v", err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	publish(publisher, events.MediaUpdated, events.MediaData{ID: media.ID})
+
+	writeJSON(w, http.StatusOK, media)
+}
+
+// orderMedias sets the position of pinned medias according to the order of
+// the provided IDs. It expects a body like {"ids": ["id1", "id2"]}. Medias are
+// checked before any is updated.
+func orderMedias(w http.ResponseWriter, r *http.Request, mediaStore store.MediaStore, publisher events.Publisher) {
+	var body struct {
+		IDs []string `json:"ids"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to decode body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	checkPinned := func(media *types.Media) error {
+		if !media.Pinned {
+			return fmt.Errorf("media '%s' is not pinned", media.ID)
+		}
+
+		return nil
+	}
+
+	for _, id := range body.IDs {
+		media, err := mediaStore.Get(id)
+		if err == nil {
+			err = checkPinned(&media)
+		}
+
+		if errors.Is(err, store.ErrNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	medias := make([]types.Media, len(body.IDs))
+
+	for i, id := range body.IDs {
+		medias[i], err = mediaStore.Update(id, func(media *types.Media) error {
+			err := checkPinned(media)
+			if err != nil {
+				return err
+			}
+
+			media.Position = i + 1
+
+			return nil
+		})
+
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to update media: %v", err),
+				http.StatusInternalServerError)
+			return
+		}
+	}
+
+	for _, media := range medias {
+		publish(publisher, events.MediaUpdated, events.MediaData{ID: media.ID})
+	}
+
+	writeJSON(w, http.StatusOK, medias)
+}
+
+// deleteMedia deletes a media, its image and its renditions. The media is
+// marked as deleted so that the aggregator doesn't add it back.
+func deleteMedia(w http.ResponseWriter, mediaStore store.MediaStore, publisher events.Publisher, imagesFolder, id string) {
+	media, err := mediaStore.Delete(id)
+
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, fmt.Sprintf("media '%s' not found", id), http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to delete media: %v", err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	publish(publisher, events.MediaDeleted, events.MediaData{ID: id})
+
+	files := []string{filepath.Base(id) + ".jpg"}
+	for _, rendition := range media.Renditions {
+		files = append(files, filepath.Base(rendition.File))
+	}
+
+	for _, file := range files {
+		err = os.Remove(filepath.Join(imagesFolder, file))
+		if err != nil && !os.IsNotExist(err) {
+			http.Error(w, fmt.Sprintf("failed to delete image: %v", err),
+				http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// syncMedias triggers an immediate synchronization and writes its report
+func syncMedias(w http.ResponseWriter, syncer Syncer) {
+	if syncer == nil {
+		http.Error(w, "sync not available", http.StatusNotImplemented)
+		return
+	}
+
+	report, err := syncer.Trigger()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to sync: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+// sortPinned sorts pinned medias by position. Medias with the same position
+// keep their order.
+func sortPinned(medias []types.Media) {
+	sort.SliceStable(medias, func(i, j int) bool {
+		return medias[i].Position < medias[j].Position
+	})
+}
+
+// allowMethod checks that the request uses the expected method. It writes an
+// error and returns false otherwise.
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+
+	w.Header().Set("Allow", method)
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+	return false
+}
+
+// writeJSON writes a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,295 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nkcr/OSIA/aggregator"
+	"github.com/nkcr/OSIA/instagram/types"
+	"github.com/nkcr/OSIA/store"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/buntdb"
+)
+
+func TestAuthenticated(t *testing.T) {
+	db, err := buntdb.Open(":memory:")
+	require.NoError(t, err)
+
+	key, err := CreateAPIKey(db, "test")
+	require.NoError(t, err)
+
+	handler := authenticated(db)(okHandler())
+
+	table := []struct {
+		auth     string
+		expected int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer", http.StatusUnauthorized},
+		{"Basic " + key, http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Bearer " + key, http.StatusOK},
+		{"bearer " + key, http.StatusOK},
+	}
+
+	for _, entry := range table {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "http://example.com/admin/api/medias", nil)
+		require.NoError(t, err)
+
+		req.Header.Set("Authorization", entry.auth)
+
+		handler.ServeHTTP(rr, req)
+		require.Equal(t, entry.expected, rr.Result().StatusCode, entry.auth)
+
+		if entry.expected == http.StatusUnauthorized {
+			require.Contains(t, rr.Header().Get("WWW-Authenticate"), "Bearer")
+		}
+	}
+}
+
+func TestAdminHideUnhide(t *testing.T) {
+	mediaStore, db := newMediasStore(t, "a", "b", "c")
+	handler := adminAPI(mediaStore, db, "", nil, nil)
+
+	rr := adminRequest(t, handler, http.MethodPost, "/admin/api/medias/b/hide", "")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	var media types.Media
+	err := json.Unmarshal(rr.Body.Bytes(), &media)
+	require.NoError(t, err)
+	require.True(t, media.Hidden)
+
+	require.Equal(t, []string{"c", "a"}, publicIDs(t, mediaStore))
+
+	// hidden medias are still listed by the admin API
+	rr = adminRequest(t, handler, http.MethodGet, "/admin/api/medias", "")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	medias := []types.Media{}
+	err = json.Unmarshal(rr.Body.Bytes(), &medias)
+	require.NoError(t, err)
+	require.Len(t, medias, 3)
+
+	rr = adminRequest(t, handler, http.MethodPost, "/admin/api/medias/b/unhide", "")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	require.Equal(t, []string{"c", "b", "a"}, publicIDs(t, mediaStore))
+}
+
+func TestAdminPinOrder(t *testing.T) {
+	mediaStore, db := newMediasStore(t, "a", "b", "c", "d")
+	handler := adminAPI(mediaStore, db, "", nil, nil)
+
+	rr := adminRequest(t, handler, http.MethodPost, "/admin/api/medias/a/pin", "")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	rr = adminRequest(t, handler, http.MethodPost, "/admin/api/medias/b/pin", "")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	require.Equal(t, []string{"a", "b", "d", "c"}, publicIDs(t, mediaStore))
+
+	rr = adminRequest(t, handler, http.MethodPut, "/admin/api/medias/order", `{"ids": ["b", "a"]}`)
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	require.Equal(t, []string{"b", "a", "d", "c"}, publicIDs(t, mediaStore))
+
+	// only pinned medias can be ordered
+	rr = adminRequest(t, handler, http.MethodPut, "/admin/api/medias/order", `{"ids": ["c"]}`)
+	require.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+
+	rr = adminRequest(t, handler, http.MethodPut, "/admin/api/medias/order", `{"ids": ["x"]}`)
+	require.Equal(t, http.StatusNotFound, rr.Result().StatusCode)
+
+	rr = adminRequest(t, handler, http.MethodPost, "/admin/api/medias/b/unpin", "")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	require.Equal(t, []string{"a", "d", "c", "b"}, publicIDs(t, mediaStore))
+}
+
+func TestAdminDelete(t *testing.T) {
+	mediaStore, db := newMediasStore(t, "a", "b")
+
+	tmpdir := t.TempDir()
+
+	err := os.WriteFile(filepath.Join(tmpdir, "a.jpg"), []byte("image"), os.ModePerm)
+	require.NoError(t, err)
+
+	handler := adminAPI(mediaStore, db, tmpdir, nil, nil)
+
+	rr := adminRequest(t, handler, http.MethodDelete, "/admin/api/medias/a", "")
+	require.Equal(t, http.StatusNoContent, rr.Result().StatusCode)
+
+	_, err = os.Stat(filepath.Join(tmpdir, "a.jpg"))
+	require.True(t, os.IsNotExist(err))
+
+	require.Equal(t, []string{"b"}, publicIDs(t, mediaStore))
+
+	deleted, err := mediaStore.IsDeleted("a")
+	require.NoError(t, err)
+	require.True(t, deleted)
+
+	rr = adminRequest(t, handler, http.MethodDelete, "/admin/api/medias/a", "")
+	require.Equal(t, http.StatusNotFound, rr.Result().StatusCode)
+}
+
+func TestAdminDeleteRenditions(t *testing.T) {
+	mediaStore, db := newMediasStore(t, "a")
+
+	tmpdir := t.TempDir()
+
+	_, err := mediaStore.Update("a", func(media *types.Media) error {
+		media.Renditions = []types.Rendition{{Name: "320", File: "a-320.jpg"}}
+		return nil
+	})
+	require.NoError(t, err)
+
+	for _, file := range []string{"a.jpg", "a-320.jpg", "b-320.jpg"} {
+		err = os.WriteFile(filepath.Join(tmpdir, file), []byte("image"), os.ModePerm)
+		require.NoError(t, err)
+	}
+
+	handler := adminAPI(mediaStore, db, tmpdir, nil, nil)
+
+	rr := adminRequest(t, handler, http.MethodDelete, "/admin/api/medias/a", "")
+	require.Equal(t, http.StatusNoContent, rr.Result().StatusCode)
+
+	require.NoFileExists(t, filepath.Join(tmpdir, "a.jpg"))
+	require.NoFileExists(t, filepath.Join(tmpdir, "a-320.jpg"))
+	require.FileExists(t, filepath.Join(tmpdir, "b-320.jpg"))
+}
+
+// Keys that are not medias must not be altered by the admin API.
+func TestAdminNotAMedia(t *testing.T) {
+	mediaStore, db := newMediasStore(t, "a")
+
+	_, err := CreateAPIKey(db, "test")
+	require.NoError(t, err)
+
+	keys, err := ListAPIKeys(db)
+	require.NoError(t, err)
+
+	handler := adminAPI(mediaStore, db, "", nil, nil)
+
+	rr := adminRequest(t, handler, http.MethodDelete, "/admin/api/medias/"+apiKeyPrefix+keys[0].Hash, "")
+	require.Equal(t, http.StatusNotFound, rr.Result().StatusCode)
+
+	rr = adminRequest(t, handler, http.MethodPost, "/admin/api/medias/"+apiKeyPrefix+keys[0].Hash+"/hide", "")
+	require.Equal(t, http.StatusNotFound, rr.Result().StatusCode)
+
+	keys, err = ListAPIKeys(db)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+
+	require.Equal(t, []string{"a"}, publicIDs(t, mediaStore))
+}
+
+func TestAdminSync(t *testing.T) {
+	mediaStore, db := newMediasStore(t)
+
+	rr := adminRequest(t, adminAPI(mediaStore, db, "", nil, nil), http.MethodPost, "/admin/api/sync", "")
+	require.Equal(t, http.StatusNotImplemented, rr.Result().StatusCode)
+
+	syncer := &fakeSyncer{
+		report: aggregator.Report{Added: []string{"a"}},
+	}
+
+	rr = adminRequest(t, adminAPI(mediaStore, db, "", syncer, nil), http.MethodPost, "/admin/api/sync", "")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, 1, syncer.calls)
+
+	var report aggregator.Report
+	err := json.Unmarshal(rr.Body.Bytes(), &report)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a"}, report.Added)
+
+	syncer.err = errors.New("fake")
+
+	rr = adminRequest(t, adminAPI(mediaStore, db, "", syncer, nil), http.MethodPost, "/admin/api/sync", "")
+	require.Equal(t, http.StatusInternalServerError, rr.Result().StatusCode)
+	require.Equal(t, "failed to sync: fake\n", rr.Body.String())
+}
+
+func TestAdminBadRoutes(t *testing.T) {
+	mediaStore, db := newMediasStore(t, "a")
+	handler := adminAPI(mediaStore, db, "", nil, nil)
+
+	rr := adminRequest(t, handler, http.MethodGet, "/admin/api/unknown", "")
+	require.Equal(t, http.StatusNotFound, rr.Result().StatusCode)
+
+	rr = adminRequest(t, handler, http.MethodGet, "/admin/api/sync", "")
+	require.Equal(t, http.StatusMethodNotAllowed, rr.Result().StatusCode)
+	require.Equal(t, http.MethodPost, rr.Header().Get("Allow"))
+
+	rr = adminRequest(t, handler, http.MethodPost, "/admin/api/medias/a/unknown", "")
+	require.Equal(t, http.StatusNotFound, rr.Result().StatusCode)
+
+	rr = adminRequest(t, handler, http.MethodPost, "/admin/api/medias/x/hide", "")
+	require.Equal(t, http.StatusNotFound, rr.Result().StatusCode)
+
+	rr = adminRequest(t, handler, http.MethodPut, "/admin/api/medias/order", "not json")
+	require.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+// newMediasStore returns a store with medias whose timestamps follow the order
+// of the provided IDs, and an empty database for the other records.
+func newMediasStore(t *testing.T, ids ...string) (store.MediaStore, *buntdb.DB) {
+	db, err := buntdb.Open(":memory:")
+	require.NoError(t, err)
+
+	mediaStore := store.NewMemoryStore()
+
+	for i, id := range ids {
+		err = mediaStore.Put(types.Media{
+			ID:        id,
+			Timestamp: types.NewTimestamp(time.Date(2022, 1, 1+i, 0, 0, 0, 0, time.UTC)),
+		})
+		require.NoError(t, err)
+	}
+
+	return mediaStore, db
+}
+
+// publicIDs returns the IDs of the medias that are publicly served
+func publicIDs(t *testing.T, mediaStore store.MediaStore) []string {
+	medias, err := publicMedias(mediaStore, maxMedias)
+	require.NoError(t, err)
+
+	ids := make([]string, len(medias))
+	for i, media := range medias {
+		ids[i] = media.ID
+	}
+
+	return ids
+}
+
+func adminRequest(t *testing.T, handler http.Handler, method, url, body string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(method, "http://example.com"+url, strings.NewReader(body))
+	require.NoError(t, err)
+
+	handler.ServeHTTP(rr, req)
+
+	return rr
+}
+
+type fakeSyncer struct {
+	calls  int
+	report aggregator.Report
+	err    error
+}
+
+func (s *fakeSyncer) Trigger() (aggregator.Report, error) {
+	s.calls++
+	return s.report, s.err
+}
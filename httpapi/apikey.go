@@ -0,0 +1,180 @@
+package httpapi
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+// apiKeyPrefix is the prefix of the keys that store the API keys. API keys are
+// stored as "apikey:<sha256 of the key>".
+const apiKeyPrefix = "apikey:"
+
+// APIKey defines an API key, as stored in the database. The key itself is never
+// stored, only its hash.
+type APIKey struct {
+	Name    string `json:"name"`
+	Hash    string `json:"hash"`
+	Created string `json:"created"`
+}
+
+// CreateAPIKey generates a new API key, stores its hash, and returns the key.
+// The key can't be retrieved afterwards. Names must be unique.
+func CreateAPIKey(db *buntdb.DB, name string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("name must not be empty")
+	}
+
+	buf := make([]byte, 32)
+
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate key: %v", err)
+	}
+
+	key := "osia_" + base64.RawURLEncoding.EncodeToString(buf)
+
+	apiKey := APIKey{
+		Name:    name,
+		Hash:    hashAPIKey(key),
+		Created: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	err = db.Update(func(tx *buntdb.Tx) error {
+		keys, err := listAPIKeys(tx)
+		if err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			if k.Name == name {
+				return fmt.Errorf("key '%s' already exists", name)
+			}
+		}
+
+		buf, err := json.Marshal(apiKey)
+		if err != nil {
+			return fmt.Errorf("failed to marshal key: %v", err)
+		}
+
+		_, _, err = tx.Set(apiKeyPrefix+apiKey.Hash, string(buf), nil)
+		if err != nil {
+			return fmt.Errorf("failed to set: %v", err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return key, nil
+}
+
+// ListAPIKeys returns the stored API keys, sorted by name.
+func ListAPIKeys(db *buntdb.DB) ([]APIKey, error) {
+	var keys []APIKey
+
+	err := db.View(func(tx *buntdb.Tx) error {
+		var err error
+
+		keys, err = listAPIKeys(tx)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// RevokeAPIKey deletes the API key with the given name.
+func RevokeAPIKey(db *buntdb.DB, name string) error {
+	return db.Update(func(tx *buntdb.Tx) error {
+		keys, err := listAPIKeys(tx)
+		if err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			if k.Name == name {
+				_, err = tx.Delete(apiKeyPrefix + k.Hash)
+				if err != nil {
+					return fmt.Errorf("failed to delete: %v", err)
+				}
+
+				return nil
+			}
+		}
+
+		return fmt.Errorf("key '%s' not found", name)
+	})
+}
+
+// checkAPIKey tells if the key is a valid API key. It returns the name of the
+// key if so.
+func checkAPIKey(db *buntdb.DB, key string) (string, bool) {
+	var apiKey APIKey
+
+	err := db.View(func(tx *buntdb.Tx) error {
+		value, err := tx.Get(apiKeyPrefix + hashAPIKey(key))
+		if err != nil {
+			return err
+		}
+
+		return json.Unmarshal([]byte(value), &apiKey)
+	})
+
+	if err != nil {
+		return "", false
+	}
+
+	return apiKey.Name, true
+}
+
+// listAPIKeys returns the API keys sorted by name.
+func listAPIKeys(tx *buntdb.Tx) ([]APIKey, error) {
+	keys := []APIKey{}
+
+	var err error
+
+	tx.AscendKeys(apiKeyPrefix+"*", func(key, value string) bool {
+		var apiKey APIKey
+
+		err = json.Unmarshal([]byte(value), &apiKey)
+		if err != nil {
+			err = fmt.Errorf("failed to unmarshal key '%s': %v", key, err)
+			return false
+		}
+
+		keys = append(keys, apiKey)
+
+		return true
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Name < keys[j].Name
+	})
+
+	return keys, nil
+}
+
+// hashAPIKey returns the hex-encoded SHA-256 of a key. API keys are random and
+// long enough that a fast hash is sufficient.
+func hashAPIKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,80 @@
+package httpapi
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/buntdb"
+)
+
+func TestCreateAPIKey(t *testing.T) {
+	db, err := buntdb.Open(":memory:")
+	require.NoError(t, err)
+
+	key, err := CreateAPIKey(db, "website")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(key, "osia_"))
+
+	name, ok := checkAPIKey(db, key)
+	require.True(t, ok)
+	require.Equal(t, "website", name)
+
+	_, ok = checkAPIKey(db, key+"x")
+	require.False(t, ok)
+
+	// the key itself must not be stored
+	err = db.View(func(tx *buntdb.Tx) error {
+		return tx.Ascend("", func(k, value string) bool {
+			require.NotContains(t, k, key)
+			require.NotContains(t, value, key)
+			return true
+		})
+	})
+	require.NoError(t, err)
+}
+
+func TestCreateAPIKeyDuplicate(t *testing.T) {
+	db, err := buntdb.Open(":memory:")
+	require.NoError(t, err)
+
+	_, err = CreateAPIKey(db, "website")
+	require.NoError(t, err)
+
+	_, err = CreateAPIKey(db, "website")
+	require.EqualError(t, err, "key 'website' already exists")
+
+	_, err = CreateAPIKey(db, "")
+	require.EqualError(t, err, "name must not be empty")
+}
+
+func TestListRevokeAPIKeys(t *testing.T) {
+	db, err := buntdb.Open(":memory:")
+	require.NoError(t, err)
+
+	keyB, err := CreateAPIKey(db, "b")
+	require.NoError(t, err)
+
+	_, err = CreateAPIKey(db, "a")
+	require.NoError(t, err)
+
+	keys, err := ListAPIKeys(db)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	require.Equal(t, "a", keys[0].Name)
+	require.Equal(t, "b", keys[1].Name)
+	require.Equal(t, hashAPIKey(keyB), keys[1].Hash)
+
+	err = RevokeAPIKey(db, "b")
+	require.NoError(t, err)
+
+	_, ok := checkAPIKey(db, keyB)
+	require.False(t, ok)
+
+	err = RevokeAPIKey(db, "b")
+	require.EqualError(t, err, "key 'b' not found")
+
+	keys, err = ListAPIKeys(db)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+}
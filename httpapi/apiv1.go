@@ -0,0 +1,273 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/jpeg" // registers the decoder of the saved images
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nkcr/OSIA/images"
+	"github.com/nkcr/OSIA/instagram/types"
+	"github.com/nkcr/OSIA/store"
+)
+
+// apiV1Prefix is the prefix of the routes of the first version of the API
+const apiV1Prefix = "/api/v1"
+
+// apiMedia is the public representation of a media in the v1 API. It is
+// independent of the storage format, which can therefore evolve without
+// breaking clients. All the fields are always present.
+type apiMedia struct {
+	ID           string   `json:"id"`
+	MediaType    string   `json:"media_type"`
+	Caption      string   `json:"caption"`
+	CaptionHTML  string   `json:"caption_html"`
+	Hashtags     []string `json:"hashtags"`
+	Mentions     []string `json:"mentions"`
+	Permalink    string   `json:"permalink"`
+	Username     string   `json:"username"`
+	Timestamp    string   `json:"timestamp"`
+	ImageURL     string   `json:"image_url"`
+	ThumbnailURL string   `json:"thumbnail_url"`
+	Width        int      `json:"width"`
+	Height       int      `json:"height"`
+	// AspectRatio, DominantColor and BlurHash are extracted from the image,
+	// so that pages can display a placeholder of the right size before the
+	// image loads. They are empty for videos.
+	AspectRatio   float64 `json:"aspect_ratio"`
+	DominantColor string  `json:"dominant_color"`
+	BlurHash      string  `json:"blurhash"`
+	Pinned        bool    `json:"pinned"`
+	// Renditions contains the resized versions of the image generated when the
+	// media was added, and Srcset those which keep the aspect ratio, with the
+	// original, as the value of a srcset attribute.
+	Renditions []apiRendition `json:"renditions"`
+	Srcset     string         `json:"srcset"`
+}
+
+// apiRendition is the public representation of a rendition
+type apiRendition struct {
+	Name    string `json:"name"`
+	URL     string `json:"url"`
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	Cropped bool   `json:"cropped"`
+}
+
+// apiMediaFields contains the fields of apiMedia that can be selected
+var apiMediaFields = []string{"id", "media_type", "caption", "caption_html", "hashtags",
+	"mentions", "permalink", "username", "timestamp", "image_url", "thumbnail_url", "width",
+	"height", "aspect_ratio", "dominant_color", "blurhash", "pinned", "renditions", "srcset"}
+
+// apiV1 returns the handler of the v1 API. Medias are served at
+// "/api/v1/medias", with the optional "count" and "fields" parameters.
+func apiV1(mediaStore store.MediaStore, imagesFolder string, conf config) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc(apiV1Prefix+"/medias", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+
+		count, err := parseCount(r.URL.Query().Get("count"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		fields, err := parseFields(r.URL.Query().Get("fields"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		base, err := baseURL(r, conf)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to build links: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		medias, err := publicMedias(mediaStore, count)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to list medias: %v", err),
+				http.StatusInternalServerError)
+			return
+		}
+
+		result := make([]map[string]json.RawMessage, len(medias))
+
+		for i, media := range medias {
+			res := newAPIMedia(media, imagesFolder, base, conf)
+
+			result[i], err = selectFields(res, fields)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("failed to select fields: %v", err),
+					http.StatusInternalServerError)
+				return
+			}
+		}
+
+		writeJSON(w, http.StatusOK, result)
+	})
+
+	return mux
+}
+
+// newAPIMedia creates the public representation of a media
+func newAPIMedia(media types.Media, imagesFolder, base string, conf config) apiMedia {
+	parsed := parseCaption(media.Caption, conf.hashtagURL, conf.mentionURL)
+
+	res := apiMedia{
+		ID:          media.ID,
+		MediaType:   media.MediaType,
+		Caption:     media.Caption,
+		CaptionHTML: parsed.html,
+		Hashtags:    parsed.hashtags,
+		Mentions:    parsed.mentions,
+		Permalink:   media.Permalink,
+		Username:    media.Username,
+		Timestamp:   media.Timestamp.String(),
+		ImageURL:    base + "/images/" + url.PathEscape(media.ID) + ".jpg",
+		Pinned:      media.Pinned,
+
+		Width:         media.Width,
+		Height:        media.Height,
+		AspectRatio:   media.AspectRatio,
+		DominantColor: media.DominantColor,
+		BlurHash:      media.BlurHash,
+	}
+
+	// videos are saved as is, without thumbnail nor readable dimensions
+	if media.MediaType != "VIDEO" {
+		res.ThumbnailURL = res.ImageURL
+
+		// medias added before the metadata was extracted only have their
+		// dimensions, read from the image
+		if res.Width == 0 {
+			res.Width, res.Height, _ = imageSize(imagesFolder, media.ID)
+			res.AspectRatio = images.AspectRatio(res.Width, res.Height)
+		}
+	}
+
+	res.Renditions = make([]apiRendition, len(media.Renditions))
+
+	srcset := []apiRendition{}
+
+	for i, rendition := range media.Renditions {
+		res.Renditions[i] = apiRendition{
+			Name:    rendition.Name,
+			URL:     base + "/images/" + url.PathEscape(rendition.File),
+			Width:   rendition.Width,
+			Height:  rendition.Height,
+			Cropped: rendition.Cropped,
+		}
+
+		if !rendition.Cropped {
+			srcset = append(srcset, res.Renditions[i])
+		}
+	}
+
+	if len(srcset) != 0 && res.Width != 0 {
+		srcset = append(srcset, apiRendition{URL: res.ImageURL, Width: res.Width})
+	}
+
+	sort.SliceStable(srcset, func(i, j int) bool {
+		return srcset[i].Width < srcset[j].Width
+	})
+
+	candidates := make([]string, len(srcset))
+	for i, rendition := range srcset {
+		candidates[i] = rendition.URL + " " + strconv.Itoa(rendition.Width) + "w"
+	}
+
+	res.Srcset = strings.Join(candidates, ", ")
+
+	return res
+}
+
+// imageSize returns the dimensions of a saved image. It returns false if they
+// can't be read.
+func imageSize(imagesFolder, id string) (int, int, bool) {
+	f, err := os.Open(filepath.Join(imagesFolder, id+".jpg"))
+	if err != nil {
+		return 0, 0, false
+	}
+
+	defer f.Close()
+
+	config, _, err := image.DecodeConfig(f)
+	if err != nil || config.Width == 0 || config.Height == 0 {
+		return 0, 0, false
+	}
+
+	return config.Width, config.Height, true
+}
+
+// parseCount parses the count parameter. The count is limited to the maximum
+// number of medias, which is also the default.
+func parseCount(value string) (int, error) {
+	if value == "" {
+		return maxMedias, nil
+	}
+
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 1 {
+		return 0, fmt.Errorf("bad count value: %s", value)
+	}
+
+	if count > maxMedias {
+		count = maxMedias
+	}
+
+	return count, nil
+}
+
+// parseFields parses the comma-separated list of fields. An empty list selects
+// all the fields.
+func parseFields(value string) ([]string, error) {
+	if value == "" {
+		return apiMediaFields, nil
+	}
+
+	fields := strings.Split(value, ",")
+
+	for i, field := range fields {
+		fields[i] = strings.ToLower(strings.TrimSpace(field))
+
+		if !contains(apiMediaFields, fields[i]) {
+			return nil, fmt.Errorf("unknown field: %s", fields[i])
+		}
+	}
+
+	return fields, nil
+}
+
+// selectFields returns the JSON fields of the media that are selected
+func selectFields(media apiMedia, fields []string) (map[string]json.RawMessage, error) {
+	buf, err := json.Marshal(media)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal: %v", err)
+	}
+
+	all := map[string]json.RawMessage{}
+
+	err = json.Unmarshal(buf, &all)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal: %v", err)
+	}
+
+	res := make(map[string]json.RawMessage, len(fields))
+
+	for _, field := range fields {
+		res[field] = all[field]
+	}
+
+	return res, nil
+}
@@ -0,0 +1,174 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nkcr/OSIA/instagram/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIV1Medias(t *testing.T) {
+	mediaStore, _, imagesFolder := newFeedStore(t)
+
+	f, err := os.Create(filepath.Join(imagesFolder, "a.jpg"))
+	require.NoError(t, err)
+
+	err = jpeg.Encode(f, image.NewRGBA(image.Rect(0, 0, 300, 200)), nil)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	handler := apiV1(mediaStore, imagesFolder, newConfig(WithPublicURL("https://osia.example.com")))
+
+	rr := feedRequest(t, handler, "/api/v1/medias")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	result := []apiMedia{}
+
+	err = json.Unmarshal(rr.Body.Bytes(), &result)
+	require.NoError(t, err)
+	require.Len(t, result, 2)
+
+	require.Equal(t, apiMedia{
+		ID:           "a",
+		MediaType:    "IMAGE",
+		Caption:      "First post\n<script>alert(1)</script>",
+		CaptionHTML:  "First post<br>\n&lt;script&gt;alert(1)&lt;/script&gt;",
+		Hashtags:     []string{},
+		Mentions:     []string{},
+		Permalink:    "https://instagram.com/p/a",
+		Username:     "osia",
+		Timestamp:    "2022-01-03T10:00:00Z",
+		ImageURL:     "https://osia.example.com/images/a.jpg",
+		ThumbnailURL: "https://osia.example.com/images/a.jpg",
+		Width:        300,
+		Height:       200,
+		AspectRatio:  1.5,
+		Renditions:   []apiRendition{},
+	}, result[1])
+
+	require.Equal(t, "b", result[0].ID)
+	require.Equal(t, "", result[0].ThumbnailURL)
+	require.Equal(t, 0, result[0].Width)
+
+	// the storage format must not leak
+	require.NotContains(t, rr.Body.String(), "media_url")
+
+	rr = feedRequest(t, handler, "/api/v1/medias?count=1&fields=id,%20Image_URL")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, `[{"id":"b","image_url":"https://osia.example.com/images/b.jpg"}]`,
+		strings.TrimSpace(rr.Body.String()))
+}
+
+// The stored metadata is used instead of reading the image.
+func TestAPIV1Metadata(t *testing.T) {
+	mediaStore, _, imagesFolder := newFeedStore(t)
+
+	_, err := mediaStore.Update("a", func(media *types.Media) error {
+		media.Width = 1080
+		media.Height = 1350
+		media.AspectRatio = 0.8
+		media.DominantColor = "#aabbcc"
+		media.BlurHash = "L00000fQfQfQfQfQfQfQfQfQfQfQ"
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	handler := apiV1(mediaStore, imagesFolder, newConfig(WithAllowedHosts("example.com")))
+
+	rr := feedRequest(t, handler,
+		"/api/v1/medias?fields=id,width,height,aspect_ratio,dominant_color,blurhash")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.JSONEq(t, `[
+		{"id": "b", "width": 0, "height": 0, "aspect_ratio": 0, "dominant_color": "", "blurhash": ""},
+		{"id": "a", "width": 1080, "height": 1350, "aspect_ratio": 0.8, "dominant_color": "#aabbcc",
+			"blurhash": "L00000fQfQfQfQfQfQfQfQfQfQfQ"}
+	]`, rr.Body.String())
+}
+
+func TestAPIV1Renditions(t *testing.T) {
+	mediaStore, _, imagesFolder := newFeedStore(t)
+
+	f, err := os.Create(filepath.Join(imagesFolder, "a.jpg"))
+	require.NoError(t, err)
+
+	err = jpeg.Encode(f, image.NewRGBA(image.Rect(0, 0, 1080, 720)), nil)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = mediaStore.Update("a", func(media *types.Media) error {
+		media.Renditions = []types.Rendition{
+			{Name: "640", File: "a-640.jpg", Width: 640, Height: 427},
+			{Name: "320x320", File: "a-320x320.jpg", Width: 320, Height: 320, Cropped: true},
+			{Name: "320", File: "a-320.jpg", Width: 320, Height: 213},
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	handler := apiV1(mediaStore, imagesFolder, newConfig(WithPublicURL("https://osia.example.com")))
+
+	rr := feedRequest(t, handler, "/api/v1/medias?fields=id,renditions,srcset")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	result := []apiMedia{}
+
+	err = json.Unmarshal(rr.Body.Bytes(), &result)
+	require.NoError(t, err)
+	require.Len(t, result, 2)
+
+	require.Equal(t, []apiRendition{
+		{Name: "640", URL: "https://osia.example.com/images/a-640.jpg", Width: 640, Height: 427},
+		{Name: "320x320", URL: "https://osia.example.com/images/a-320x320.jpg", Width: 320,
+			Height: 320, Cropped: true},
+		{Name: "320", URL: "https://osia.example.com/images/a-320.jpg", Width: 320, Height: 213},
+	}, result[1].Renditions)
+
+	// crops are not part of the srcset, the original is
+	require.Equal(t, "https://osia.example.com/images/a-320.jpg 320w, "+
+		"https://osia.example.com/images/a-640.jpg 640w, "+
+		"https://osia.example.com/images/a.jpg 1080w", result[1].Srcset)
+
+	// without renditions, there is no srcset
+	require.Equal(t, []apiRendition{}, result[0].Renditions)
+	require.Equal(t, "", result[0].Srcset)
+}
+
+func TestAPIV1Errors(t *testing.T) {
+	mediaStore, _, imagesFolder := newFeedStore(t)
+	handler := apiV1(mediaStore, imagesFolder, newConfig(WithAllowedHosts("example.com")))
+
+	rr := feedRequest(t, handler, "/api/v1/medias?fields=id,media_url")
+	require.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+	require.Equal(t, "unknown field: media_url\n", rr.Body.String())
+
+	rr = feedRequest(t, handler, "/api/v1/medias?count=0")
+	require.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+
+	rr = feedRequest(t, handler, "/api/v1/unknown")
+	require.Equal(t, http.StatusNotFound, rr.Result().StatusCode)
+
+	rr = adminRequest(t, handler, http.MethodPost, "/api/v1/medias", "")
+	require.Equal(t, http.StatusMethodNotAllowed, rr.Result().StatusCode)
+}
+
+// The list of selectable fields must match the public schema.
+func TestAPIMediaFields(t *testing.T) {
+	typ := reflect.TypeOf(apiMedia{})
+
+	fields := make([]string, typ.NumField())
+	for i := range fields {
+		fields[i] = typ.Field(i).Tag.Get("json")
+	}
+
+	require.Equal(t, fields, apiMediaFields)
+}
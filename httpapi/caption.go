@@ -0,0 +1,152 @@
+package httpapi
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/nkcr/OSIA/instagram/types"
+)
+
+// DefaultHashtagURL is the default URL template of hashtag links
+const DefaultHashtagURL = "https://www.instagram.com/explore/tags/{hashtag}/"
+
+// DefaultMentionURL is the default URL template of mention links
+const DefaultMentionURL = "https://www.instagram.com/{username}/"
+
+// captionTokens matches the URLs, hashtags and mentions of a caption. A URL
+// comes first so that its fragment is not taken for a hashtag.
+var captionTokens = regexp.MustCompile(`https?://[^\s<>"]+|#[\p{L}\p{N}_]+|@[A-Za-z0-9._]+`)
+
+// WithCaptionLinks sets the URL templates of the links created for hashtags
+// and mentions in captions. "{hashtag}" and "{username}" are replaced by the
+// hashtag, without "#", and the username, without "@".
+func WithCaptionLinks(hashtagURL, mentionURL string) Option {
+	return func(c *config) {
+		c.hashtagURL = hashtagURL
+		c.mentionURL = mentionURL
+	}
+}
+
+// captionMedia is a media with its parsed caption
+type captionMedia struct {
+	types.Media
+
+	CaptionHTML string   `json:"caption_html"`
+	Hashtags    []string `json:"hashtags"`
+	Mentions    []string `json:"mentions"`
+}
+
+// withParsedCaptions returns the medias with their parsed caption
+func withParsedCaptions(medias []types.Media, hashtagURL, mentionURL string) []captionMedia {
+	res := make([]captionMedia, len(medias))
+
+	for i, media := range medias {
+		parsed := parseCaption(media.Caption, hashtagURL, mentionURL)
+
+		res[i] = captionMedia{
+			Media:       media,
+			CaptionHTML: parsed.html,
+			Hashtags:    parsed.hashtags,
+			Mentions:    parsed.mentions,
+		}
+	}
+
+	return res
+}
+
+// caption contains the parsed elements of a caption
+type caption struct {
+	html     string
+	hashtags []string
+	mentions []string
+}
+
+// parseCaption parses a caption. The returned HTML is escaped, with line
+// breaks converted, and URLs, hashtags and mentions turned into links.
+// Hashtags and mentions are listed once, in order of appearance.
+func parseCaption(text, hashtagURL, mentionURL string) caption {
+	res := caption{
+		hashtags: []string{},
+		mentions: []string{},
+	}
+
+	seen := map[string]bool{}
+
+	var sb strings.Builder
+
+	last := 0
+
+	for _, loc := range captionTokens.FindAllStringIndex(text, -1) {
+		start, end := loc[0], loc[1]
+		token := text[start:end]
+
+		var link string
+
+		switch token[0] {
+		case 'h':
+			token = strings.TrimRight(token, ".,;:!?)'")
+			link = token
+		case '#':
+			if !tokenBoundary(text, start) {
+				continue
+			}
+
+			tag := token[1:]
+			if !seen[strings.ToLower(token)] {
+				seen[strings.ToLower(token)] = true
+				res.hashtags = append(res.hashtags, tag)
+			}
+
+			link = strings.ReplaceAll(hashtagURL, "{hashtag}", url.PathEscape(tag))
+		case '@':
+			if !tokenBoundary(text, start) {
+				continue
+			}
+
+			// a username can't end with a period
+			token = strings.TrimRight(token, ".")
+			if len(token) == 1 {
+				continue
+			}
+
+			username := strings.ToLower(token[1:])
+			if !seen["@"+username] {
+				seen["@"+username] = true
+				res.mentions = append(res.mentions, username)
+			}
+
+			link = strings.ReplaceAll(mentionURL, "{username}", url.PathEscape(username))
+		}
+
+		end = start + len(token)
+
+		sb.WriteString(html.EscapeString(text[last:start]))
+		sb.WriteString(`<a href="` + html.EscapeString(link) + `" rel="nofollow noopener">`)
+		sb.WriteString(html.EscapeString(token))
+		sb.WriteString("</a>")
+
+		last = end
+	}
+
+	sb.WriteString(html.EscapeString(text[last:]))
+
+	res.html = strings.ReplaceAll(sb.String(), "\n", "<br>\n")
+
+	return res
+}
+
+// tokenBoundary returns true if the token starting at the given index is not
+// preceded by a word character, so that "me@example.com" is not a mention.
+func tokenBoundary(text string, start int) bool {
+	if start == 0 {
+		return true
+	}
+
+	r, _ := utf8.DecodeLastRuneInString(text[:start])
+
+	return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '_' && r != '&'
+}
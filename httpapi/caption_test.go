@@ -0,0 +1,95 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCaption(t *testing.T) {
+	table := []struct {
+		text     string
+		html     string
+		hashtags []string
+		mentions []string
+	}{
+		{
+			text:     "",
+			html:     "",
+			hashtags: []string{},
+			mentions: []string{},
+		},
+		{
+			text:     "Hello <b>world</b> & co\nbye",
+			html:     "Hello &lt;b&gt;world&lt;/b&gt; &amp; co<br>\nbye",
+			hashtags: []string{},
+			mentions: []string{},
+		},
+		{
+			text: "Sunset #Nature #été with @John.Doe. #nature",
+			html: `Sunset <a href="https://tags/Nature" rel="nofollow noopener">#Nature</a> ` +
+				`<a href="https://tags/%C3%A9t%C3%A9" rel="nofollow noopener">#été</a> with ` +
+				`<a href="https://users/john.doe" rel="nofollow noopener">@John.Doe</a>. ` +
+				`<a href="https://tags/nature" rel="nofollow noopener">#nature</a>`,
+			hashtags: []string{"Nature", "été"},
+			mentions: []string{"john.doe"},
+		},
+		{
+			text:     "mail me@example.com, not a#tag",
+			html:     "mail me@example.com, not a#tag",
+			hashtags: []string{},
+			mentions: []string{},
+		},
+		{
+			text: "see https://example.com/a?b=1&c=2#top.",
+			html: `see <a href="https://example.com/a?b=1&amp;c=2#top" rel="nofollow noopener">` +
+				`https://example.com/a?b=1&amp;c=2#top</a>.`,
+			hashtags: []string{},
+			mentions: []string{},
+		},
+		{
+			text:     `#"><script>`,
+			html:     "#&#34;&gt;&lt;script&gt;",
+			hashtags: []string{},
+			mentions: []string{},
+		},
+	}
+
+	for _, entry := range table {
+		res := parseCaption(entry.text, "https://tags/{hashtag}", "https://users/{username}")
+
+		require.Equal(t, entry.html, res.html, entry.text)
+		require.Equal(t, entry.hashtags, res.hashtags, entry.text)
+		require.Equal(t, entry.mentions, res.mentions, entry.text)
+	}
+}
+
+func TestGetMediasCaptionHTML(t *testing.T) {
+	mediaStore, _, _ := newFeedStore(t)
+	handler := http.HandlerFunc(getMedias(mediaStore, DefaultHashtagURL, DefaultMentionURL))
+
+	rr := feedRequest(t, handler, "/api/medias?caption_html=true")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	result := []captionMedia{}
+
+	err := json.Unmarshal(rr.Body.Bytes(), &result)
+	require.NoError(t, err)
+	require.Len(t, result, 2)
+
+	require.Equal(t, "b", result[0].ID)
+	require.Equal(t, "Second post", result[0].CaptionHTML)
+	require.Equal(t, "First post\n<script>alert(1)</script>", result[1].Caption)
+	require.Equal(t, "First post<br>\n&lt;script&gt;alert(1)&lt;/script&gt;", result[1].CaptionHTML)
+	require.Equal(t, []string{}, result[1].Hashtags)
+
+	// the fields are only added on demand
+	rr = feedRequest(t, handler, "/api/medias")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.NotContains(t, rr.Body.String(), "caption_html")
+
+	rr = feedRequest(t, handler, "/api/medias?caption_html=maybe")
+	require.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+}
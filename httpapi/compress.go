@@ -0,0 +1,350 @@
+package httpapi
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// encoders contains the supported content encodings
+var encoders = map[string]func(io.Writer) io.WriteCloser{
+	"gzip": func(w io.Writer) io.WriteCloser {
+		return gzip.NewWriter(w)
+	},
+	"br": func(w io.Writer) io.WriteCloser {
+		return brotli.NewWriterLevel(w, brotli.DefaultCompression)
+	},
+}
+
+// precompressedExt maps a content encoding to the file extension used by a
+// precompressed asset.
+var precompressedExt = map[string]string{
+	"br":   ".br",
+	"gzip": ".gz",
+}
+
+// incompressibleTypes contains the content type prefixes that are already
+// compressed and that we shouldn't compress again.
+var incompressibleTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/octet-stream",
+}
+
+// compression is a utility function that compresses responses with the best
+// encoding accepted by the client, among the provided ones. Responses smaller
+// than minSize, or with an already compressed content, are sent as is.
+func compression(minSize int, encodings []string) func(http.Handler) http.Handler {
+	supported := make([]string, 0, len(encodings))
+
+	for _, encoding := range encodings {
+		if encoders[encoding] != nil {
+			supported = append(supported, encoding)
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+
+			encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), supported)
+			if encoding == "" || r.Header.Get("Range") != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &compressWriter{
+				ResponseWriter: w,
+				encoding:       encoding,
+				minSize:        minSize,
+				head:           r.Method == http.MethodHead,
+			}
+
+			defer cw.Close()
+
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// negotiateEncoding returns the supported encoding with the highest quality
+// value from an Accept-Encoding header. The order of supported encodings is
+// used to break ties. It returns an empty string if no encoding is acceptable.
+func negotiateEncoding(header string, supported []string) string {
+	if header == "" {
+		return ""
+	}
+
+	return negotiate(header, supported, func(string) []string {
+		return []string{"*"}
+	})
+}
+
+// compressWriter is a response writer that buffers the beginning of a
+// response until it knows if it is worth compressing.
+//
+// - implements http.ResponseWriter
+// - implements http.Flusher
+// - implements http.Hijacker
+type compressWriter struct {
+	http.ResponseWriter
+
+	encoding string
+	minSize  int
+	head     bool
+
+	status  int
+	buf     []byte
+	decided bool
+	encoder io.WriteCloser
+}
+
+// WriteHeader implements http.ResponseWriter. The header is delayed until we
+// know if the response is compressed.
+func (c *compressWriter) WriteHeader(status int) {
+	if c.status != 0 {
+		return
+	}
+
+	c.status = status
+
+	// those responses have no body, there is nothing to compress
+	if status < 200 || status == http.StatusNoContent ||
+		status == http.StatusNotModified || status == http.StatusPartialContent {
+
+		c.decide(false)
+	}
+}
+
+// Write implements http.ResponseWriter
+func (c *compressWriter) Write(buf []byte) (int, error) {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+
+	if c.decided {
+		return c.write(buf)
+	}
+
+	c.buf = append(c.buf, buf...)
+
+	if len(c.buf) >= c.minSize {
+		c.decide(c.compressible())
+	}
+
+	return len(buf), nil
+}
+
+// Flush implements http.Flusher. Flushing forces the decision, regardless of
+// the amount of data written so far.
+func (c *compressWriter) Flush() {
+	if !c.decided {
+		c.decide(len(c.buf) >= c.minSize && c.compressible())
+	}
+
+	if c.encoder != nil {
+		flusher, ok := c.encoder.(interface{ Flush() error })
+		if ok {
+			flusher.Flush()
+		}
+	}
+
+	flusher, ok := c.ResponseWriter.(http.Flusher)
+	if ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the underlying response writer, which is used by
+// http.ResponseController.
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// Hijack implements http.Hijacker
+func (c *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := c.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer doesn't support hijacking")
+	}
+
+	return hijacker.Hijack()
+}
+
+// Close finishes the response. It must be called once the handler is done.
+func (c *compressWriter) Close() error {
+	if !c.decided {
+		if c.status == 0 && len(c.buf) == 0 {
+			// nothing has been written, let the server handle the response
+			return nil
+		}
+
+		c.decide(len(c.buf) >= c.minSize && c.compressible())
+	}
+
+	if c.encoder != nil {
+		return c.encoder.Close()
+	}
+
+	return nil
+}
+
+// compressible tells if the response can be compressed, based on its headers.
+func (c *compressWriter) compressible() bool {
+	header := c.Header()
+
+	if header.Get("Content-Encoding") != "" {
+		return false
+	}
+
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(c.buf)
+		header.Set("Content-Type", contentType)
+	}
+
+	contentType = strings.ToLower(contentType)
+
+	for _, prefix := range incompressibleTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// decide writes the header, with or without compression, and the buffered
+// content.
+func (c *compressWriter) decide(compress bool) {
+	c.decided = true
+
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+
+	if compress {
+		header := c.Header()
+		header.Set("Content-Encoding", c.encoding)
+		header.Del("Content-Length")
+
+		// the entity changes with the encoding, a strong ETag must change too
+		etag := header.Get("ETag")
+		if etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/"+etag)
+		}
+
+		if !c.head {
+			c.encoder = encoders[c.encoding](c.ResponseWriter)
+		}
+	}
+
+	c.ResponseWriter.WriteHeader(c.status)
+
+	if len(c.buf) != 0 {
+		buf := c.buf
+		c.buf = nil
+
+		c.write(buf)
+	}
+}
+
+// write writes to the underlying writer, through the encoder if any.
+func (c *compressWriter) write(buf []byte) (int, error) {
+	if c.head {
+		return len(buf), nil
+	}
+
+	if c.encoder != nil {
+		return c.encoder.Write(buf)
+	}
+
+	return c.ResponseWriter.Write(buf)
+}
+
+// precompressed defines a handler that serves a precompressed version of a
+// file, such as "a.js.br" or "a.js.gz", if it exists in dir and if the client
+// accepts it. It falls back on next otherwise.
+func precompressed(dir string, encodings []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		name := path.Clean("/" + r.URL.Path)
+
+		accepted := []string{}
+		for _, encoding := range encodings {
+			if precompressedExt[encoding] != "" {
+				accepted = append(accepted, encoding)
+			}
+		}
+
+		// we try encodings in the order of preference, until we find a file
+		for len(accepted) != 0 {
+			encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), accepted)
+			if encoding == "" {
+				break
+			}
+
+			filePath := filepath.Join(dir, filepath.FromSlash(name)+precompressedExt[encoding])
+
+			file, err := os.Open(filePath)
+			if err != nil {
+				accepted = remove(accepted, encoding)
+				continue
+			}
+
+			defer file.Close()
+
+			stat, err := file.Stat()
+			if err != nil || stat.IsDir() {
+				accepted = remove(accepted, encoding)
+				continue
+			}
+
+			contentType := mime.TypeByExtension(path.Ext(name))
+			if contentType == "" {
+				contentType = "application/octet-stream"
+			}
+
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("Content-Encoding", encoding)
+
+			http.ServeContent(w, r, name, stat.ModTime(), file)
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// remove returns a copy of the slice without the provided element.
+func remove(elements []string, element string) []string {
+	res := make([]string, 0, len(elements))
+
+	for _, e := range elements {
+		if e != element {
+			res = append(res, e)
+		}
+	}
+
+	return res
+}
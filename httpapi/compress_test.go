@@ -0,0 +1,228 @@
+package httpapi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	supported := []string{"br", "gzip"}
+
+	table := []struct {
+		header   string
+		expected string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"gzip, br", "br"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"br;q=0, gzip;q=0", ""},
+		{"*", "br"},
+		{"*;q=0.1, gzip;q=0.5", "gzip"},
+		{"identity", ""},
+		{"deflate, GZIP", "gzip"},
+	}
+
+	for _, entry := range table {
+		require.Equal(t, entry.expected, negotiateEncoding(entry.header, supported), entry.header)
+	}
+}
+
+func TestCompressionGzip(t *testing.T) {
+	body := strings.Repeat("hello world ", 200)
+
+	handler := compression(100, []string{"br", "gzip"})(textHandler(body))
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	require.NoError(t, err)
+
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, "gzip", rr.Header().Get("Content-Encoding"))
+	require.Equal(t, "Accept-Encoding", rr.Header().Get("Vary"))
+	require.Less(t, rr.Body.Len(), len(body))
+
+	reader, err := gzip.NewReader(rr.Body)
+	require.NoError(t, err)
+
+	res, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, body, string(res))
+}
+
+func TestCompressionBrotli(t *testing.T) {
+	body := strings.Repeat("hello world ", 200)
+
+	handler := compression(100, []string{"br", "gzip"})(textHandler(body))
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	require.NoError(t, err)
+
+	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, "br", rr.Header().Get("Content-Encoding"))
+
+	res, err := io.ReadAll(brotli.NewReader(rr.Body))
+	require.NoError(t, err)
+	require.Equal(t, body, string(res))
+}
+
+func TestCompressionBelowMinSize(t *testing.T) {
+	body := "small"
+
+	handler := compression(100, []string{"gzip"})(textHandler(body))
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	require.NoError(t, err)
+
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, "", rr.Header().Get("Content-Encoding"))
+	require.Equal(t, "Accept-Encoding", rr.Header().Get("Vary"))
+	require.Equal(t, body, rr.Body.String())
+}
+
+func TestCompressionNotAccepted(t *testing.T) {
+	body := strings.Repeat("hello world ", 200)
+
+	handler := compression(100, []string{"gzip"})(textHandler(body))
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	require.NoError(t, err)
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, "", rr.Header().Get("Content-Encoding"))
+	require.Equal(t, body, rr.Body.String())
+}
+
+// Images are already compressed, we should not compress them again.
+func TestCompressionImage(t *testing.T) {
+	body := append([]byte("\xff\xd8\xff"), bytes.Repeat([]byte{0}, 2000)...)
+
+	handler := compression(100, []string{"gzip"})(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write(body)
+		}))
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "http://example.com/a.jpg", nil)
+	require.NoError(t, err)
+
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, "", rr.Header().Get("Content-Encoding"))
+	require.Equal(t, "image/jpeg", rr.Header().Get("Content-Type"))
+	require.Equal(t, body, rr.Body.Bytes())
+}
+
+func TestCompressionAlreadyEncoded(t *testing.T) {
+	body := strings.Repeat("hello world ", 200)
+
+	handler := compression(100, []string{"gzip"})(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "br")
+			w.Write([]byte(body))
+		}))
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	require.NoError(t, err)
+
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, "br", rr.Header().Get("Content-Encoding"))
+	require.Equal(t, body, rr.Body.String())
+}
+
+func TestCompressionNoContent(t *testing.T) {
+	handler := compression(0, []string{"gzip"})(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	require.NoError(t, err)
+
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusNoContent, rr.Result().StatusCode)
+	require.Equal(t, "", rr.Header().Get("Content-Encoding"))
+	require.Equal(t, 0, rr.Body.Len())
+}
+
+func TestPrecompressed(t *testing.T) {
+	tmpdir := t.TempDir()
+
+	err := os.WriteFile(filepath.Join(tmpdir, "a.js"), []byte("plain"), os.ModePerm)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(tmpdir, "a.js.gz"), []byte("gzipped"), os.ModePerm)
+	require.NoError(t, err)
+
+	fs := http.FileServer(http.Dir(tmpdir))
+	handler := compression(0, []string{"br", "gzip"})(precompressed(tmpdir, []string{"br", "gzip"}, fs))
+
+	// the client accepts gzip, it should get the precompressed file
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "http://example.com/a.js", nil)
+	require.NoError(t, err)
+
+	req.Header.Set("Accept-Encoding", "br, gzip")
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, "gzip", rr.Header().Get("Content-Encoding"))
+	require.Equal(t, "Accept-Encoding", rr.Header().Get("Vary"))
+	require.Contains(t, rr.Header().Get("Content-Type"), "javascript")
+	require.Equal(t, "gzipped", rr.Body.String())
+
+	// the client doesn't accept any encoding, it should get the plain file
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodGet, "http://example.com/a.js", nil)
+	require.NoError(t, err)
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, "", rr.Header().Get("Content-Encoding"))
+	require.Equal(t, "plain", rr.Body.String())
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+func textHandler(body string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(body))
+	})
+}
@@ -0,0 +1,218 @@
+package httpapi
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig defines the Cross-Origin Resource Sharing policy applied to all
+// the routes of the HTTP server.
+type CORSConfig struct {
+	// AllowedOrigins contains the origins allowed to make cross-origin
+	// requests. An origin can be exact, such as "https://example.com", match
+	// any subdomain with a wildcard, such as "https://*.example.com", or be
+	// "*" to allow any origin. A pattern without scheme matches any scheme.
+	AllowedOrigins []string
+
+	// AllowedMethods contains the methods allowed in cross-origin requests.
+	AllowedMethods []string
+
+	// AllowedHeaders contains the request headers allowed in cross-origin
+	// requests. "*" allows any header.
+	AllowedHeaders []string
+
+	// ExposedHeaders contains the response headers a browser can expose to the
+	// client script.
+	ExposedHeaders []string
+
+	// AllowCredentials tells if cross-origin requests can include credentials,
+	// such as cookies or the Authorization header.
+	AllowCredentials bool
+
+	// MaxAge tells how long the result of a preflight request can be cached.
+	// It is not sent if zero.
+	MaxAge time.Duration
+}
+
+// DefaultCORSConfig returns the default CORS policy, which allows any origin to
+// read the API.
+func DefaultCORSConfig() CORSConfig {
+	return CORSConfig{
+		AllowedOrigins: []string{"*"},
+		AllowedMethods: []string{http.MethodGet, http.MethodHead},
+		MaxAge:         time.Hour,
+	}
+}
+
+// WithCORS sets the CORS policy of the HTTP server.
+func WithCORS(cors CORSConfig) Option {
+	return func(c *config) {
+		c.cors = cors
+	}
+}
+
+// cors is a utility function that applies a CORS policy. It answers preflight
+// requests and adds the CORS headers to the actual requests.
+func cors(config CORSConfig) func(http.Handler) http.Handler {
+	anyOrigin := false
+	for _, origin := range config.AllowedOrigins {
+		if origin == "*" {
+			anyOrigin = true
+		}
+	}
+
+	anyHeader := false
+	for _, header := range config.AllowedHeaders {
+		if header == "*" {
+			anyHeader = true
+		}
+	}
+
+	methods := strings.Join(config.AllowedMethods, ", ")
+	headers := strings.Join(config.AllowedHeaders, ", ")
+	exposed := strings.Join(config.ExposedHeaders, ", ")
+	maxAge := strconv.Itoa(int(config.MaxAge.Seconds()))
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+
+			preflight := r.Method == http.MethodOptions &&
+				r.Header.Get("Access-Control-Request-Method") != ""
+
+			// the response depends on the origin, unless we always answer "*"
+			if !anyOrigin || config.AllowCredentials {
+				w.Header().Add("Vary", "Origin")
+			}
+
+			if preflight {
+				w.Header().Add("Vary", "Access-Control-Request-Method")
+				w.Header().Add("Vary", "Access-Control-Request-Headers")
+			}
+
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if !anyOrigin && !originAllowed(origin, config.AllowedOrigins) {
+				if preflight {
+					http.Error(w, "origin not allowed: "+origin, http.StatusForbidden)
+					return
+				}
+
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if anyOrigin && !config.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+
+			if config.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			if !preflight {
+				if exposed != "" {
+					w.Header().Set("Access-Control-Expose-Headers", exposed)
+				}
+
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			method := r.Header.Get("Access-Control-Request-Method")
+			if !contains(config.AllowedMethods, method) {
+				http.Error(w, "method not allowed: "+method, http.StatusForbidden)
+				return
+			}
+
+			requested := r.Header.Get("Access-Control-Request-Headers")
+
+			if !anyHeader {
+				for _, header := range strings.Split(requested, ",") {
+					header = strings.TrimSpace(header)
+					if header != "" && !contains(config.AllowedHeaders, header) {
+						http.Error(w, "header not allowed: "+header, http.StatusForbidden)
+						return
+					}
+				}
+			}
+
+			w.Header().Set("Access-Control-Allow-Methods", methods)
+
+			if anyHeader && requested != "" {
+				w.Header().Set("Access-Control-Allow-Headers", requested)
+			} else if headers != "" {
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+			}
+
+			if config.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", maxAge)
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
+
+// originAllowed tells if an origin matches one of the allowed patterns.
+func originAllowed(origin string, patterns []string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+
+	for _, pattern := range patterns {
+		if strings.EqualFold(pattern, origin) {
+			return true
+		}
+
+		scheme := ""
+		host := pattern
+
+		i := strings.Index(pattern, "://")
+		if i != -1 {
+			scheme = pattern[:i]
+			host = pattern[i+3:]
+		}
+
+		if scheme != "" && !strings.EqualFold(scheme, u.Scheme) {
+			continue
+		}
+
+		if strings.EqualFold(host, u.Host) {
+			return true
+		}
+
+		// "*.example.com" matches "a.example.com" and "a.b.example.com", but
+		// not "example.com".
+		if strings.HasPrefix(host, "*.") {
+			suffix := strings.ToLower(host[1:])
+			candidate := strings.ToLower(u.Host)
+
+			if strings.HasSuffix(candidate, suffix) && len(candidate) > len(suffix) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// contains tells if a list contains an element, ignoring the case.
+func contains(elements []string, element string) bool {
+	for _, e := range elements {
+		if strings.EqualFold(e, element) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,193 @@
+package httpapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	patterns := []string{
+		"https://example.com",
+		"https://*.osia.dev",
+		"*.other.com",
+	}
+
+	table := []struct {
+		origin   string
+		expected bool
+	}{
+		{"https://example.com", true},
+		{"http://example.com", false},
+		{"https://www.example.com", false},
+		{"https://a.osia.dev", true},
+		{"https://a.b.osia.dev", true},
+		{"https://osia.dev", false},
+		{"http://a.osia.dev", false},
+		{"https://evilosia.dev", false},
+		{"http://a.other.com", true},
+		{"https://a.other.com", true},
+		{"null", false},
+		{"", false},
+	}
+
+	for _, entry := range table {
+		require.Equal(t, entry.expected, originAllowed(entry.origin, patterns), entry.origin)
+	}
+}
+
+func TestCORSDefault(t *testing.T) {
+	handler := cors(DefaultCORSConfig())(okHandler())
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "http://example.com/api/medias", nil)
+	require.NoError(t, err)
+
+	req.Header.Set("Origin", "https://anything.com")
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, "*", rr.Header().Get("Access-Control-Allow-Origin"))
+	require.Empty(t, rr.Header().Values("Vary"))
+}
+
+func TestCORSNotAllowed(t *testing.T) {
+	config := CORSConfig{
+		AllowedOrigins: []string{"https://example.com"},
+		AllowedMethods: []string{http.MethodGet},
+	}
+
+	handler := cors(config)(okHandler())
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "http://example.com/api/medias", nil)
+	require.NoError(t, err)
+
+	req.Header.Set("Origin", "https://evil.com")
+
+	handler.ServeHTTP(rr, req)
+
+	// the request is served, but the browser won't expose the response
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, "", rr.Header().Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "Origin", rr.Header().Get("Vary"))
+
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodOptions, "http://example.com/api/medias", nil)
+	require.NoError(t, err)
+
+	req.Header.Set("Origin", "https://evil.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusForbidden, rr.Result().StatusCode)
+	require.Equal(t, "", rr.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestCORSCredentials(t *testing.T) {
+	config := CORSConfig{
+		AllowedOrigins:   []string{"*"},
+		AllowedMethods:   []string{http.MethodGet},
+		ExposedHeaders:   []string{"X-Request-Id"},
+		AllowCredentials: true,
+	}
+
+	handler := cors(config)(okHandler())
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "http://example.com/api/medias", nil)
+	require.NoError(t, err)
+
+	req.Header.Set("Origin", "https://a.com")
+
+	handler.ServeHTTP(rr, req)
+
+	// with credentials, the origin can't be "*"
+	require.Equal(t, "https://a.com", rr.Header().Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "true", rr.Header().Get("Access-Control-Allow-Credentials"))
+	require.Equal(t, "X-Request-Id", rr.Header().Get("Access-Control-Expose-Headers"))
+	require.Equal(t, "Origin", rr.Header().Get("Vary"))
+}
+
+func TestCORSPreflight(t *testing.T) {
+	config := CORSConfig{
+		AllowedOrigins: []string{"https://*.example.com"},
+		AllowedMethods: []string{http.MethodGet, http.MethodPost},
+		AllowedHeaders: []string{"Authorization", "Content-Type"},
+		MaxAge:         10 * time.Minute,
+	}
+
+	called := false
+
+	handler := cors(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodOptions, "http://example.com/admin/api", nil)
+	require.NoError(t, err)
+
+	req.Header.Set("Origin", "https://www.example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	req.Header.Set("Access-Control-Request-Headers", "authorization, content-type")
+
+	handler.ServeHTTP(rr, req)
+
+	require.False(t, called)
+	require.Equal(t, http.StatusNoContent, rr.Result().StatusCode)
+	require.Equal(t, "https://www.example.com", rr.Header().Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "GET, POST", rr.Header().Get("Access-Control-Allow-Methods"))
+	require.Equal(t, "Authorization, Content-Type", rr.Header().Get("Access-Control-Allow-Headers"))
+	require.Equal(t, "600", rr.Header().Get("Access-Control-Max-Age"))
+
+	// a method that is not allowed
+	rr = httptest.NewRecorder()
+	req.Header.Set("Access-Control-Request-Method", http.MethodDelete)
+	req.Header.Del("Access-Control-Request-Headers")
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusForbidden, rr.Result().StatusCode)
+
+	// a header that is not allowed
+	rr = httptest.NewRecorder()
+	req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	req.Header.Set("Access-Control-Request-Headers", "X-Custom")
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusForbidden, rr.Result().StatusCode)
+}
+
+// An OPTIONS request that is not a preflight must reach the handler.
+func TestCORSOptionsNotPreflight(t *testing.T) {
+	called := false
+
+	handler := cors(DefaultCORSConfig())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodOptions, "http://example.com/api/medias", nil)
+	require.NoError(t, err)
+
+	req.Header.Set("Origin", "https://a.com")
+
+	handler.ServeHTTP(rr, req)
+
+	require.True(t, called)
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+func okHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+}
@@ -0,0 +1,273 @@
+package httpapi
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/nkcr/OSIA/instagram/types"
+	"github.com/nkcr/OSIA/store"
+)
+
+// defaultEmbedCount is the number of posts displayed by default in the embed
+const defaultEmbedCount = 9
+
+// maxEmbedColumns is the maximum number of columns of the embed grid
+const maxEmbedColumns = 6
+
+//go:embed templates
+var templatesFS embed.FS
+
+var embedTemplate = template.Must(template.ParseFS(templatesFS, "templates/embed.html"))
+
+var embedScriptTemplate = texttemplate.Must(texttemplate.ParseFS(templatesFS, "templates/embed.js"))
+
+// embedOptions contains the options of the embed, set by the query
+type embedOptions struct {
+	Count    int
+	Columns  int
+	Theme    string
+	Captions bool
+}
+
+// embedPage contains the data used to render the embed template
+type embedPage struct {
+	embedOptions
+
+	Title         string
+	OEmbedURL     string
+	MobileColumns int
+	Posts         []embedPost
+}
+
+// embedPost contains the data of a post rendered by the embed template
+type embedPost struct {
+	Media    types.Media
+	Title    string
+	ImageURL string
+	Video    bool
+	Date     time.Time
+}
+
+// parseEmbedOptions parses the options from the query. Missing options take
+// their default value.
+func parseEmbedOptions(query url.Values) (embedOptions, error) {
+	opts := embedOptions{
+		Count:    defaultEmbedCount,
+		Columns:  3,
+		Theme:    "light",
+		Captions: false,
+	}
+
+	var err error
+
+	if query.Get("count") != "" {
+		opts.Count, err = strconv.Atoi(query.Get("count"))
+		if err != nil || opts.Count < 1 {
+			return opts, fmt.Errorf("bad count value: %s", query.Get("count"))
+		}
+
+		if opts.Count > maxMedias {
+			opts.Count = maxMedias
+		}
+	}
+
+	if query.Get("columns") != "" {
+		opts.Columns, err = strconv.Atoi(query.Get("columns"))
+		if err != nil || opts.Columns < 1 || opts.Columns > maxEmbedColumns {
+			return opts, fmt.Errorf("bad columns value: %s", query.Get("columns"))
+		}
+	}
+
+	if query.Get("theme") != "" {
+		opts.Theme = query.Get("theme")
+
+		if opts.Theme != "light" && opts.Theme != "dark" && opts.Theme != "auto" {
+			return opts, fmt.Errorf("bad theme value: %s", opts.Theme)
+		}
+	}
+
+	if query.Get("captions") != "" {
+		opts.Captions, err = strconv.ParseBool(query.Get("captions"))
+		if err != nil {
+			return opts, fmt.Errorf("bad captions value: %s", query.Get("captions"))
+		}
+	}
+
+	return opts, nil
+}
+
+// query returns the options as a query, without the default values.
+func (o embedOptions) query() url.Values {
+	query := url.Values{}
+
+	if o.Count != defaultEmbedCount {
+		query.Set("count", strconv.Itoa(o.Count))
+	}
+
+	if o.Columns != 3 {
+		query.Set("columns", strconv.Itoa(o.Columns))
+	}
+
+	if o.Theme != "light" {
+		query.Set("theme", o.Theme)
+	}
+
+	if o.Captions {
+		query.Set("captions", "true")
+	}
+
+	return query
+}
+
+// url returns the URL of the embed page with the options
+func (o embedOptions) url(base string) string {
+	if len(o.query()) == 0 {
+		return base + "/embed"
+	}
+
+	return base + "/embed?" + o.query().Encode()
+}
+
+// getEmbed returns an HTTP handler that renders a grid of the latest posts,
+// meant to be displayed in an iframe. The page links to its oEmbed endpoint.
+func getEmbed(mediaStore store.MediaStore, conf config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		opts, err := parseEmbedOptions(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		medias, err := publicMedias(mediaStore, opts.Count)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to list medias: %v", err),
+				http.StatusInternalServerError)
+			return
+		}
+
+		page := embedPage{
+			embedOptions:  opts,
+			Title:         "Instagram posts",
+			MobileColumns: opts.Columns,
+			Posts:         make([]embedPost, len(medias)),
+		}
+
+		// the page only links to relative URLs, except its oEmbed link which is
+		// left out without a base.
+		base, err := baseURL(r, conf)
+		if err == nil {
+			page.OEmbedURL = base + "/oembed?url=" + url.QueryEscape(opts.url(base))
+		}
+
+		// small screens have at most 2 columns
+		if page.MobileColumns > 2 {
+			page.MobileColumns = 2
+		}
+
+		for i, media := range medias {
+			if media.Username != "" {
+				page.Title = "@" + media.Username + " on Instagram"
+			}
+
+			page.Posts[i] = embedPost{
+				Media:    media,
+				Title:    captionTitle(media.Caption),
+				ImageURL: "/images/" + url.PathEscape(media.ID) + ".jpg",
+				Video:    media.MediaType == "VIDEO",
+				Date:     media.Timestamp.Time,
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; img-src 'self'; "+
+			"media-src 'self'; style-src 'unsafe-inline'; script-src 'unsafe-inline'")
+
+		err = embedTemplate.Execute(w, page)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to render: %v", err),
+				http.StatusInternalServerError)
+		}
+	}
+}
+
+// getEmbedScript returns an HTTP handler that serves the script which replaces
+// ".osia-embed" elements with the embed iframe.
+func getEmbedScript(conf config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// without a base, the script uses the URL it is loaded from
+		base, _ := baseURL(r, conf)
+
+		baseJSON, err := json.Marshal(base)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to marshal: %v", err),
+				http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+
+		err = embedScriptTemplate.Execute(w, string(baseJSON))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to render: %v", err),
+				http.StatusInternalServerError)
+		}
+	}
+}
+
+// embedSnippets contains the HTML snippets to embed the posts in a page
+type embedSnippets struct {
+	IFrame string `json:"iframe"`
+	Script string `json:"script"`
+}
+
+// getEmbedSnippets returns an HTTP handler that generates the HTML snippets to
+// embed the posts, with the options from the query.
+func getEmbedSnippets(conf config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		opts, err := parseEmbedOptions(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		base, err := baseURL(r, conf)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to build links: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		src := opts.url(base)
+
+		data := ""
+		for _, key := range []string{"count", "columns", "theme", "captions"} {
+			value := opts.query().Get(key)
+			if value != "" {
+				data += fmt.Sprintf(` data-%s="%s"`, key, template.HTMLEscapeString(value))
+			}
+		}
+
+		snippets := embedSnippets{
+			IFrame: fmt.Sprintf(`<iframe src="%s" title="Instagram posts" loading="lazy" `+
+				`style="width:100%%;border:0;aspect-ratio:%d/%d"></iframe>`,
+				template.HTMLEscapeString(src), opts.Columns, rows(opts.Count, opts.Columns)),
+			Script: fmt.Sprintf(`<div class="osia-embed"%s></div>`+"\n"+
+				`<script src="%s" async></script>`, data,
+				template.HTMLEscapeString(base+"/embed.js")),
+		}
+
+		writeJSON(w, http.StatusOK, snippets)
+	}
+}
+
+// rows returns the number of rows needed to display count elements on the
+// given number of columns.
+func rows(count, columns int) int {
+	return (count + columns - 1) / columns
+}
@@ -0,0 +1,128 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmbed(t *testing.T) {
+	mediaStore, _, _ := newFeedStore(t)
+
+	rr := feedRequest(t, getEmbed(mediaStore, newConfig(WithAllowedHosts("example.com"))), "/embed?captions=true&columns=4&theme=dark")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, "text/html; charset=utf-8", rr.Header().Get("Content-Type"))
+	require.Contains(t, rr.Header().Get("Content-Security-Policy"), "default-src 'none'")
+
+	body := rr.Body.String()
+
+	require.Contains(t, body, "<title>@osia on Instagram</title>")
+	require.Contains(t, body, "repeat(4, minmax(0, 1fr))")
+	require.Contains(t, body, "#121212")
+	require.Contains(t, body, `href="https://instagram.com/p/a"`)
+	require.Contains(t, body, `<img src="/images/a.jpg" alt="First post"`)
+	require.Contains(t, body, `<video src="/images/b.jpg"`)
+	require.Contains(t, body, `datetime="2022-01-04T10:00:00Z"`)
+
+	// captions must be escaped
+	require.NotContains(t, body, "<script>alert(1)</script>")
+	require.Contains(t, body, "&lt;script&gt;alert(1)&lt;/script&gt;")
+
+	// the newest post comes first
+	require.Less(t, strings.Index(body, "/images/b.jpg"), strings.Index(body, "/images/a.jpg"))
+
+	rr = feedRequest(t, getEmbed(mediaStore, newConfig(WithAllowedHosts("example.com"))), "/embed?count=1")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.NotContains(t, rr.Body.String(), "/images/a.jpg")
+	require.NotContains(t, rr.Body.String(), "osia-caption\"")
+
+	rr = feedRequest(t, getEmbed(mediaStore, newConfig(WithAllowedHosts("example.com"))), "/embed?columns=10")
+	require.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+}
+
+func TestEmbedDiscovery(t *testing.T) {
+	mediaStore, _, _ := newFeedStore(t)
+
+	rr := feedRequest(t, getEmbed(mediaStore, newConfig(WithPublicURL("https://osia.example.com"))), "/embed?theme=dark")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	require.Contains(t, rr.Body.String(), `<link rel="alternate" type="application/json+oembed" `+
+		`href="https://osia.example.com/oembed?url=https%3A%2F%2Fosia.example.com%2Fembed%3Ftheme%3Ddark"`)
+
+	// without a base the page is still served, without its oEmbed link
+	rr = feedRequest(t, getEmbed(mediaStore, newConfig()), "/embed?theme=dark")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.NotContains(t, rr.Body.String(), "json+oembed")
+	require.Contains(t, rr.Body.String(), `<img src="/images/a.jpg"`)
+}
+
+func TestParseEmbedOptions(t *testing.T) {
+	opts, err := parseEmbedOptions(url.Values{})
+	require.NoError(t, err)
+	require.Equal(t, embedOptions{Count: defaultEmbedCount, Columns: 3, Theme: "light"}, opts)
+	require.Len(t, opts.query(), 0)
+
+	opts, err = parseEmbedOptions(url.Values{"count": {"1000"}, "theme": {"auto"}})
+	require.NoError(t, err)
+	require.Equal(t, maxMedias, opts.Count)
+	require.Equal(t, "auto", opts.Theme)
+	require.Equal(t, "count="+strconv.Itoa(maxMedias)+"&theme=auto", opts.query().Encode())
+
+	table := []url.Values{
+		{"count": {"0"}},
+		{"count": {"x"}},
+		{"columns": {"0"}},
+		{"columns": {"7"}},
+		{"theme": {"pink"}},
+		{"captions": {"maybe"}},
+	}
+
+	for _, query := range table {
+		_, err = parseEmbedOptions(query)
+		require.Error(t, err, query.Encode())
+	}
+}
+
+func TestEmbedScript(t *testing.T) {
+	rr := feedRequest(t, getEmbedScript(newConfig(WithAllowedHosts("example.com"))), "/embed.js")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, "text/javascript; charset=utf-8", rr.Header().Get("Content-Type"))
+	require.Contains(t, rr.Body.String(), `var base = "http://example.com" ||`)
+
+	rr = feedRequest(t, getEmbedScript(newConfig(WithPublicURL("https://osia.example.com"))), "/embed.js")
+	require.Contains(t, rr.Body.String(), `var base = "https://osia.example.com" ||`)
+
+	// without a base, the script falls back to the URL it is loaded from
+	rr = feedRequest(t, getEmbedScript(newConfig()), "/embed.js")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Contains(t, rr.Body.String(), `var base = "" || document.currentScript.src`)
+}
+
+func TestEmbedSnippets(t *testing.T) {
+	rr := feedRequest(t, getEmbedSnippets(newConfig(WithPublicURL("https://osia.example.com"))), "/embed/snippet?count=6&theme=dark")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	var snippets embedSnippets
+	err := json.Unmarshal(rr.Body.Bytes(), &snippets)
+	require.NoError(t, err)
+
+	require.Equal(t, `<iframe src="https://osia.example.com/embed?count=6&amp;theme=dark" `+
+		`title="Instagram posts" loading="lazy" style="width:100%;border:0;aspect-ratio:3/2"></iframe>`,
+		snippets.IFrame)
+	require.Equal(t, `<div class="osia-embed" data-count="6" data-theme="dark"></div>`+"\n"+
+		`<script src="https://osia.example.com/embed.js" async></script>`, snippets.Script)
+
+	rr = feedRequest(t, getEmbedSnippets(newConfig(WithAllowedHosts("example.com"))), "/embed/snippet?theme=pink")
+	require.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+}
+
+func TestRows(t *testing.T) {
+	require.Equal(t, 3, rows(9, 3))
+	require.Equal(t, 4, rows(10, 3))
+	require.Equal(t, 1, rows(1, 6))
+}
@@ -0,0 +1,129 @@
+package httpapi
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nkcr/OSIA/events"
+)
+
+// heartbeatInterval is the default interval between two heartbeat comments on
+// an event stream, which keep the connection open through proxies.
+const heartbeatInterval = 15 * time.Second
+
+// retryDelay is the delay after which clients should reconnect to the event
+// stream, in milliseconds.
+const retryDelay = 3000
+
+// WithEvents sets the bus whose events are streamed at /api/events. The admin
+// API also publishes the moderation events on it, and on the other publishers,
+// such as the webhooks dispatcher. The stream is not available without a bus.
+func WithEvents(bus *events.Bus, publishers ...events.Publisher) Option {
+	return func(c *config) {
+		c.events = bus
+		c.publishers = publishers
+	}
+}
+
+// getEvents returns an HTTP handler that streams the events of the bus as
+// Server-Sent Events. Clients can resume with the Last-Event-ID header. Each
+// write must complete within the write timeout, which is extended for every
+// message so that the connection can last longer.
+func getEvents(bus *events.Bus, heartbeat time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if bus == nil {
+			http.Error(w, "events not available", http.StatusNotImplemented)
+			return
+		}
+
+		var lastID uint64
+
+		lastIDStr := r.Header.Get("Last-Event-ID")
+		if lastIDStr != "" {
+			id, err := strconv.ParseUint(lastIDStr, 10, 64)
+			if err != nil {
+				http.Error(w, "bad Last-Event-ID value: "+lastIDStr, http.StatusBadRequest)
+				return
+			}
+
+			lastID = id
+		}
+
+		sub, missed := bus.Subscribe(lastID)
+		defer sub.Close()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		// disables the buffering of nginx
+		w.Header().Set("X-Accel-Buffering", "no")
+
+		rc := http.NewResponseController(w)
+
+		send := func(message string) error {
+			// not all writers support deadlines, such as in tests
+			rc.SetWriteDeadline(time.Now().Add(writeTimeout))
+
+			_, err := io.WriteString(w, message)
+			if err != nil {
+				return err
+			}
+
+			return rc.Flush()
+		}
+
+		err := send(fmt.Sprintf("retry: %d\n\n", retryDelay))
+		if err != nil {
+			return
+		}
+
+		for _, event := range missed {
+			err = send(formatEvent(event))
+			if err != nil {
+				return
+			}
+		}
+
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case event, ok := <-sub.Events():
+				// the subscriber was too slow or the bus is closed, the client
+				// will reconnect and resume.
+				if !ok {
+					return
+				}
+
+				err = send(formatEvent(event))
+			case <-ticker.C:
+				err = send(": heartbeat\n\n")
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// formatEvent formats an event as a Server-Sent Events message
+func formatEvent(event events.Event) string {
+	data := strings.ReplaceAll(string(event.Data), "\n", "\ndata: ")
+	return fmt.Sprintf("id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+}
+
+// publish publishes an event if a publisher is set
+func publish(publisher events.Publisher, eventType string, data interface{}) {
+	if publisher == nil {
+		return
+	}
+
+	publisher.Publish(eventType, data)
+}
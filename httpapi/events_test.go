@@ -0,0 +1,167 @@
+package httpapi
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nkcr/OSIA/events"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvents(t *testing.T) {
+	bus := events.NewBus(events.DefaultHistorySize)
+
+	server := httptest.NewServer(getEvents(bus, time.Hour))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	require.Equal(t, "no-cache", resp.Header.Get("Cache-Control"))
+
+	reader := bufio.NewReader(resp.Body)
+	require.Equal(t, "retry: 3000\n\n", readMessage(t, reader))
+
+	// to know the IDs of the events
+	sub, _ := bus.Subscribe(0)
+
+	err = bus.Publish(events.MediaAdded, events.MediaData{ID: "a"})
+	require.NoError(t, err)
+
+	id := (<-sub.Events()).ID
+	require.Equal(t, fmt.Sprintf("id: %d\nevent: media.added\ndata: {\"id\":\"a\"}\n\n", id),
+		readMessage(t, reader))
+
+	err = bus.Publish(events.SyncCompleted, map[string]interface{}{"added": []string{"a"}})
+	require.NoError(t, err)
+
+	require.Equal(t, fmt.Sprintf("id: %d\nevent: sync.completed\ndata: {\"added\":[\"a\"]}\n\n", id+1),
+		readMessage(t, reader))
+
+	// the stream ends with the bus
+	bus.Close()
+
+	_, err = reader.ReadString('\n')
+	require.Error(t, err)
+}
+
+func TestEventsResume(t *testing.T) {
+	bus := events.NewBus(events.DefaultHistorySize)
+	sub, _ := bus.Subscribe(0)
+
+	for _, id := range []string{"a", "b", "c"} {
+		err := bus.Publish(events.MediaAdded, events.MediaData{ID: id})
+		require.NoError(t, err)
+	}
+
+	first := (<-sub.Events()).ID
+
+	server := httptest.NewServer(getEvents(bus, time.Hour))
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+
+	req.Header.Set("Last-Event-ID", strconv.FormatUint(first, 10))
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+
+	defer resp.Body.Close()
+
+	reader := bufio.NewReader(resp.Body)
+	readMessage(t, reader)
+
+	require.Contains(t, readMessage(t, reader), fmt.Sprintf("id: %d\n", first+1))
+	require.Contains(t, readMessage(t, reader), fmt.Sprintf("id: %d\n", first+2))
+}
+
+func TestEventsHeartbeat(t *testing.T) {
+	bus := events.NewBus(events.DefaultHistorySize)
+
+	server := httptest.NewServer(getEvents(bus, 10*time.Millisecond))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+
+	defer resp.Body.Close()
+
+	reader := bufio.NewReader(resp.Body)
+	readMessage(t, reader)
+
+	require.Equal(t, ": heartbeat\n\n", readMessage(t, reader))
+	require.Equal(t, ": heartbeat\n\n", readMessage(t, reader))
+}
+
+func TestEventsErrors(t *testing.T) {
+	rr := feedRequest(t, getEvents(nil, time.Hour), "/api/events")
+	require.Equal(t, http.StatusNotImplemented, rr.Result().StatusCode)
+
+	rr = httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "http://example.com/api/events", nil)
+	require.NoError(t, err)
+
+	req.Header.Set("Last-Event-ID", "abc")
+
+	getEvents(events.NewBus(events.DefaultHistorySize), time.Hour).ServeHTTP(rr, req)
+	require.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+}
+
+// The admin API publishes moderation events.
+func TestEventsAdmin(t *testing.T) {
+	mediaStore, db := newMediasStore(t, "a", "b")
+	bus := events.NewBus(events.DefaultHistorySize)
+	handler := adminAPI(mediaStore, db, t.TempDir(), nil, bus)
+
+	sub, _ := bus.Subscribe(0)
+
+	rr := adminRequest(t, handler, http.MethodPost, "/admin/api/medias/a/hide", "")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	rr = adminRequest(t, handler, http.MethodDelete, "/admin/api/medias/b", "")
+	require.Equal(t, http.StatusNoContent, rr.Result().StatusCode)
+
+	// failures don't publish anything
+	rr = adminRequest(t, handler, http.MethodPost, "/admin/api/medias/x/pin", "")
+	require.Equal(t, http.StatusNotFound, rr.Result().StatusCode)
+
+	event := <-sub.Events()
+	require.Equal(t, events.MediaUpdated, event.Type)
+	require.JSONEq(t, `{"id": "a"}`, string(event.Data))
+
+	event = <-sub.Events()
+	require.Equal(t, events.MediaDeleted, event.Type)
+	require.JSONEq(t, `{"id": "b"}`, string(event.Data))
+
+	require.Len(t, sub.Events(), 0)
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+// readMessage reads an event stream until the end of a message
+func readMessage(t *testing.T, reader *bufio.Reader) string {
+	var sb strings.Builder
+
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+
+		sb.WriteString(line)
+
+		if line == "\n" {
+			return sb.String()
+		}
+	}
+}
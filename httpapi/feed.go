@@ -0,0 +1,457 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nkcr/OSIA/instagram/types"
+	"github.com/nkcr/OSIA/store"
+)
+
+// maxFeedItems is the number of medias included in a feed
+const maxFeedItems = 50
+
+// maxTitleLength is the maximum number of characters of an item's title
+const maxTitleLength = 80
+
+// WithPublicURL sets the URL under which OSIA is publicly reachable, such as
+// "https://osia.example.com". It is used to build absolute links. By default
+// the host of the request is used if it is allowed, see WithAllowedHosts.
+func WithPublicURL(url string) Option {
+	return func(c *config) {
+		c.publicURL = strings.TrimSuffix(url, "/")
+	}
+}
+
+// WithAllowedHosts sets the hosts, as sent by clients in requests, such as
+// "osia.example.com" or "osia.example.com:3333", from which absolute links can
+// be built when no public URL is set. The listen address and loopback hosts are
+// always allowed.
+func WithAllowedHosts(hosts ...string) Option {
+	return func(c *config) {
+		for _, host := range hosts {
+			c.allowedHosts[strings.ToLower(host)] = true
+		}
+	}
+}
+
+// feedItem contains the data of a media needed by the feeds
+type feedItem struct {
+	media     types.Media
+	title     string
+	published time.Time
+	imageURL  string
+	mimeType  string
+	size      int64
+	content   string
+}
+
+// feed contains the data common to all feed formats
+type feed struct {
+	title   string
+	homeURL string
+	feedURL string
+	updated time.Time
+	author  string
+	items   []feedItem
+}
+
+// getFeed returns an HTTP handler that serves the latest medias as a feed. The
+// format is one of "rss", "atom" or "json".
+func getFeed(mediaStore store.MediaStore, imagesFolder string, conf config, format string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		base, err := baseURL(r, conf)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to build links: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		medias, err := publicMedias(mediaStore, maxFeedItems)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to list medias: %v", err),
+				http.StatusInternalServerError)
+			return
+		}
+
+		f := newFeed(medias, imagesFolder, base, base+r.URL.Path)
+
+		switch format {
+		case "rss":
+			w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+			writeXML(w, f.rss())
+		case "atom":
+			w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+			writeXML(w, f.atom())
+		case "json":
+			w.Header().Set("Content-Type", "application/feed+json; charset=utf-8")
+			json.NewEncoder(w).Encode(f.jsonFeed())
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
+
+// newFeed creates a feed from a list of medias
+func newFeed(medias []types.Media, imagesFolder, base, feedURL string) feed {
+	f := feed{
+		title:   "OSIA",
+		homeURL: base + "/",
+		feedURL: feedURL,
+		items:   make([]feedItem, len(medias)),
+	}
+
+	for i, media := range medias {
+		if f.author == "" && media.Username != "" {
+			f.author = media.Username
+			f.title = "@" + media.Username + " on Instagram"
+		}
+
+		item := feedItem{
+			media:     media,
+			title:     captionTitle(media.Caption),
+			imageURL:  base + "/images/" + media.ID + ".jpg",
+			mimeType:  mediaMimeType(media),
+			published: media.Timestamp.Time,
+		}
+
+		if item.published.After(f.updated) {
+			f.updated = item.published
+		}
+
+		stat, err := os.Stat(filepath.Join(imagesFolder, media.ID+".jpg"))
+		if err == nil {
+			item.size = stat.Size()
+		}
+
+		item.content = "<p>" + strings.ReplaceAll(html.EscapeString(media.Caption), "\n", "<br>") + "</p>"
+
+		if item.mimeType == "video/mp4" {
+			item.content += fmt.Sprintf(`<video src="%s" controls></video>`,
+				html.EscapeString(item.imageURL))
+		} else {
+			item.content += fmt.Sprintf(`<img src="%s" alt="%s">`,
+				html.EscapeString(item.imageURL), html.EscapeString(item.title))
+		}
+
+		f.items[i] = item
+	}
+
+	if f.updated.IsZero() {
+		f.updated = time.Now()
+	}
+
+	return f
+}
+
+// rssFeed defines an RSS 2.0 document
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	AtomNS  string     `xml:"xmlns:atom,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	AtomLink      atomLink  `xml:"atom:link"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string       `xml:"title"`
+	Link        string       `xml:"link"`
+	Description string       `xml:"description"`
+	GUID        rssGUID      `xml:"guid"`
+	PubDate     string       `xml:"pubDate,omitempty"`
+	Enclosure   rssEnclosure `xml:"enclosure"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+// rss returns the feed as an RSS 2.0 document
+func (f feed) rss() rssFeed {
+	items := make([]rssItem, len(f.items))
+
+	for i, item := range f.items {
+		items[i] = rssItem{
+			Title:       item.title,
+			Link:        item.media.Permalink,
+			Description: item.content,
+			GUID: rssGUID{
+				Value: item.media.ID,
+			},
+			Enclosure: rssEnclosure{
+				URL:    item.imageURL,
+				Length: item.size,
+				Type:   item.mimeType,
+			},
+		}
+
+		if !item.published.IsZero() {
+			items[i].PubDate = item.published.Format(time.RFC1123Z)
+		}
+	}
+
+	return rssFeed{
+		Version: "2.0",
+		AtomNS:  "http://www.w3.org/2005/Atom",
+		Channel: rssChannel{
+			Title:         f.title,
+			Link:          f.homeURL,
+			Description:   "Latest posts of " + f.title,
+			LastBuildDate: f.updated.Format(time.RFC1123Z),
+			AtomLink: atomLink{
+				Href: f.feedURL,
+				Rel:  "self",
+				Type: "application/rss+xml",
+			},
+			Items: items,
+		},
+	}
+}
+
+// atomFeed defines an Atom document
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Author  *atomAuthor `xml:"author,omitempty"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href   string `xml:"href,attr"`
+	Rel    string `xml:"rel,attr,omitempty"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length int64  `xml:"length,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Title     string      `xml:"title"`
+	ID        string      `xml:"id"`
+	Updated   string      `xml:"updated"`
+	Published string      `xml:"published,omitempty"`
+	Links     []atomLink  `xml:"link"`
+	Content   atomContent `xml:"content"`
+}
+
+type atomContent struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+// atom returns the feed as an Atom document
+func (f feed) atom() atomFeed {
+	entries := make([]atomEntry, len(f.items))
+
+	for i, item := range f.items {
+		updated := item.published
+		if updated.IsZero() {
+			updated = f.updated
+		}
+
+		entries[i] = atomEntry{
+			Title:   item.title,
+			ID:      f.homeURL + "media/" + item.media.ID,
+			Updated: updated.Format(time.RFC3339),
+			Links: []atomLink{
+				{Href: item.media.Permalink, Rel: "alternate", Type: "text/html"},
+				{Href: item.imageURL, Rel: "enclosure", Type: item.mimeType, Length: item.size},
+			},
+			Content: atomContent{
+				Type:  "html",
+				Value: item.content,
+			},
+		}
+
+		if !item.published.IsZero() {
+			entries[i].Published = item.published.Format(time.RFC3339)
+		}
+	}
+
+	res := atomFeed{
+		Title:   f.title,
+		ID:      f.homeURL,
+		Updated: f.updated.Format(time.RFC3339),
+		Links: []atomLink{
+			{Href: f.feedURL, Rel: "self", Type: "application/atom+xml"},
+			{Href: f.homeURL, Rel: "alternate"},
+		},
+		Entries: entries,
+	}
+
+	if f.author != "" {
+		res.Author = &atomAuthor{Name: f.author}
+	}
+
+	return res
+}
+
+// jsonFeed defines a JSON Feed 1.1 document, see https://jsonfeed.org
+type jsonFeed struct {
+	Version     string           `json:"version"`
+	Title       string           `json:"title"`
+	HomePageURL string           `json:"home_page_url"`
+	FeedURL     string           `json:"feed_url"`
+	Authors     []jsonFeedAuthor `json:"authors,omitempty"`
+	Items       []jsonFeedItem   `json:"items"`
+}
+
+type jsonFeedAuthor struct {
+	Name string `json:"name"`
+}
+
+type jsonFeedItem struct {
+	ID            string               `json:"id"`
+	URL           string               `json:"url"`
+	Title         string               `json:"title,omitempty"`
+	ContentHTML   string               `json:"content_html"`
+	ContentText   string               `json:"content_text"`
+	Image         string               `json:"image,omitempty"`
+	DatePublished string               `json:"date_published,omitempty"`
+	Attachments   []jsonFeedAttachment `json:"attachments"`
+}
+
+type jsonFeedAttachment struct {
+	URL         string `json:"url"`
+	MimeType    string `json:"mime_type"`
+	SizeInBytes int64  `json:"size_in_bytes,omitempty"`
+}
+
+// jsonFeed returns the feed as a JSON Feed document
+func (f feed) jsonFeed() jsonFeed {
+	items := make([]jsonFeedItem, len(f.items))
+
+	for i, item := range f.items {
+		items[i] = jsonFeedItem{
+			ID:          item.media.ID,
+			URL:         item.media.Permalink,
+			Title:       item.title,
+			ContentHTML: item.content,
+			ContentText: item.media.Caption,
+			Attachments: []jsonFeedAttachment{
+				{URL: item.imageURL, MimeType: item.mimeType, SizeInBytes: item.size},
+			},
+		}
+
+		if item.mimeType != "video/mp4" {
+			items[i].Image = item.imageURL
+		}
+
+		if !item.published.IsZero() {
+			items[i].DatePublished = item.published.Format(time.RFC3339)
+		}
+	}
+
+	res := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       f.title,
+		HomePageURL: f.homeURL,
+		FeedURL:     f.feedURL,
+		Items:       items,
+	}
+
+	if f.author != "" {
+		res.Authors = []jsonFeedAuthor{{Name: f.author}}
+	}
+
+	return res
+}
+
+// captionTitle returns the first line of a caption, truncated if too long
+func captionTitle(caption string) string {
+	title := strings.TrimSpace(strings.SplitN(caption, "\n", 2)[0])
+
+	if utf8.RuneCountInString(title) > maxTitleLength {
+		runes := []rune(title)
+		title = strings.TrimSpace(string(runes[:maxTitleLength-1])) + "…"
+	}
+
+	return title
+}
+
+// mediaMimeType returns the mime type of a media's local file
+func mediaMimeType(media types.Media) string {
+	if media.MediaType == "VIDEO" {
+		return "video/mp4"
+	}
+
+	return "image/jpeg"
+}
+
+// baseURL returns the public URL if set, or the URL deduced from the request if
+// its host is allowed. The host is chosen by the client, and caches in front of
+// OSIA could serve links to other hosts to everyone.
+func baseURL(r *http.Request, conf config) (string, error) {
+	if conf.publicURL != "" {
+		return conf.publicURL, nil
+	}
+
+	if !conf.allowedHost(r.Host) {
+		return "", fmt.Errorf("host '%s' is not allowed, set the public URL "+
+			"or allow the host", r.Host)
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	// a proxy terminating TLS forwards plain HTTP requests
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err == nil && isTrusted(remote, conf.trustedProxies) {
+		proto := strings.ToLower(r.Header.Get("X-Forwarded-Proto"))
+		if proto == "http" || proto == "https" {
+			scheme = proto
+		}
+	}
+
+	return scheme + "://" + r.Host, nil
+}
+
+// allowedHost returns true if absolute links can be built from the host of a
+// request. Only explicitly allowed hosts are, since requests forwarded by a
+// local proxy may have a loopback host.
+func (c config) allowedHost(host string) bool {
+	return c.allowedHosts[strings.ToLower(host)]
+}
+
+// writeXML writes an XML document with its header
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Write([]byte(xml.Header))
+
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+
+	err := encoder.Encode(v)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode: %v", err), http.StatusInternalServerError)
+	}
+}
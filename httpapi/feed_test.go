@@ -0,0 +1,232 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nkcr/OSIA/instagram/types"
+	"github.com/nkcr/OSIA/store"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/buntdb"
+)
+
+func TestFeedRSS(t *testing.T) {
+	mediaStore, _, tmpdir := newFeedStore(t)
+
+	rr := feedRequest(t, getFeed(mediaStore, tmpdir, newConfig(WithPublicURL("https://osia.example.com")), "rss"), "/feed.rss")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, "application/rss+xml; charset=utf-8", rr.Header().Get("Content-Type"))
+
+	var feed rssFeed
+	err := xml.Unmarshal(rr.Body.Bytes(), &feed)
+	require.NoError(t, err)
+
+	require.Equal(t, "2.0", feed.Version)
+	require.Equal(t, "@osia on Instagram", feed.Channel.Title)
+	require.Contains(t, rr.Body.String(), "<link>https://osia.example.com/</link>")
+	require.Contains(t, rr.Body.String(), `<atom:link href="https://osia.example.com/feed.rss" rel="self" type="application/rss+xml"></atom:link>`)
+	require.Len(t, feed.Channel.Items, 2)
+
+	item := feed.Channel.Items[0]
+	require.Equal(t, "Second post", item.Title)
+	require.Equal(t, "https://instagram.com/p/b", item.Link)
+	require.Equal(t, "b", item.GUID.Value)
+	require.False(t, item.GUID.IsPermaLink)
+	require.Equal(t, "Tue, 04 Jan 2022 10:00:00 +0000", item.PubDate)
+	require.Equal(t, "https://osia.example.com/images/b.jpg", item.Enclosure.URL)
+	require.Equal(t, "video/mp4", item.Enclosure.Type)
+	require.Equal(t, int64(0), item.Enclosure.Length)
+
+	item = feed.Channel.Items[1]
+	require.Equal(t, "image/jpeg", item.Enclosure.Type)
+	require.Equal(t, int64(len("fake image")), item.Enclosure.Length)
+
+	// the caption must be escaped
+	require.Contains(t, item.Description, "&lt;script&gt;")
+	require.Contains(t, item.Description, "<br>")
+	require.NotContains(t, item.Description, "<script>")
+}
+
+func TestFeedAtom(t *testing.T) {
+	mediaStore, _, tmpdir := newFeedStore(t)
+
+	rr := feedRequest(t, getFeed(mediaStore, tmpdir, newConfig(WithAllowedHosts("example.com")), "atom"), "/feed.atom")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, "application/atom+xml; charset=utf-8", rr.Header().Get("Content-Type"))
+
+	var feed atomFeed
+	err := xml.Unmarshal(rr.Body.Bytes(), &feed)
+	require.NoError(t, err)
+
+	// without public URL, the host of the request is used
+	require.Equal(t, "http://example.com/", feed.ID)
+	require.Equal(t, "2022-01-04T10:00:00Z", feed.Updated)
+	require.Equal(t, "osia", feed.Author.Name)
+	require.Len(t, feed.Entries, 2)
+
+	entry := feed.Entries[1]
+	require.Equal(t, "First post", entry.Title)
+	require.Equal(t, "2022-01-03T10:00:00Z", entry.Published)
+	require.Equal(t, "html", entry.Content.Type)
+	require.Equal(t, []atomLink{
+		{Href: "https://instagram.com/p/a", Rel: "alternate", Type: "text/html"},
+		{Href: "http://example.com/images/a.jpg", Rel: "enclosure", Type: "image/jpeg", Length: 10},
+	}, entry.Links)
+}
+
+func TestFeedJSON(t *testing.T) {
+	mediaStore, _, tmpdir := newFeedStore(t)
+
+	rr := feedRequest(t, getFeed(mediaStore, tmpdir, newConfig(WithPublicURL("https://osia.example.com")), "json"), "/feed.json")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, "application/feed+json; charset=utf-8", rr.Header().Get("Content-Type"))
+
+	var feed jsonFeed
+	err := json.Unmarshal(rr.Body.Bytes(), &feed)
+	require.NoError(t, err)
+
+	require.Equal(t, "https://jsonfeed.org/version/1.1", feed.Version)
+	require.Equal(t, "https://osia.example.com/feed.json", feed.FeedURL)
+	require.Len(t, feed.Items, 2)
+
+	item := feed.Items[1]
+	require.Equal(t, "a", item.ID)
+	require.Equal(t, "https://instagram.com/p/a", item.URL)
+	require.Equal(t, "https://osia.example.com/images/a.jpg", item.Image)
+	require.Equal(t, "2022-01-03T10:00:00Z", item.DatePublished)
+	require.Equal(t, "First post\n<script>alert(1)</script>", item.ContentText)
+	require.Equal(t, []jsonFeedAttachment{
+		{URL: "https://osia.example.com/images/a.jpg", MimeType: "image/jpeg", SizeInBytes: 10},
+	}, item.Attachments)
+}
+
+// Links must not be built from a host chosen by the client
+func TestFeedUntrustedHost(t *testing.T) {
+	mediaStore, _, tmpdir := newFeedStore(t)
+
+	rr := feedRequest(t, getFeed(mediaStore, tmpdir, newConfig(), "atom"), "/feed.atom")
+	require.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+	require.Contains(t, rr.Body.String(), "host 'example.com' is not allowed")
+}
+
+func TestAllowedHost(t *testing.T) {
+	conf := newConfig(WithAllowedHosts("osia.example.com"))
+
+	require.True(t, conf.allowedHost("osia.example.com"))
+	require.True(t, conf.allowedHost("OSIA.example.com"))
+
+	require.False(t, conf.allowedHost(""))
+	require.False(t, conf.allowedHost("evil.example.com"))
+	require.False(t, conf.allowedHost("osia.example.com:8080"))
+	require.False(t, conf.allowedHost("10.0.0.1:3333"))
+
+	// requests forwarded by a local proxy must not give loopback links
+	require.False(t, conf.allowedHost("localhost:3333"))
+	require.False(t, conf.allowedHost("127.0.0.1:3333"))
+	require.False(t, conf.allowedHost("[::1]:3333"))
+}
+
+func TestBaseURL(t *testing.T) {
+	trusted, err := ParseTrustedProxies([]string{"127.0.0.1"})
+	require.NoError(t, err)
+
+	conf := newConfig(WithAllowedHosts("example.com"), WithTrustedProxies(trusted...))
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com/feed.rss", nil)
+	require.NoError(t, err)
+
+	req.Header.Set("X-Forwarded-Proto", "https")
+
+	// the scheme is only taken from trusted proxies
+	req.RemoteAddr = "1.2.3.4:1234"
+
+	base, err := baseURL(req, conf)
+	require.NoError(t, err)
+	require.Equal(t, "http://example.com", base)
+
+	req.RemoteAddr = "127.0.0.1:1234"
+
+	base, err = baseURL(req, conf)
+	require.NoError(t, err)
+	require.Equal(t, "https://example.com", base)
+
+	conf = newConfig(WithPublicURL("https://osia.example.com"))
+
+	base, err = baseURL(req, conf)
+	require.NoError(t, err)
+	require.Equal(t, "https://osia.example.com", base)
+
+	_, err = baseURL(req, newConfig())
+	require.EqualError(t, err, "host 'example.com' is not allowed, set the public URL or allow the host")
+}
+
+func TestCaptionTitle(t *testing.T) {
+	require.Equal(t, "", captionTitle(""))
+	require.Equal(t, "hello", captionTitle(" hello \nworld"))
+
+	long := strings.Repeat("é", 100)
+	title := captionTitle(long)
+	require.Equal(t, maxTitleLength, len([]rune(title)))
+	require.True(t, strings.HasSuffix(title, "…"))
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+// newFeedStore returns a store with two medias, an empty database for the
+// other records, and an images folder that contains the image of the first
+// one.
+func newFeedStore(t *testing.T) (store.MediaStore, *buntdb.DB, string) {
+	db, err := buntdb.Open(":memory:")
+	require.NoError(t, err)
+
+	mediaStore := store.NewMemoryStore()
+
+	medias := []types.Media{
+		{
+			ID:        "a",
+			Caption:   "First post\n<script>alert(1)</script>",
+			MediaType: "IMAGE",
+			Permalink: "https://instagram.com/p/a",
+			Username:  "osia",
+			Timestamp: types.NewTimestamp(time.Date(2022, 1, 3, 10, 0, 0, 0, time.UTC)),
+		},
+		{
+			ID:        "b",
+			Caption:   "Second post",
+			MediaType: "VIDEO",
+			Permalink: "https://instagram.com/p/b",
+			Username:  "osia",
+			Timestamp: types.NewTimestamp(time.Date(2022, 1, 4, 10, 0, 0, 0, time.UTC)),
+		},
+	}
+
+	for _, media := range medias {
+		err = mediaStore.Put(media)
+		require.NoError(t, err)
+	}
+
+	tmpdir := t.TempDir()
+
+	err = os.WriteFile(filepath.Join(tmpdir, "a.jpg"), []byte("fake image"), os.ModePerm)
+	require.NoError(t, err)
+
+	return mediaStore, db, tmpdir
+}
+
+func feedRequest(t *testing.T, handler http.Handler, path string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+	require.NoError(t, err)
+
+	handler.ServeHTTP(rr, req)
+
+	return rr
+}
@@ -6,10 +6,14 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/nkcr/OSIA/events"
+	"github.com/nkcr/OSIA/instagram/types"
+	"github.com/nkcr/OSIA/store"
 	"github.com/rs/zerolog"
 	"github.com/tidwall/buntdb"
 )
@@ -26,9 +30,74 @@ type key int
 const requestIDKey key = 0
 const maxMedias = 12
 
-// NewNativeHTTP returns a new initialized Instagram HTTP server
-func NewInstagramHTTP(addr string, db *buntdb.DB, imagesFolder string,
-	logger zerolog.Logger) HTTP {
+// writeTimeout is the maximum duration to write a response
+const writeTimeout = 10 * time.Second
+
+// Option defines an option that can be passed when creating a new HTTP server
+type Option func(*config)
+
+// config contains the options of the HTTP server
+type config struct {
+	compressEncodings []string
+	compressMinSize   int
+	cors              CORSConfig
+	rateLimits        map[string]RateLimit
+	trustedProxies    []*net.IPNet
+	syncer            Syncer
+	publicURL         string
+	allowedHosts      map[string]bool
+	hashtagURL        string
+	mentionURL        string
+	events            *events.Bus
+	publishers        []events.Publisher
+	imageSizes        ImageSizes
+	imageCache        string
+}
+
+// newConfig returns a config with the default values and the provided options
+// applied.
+func newConfig(opts ...Option) config {
+	c := config{
+		compressEncodings: []string{"br", "gzip"},
+		compressMinSize:   1024,
+		cors:              DefaultCORSConfig(),
+		rateLimits: map[string]RateLimit{
+			"api":    {Rate: 5, Burst: 20},
+			"images": {Rate: 20, Burst: 60},
+			"admin":  {Rate: 2, Burst: 10},
+		},
+		allowedHosts: map[string]bool{},
+		hashtagURL:   DefaultHashtagURL,
+		mentionURL:   DefaultMentionURL,
+		imageSizes:   DefaultImageSizes(),
+	}
+
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	return c
+}
+
+// WithCompression sets the encodings used to compress responses, by order of
+// preference. Only "br" and "gzip" are supported. Responses smaller than
+// minSize bytes are not compressed. Compression is disabled if no encoding is
+// provided.
+func WithCompression(minSize int, encodings ...string) Option {
+	return func(c *config) {
+		c.compressEncodings = encodings
+		c.compressMinSize = minSize
+	}
+}
+
+// NewNativeHTTP returns a new initialized Instagram HTTP server. Medias are
+// read from the media store, while the db stores the API keys and the webhooks
+// of the admin API. Only medias are abstracted by a store: API keys, webhooks
+// and deliveries are always kept in buntdb, whatever the media store.
+func NewInstagramHTTP(addr string, mediaStore store.MediaStore, db *buntdb.DB,
+	imagesFolder string, logger zerolog.Logger, opts ...Option) HTTP {
+
+	config := newConfig(opts...)
 
 	logger = logger.With().Str("role", "http").Logger()
 	logger.Info().Msg("Server is starting...")
@@ -37,21 +106,27 @@ func NewInstagramHTTP(addr string, db *buntdb.DB, imagesFolder string,
 		return fmt.Sprintf("%d", time.Now().UnixNano())
 	}
 
-	mux := http.NewServeMux()
+	var handler http.Handler = routeMux(newRoutes(mediaStore, db, imagesFolder, config), config)
 
-	mux.HandleFunc("/api/medias", getMedias(db))
+	if len(config.compressEncodings) != 0 {
+		handler = compression(config.compressMinSize, config.compressEncodings)(handler)
+	}
 
-	fs := http.FileServer(http.Dir(imagesFolder))
-	mux.Handle("/images/", noListings(http.StripPrefix("/images/", fs)))
+	handler = cors(config.cors)(handler)
 
 	server := &http.Server{
 		Addr:         addr,
-		Handler:      tracing(nextRequestID)(logging(logger)(mux)),
+		Handler:      tracing(nextRequestID)(logging(logger)(handler)),
 		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		WriteTimeout: writeTimeout,
 		IdleTimeout:  15 * time.Second,
 	}
 
+	// requests' contexts are canceled on shutdown, which ends the event streams
+	ctx, cancel := context.WithCancel(context.Background())
+	server.BaseContext = func(net.Listener) context.Context { return ctx }
+	server.RegisterOnShutdown(cancel)
+
 	return &InstagramHTTP{
 		logger: logger,
 		server: server,
@@ -59,6 +134,80 @@ func NewInstagramHTTP(addr string, db *buntdb.DB, imagesFolder string,
 	}
 }
 
+// route defines a route of the server. Its rate is limited by the limits of
+// its group.
+type route struct {
+	pattern string
+	group   string
+	handler http.Handler
+}
+
+// routeMux returns a mux serving the routes. The routes of a group share the
+// same rate limiter, so that a client has one bucket per group.
+func routeMux(routes []route, config config) *http.ServeMux {
+	limiters := make(map[string]*rateLimiter)
+	mux := http.NewServeMux()
+
+	for _, route := range routes {
+		limiter, found := limiters[route.group]
+		if !found {
+			limiter = newRateLimiter(config.rateLimits[route.group])
+			limiters[route.group] = limiter
+		}
+
+		mux.Handle(route.pattern, rateLimiting(limiter, config.trustedProxies)(route.handler))
+	}
+
+	return mux
+}
+
+// newRoutes returns the routes of the server. Each route must be described by
+// the OpenAPI document.
+func newRoutes(mediaStore store.MediaStore, db *buntdb.DB, imagesFolder string, config config) []route {
+	fs := http.FileServer(http.Dir(imagesFolder))
+	fs = precompressed(imagesFolder, config.compressEncodings, fs)
+
+	imageCache := config.imageCache
+	if imageCache == "" {
+		imageCache = filepath.Clean(imagesFolder) + "-resized"
+	}
+
+	fs = resized(imagesFolder, imageCache, config.imageSizes, fs)
+
+	// a nil bus must not be stored in a non-nil interface
+	publishers := events.Publishers{}
+	if config.events != nil {
+		publishers = append(publishers, config.events)
+	}
+
+	publishers = append(publishers, config.publishers...)
+
+	var publisher events.Publisher
+	if len(publishers) != 0 {
+		publisher = publishers
+	}
+
+	return []route{
+		{"/api/medias", "api", http.HandlerFunc(getMedias(mediaStore, config.hashtagURL, config.mentionURL))},
+		{apiV1Prefix + "/", "api", apiV1(mediaStore, imagesFolder, config)},
+		{"/api/openapi.json", "api", getOpenAPI()},
+		{"/api/events", "api", getEvents(config.events, heartbeatInterval)},
+
+		{"/feed.rss", "api", getFeed(mediaStore, imagesFolder, config, "rss")},
+		{"/feed.atom", "api", getFeed(mediaStore, imagesFolder, config, "atom")},
+		{"/feed.json", "api", getFeed(mediaStore, imagesFolder, config, "json")},
+
+		{"/embed", "api", getEmbed(mediaStore, config)},
+		{"/embed.js", "api", getEmbedScript(config)},
+		{"/embed/snippet", "api", getEmbedSnippets(config)},
+		{"/oembed", "api", getOEmbed(mediaStore, config)},
+
+		{"/images/", "images", noListings(http.StripPrefix("/images/", fs))},
+
+		{adminPrefix + "/", "admin", authenticated(db)(adminAPI(mediaStore, db, imagesFolder, config.syncer, publisher))},
+	}
+}
+
 // InstagramHTTP implements an HTTP server that serves aggregated Instagram
 // posts.
 //
@@ -128,55 +277,48 @@ func (n InstagramHTTP) GetAddr() net.Addr {
 	return n.ln.Addr()
 }
 
-// getMedias returns an HTTP handler that returns a list of medias
-func getMedias(db *buntdb.DB) func(http.ResponseWriter, *http.Request) {
+// getMedias returns an HTTP handler that returns a list of medias. With the
+// "caption_html" parameter, medias also contain their parsed caption, with
+// hashtags and mentions linked using the URL templates.
+func getMedias(mediaStore store.MediaStore, hashtagURL, mentionURL string) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		count := maxMedias
+		count, err := parseCount(r.URL.Query().Get("count"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		withCaption := false
 
-		countStr := r.URL.Query().Get("count")
-		if countStr != "" {
-			c, err := strconv.Atoi(countStr)
-			if err != nil || c < 1 {
-				http.Error(w, "bad count value: "+countStr, http.StatusBadRequest)
+		captionStr := r.URL.Query().Get("caption_html")
+		if captionStr != "" {
+			b, err := strconv.ParseBool(captionStr)
+			if err != nil {
+				http.Error(w, "bad caption_html value: "+captionStr, http.StatusBadRequest)
 				return
 			}
 
-			count = c
-
-			if count > maxMedias {
-				count = maxMedias
-			}
+			withCaption = b
 		}
 
-		result := make([]json.RawMessage, count)
-		i := 0
-
-		err := db.View(func(tx *buntdb.Tx) error {
-			tx.Descend("timestamp", func(key, value string) bool {
-				result[i] = []byte(value)
-				i++
-
-				return i < count
-			})
-
-			return nil
-		})
-
+		result, err := publicMedias(mediaStore, count)
 		if err != nil {
-			http.Error(w, fmt.Errorf("failed to view the db: %v", err).Error(),
+			http.Error(w, fmt.Errorf("failed to list medias: %v", err).Error(),
 				http.StatusInternalServerError)
 			return
 		}
 
-		result = result[:i]
-
 		w.Header().Add("Content-Type", "application/json")
-		w.Header().Add("Access-Control-Allow-Origin", "*")
 
 		encoder := json.NewEncoder(w)
 
-		err = encoder.Encode(result)
+		if withCaption {
+			err = encoder.Encode(withParsedCaptions(result, hashtagURL, mentionURL))
+		} else {
+			err = encoder.Encode(result)
+		}
+
 		if err != nil {
 			http.Error(w, fmt.Errorf("failed to encode: %v", err).Error(),
 				http.StatusInternalServerError)
@@ -185,6 +327,36 @@ func getMedias(db *buntdb.DB) func(http.ResponseWriter, *http.Request) {
 	}
 }
 
+// publicMedias returns at most count medias that are not hidden and whose image
+// is saved. Pinned medias come first, sorted by position, followed by the
+// others sorted by timestamp.
+func publicMedias(mediaStore store.MediaStore, count int) ([]types.Media, error) {
+	pinned, _, err := mediaStore.List(store.Query{
+		Filter: store.Filter{Visible: true, Saved: true, Pinned: true},
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sortPinned(pinned)
+
+	if len(pinned) >= count {
+		return pinned[:count], nil
+	}
+
+	others, _, err := mediaStore.List(store.Query{
+		Filter: store.Filter{Visible: true, Saved: true, Unpinned: true},
+		Limit:  count - len(pinned),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append(pinned, others...), nil
+}
+
 // logging is a utility function that logs the http server events
 func logging(logger zerolog.Logger) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
@@ -15,6 +15,7 @@ import (
 	"time"
 
 	"github.com/nkcr/OSIA/instagram/types"
+	"github.com/nkcr/OSIA/store"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/require"
 	"github.com/tidwall/buntdb"
@@ -33,7 +34,7 @@ func TestScenario(t *testing.T) {
 
 	defer os.RemoveAll(tmpdir)
 
-	httpapi := NewInstagramHTTP("localhost:0", db, tmpdir, logger)
+	httpapi := NewInstagramHTTP("localhost:0", store.NewMemoryStore(), db, tmpdir, logger)
 
 	wait := sync.WaitGroup{}
 	wait.Add(1)
@@ -82,37 +83,44 @@ func TestGetAddr(t *testing.T) {
 }
 
 func TestGetMedias(t *testing.T) {
-	db, err := buntdb.Open(":memory:")
-	require.NoError(t, err)
-
-	err = db.CreateIndex("timestamp", "*", buntdb.IndexJSON("timestamp"))
-	require.NoError(t, err)
+	mediaStore := store.NewMemoryStore()
 
 	n := 20
 	medias := make([]types.Media, n)
+	ids := map[string]bool{}
+	timestamps := map[types.Timestamp]bool{}
+
 	for i := range medias {
 		media := getRandomMedia(t)
-		medias[i] = media
 
-		mediaBuf, err := json.Marshal(&media)
-		require.NoError(t, err)
+		// IDs and timestamps must be unique to have a deterministic order
+		for ids[media.ID] || timestamps[media.Timestamp] {
+			media = getRandomMedia(t)
+		}
 
-		err = db.Update(func(tx *buntdb.Tx) error {
-			_, _, err = tx.Set(media.ID, string(mediaBuf), nil)
-			return err
-		})
+		ids[media.ID] = true
+		timestamps[media.Timestamp] = true
+		medias[i] = media
+
+		err := mediaStore.Put(media)
 		require.NoError(t, err)
 	}
 
-	handler := getMedias(db)
+	// the result should be sorted by timestamp. We sort it once since sub-tests
+	// run in parallel.
+	sort.SliceStable(medias, func(i, j int) bool {
+		return medias[i].Timestamp.After(medias[j].Timestamp.Time)
+	})
+
+	handler := getMedias(mediaStore, DefaultHashtagURL, DefaultMentionURL)
 
-	t.Run("Get Medias without count", getTestWithtoutCount(db, medias, handler))
-	t.Run("Get Medias with count", getTestWithCount(db, medias, handler))
-	t.Run("Get Medias with wrong count", getTestWithWrongCount(db, medias, handler))
-	t.Run("Get Medias with over maximum count", getTestWithOverMaximumCount(db, medias, handler))
+	t.Run("Get Medias without count", getTestWithtoutCount(mediaStore, medias, handler))
+	t.Run("Get Medias with count", getTestWithCount(mediaStore, medias, handler))
+	t.Run("Get Medias with wrong count", getTestWithWrongCount(mediaStore, medias, handler))
+	t.Run("Get Medias with over maximum count", getTestWithOverMaximumCount(mediaStore, medias, handler))
 }
 
-func getTestWithtoutCount(db *buntdb.DB, medias []types.Media,
+func getTestWithtoutCount(mediaStore store.MediaStore, medias []types.Media,
 	handler func(http.ResponseWriter, *http.Request)) func(t *testing.T) {
 
 	return func(t *testing.T) {
@@ -125,11 +133,6 @@ func getTestWithtoutCount(db *buntdb.DB, medias []types.Media,
 		handler(rr, req)
 		require.Equal(t, http.StatusOK, rr.Result().StatusCode)
 
-		// the result should be sorted by timestamp
-		sort.SliceStable(medias, func(i, j int) bool {
-			return medias[i].Timestamp > medias[j].Timestamp
-		})
-
 		result := []types.Media{}
 
 		err = json.Unmarshal(rr.Body.Bytes(), &result)
@@ -142,7 +145,7 @@ func getTestWithtoutCount(db *buntdb.DB, medias []types.Media,
 	}
 }
 
-func getTestWithCount(db *buntdb.DB, medias []types.Media,
+func getTestWithCount(mediaStore store.MediaStore, medias []types.Media,
 	handler func(http.ResponseWriter, *http.Request)) func(t *testing.T) {
 
 	return func(t *testing.T) {
@@ -155,11 +158,6 @@ func getTestWithCount(db *buntdb.DB, medias []types.Media,
 		handler(rr, req)
 		require.Equal(t, http.StatusOK, rr.Result().StatusCode)
 
-		// the result should be sorted by timestamp
-		sort.SliceStable(medias, func(i, j int) bool {
-			return medias[i].Timestamp > medias[j].Timestamp
-		})
-
 		result := []types.Media{}
 
 		err = json.Unmarshal(rr.Body.Bytes(), &result)
@@ -172,7 +170,7 @@ func getTestWithCount(db *buntdb.DB, medias []types.Media,
 	}
 }
 
-func getTestWithWrongCount(db *buntdb.DB, medias []types.Media,
+func getTestWithWrongCount(mediaStore store.MediaStore, medias []types.Media,
 	handler func(http.ResponseWriter, *http.Request)) func(t *testing.T) {
 
 	return func(t *testing.T) {
@@ -187,7 +185,7 @@ func getTestWithWrongCount(db *buntdb.DB, medias []types.Media,
 	}
 }
 
-func getTestWithOverMaximumCount(db *buntdb.DB, medias []types.Media,
+func getTestWithOverMaximumCount(mediaStore store.MediaStore, medias []types.Media,
 	handler func(http.ResponseWriter, *http.Request)) func(t *testing.T) {
 
 	return func(t *testing.T) {
@@ -200,11 +198,6 @@ func getTestWithOverMaximumCount(db *buntdb.DB, medias []types.Media,
 		handler(rr, req)
 		require.Equal(t, http.StatusOK, rr.Result().StatusCode)
 
-		// the result should be sorted by timestamp
-		sort.SliceStable(medias, func(i, j int) bool {
-			return medias[i].Timestamp > medias[j].Timestamp
-		})
-
 		result := []types.Media{}
 
 		err = json.Unmarshal(rr.Body.Bytes(), &result)
@@ -217,6 +210,70 @@ func getTestWithOverMaximumCount(db *buntdb.DB, medias []types.Media,
 	}
 }
 
+// Medias whose image is not saved must not be listed publicly
+func TestPublicMediasAssetState(t *testing.T) {
+	mediaStore, _ := newMediasStore(t, "legacy", "ok", "pending", "failed")
+
+	for _, state := range []string{types.AssetOK, types.AssetPending, types.AssetFailed} {
+		_, err := mediaStore.Update(state, func(media *types.Media) error {
+			media.AssetState = state
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, []string{"ok", "legacy"}, publicIDs(t, mediaStore))
+
+	// pinned medias too
+	_, err := mediaStore.Update("pending", func(media *types.Media) error {
+		media.Pinned = true
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"ok", "legacy"}, publicIDs(t, mediaStore))
+
+	handler := getOEmbed(mediaStore, newConfig(WithAllowedHosts("example.com")))
+
+	rr := feedRequest(t, handler, "/oembed?url=http://example.com/images/pending.jpg")
+	require.Equal(t, http.StatusNotFound, rr.Result().StatusCode)
+
+	rr = feedRequest(t, handler, "/oembed?url=http://example.com/images/ok.jpg")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+}
+
+func TestRouteMuxSharedLimit(t *testing.T) {
+	config := newConfig(WithRateLimit("api", RateLimit{Rate: 0.5, Burst: 1}))
+
+	routes := []route{
+		{"/a", "api", okHandler()},
+		{"/b", "api", okHandler()},
+		{"/c", "images", okHandler()},
+	}
+
+	mux := routeMux(routes, config)
+
+	get := func(path string) int {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+		require.NoError(t, err)
+
+		req.RemoteAddr = "1.2.3.4:1234"
+
+		mux.ServeHTTP(rr, req)
+		return rr.Result().StatusCode
+	}
+
+	require.Equal(t, http.StatusOK, get("/a"))
+
+	// the routes of the same group drain the same bucket
+	require.Equal(t, http.StatusTooManyRequests, get("/b"))
+	require.Equal(t, http.StatusTooManyRequests, get("/a"))
+
+	// other groups have their own bucket
+	require.Equal(t, http.StatusOK, get("/c"))
+}
+
 func TestNoListings(t *testing.T) {
 	handler := noListings(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
 
@@ -254,6 +311,6 @@ func getRandomMedia(t *testing.T) types.Media {
 		MediaURL:  hex.EncodeToString(buf[3:4]),
 		Permalink: hex.EncodeToString(buf[4:5]),
 		Username:  hex.EncodeToString(buf[5:6]),
-		Timestamp: hex.EncodeToString(buf[6:7]),
+		Timestamp: types.NewTimestamp(time.Unix(int64(buf[6])*3600, 0)),
 	}
 }
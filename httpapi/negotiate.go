@@ -0,0 +1,71 @@
+package httpapi
+
+import (
+	"strconv"
+	"strings"
+)
+
+// negotiate returns the supported value with the highest quality value from an
+// Accept-style header, such as Accept or Accept-Encoding. The order of
+// supported values is used to break ties. A value that is not in the header
+// gets the quality of its first wildcard that is. It returns an empty string if
+// no value is acceptable.
+func negotiate(header string, supported []string, wildcards func(value string) []string) string {
+	qualities := parseQualities(header)
+
+	best := ""
+	bestQ := 0.0
+
+	for _, value := range supported {
+		q, ok := qualities[value]
+
+		fallbacks := wildcards(value)
+		for i := 0; !ok && i < len(fallbacks); i++ {
+			q, ok = qualities[fallbacks[i]]
+		}
+
+		if !ok || q <= 0 {
+			continue
+		}
+
+		if q > bestQ {
+			best = value
+			bestQ = q
+		}
+	}
+
+	return best
+}
+
+// parseQualities returns the quality value of each element of an Accept-style
+// header, which is 1 by default. Elements are lower-cased.
+func parseQualities(header string) map[string]float64 {
+	qualities := map[string]float64{}
+
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name == "" {
+			continue
+		}
+
+		q := 1.0
+
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+
+			v, err := strconv.ParseFloat(param[2:], 64)
+			if err == nil {
+				q = v
+			}
+		}
+
+		qualities[name] = q
+	}
+
+	return qualities
+}
@@ -0,0 +1,32 @@
+package httpapi
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseQualities(t *testing.T) {
+	qualities := parseQualities("GZIP, br;q=0.8, , *;q=0, deflate;level=1;q=x")
+
+	require.Equal(t, map[string]float64{
+		"gzip":    1,
+		"br":      0.8,
+		"*":       0,
+		"deflate": 1,
+	}, qualities)
+}
+
+func TestNegotiate(t *testing.T) {
+	wildcards := func(value string) []string {
+		return []string{"a*", "*"}
+	}
+
+	require.Equal(t, "b", negotiate("a;q=0.5, b", []string{"a", "b"}, wildcards))
+	require.Equal(t, "a", negotiate("a, b", []string{"a", "b"}, wildcards))
+
+	// the first wildcard in the header is used
+	require.Equal(t, "a", negotiate("a*;q=0.8, *;q=0.9", []string{"a"}, wildcards))
+	require.Equal(t, "", negotiate("a*;q=0, *", []string{"a"}, wildcards))
+	require.Equal(t, "", negotiate("c", []string{"a", "b"}, wildcards))
+}
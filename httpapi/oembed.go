@@ -0,0 +1,260 @@
+package httpapi
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/nkcr/OSIA/instagram/types"
+	"github.com/nkcr/OSIA/store"
+)
+
+// defaultMediaSize is the size of a media whose dimensions are unknown, which
+// is the default size of a square Instagram post.
+const defaultMediaSize = 1080
+
+// defaultEmbedWidth is the width of the embed grid in oEmbed responses
+const defaultEmbedWidth = 600
+
+// oEmbed is a response of the oEmbed endpoint, see https://oembed.com.
+type oEmbed struct {
+	Version      string `json:"version"`
+	Type         string `json:"type"`
+	Title        string `json:"title,omitempty"`
+	AuthorName   string `json:"author_name,omitempty"`
+	AuthorURL    string `json:"author_url,omitempty"`
+	ProviderName string `json:"provider_name"`
+	ProviderURL  string `json:"provider_url"`
+	URL          string `json:"url,omitempty"`
+	HTML         string `json:"html,omitempty"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+}
+
+// getOEmbed returns an HTTP handler that implements an oEmbed provider. The
+// url parameter is either the permalink of a post, the URL of a media served
+// by OSIA, or the URL of the embed page.
+func getOEmbed(mediaStore store.MediaStore, conf config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		// only JSON is supported, as allowed by the specification
+		if query.Get("format") != "" && query.Get("format") != "json" {
+			http.Error(w, "format not implemented", http.StatusNotImplemented)
+			return
+		}
+
+		maxWidth, err := parseMaxSize(query.Get("maxwidth"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad maxwidth value: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		maxHeight, err := parseMaxSize(query.Get("maxheight"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad maxheight value: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		target, err := url.Parse(query.Get("url"))
+		if err != nil || query.Get("url") == "" {
+			http.Error(w, "bad url value", http.StatusBadRequest)
+			return
+		}
+
+		// URLs are matched against the base, and the response has absolute links
+		base, err := baseURL(r, conf)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to build links: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		res := oEmbed{
+			Version:      "1.0",
+			ProviderName: "OSIA",
+			ProviderURL:  base + "/",
+		}
+
+		if isEmbedURL(target, base) {
+			opts, err := parseEmbedOptions(target.Query())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			res.Type = "rich"
+			res.Title = "Instagram posts"
+			res.Width, res.Height = fitSize(defaultEmbedWidth,
+				defaultEmbedWidth*rows(opts.Count, opts.Columns)/opts.Columns, maxWidth, maxHeight)
+			res.HTML = fmt.Sprintf(`<iframe src="%s" title="Instagram posts" width="%d" height="%d" `+
+				`loading="lazy" style="border:0"></iframe>`, html.EscapeString(opts.url(base)),
+				res.Width, res.Height)
+
+			writeJSON(w, http.StatusOK, res)
+			return
+		}
+
+		media, err := findMedia(mediaStore, target, base)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to find media: %v", err),
+				http.StatusInternalServerError)
+			return
+		}
+
+		if media == nil {
+			http.Error(w, store.ErrNotFound.Error(), http.StatusNotFound)
+			return
+		}
+
+		width, height := mediaSize(*media)
+		res.Width, res.Height = fitSize(width, height, maxWidth, maxHeight)
+
+		res.Title = captionTitle(media.Caption)
+
+		if media.Username != "" {
+			res.AuthorName = media.Username
+			res.AuthorURL = "https://www.instagram.com/" + url.PathEscape(media.Username) + "/"
+		}
+
+		mediaURL := base + "/images/" + url.PathEscape(media.ID) + ".jpg"
+
+		if media.MediaType == "VIDEO" {
+			res.Type = "video"
+			res.HTML = fmt.Sprintf(`<video src="%s" width="%d" height="%d" controls playsinline></video>`,
+				html.EscapeString(mediaURL), res.Width, res.Height)
+		} else {
+			res.Type = "photo"
+			res.URL = mediaURL
+		}
+
+		writeJSON(w, http.StatusOK, res)
+	}
+}
+
+// isEmbedURL returns true if the URL is the one of the embed page
+func isEmbedURL(target *url.URL, base string) bool {
+	return strings.TrimSuffix(location(target), "/") == withoutScheme(base)+"/embed"
+}
+
+// location returns the host and path of a URL. The scheme is ignored since it
+// may differ behind a reverse proxy.
+func location(u *url.URL) string {
+	return u.Host + u.Path
+}
+
+// withoutScheme returns the URL without its scheme
+func withoutScheme(rawURL string) string {
+	_, rest, found := strings.Cut(rawURL, "://")
+	if !found {
+		return rawURL
+	}
+
+	return rest
+}
+
+// findMedia returns the public media targeted by the URL, which is either its
+// permalink or its URL on OSIA. It returns nil if there is no such media.
+func findMedia(mediaStore store.MediaStore, target *url.URL, base string) (*types.Media, error) {
+	prefix := withoutScheme(base) + "/images/"
+	targetLocation := location(target)
+
+	if strings.HasPrefix(targetLocation, prefix) && strings.HasSuffix(targetLocation, ".jpg") {
+		id := strings.TrimSuffix(strings.TrimPrefix(targetLocation, prefix), ".jpg")
+
+		media, err := mediaStore.Get(id)
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		// as listed by publicMedias
+		if media.Hidden || media.AssetState != types.AssetOK && media.AssetState != "" {
+			return nil, nil
+		}
+
+		return &media, nil
+	}
+
+	permalink := normalizePermalink(target)
+
+	// the permalink is not the ID, only the medias listed in the feeds are
+	// looked up so that a request doesn't scan the whole store.
+	medias, err := publicMedias(mediaStore, maxFeedItems)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, media := range medias {
+		if media.Permalink == "" {
+			continue
+		}
+
+		mediaPermalink, err := url.Parse(media.Permalink)
+		if err != nil || normalizePermalink(mediaPermalink) != permalink {
+			continue
+		}
+
+		return &media, nil
+	}
+
+	return nil, nil
+}
+
+// normalizePermalink returns a permalink without its query, trailing slash,
+// and "www." prefix, so that equivalent permalinks are equal.
+func normalizePermalink(permalink *url.URL) string {
+	host := strings.TrimPrefix(strings.ToLower(permalink.Host), "www.")
+	return host + strings.TrimSuffix(permalink.Path, "/")
+}
+
+// mediaSize returns the stored dimensions of a media, or a default size if they
+// are unknown.
+func mediaSize(media types.Media) (int, int) {
+	if media.Width <= 0 || media.Height <= 0 {
+		return defaultMediaSize, defaultMediaSize
+	}
+
+	return media.Width, media.Height
+}
+
+// fitSize scales down the dimensions to fit in the maximum ones, keeping the
+// aspect ratio. A maximum of 0 means no limit.
+func fitSize(width, height, maxWidth, maxHeight int) (int, int) {
+	if maxWidth > 0 && width > maxWidth {
+		height = height * maxWidth / width
+		width = maxWidth
+	}
+
+	if maxHeight > 0 && height > maxHeight {
+		width = width * maxHeight / height
+		height = maxHeight
+	}
+
+	return width, height
+}
+
+// parseMaxSize parses a maxwidth or maxheight parameter. An empty value means
+// no limit.
+func parseMaxSize(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	size, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+
+	if size < 1 {
+		return 0, fmt.Errorf("must be positive: %d", size)
+	}
+
+	return size, nil
+}
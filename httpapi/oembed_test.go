@@ -0,0 +1,154 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/nkcr/OSIA/instagram/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOEmbedPhoto(t *testing.T) {
+	mediaStore, _, _ := newFeedStore(t)
+
+	// the stored dimensions are used, without reading the image
+	_, err := mediaStore.Update("a", func(media *types.Media) error {
+		media.Width = 400
+		media.Height = 200
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	handler := getOEmbed(mediaStore, newConfig(WithPublicURL("https://osia.example.com")))
+
+	for _, target := range []string{
+		"https://www.instagram.com/p/a/",
+		"https://instagram.com/p/a?utm_source=ig_web",
+		"https://osia.example.com/images/a.jpg",
+		"http://osia.example.com/images/a.jpg",
+	} {
+		res := oEmbedRequest(t, handler, target, "")
+
+		require.Equal(t, "1.0", res.Version, target)
+		require.Equal(t, "photo", res.Type)
+		require.Equal(t, "https://osia.example.com/images/a.jpg", res.URL)
+		require.Equal(t, "First post", res.Title)
+		require.Equal(t, "osia", res.AuthorName)
+		require.Equal(t, "https://www.instagram.com/osia/", res.AuthorURL)
+		require.Equal(t, "OSIA", res.ProviderName)
+		require.Equal(t, "https://osia.example.com/", res.ProviderURL)
+		require.Equal(t, 400, res.Width)
+		require.Equal(t, 200, res.Height)
+	}
+
+	res := oEmbedRequest(t, handler, "https://instagram.com/p/a", "&maxwidth=100")
+	require.Equal(t, 100, res.Width)
+	require.Equal(t, 50, res.Height)
+}
+
+func TestOEmbedVideo(t *testing.T) {
+	mediaStore, _, _ := newFeedStore(t)
+
+	res := oEmbedRequest(t, getOEmbed(mediaStore, newConfig(WithAllowedHosts("example.com"))), "https://instagram.com/p/b", "&maxheight=540")
+
+	require.Equal(t, "video", res.Type)
+	require.Equal(t, "", res.URL)
+	require.Equal(t, 540, res.Width)
+	require.Equal(t, 540, res.Height)
+	require.Equal(t, `<video src="http://example.com/images/b.jpg" width="540" height="540" `+
+		`controls playsinline></video>`, res.HTML)
+}
+
+func TestOEmbedRich(t *testing.T) {
+	mediaStore, _, _ := newFeedStore(t)
+
+	res := oEmbedRequest(t, getOEmbed(mediaStore, newConfig(WithAllowedHosts("example.com"))), "http://example.com/embed?count=6&theme=dark", "&maxwidth=300")
+
+	require.Equal(t, "rich", res.Type)
+	require.Equal(t, 300, res.Width)
+	require.Equal(t, 200, res.Height)
+	require.Equal(t, `<iframe src="http://example.com/embed?count=6&amp;theme=dark" title="Instagram posts" `+
+		`width="300" height="200" loading="lazy" style="border:0"></iframe>`, res.HTML)
+}
+
+func TestOEmbedErrors(t *testing.T) {
+	mediaStore, _, _ := newFeedStore(t)
+	handler := getOEmbed(mediaStore, newConfig(WithAllowedHosts("example.com")))
+
+	table := []struct {
+		query    string
+		expected int
+	}{
+		{"", http.StatusBadRequest},
+		{"?url=https://instagram.com/p/x", http.StatusNotFound},
+		{"?url=http://example.com/images/x.jpg", http.StatusNotFound},
+		{"?url=http://other.com/images/a.jpg", http.StatusNotFound},
+		{"?url=https://instagram.com/p/a&format=xml", http.StatusNotImplemented},
+		{"?url=https://instagram.com/p/a&maxwidth=0", http.StatusBadRequest},
+		{"?url=https://instagram.com/p/a&maxheight=x", http.StatusBadRequest},
+		{"?url=" + url.QueryEscape("http://example.com/embed?theme=pink"), http.StatusBadRequest},
+	}
+
+	for _, entry := range table {
+		rr := feedRequest(t, handler, "/oembed"+entry.query)
+		require.Equal(t, entry.expected, rr.Result().StatusCode, entry.query)
+	}
+}
+
+// Without a base, URLs can't be matched and links can't be absolute.
+func TestOEmbedUntrustedHost(t *testing.T) {
+	mediaStore, _, _ := newFeedStore(t)
+
+	rr := feedRequest(t, getOEmbed(mediaStore, newConfig()), "/oembed?url=https://instagram.com/p/a")
+	require.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+	require.Contains(t, rr.Body.String(), "host 'example.com' is not allowed")
+}
+
+// Hidden medias must not be embeddable.
+func TestOEmbedHidden(t *testing.T) {
+	mediaStore, db, imagesFolder := newFeedStore(t)
+
+	rr := adminRequest(t, adminAPI(mediaStore, db, imagesFolder, nil, nil), http.MethodPost, "/admin/api/medias/a/hide", "")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	rr = feedRequest(t, getOEmbed(mediaStore, newConfig(WithAllowedHosts("example.com"))), "/oembed?url=https://instagram.com/p/a")
+	require.Equal(t, http.StatusNotFound, rr.Result().StatusCode)
+}
+
+func TestFitSize(t *testing.T) {
+	table := []struct {
+		width, height, maxWidth, maxHeight int
+		expectedWidth, expectedHeight      int
+	}{
+		{1080, 1080, 0, 0, 1080, 1080},
+		{1080, 1350, 540, 0, 540, 675},
+		{1080, 1350, 0, 675, 540, 675},
+		{1080, 1350, 540, 300, 240, 300},
+		{100, 100, 500, 500, 100, 100},
+	}
+
+	for _, entry := range table {
+		width, height := fitSize(entry.width, entry.height, entry.maxWidth, entry.maxHeight)
+		require.Equal(t, entry.expectedWidth, width)
+		require.Equal(t, entry.expectedHeight, height)
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+func oEmbedRequest(t *testing.T, handler http.Handler, target, params string) oEmbed {
+	rr := feedRequest(t, handler, "/oembed?url="+url.QueryEscape(target)+params)
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode, rr.Body.String())
+	require.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+
+	var res oEmbed
+
+	err := json.Unmarshal(rr.Body.Bytes(), &res)
+	require.NoError(t, err)
+
+	return res
+}
@@ -0,0 +1,20 @@
+package httpapi
+
+import (
+	_ "embed" // needed to embed the OpenAPI document
+	"net/http"
+)
+
+// openAPIDocument is the OpenAPI 3 document that describes all the routes of
+// the server. Tests check the handlers' responses against it.
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// getOpenAPI returns an HTTP handler that serves the OpenAPI document
+func getOpenAPI() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openAPIDocument)
+	}
+}
@@ -0,0 +1,409 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/nkcr/OSIA/aggregator"
+	"github.com/nkcr/OSIA/instagram/types"
+	"github.com/nkcr/OSIA/webhooks"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenAPIDocument(t *testing.T) {
+	doc := loadOpenAPI(t)
+
+	require.Equal(t, "3.0.3", doc["openapi"])
+
+	// all the references must be resolvable
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			ref, ok := v["$ref"].(string)
+			if ok {
+				_, err := resolveRef(doc, ref)
+				require.NoError(t, err)
+			}
+
+			for _, e := range v {
+				walk(e)
+			}
+		case []interface{}:
+			for _, e := range v {
+				walk(e)
+			}
+		}
+	}
+
+	walk(doc)
+
+	rr := feedRequest(t, getOpenAPI(), "/api/openapi.json")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	require.JSONEq(t, string(openAPIDocument), rr.Body.String())
+}
+
+// Each route of the server must be described, and each described path must be
+// served by a route.
+func TestOpenAPIRoutes(t *testing.T) {
+	doc := loadOpenAPI(t)
+	paths := doc["paths"].(map[string]interface{})
+
+	mediaStore, db, imagesFolder := newFeedStore(t)
+	routes := newRoutes(mediaStore, db, imagesFolder, newConfig())
+
+	served := func(path string) bool {
+		for _, route := range routes {
+			if path == route.pattern ||
+				strings.HasSuffix(route.pattern, "/") && strings.HasPrefix(path, route.pattern) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	for _, route := range routes {
+		found := false
+
+		for path := range paths {
+			if path == route.pattern ||
+				strings.HasSuffix(route.pattern, "/") && strings.HasPrefix(path, route.pattern) {
+				found = true
+			}
+		}
+
+		require.True(t, found, "route %s is not described", route.pattern)
+	}
+
+	for path := range paths {
+		require.True(t, served(path), "path %s is not served", path)
+	}
+}
+
+// Responses of the handlers must match the document.
+func TestOpenAPIResponses(t *testing.T) {
+	doc := loadOpenAPI(t)
+
+	mediaStore, db, imagesFolder := newFeedStore(t)
+
+	key, err := CreateAPIKey(db, "test")
+	require.NoError(t, err)
+
+	syncer := &fakeSyncer{report: aggregator.Report{Added: []string{}}}
+
+	_, err = mediaStore.Update("a", func(media *types.Media) error {
+		media.Renditions = []types.Rendition{
+			{Name: "320", File: "a-320.jpg", Width: 320, Height: 213},
+			{Name: "320x320", File: "a-320x320.jpg", Width: 320, Height: 320, Cropped: true},
+		}
+
+		media.Width = 480
+		media.Height = 320
+		media.AspectRatio = 1.5
+		media.DominantColor = "#000000"
+		media.BlurHash = "L00000fQfQfQfQfQfQfQfQfQfQfQ"
+		media.Checksum = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+		media.AssetState = types.AssetOK
+		media.AssetAttempts = 1
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	// moderation events are queued for the webhooks, and listed in the log
+	dispatcher := webhooks.NewDispatcher(db, nil, zerolog.New(io.Discard))
+
+	mux := http.NewServeMux()
+	for _, route := range newRoutes(mediaStore, db, imagesFolder, newConfig(WithSyncer(syncer),
+		WithEvents(nil, dispatcher), WithAllowedHosts("example.com"))) {
+		mux.Handle(route.pattern, route.handler)
+	}
+
+	table := []struct {
+		method string
+		url    string
+		path   string
+		body   string
+		status int
+	}{
+		{http.MethodGet, "/api/medias", "/api/medias", "", 200},
+		{http.MethodGet, "/api/medias?caption_html=true", "/api/medias", "", 200},
+		{http.MethodGet, "/api/medias?count=0", "/api/medias", "", 400},
+		{http.MethodGet, "/api/v1/medias", "/api/v1/medias", "", 200},
+		{http.MethodGet, "/api/v1/medias?fields=id,width", "/api/v1/medias", "", 200},
+		{http.MethodGet, "/api/v1/medias?fields=x", "/api/v1/medias", "", 400},
+		{http.MethodGet, "/api/openapi.json", "/api/openapi.json", "", 200},
+		{http.MethodGet, "/api/events", "/api/events", "", 501},
+		{http.MethodGet, "/feed.rss", "/feed.rss", "", 200},
+		{http.MethodGet, "/feed.atom", "/feed.atom", "", 200},
+		{http.MethodGet, "/feed.json", "/feed.json", "", 200},
+		{http.MethodGet, "/embed?captions=true", "/embed", "", 200},
+		{http.MethodGet, "/embed?theme=x", "/embed", "", 400},
+		{http.MethodGet, "/embed.js", "/embed.js", "", 200},
+		{http.MethodGet, "/embed/snippet", "/embed/snippet", "", 200},
+		{http.MethodGet, "/oembed?url=https://instagram.com/p/a", "/oembed", "", 200},
+		{http.MethodGet, "/oembed?url=https://instagram.com/p/b", "/oembed", "", 200},
+		{http.MethodGet, "/oembed?url=http://example.com/embed", "/oembed", "", 200},
+		{http.MethodGet, "/oembed?url=https://instagram.com/p/x", "/oembed", "", 404},
+		{http.MethodGet, "/oembed?url=https://instagram.com/p/a&format=xml", "/oembed", "", 501},
+		{http.MethodGet, "/images/a.jpg", "/images/{file}", "", 200},
+		{http.MethodGet, "/images/x.jpg", "/images/{file}", "", 404},
+		{http.MethodGet, "/images/a.jpg?w=320", "/images/{file}", "", 200},
+		{http.MethodGet, "/images/a.jpg?w=333", "/images/{file}", "", 400},
+		{http.MethodGet, "/admin/api/medias", "/admin/api/medias", "", 200},
+		{http.MethodPost, "/admin/api/webhooks", "/admin/api/webhooks", `{"url": "https://example.com"}`, 201},
+		{http.MethodPost, "/admin/api/webhooks", "/admin/api/webhooks", `{"url": "example.com"}`, 400},
+		{http.MethodGet, "/admin/api/webhooks", "/admin/api/webhooks", "", 200},
+		{http.MethodDelete, "/admin/api/webhooks/x", "/admin/api/webhooks/{webhookId}", "", 404},
+		{http.MethodPost, "/admin/api/medias/a/pin", "/admin/api/medias/{id}/{action}", "", 200},
+		{http.MethodPut, "/admin/api/medias/order", "/admin/api/medias/order", `{"ids": ["a"]}`, 200},
+		{http.MethodPut, "/admin/api/medias/order", "/admin/api/medias/order", `{"ids": ["x"]}`, 404},
+		{http.MethodPost, "/admin/api/medias/x/hide", "/admin/api/medias/{id}/{action}", "", 404},
+		{http.MethodPost, "/admin/api/sync", "/admin/api/sync", "", 200},
+		{http.MethodDelete, "/admin/api/medias/b", "/admin/api/medias/{id}", "", 204},
+		{http.MethodGet, "/admin/api/webhooks/deliveries", "/admin/api/webhooks/deliveries", "", 200},
+		{http.MethodGet, "/admin/api/webhooks/deliveries?count=x", "/admin/api/webhooks/deliveries", "", 400},
+		{http.MethodGet, "/admin/api/medias?unauthenticated", "/admin/api/medias", "", 401},
+	}
+
+	for _, entry := range table {
+		name := entry.method + " " + entry.url
+
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest(entry.method, "http://example.com"+entry.url, strings.NewReader(entry.body))
+		require.NoError(t, err)
+
+		if !strings.HasSuffix(entry.url, "unauthenticated") {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+
+		mux.ServeHTTP(rr, req)
+		require.Equal(t, entry.status, rr.Result().StatusCode, name)
+
+		err = validateResponse(doc, entry.path, entry.method, rr)
+		require.NoError(t, err, name)
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+func loadOpenAPI(t *testing.T) map[string]interface{} {
+	doc := map[string]interface{}{}
+
+	err := json.Unmarshal(openAPIDocument, &doc)
+	require.NoError(t, err)
+
+	return doc
+}
+
+// resolveRef returns the element referenced by a local reference, such as
+// "#/components/schemas/Media".
+func resolveRef(doc map[string]interface{}, ref string) (map[string]interface{}, error) {
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("unsupported reference: %s", ref)
+	}
+
+	current := doc
+
+	for _, segment := range strings.Split(ref[2:], "/") {
+		next, ok := current[segment].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("reference not found: %s", ref)
+		}
+
+		current = next
+	}
+
+	return current, nil
+}
+
+// deref follows the reference of an element, if any
+func deref(doc, element map[string]interface{}) (map[string]interface{}, error) {
+	ref, ok := element["$ref"].(string)
+	if !ok {
+		return element, nil
+	}
+
+	return resolveRef(doc, ref)
+}
+
+// validateResponse checks that a response is described by the operation of
+// the document, and that its body matches the schema.
+func validateResponse(doc map[string]interface{}, path, method string, rr *httptest.ResponseRecorder) error {
+	paths := doc["paths"].(map[string]interface{})
+
+	item, ok := paths[path].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("path not found: %s", path)
+	}
+
+	operation, ok := item[strings.ToLower(method)].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("operation not found: %s %s", method, path)
+	}
+
+	responses := operation["responses"].(map[string]interface{})
+
+	response, ok := responses[strconv.Itoa(rr.Code)].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("response %d not described", rr.Code)
+	}
+
+	response, err := deref(doc, response)
+	if err != nil {
+		return err
+	}
+
+	content, ok := response["content"].(map[string]interface{})
+	if !ok {
+		if rr.Body.Len() != 0 {
+			return fmt.Errorf("unexpected body: %s", rr.Body.String())
+		}
+
+		return nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(rr.Header().Get("Content-Type"))
+	if err != nil {
+		return fmt.Errorf("failed to parse content type: %v", err)
+	}
+
+	media, ok := content[mediaType].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("content type %s not described", mediaType)
+	}
+
+	if !strings.HasSuffix(mediaType, "json") {
+		return nil
+	}
+
+	var body interface{}
+
+	err = json.Unmarshal(rr.Body.Bytes(), &body)
+	if err != nil {
+		return fmt.Errorf("failed to decode body: %v", err)
+	}
+
+	return validateSchema(doc, media["schema"].(map[string]interface{}), body, "body")
+}
+
+// validateSchema checks a value against a schema. It supports the subset of
+// the schema object used by the document.
+func validateSchema(doc, schema map[string]interface{}, value interface{}, at string) error {
+	schema, err := deref(doc, schema)
+	if err != nil {
+		return err
+	}
+
+	if value == nil {
+		if schema["nullable"] == true {
+			return nil
+		}
+
+		return fmt.Errorf("%s: must not be null", at)
+	}
+
+	enum, ok := schema["enum"].([]interface{})
+	if ok {
+		found := false
+
+		for _, e := range enum {
+			if e == value {
+				found = true
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("%s: %v not in %v", at, value, enum)
+		}
+	}
+
+	switch schema["type"] {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected an object", at)
+		}
+
+		properties, _ := schema["properties"].(map[string]interface{})
+
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			_, ok := object[name.(string)]
+			if !ok {
+				return fmt.Errorf("%s: missing property %s", at, name)
+			}
+		}
+
+		names := make([]string, 0, len(object))
+		for name := range object {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		for _, name := range names {
+			property, ok := properties[name].(map[string]interface{})
+			if !ok {
+				if schema["additionalProperties"] == false {
+					return fmt.Errorf("%s: unexpected property %s", at, name)
+				}
+
+				continue
+			}
+
+			err := validateSchema(doc, property, object[name], at+"."+name)
+			if err != nil {
+				return err
+			}
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected an array", at)
+		}
+
+		items := schema["items"].(map[string]interface{})
+
+		for i, e := range array {
+			err := validateSchema(doc, items, e, fmt.Sprintf("%s[%d]", at, i))
+			if err != nil {
+				return err
+			}
+		}
+	case "string":
+		_, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s: expected a string", at)
+		}
+	case "integer":
+		number, ok := value.(float64)
+		if !ok || number != float64(int64(number)) {
+			return fmt.Errorf("%s: expected an integer", at)
+		}
+	case "number":
+		_, ok := value.(float64)
+		if !ok {
+			return fmt.Errorf("%s: expected a number", at)
+		}
+	case "boolean":
+		_, ok := value.(bool)
+		if !ok {
+			return fmt.Errorf("%s: expected a boolean", at)
+		}
+	}
+
+	return nil
+}
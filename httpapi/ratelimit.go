@@ -0,0 +1,223 @@
+package httpapi
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sweepInterval defines how often idle buckets are removed
+const sweepInterval = time.Minute
+
+// RateLimit defines the token bucket parameters applied to each client of a
+// route group. A client can make Burst requests at once, and then Rate requests
+// per second. The limit is disabled if Rate is zero.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// WithRateLimit sets the rate limit of a route group. Groups are "api" for the
+// JSON API and "images" for the images.
+func WithRateLimit(group string, limit RateLimit) Option {
+	return func(c *config) {
+		c.rateLimits[group] = limit
+	}
+}
+
+// WithTrustedProxies sets the proxies that are trusted to provide the client's
+// IP with the X-Forwarded-For header. By default no proxy is trusted.
+func WithTrustedProxies(proxies ...*net.IPNet) Option {
+	return func(c *config) {
+		c.trustedProxies = proxies
+	}
+}
+
+// ParseTrustedProxies parses a list of IPs or CIDRs, such as "127.0.0.1" or
+// "10.0.0.0/8".
+func ParseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	res := make([]*net.IPNet, len(proxies))
+
+	for i, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP '%s'", proxy)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+
+			res[i] = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR '%s': %v", proxy, err)
+		}
+
+		res[i] = ipnet
+	}
+
+	return res, nil
+}
+
+// newRateLimiter returns a new initialized rate limiter
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+
+	return &rateLimiter{
+		limit:     limit,
+		buckets:   make(map[string]*bucket),
+		now:       time.Now,
+		lastSweep: time.Now(),
+	}
+}
+
+// rateLimiter implements a token bucket rate limiter, with one bucket per key.
+type rateLimiter struct {
+	sync.Mutex
+	limit     RateLimit
+	buckets   map[string]*bucket
+	now       func() time.Time
+	lastSweep time.Time
+}
+
+// bucket defines a token bucket
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token from the key's bucket. If there is no token left, it
+// returns false and the time to wait until a token is available.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	now := l.now()
+
+	if now.Sub(l.lastSweep) > sweepInterval {
+		l.sweep(now)
+	}
+
+	b, found := l.buckets[key]
+	if !found {
+		b = &bucket{
+			tokens: float64(l.limit.Burst),
+			last:   now,
+		}
+		l.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.limit.Rate
+	b.tokens = math.Min(b.tokens, float64(l.limit.Burst))
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.tokens) / l.limit.Rate * float64(time.Second))
+
+	return false, wait
+}
+
+// sweep removes the buckets that are full, which is the same as not having a
+// bucket. Must be called with the lock held.
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		tokens := b.tokens + now.Sub(b.last).Seconds()*l.limit.Rate
+		if tokens >= float64(l.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+
+	l.lastSweep = now
+}
+
+// rateLimiting is a utility function that limits the rate of requests per
+// client IP.
+func rateLimiting(limiter *rateLimiter, trusted []*net.IPNet) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if limiter.limit.Rate <= 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ok, wait := limiter.allow(clientIP(r, trusted))
+			if !ok {
+				retry := int(math.Ceil(wait.Seconds()))
+				w.Header().Set("Retry-After", strconv.Itoa(retry))
+				http.Error(w, "too many requests", http.StatusTooManyRequests)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// clientIP returns the IP of the client. The X-Forwarded-For header is only
+// used if the request comes from a trusted proxy, in which case we take the
+// right-most IP that is not a trusted proxy.
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+
+	if !isTrusted(remote, trusted) {
+		return remote
+	}
+
+	forwarded := []string{}
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+
+	client := remote
+
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(ip) == nil {
+			break
+		}
+
+		client = ip
+
+		if !isTrusted(ip, trusted) {
+			break
+		}
+	}
+
+	return client
+}
+
+// isTrusted tells if an IP is contained in one of the trusted networks.
+func isTrusted(addr string, trusted []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, ipnet := range trusted {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,140 @@
+package httpapi
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	limiter := newRateLimiter(RateLimit{Rate: 2, Burst: 3})
+
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		ok, _ := limiter.allow("a")
+		require.True(t, ok)
+	}
+
+	ok, wait := limiter.allow("a")
+	require.False(t, ok)
+	require.Equal(t, 500*time.Millisecond, wait)
+
+	// another client has its own bucket
+	ok, _ = limiter.allow("b")
+	require.True(t, ok)
+
+	// after half a second, a new token is available
+	now = now.Add(500 * time.Millisecond)
+
+	ok, _ = limiter.allow("a")
+	require.True(t, ok)
+
+	ok, _ = limiter.allow("a")
+	require.False(t, ok)
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	limiter := newRateLimiter(RateLimit{Rate: 1, Burst: 2})
+
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+
+	limiter.allow("a")
+	limiter.allow("b")
+	require.Len(t, limiter.buckets, 2)
+
+	now = now.Add(sweepInterval + time.Second)
+
+	limiter.allow("c")
+	require.Len(t, limiter.buckets, 1)
+}
+
+func TestRateLimiting(t *testing.T) {
+	limiter := newRateLimiter(RateLimit{Rate: 0.5, Burst: 1})
+	handler := rateLimiting(limiter, nil)(okHandler())
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "http://example.com/api/medias", nil)
+	require.NoError(t, err)
+
+	req.RemoteAddr = "1.2.3.4:1234"
+
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusTooManyRequests, rr.Result().StatusCode)
+	require.Equal(t, "2", rr.Header().Get("Retry-After"))
+}
+
+func TestRateLimitingDisabled(t *testing.T) {
+	limiter := newRateLimiter(RateLimit{})
+	handler := rateLimiting(limiter, nil)(okHandler())
+
+	for i := 0; i < 10; i++ {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "http://example.com/api/medias", nil)
+		require.NoError(t, err)
+
+		handler.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := ParseTrustedProxies([]string{"127.0.0.1", "10.0.0.0/8"})
+	require.NoError(t, err)
+
+	table := []struct {
+		remote    string
+		forwarded []string
+		expected  string
+	}{
+		// not from a trusted proxy, the header is ignored
+		{"1.2.3.4:80", []string{"5.6.7.8"}, "1.2.3.4"},
+		{"127.0.0.1:80", nil, "127.0.0.1"},
+		{"127.0.0.1:80", []string{"5.6.7.8"}, "5.6.7.8"},
+		// the left-most IP could be spoofed by the client
+		{"127.0.0.1:80", []string{"9.9.9.9, 5.6.7.8"}, "5.6.7.8"},
+		{"127.0.0.1:80", []string{"9.9.9.9, 5.6.7.8, 10.0.0.2"}, "5.6.7.8"},
+		{"127.0.0.1:80", []string{"9.9.9.9", "5.6.7.8"}, "5.6.7.8"},
+		{"127.0.0.1:80", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"127.0.0.1:80", []string{"garbage"}, "127.0.0.1"},
+	}
+
+	for _, entry := range table {
+		req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+		require.NoError(t, err)
+
+		req.RemoteAddr = entry.remote
+		for _, header := range entry.forwarded {
+			req.Header.Add("X-Forwarded-For", header)
+		}
+
+		require.Equal(t, entry.expected, clientIP(req, trusted), entry)
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"127.0.0.1", "::1", "192.168.0.0/16"})
+	require.NoError(t, err)
+	require.Len(t, proxies, 3)
+
+	require.True(t, proxies[0].Contains(net.ParseIP("127.0.0.1")))
+	require.False(t, proxies[0].Contains(net.ParseIP("127.0.0.2")))
+	require.True(t, proxies[1].Contains(net.ParseIP("::1")))
+	require.True(t, proxies[2].Contains(net.ParseIP("192.168.3.4")))
+
+	_, err = ParseTrustedProxies([]string{"x"})
+	require.EqualError(t, err, "invalid IP 'x'")
+
+	_, err = ParseTrustedProxies([]string{"1.2.3.4/99"})
+	require.EqualError(t, err, "invalid CIDR '1.2.3.4/99': invalid CIDR address: 1.2.3.4/99")
+}
@@ -0,0 +1,223 @@
+package httpapi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nkcr/OSIA/images"
+)
+
+// imageTypes contains the content type of the images that can be resized, by
+// extension.
+var imageTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+}
+
+// encodedTypes contains the content types in which images can be resized
+var encodedTypes = []string{"image/jpeg", "image/png"}
+
+// imageExts contains the extension of the resized images, by content type
+var imageExts = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+}
+
+// ImageSizes defines the widths to which images can be resized. Only those
+// widths are allowed, so that clients can't fill the cache with every possible
+// size.
+type ImageSizes struct {
+	// Widths contains the allowed values of the "w" parameter
+	Widths []int
+	// Presets contains named widths, used with the "size" parameter. They are
+	// allowed as "w" too.
+	Presets map[string]int
+}
+
+// DefaultImageSizes returns the default image sizes
+func DefaultImageSizes() ImageSizes {
+	return ImageSizes{
+		Widths: []int{150, 320, 480, 640, 750, 1080},
+		Presets: map[string]int{
+			"thumb":  150,
+			"small":  320,
+			"medium": 640,
+			"large":  1080,
+		},
+	}
+}
+
+// WithImageSizes sets the sizes to which images can be resized, and the folder
+// where resized images are cached. By default, the cache is next to the images
+// folder, as "<imagesfolder>-resized".
+func WithImageSizes(sizes ImageSizes, cacheDir string) Option {
+	return func(c *config) {
+		c.imageSizes = sizes
+		c.imageCache = cacheDir
+	}
+}
+
+// allowed returns the sorted list of allowed widths
+func (s ImageSizes) allowed() []int {
+	widths := append([]int{}, s.Widths...)
+
+	for _, width := range s.Presets {
+		if !containsInt(widths, width) {
+			widths = append(widths, width)
+		}
+	}
+
+	sort.Ints(widths)
+
+	return widths
+}
+
+// parse returns the width requested with the "w" or "size" parameters
+func (s ImageSizes) parse(w, size string) (int, error) {
+	if w != "" && size != "" {
+		return 0, errors.New("w and size can't be used together")
+	}
+
+	if size != "" {
+		width, ok := s.Presets[size]
+		if !ok {
+			return 0, fmt.Errorf("unknown size: %s", size)
+		}
+
+		return width, nil
+	}
+
+	width, err := strconv.Atoi(w)
+	if err != nil || !containsInt(s.allowed(), width) {
+		return 0, fmt.Errorf("bad w value: %s, allowed widths are %v", w, s.allowed())
+	}
+
+	return width, nil
+}
+
+// resized defines a handler that serves resized images when the "w" or "size"
+// parameter is set. It falls back on next otherwise, or if the file is not an
+// image, such as a video. Resized images are cached in cacheDir, and are never
+// bigger than the original. They are served in the original format, unless the
+// client doesn't accept it.
+func resized(imagesFolder, cacheDir string, sizes ImageSizes, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		if !query.Has("w") && !query.Has("size") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		width, err := sizes.parse(query.Get("w"), query.Get("size"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		name := path.Clean("/" + r.URL.Path)
+		ext := path.Ext(name)
+
+		srcType := imageTypes[strings.ToLower(ext)]
+		if srcType == "" {
+			http.Error(w, "only images can be resized", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept")
+
+		supported := []string{srcType}
+		for _, contentType := range encodedTypes {
+			if contentType != srcType {
+				supported = append(supported, contentType)
+			}
+		}
+
+		contentType := negotiateImageType(r.Header.Get("Accept"), supported)
+		if contentType == "" {
+			http.Error(w, "no acceptable image format", http.StatusNotAcceptable)
+			return
+		}
+
+		srcPath := filepath.Join(imagesFolder, filepath.FromSlash(name))
+
+		srcStat, err := os.Stat(srcPath)
+		if err != nil || srcStat.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+
+		cachePath := filepath.Join(cacheDir, filepath.FromSlash(strings.TrimSuffix(name, ext))+
+			"-"+strconv.Itoa(width)+imageExts[contentType])
+
+		// the cache is refreshed if the original changed
+		stat, err := os.Stat(cachePath)
+		if err != nil || stat.ModTime().Before(srcStat.ModTime()) {
+			err = images.Resize(srcPath, cachePath, width, contentType)
+			if errors.Is(err, images.ErrNotImage) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if err != nil {
+				http.Error(w, fmt.Sprintf("failed to resize image: %v", err),
+					http.StatusInternalServerError)
+				return
+			}
+		}
+
+		file, err := os.Open(cachePath)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to open image: %v", err),
+				http.StatusInternalServerError)
+			return
+		}
+
+		defer file.Close()
+
+		stat, err = file.Stat()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to stat image: %v", err),
+				http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentType)
+
+		http.ServeContent(w, r, name, stat.ModTime(), file)
+	})
+}
+
+// negotiateImageType returns the supported content type with the highest
+// quality value from an Accept header. The order of supported types is used to
+// break ties. The first type is returned if there is no header, and an empty
+// string if no type is acceptable.
+func negotiateImageType(header string, supported []string) string {
+	if header == "" {
+		return supported[0]
+	}
+
+	return negotiate(header, supported, func(contentType string) []string {
+		major, _, _ := strings.Cut(contentType, "/")
+		return []string{major + "/*", "*/*"}
+	})
+}
+
+// containsInt returns true if the element is in the slice
+func containsInt(elements []int, element int) bool {
+	for _, e := range elements {
+		if e == element {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,248 @@
+package httpapi
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResized(t *testing.T) {
+	imagesFolder, cacheDir := newImagesFolder(t)
+	handler := resized(imagesFolder, cacheDir, DefaultImageSizes(), nil)
+
+	rr := imageRequest(t, handler, "/a.jpg?w=320", "")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, "image/jpeg", rr.Header().Get("Content-Type"))
+	require.Equal(t, "Accept", rr.Header().Get("Vary"))
+
+	require.Equal(t, image.Pt(320, 240), decodeSize(t, rr.Body.Bytes()))
+
+	// the resized image is cached
+	cached, err := os.ReadFile(filepath.Join(cacheDir, "a-320.jpg"))
+	require.NoError(t, err)
+	require.Equal(t, rr.Body.Bytes(), cached)
+
+	rr = imageRequest(t, handler, "/a.jpg?size=thumb", "")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, image.Pt(150, 113), decodeSize(t, rr.Body.Bytes()))
+
+	// images are not enlarged
+	rr = imageRequest(t, handler, "/a.jpg?w=1080", "")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, image.Pt(800, 600), decodeSize(t, rr.Body.Bytes()))
+
+	original, err := os.ReadFile(filepath.Join(imagesFolder, "a.jpg"))
+	require.NoError(t, err)
+	require.Equal(t, original, rr.Body.Bytes())
+}
+
+func TestResizedCache(t *testing.T) {
+	imagesFolder, cacheDir := newImagesFolder(t)
+	handler := resized(imagesFolder, cacheDir, DefaultImageSizes(), nil)
+
+	cachePath := filepath.Join(cacheDir, "a-320.jpg")
+
+	err := os.WriteFile(cachePath, []byte("cached"), os.ModePerm)
+	require.NoError(t, err)
+
+	rr := imageRequest(t, handler, "/a.jpg?w=320", "")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, "cached", rr.Body.String())
+
+	// the cache is refreshed when the original changes
+	later := time.Now().Add(time.Hour)
+
+	err = os.Chtimes(filepath.Join(imagesFolder, "a.jpg"), later, later)
+	require.NoError(t, err)
+
+	rr = imageRequest(t, handler, "/a.jpg?w=320", "")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, image.Pt(320, 240), decodeSize(t, rr.Body.Bytes()))
+}
+
+func TestResizedFormat(t *testing.T) {
+	imagesFolder, cacheDir := newImagesFolder(t)
+	handler := resized(imagesFolder, cacheDir, DefaultImageSizes(), nil)
+
+	rr := imageRequest(t, handler, "/a.jpg?w=320", "image/webp,image/*;q=0.8")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, "image/jpeg", rr.Header().Get("Content-Type"))
+
+	rr = imageRequest(t, handler, "/a.jpg?w=320", "image/png")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, "image/png", rr.Header().Get("Content-Type"))
+
+	_, err := png.Decode(rr.Body)
+	require.NoError(t, err)
+
+	require.FileExists(t, filepath.Join(cacheDir, "a-320.png"))
+
+	rr = imageRequest(t, handler, "/a.jpg?w=320", "image/webp")
+	require.Equal(t, http.StatusNotAcceptable, rr.Result().StatusCode)
+}
+
+func TestResizedErrors(t *testing.T) {
+	imagesFolder, cacheDir := newImagesFolder(t)
+
+	// a truncated image
+	buf, err := os.ReadFile(filepath.Join(imagesFolder, "a.jpg"))
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(imagesFolder, "b.jpg"), buf[:len(buf)/2], os.ModePerm)
+	require.NoError(t, err)
+
+	handler := resized(imagesFolder, cacheDir, DefaultImageSizes(), nil)
+
+	table := []struct {
+		url    string
+		status int
+	}{
+		{"/a.jpg?w=333", http.StatusBadRequest},
+		{"/a.jpg?w=abc", http.StatusBadRequest},
+		{"/a.jpg?w=", http.StatusBadRequest},
+		{"/a.jpg?size=huge", http.StatusBadRequest},
+		{"/a.jpg?w=320&size=thumb", http.StatusBadRequest},
+		{"/a.mp4?w=320", http.StatusBadRequest},
+		{"/x.jpg?w=320", http.StatusNotFound},
+		{"/../a.jpg?w=320", http.StatusOK},
+		{"/b.jpg?w=320", http.StatusInternalServerError},
+	}
+
+	for _, entry := range table {
+		rr := imageRequest(t, handler, entry.url, "")
+		require.Equal(t, entry.status, rr.Result().StatusCode, entry.url)
+	}
+
+	// nothing is left in the cache after a failure
+	entries, err := os.ReadDir(cacheDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "a-320.jpg", entries[0].Name())
+}
+
+func TestResizedFallback(t *testing.T) {
+	imagesFolder, cacheDir := newImagesFolder(t)
+
+	// videos are saved with the ".jpg" extension too
+	err := os.WriteFile(filepath.Join(imagesFolder, "b.jpg"), []byte("fake video"), os.ModePerm)
+	require.NoError(t, err)
+
+	calls := 0
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	})
+
+	handler := resized(imagesFolder, cacheDir, DefaultImageSizes(), next)
+
+	imageRequest(t, handler, "/a.jpg", "")
+	require.Equal(t, 1, calls)
+
+	imageRequest(t, handler, "/b.jpg?w=320", "")
+	require.Equal(t, 2, calls)
+
+	entries, err := os.ReadDir(cacheDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 0)
+}
+
+func TestImageSizesParse(t *testing.T) {
+	sizes := ImageSizes{
+		Widths:  []int{300, 100},
+		Presets: map[string]int{"thumb": 50},
+	}
+
+	require.Equal(t, []int{50, 100, 300}, sizes.allowed())
+
+	width, err := sizes.parse("100", "")
+	require.NoError(t, err)
+	require.Equal(t, 100, width)
+
+	// presets are allowed as widths
+	width, err = sizes.parse("50", "")
+	require.NoError(t, err)
+	require.Equal(t, 50, width)
+
+	width, err = sizes.parse("", "thumb")
+	require.NoError(t, err)
+	require.Equal(t, 50, width)
+
+	_, err = sizes.parse("200", "")
+	require.EqualError(t, err, "bad w value: 200, allowed widths are [50 100 300]")
+}
+
+func TestNegotiateImageType(t *testing.T) {
+	supported := []string{"image/jpeg", "image/png"}
+
+	table := []struct {
+		header   string
+		expected string
+	}{
+		{"", "image/jpeg"},
+		{"*/*", "image/jpeg"},
+		{"image/*", "image/jpeg"},
+		{"image/png", "image/png"},
+		{"image/png, image/jpeg", "image/jpeg"},
+		{"image/png, image/jpeg;q=0.5", "image/png"},
+		{"image/avif,image/webp,*/*;q=0.8", "image/jpeg"},
+		{"image/*, image/jpeg;q=0", "image/png"},
+		{"image/webp", ""},
+		{"text/html", ""},
+	}
+
+	for _, entry := range table {
+		require.Equal(t, entry.expected, negotiateImageType(entry.header, supported), entry.header)
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+// newImagesFolder returns an images folder with an 800x600 "a.jpg" image, and a
+// cache folder.
+func newImagesFolder(t *testing.T) (string, string) {
+	imagesFolder := t.TempDir()
+	cacheDir := t.TempDir()
+
+	img := image.NewRGBA(image.Rect(0, 0, 800, 600))
+
+	f, err := os.Create(filepath.Join(imagesFolder, "a.jpg"))
+	require.NoError(t, err)
+
+	defer f.Close()
+
+	err = jpeg.Encode(f, img, nil)
+	require.NoError(t, err)
+
+	return imagesFolder, cacheDir
+}
+
+func imageRequest(t *testing.T, handler http.Handler, url, accept string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "http://example.com"+url, nil)
+	require.NoError(t, err)
+
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+
+	handler.ServeHTTP(rr, req)
+
+	return rr
+}
+
+func decodeSize(t *testing.T, buf []byte) image.Point {
+	config, _, err := image.DecodeConfig(bytes.NewReader(buf))
+	require.NoError(t, err)
+
+	return image.Pt(config.Width, config.Height)
+}
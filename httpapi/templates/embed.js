@@ -0,0 +1,48 @@
+// OSIA embed script. Replaces every element with the "osia-embed" class by an
+// iframe that displays the latest posts. Options are read from data
+// attributes: data-count, data-columns, data-theme and data-captions.
+(function () {
+  // without a public URL, OSIA is reached where this script was loaded from
+  var base = {{.}} || document.currentScript.src.replace(/\/embed\.js([?#].*)?$/, "");
+  var origin = new URL(base).origin;
+  var frames = [];
+
+  var elements = document.querySelectorAll(".osia-embed");
+
+  for (var i = 0; i < elements.length; i++) {
+    var element = elements[i];
+    var params = [];
+
+    ["count", "columns", "theme", "captions"].forEach(function (name) {
+      var value = element.getAttribute("data-" + name);
+      if (value !== null) {
+        params.push(name + "=" + encodeURIComponent(value));
+      }
+    });
+
+    var iframe = document.createElement("iframe");
+    iframe.src = base + "/embed" + (params.length ? "?" + params.join("&") : "");
+    iframe.title = "Instagram posts";
+    iframe.loading = "lazy";
+    iframe.style.width = "100%";
+    iframe.style.border = "0";
+    iframe.style.overflow = "hidden";
+    iframe.setAttribute("scrolling", "no");
+
+    element.innerHTML = "";
+    element.appendChild(iframe);
+    frames.push(iframe);
+  }
+
+  window.addEventListener("message", function (event) {
+    if (event.origin !== origin || !event.data || event.data.osia !== "resize") {
+      return;
+    }
+
+    for (var i = 0; i < frames.length; i++) {
+      if (frames[i].contentWindow === event.source) {
+        frames[i].style.height = event.data.height + "px";
+      }
+    }
+  });
+})();
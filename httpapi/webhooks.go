@@ -0,0 +1,111 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/nkcr/OSIA/webhooks"
+	"github.com/tidwall/buntdb"
+)
+
+// defaultDeliveries and maxDeliveries are the default and maximum number of
+// deliveries returned by the delivery log.
+const (
+	defaultDeliveries = 50
+	maxDeliveries     = 500
+)
+
+// listWebhooks writes the webhooks, without their secret
+func listWebhooks(w http.ResponseWriter, db *buntdb.DB) {
+	list, err := webhooks.ListWebhooks(db)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list webhooks: %v", err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// createWebhook creates a webhook. It expects a body like
+// {"url": "https://example.com/hook", "secret": "...", "events": ["media.added"]}
+// where the secret and the events are optional. The response contains the
+// secret, which is not returned afterward.
+func createWebhook(w http.ResponseWriter, r *http.Request, db *buntdb.DB) {
+	var body struct {
+		URL    string   `json:"url"`
+		Secret string   `json:"secret"`
+		Events []string `json:"events"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to decode body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	webhook, err := webhooks.CreateWebhook(db, body.URL, body.Secret, body.Events)
+	if errors.Is(err, webhooks.ErrInvalid) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to create webhook: %v", err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, webhook)
+}
+
+// deleteWebhook deletes a webhook and its pending deliveries
+func deleteWebhook(w http.ResponseWriter, db *buntdb.DB, id string) {
+	err := webhooks.DeleteWebhook(db, id)
+	if errors.Is(err, webhooks.ErrNotFound) {
+		http.Error(w, fmt.Sprintf("%v: %s", err, id), http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to delete webhook: %v", err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listDeliveries writes the most recent deliveries first. The "webhook" query
+// parameter only keeps the deliveries of a webhook, and "count" sets the
+// maximum number of deliveries.
+func listDeliveries(w http.ResponseWriter, r *http.Request, db *buntdb.DB) {
+	count := defaultDeliveries
+
+	countStr := r.URL.Query().Get("count")
+	if countStr != "" {
+		c, err := strconv.Atoi(countStr)
+		if err != nil || c < 1 {
+			http.Error(w, "bad count value: "+countStr, http.StatusBadRequest)
+			return
+		}
+
+		count = c
+	}
+
+	if count > maxDeliveries {
+		count = maxDeliveries
+	}
+
+	deliveries, err := webhooks.ListDeliveries(db, r.URL.Query().Get("webhook"), count)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list deliveries: %v", err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, deliveries)
+}
@@ -0,0 +1,144 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/nkcr/OSIA/events"
+	"github.com/nkcr/OSIA/instagram/types"
+	"github.com/nkcr/OSIA/webhooks"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminWebhooks(t *testing.T) {
+	mediaStore, db := newMediasStore(t)
+	handler := adminAPI(mediaStore, db, t.TempDir(), nil, nil)
+
+	rr := adminRequest(t, handler, http.MethodPost, "/admin/api/webhooks",
+		`{"url": "https://example.com/hook", "secret": "secret", "events": ["media.added"]}`)
+	require.Equal(t, http.StatusCreated, rr.Result().StatusCode)
+
+	var webhook webhooks.Webhook
+
+	err := json.NewDecoder(rr.Body).Decode(&webhook)
+	require.NoError(t, err)
+
+	require.Equal(t, "https://example.com/hook", webhook.URL)
+	require.Equal(t, "secret", webhook.Secret)
+	require.Equal(t, []string{events.MediaAdded}, webhook.Events)
+
+	// the secret is generated if not provided, and only returned on creation
+	rr = adminRequest(t, handler, http.MethodPost, "/admin/api/webhooks",
+		`{"url": "https://example.com/other"}`)
+	require.Equal(t, http.StatusCreated, rr.Result().StatusCode)
+	require.Contains(t, rr.Body.String(), `"secret":"whsec_`)
+
+	rr = adminRequest(t, handler, http.MethodGet, "/admin/api/webhooks", "")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	require.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	require.NotContains(t, rr.Body.String(), "secret")
+
+	var list []webhooks.Webhook
+
+	err = json.NewDecoder(rr.Body).Decode(&list)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+
+	rr = adminRequest(t, handler, http.MethodDelete, "/admin/api/webhooks/"+webhook.ID, "")
+	require.Equal(t, http.StatusNoContent, rr.Result().StatusCode)
+
+	rr = adminRequest(t, handler, http.MethodDelete, "/admin/api/webhooks/"+webhook.ID, "")
+	require.Equal(t, http.StatusNotFound, rr.Result().StatusCode)
+
+	list, err = webhooks.ListWebhooks(db)
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+
+	// webhooks are not medias
+	require.Equal(t, []string{}, publicIDs(t, mediaStore))
+}
+
+func TestAdminWebhooksInvalid(t *testing.T) {
+	mediaStore, db := newMediasStore(t)
+	handler := adminAPI(mediaStore, db, t.TempDir(), nil, nil)
+
+	for _, body := range []string{
+		`{`,
+		`{"url": "ftp://example.com"}`,
+		`{"url": "https://example.com", "events": ["media.unknown"]}`,
+	} {
+		rr := adminRequest(t, handler, http.MethodPost, "/admin/api/webhooks", body)
+		require.Equal(t, http.StatusBadRequest, rr.Result().StatusCode, body)
+	}
+
+	rr := adminRequest(t, handler, http.MethodPut, "/admin/api/webhooks", "")
+	require.Equal(t, http.StatusMethodNotAllowed, rr.Result().StatusCode)
+	require.Equal(t, "GET, POST", rr.Header().Get("Allow"))
+
+	rr = adminRequest(t, handler, http.MethodPost, "/admin/api/webhooks/deliveries", "")
+	require.Equal(t, http.StatusMethodNotAllowed, rr.Result().StatusCode)
+
+	rr = adminRequest(t, handler, http.MethodGet, "/admin/api/webhooks/abc", "")
+	require.Equal(t, http.StatusMethodNotAllowed, rr.Result().StatusCode)
+
+	rr = adminRequest(t, handler, http.MethodGet, "/admin/api/webhooks/deliveries?count=0", "")
+	require.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+}
+
+// Moderation events are queued for the webhooks and listed in the delivery
+// log.
+func TestAdminWebhookDeliveries(t *testing.T) {
+	mediaStore, db := newMediasStore(t, "a", "b")
+	dispatcher := webhooks.NewDispatcher(db, nil, zerolog.New(io.Discard))
+	handler := adminAPI(mediaStore, db, t.TempDir(), nil, events.Publishers{dispatcher})
+
+	first, err := webhooks.CreateWebhook(db, "https://example.com/first", "", nil)
+	require.NoError(t, err)
+
+	_, err = webhooks.CreateWebhook(db, "https://example.com/second", "",
+		[]string{events.MediaDeleted})
+	require.NoError(t, err)
+
+	rr := adminRequest(t, handler, http.MethodPost, "/admin/api/medias/a/hide", "")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	rr = adminRequest(t, handler, http.MethodDelete, "/admin/api/medias/b", "")
+	require.Equal(t, http.StatusNoContent, rr.Result().StatusCode)
+
+	rr = adminRequest(t, handler, http.MethodGet, "/admin/api/webhooks/deliveries", "")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	var deliveries []webhooks.Delivery
+
+	err = json.NewDecoder(rr.Body).Decode(&deliveries)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 3)
+
+	for _, delivery := range deliveries {
+		require.Equal(t, webhooks.StatusPending, delivery.Status)
+	}
+
+	rr = adminRequest(t, handler, http.MethodGet,
+		"/admin/api/webhooks/deliveries?count=1&webhook="+first.ID, "")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	err = json.NewDecoder(rr.Body).Decode(&deliveries)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	require.Equal(t, first.ID, deliveries[0].Webhook)
+	require.Equal(t, events.MediaDeleted, deliveries[0].Event)
+	require.Contains(t, string(deliveries[0].Payload), `"data":{"id":"b"}`)
+
+	// deliveries are not medias
+	rr = adminRequest(t, handler, http.MethodGet, "/admin/api/medias", "")
+	require.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	var medias []types.Media
+
+	err = json.NewDecoder(rr.Body).Decode(&medias)
+	require.NoError(t, err)
+	require.Len(t, medias, 1)
+}
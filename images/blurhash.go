@@ -0,0 +1,139 @@
+package images
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"strings"
+)
+
+// base83 is the alphabet of the BlurHash encoding
+const base83 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// blurHash encodes an image as a BlurHash with the given number of horizontal
+// and vertical components, between 1 and 9. The image should be small, since
+// every pixel is read for every component. See
+// https://github.com/woltapp/blurhash/blob/master/Algorithm.md.
+func blurHash(img image.Image, xComponents, yComponents int) string {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	// the pixels, in linear RGB
+	pixels := make([][3]float64, width*height)
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.NRGBAModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+
+			pixels[y*width+x] = [3]float64{
+				sRGBToLinear(c.R), sRGBToLinear(c.G), sRGBToLinear(c.B),
+			}
+		}
+	}
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+
+			var factor [3]float64
+
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := normalisation *
+						math.Cos(math.Pi*float64(i)*float64(x)/float64(width)) *
+						math.Cos(math.Pi*float64(j)*float64(y)/float64(height))
+
+					for k := range factor {
+						factor[k] += basis * pixels[y*width+x][k]
+					}
+				}
+			}
+
+			for k := range factor {
+				factor[k] /= float64(width * height)
+			}
+
+			factors = append(factors, factor)
+		}
+	}
+
+	var sb strings.Builder
+
+	sb.WriteString(encode83((xComponents-1)+(yComponents-1)*9, 1))
+
+	dc, ac := factors[0], factors[1:]
+
+	maximum := 1.0
+
+	if len(ac) == 0 {
+		sb.WriteString(encode83(0, 1))
+	} else {
+		actualMax := 0.0
+
+		for _, factor := range ac {
+			for _, v := range factor {
+				actualMax = math.Max(actualMax, math.Abs(v))
+			}
+		}
+
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maximum = float64(quantisedMax+1) / 166
+
+		sb.WriteString(encode83(quantisedMax, 1))
+	}
+
+	sb.WriteString(encode83(linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4))
+
+	for _, factor := range ac {
+		value := 0
+
+		for _, v := range factor {
+			quantised := int(math.Max(0, math.Min(18, math.Floor(signPow(v/maximum, 0.5)*9+9.5))))
+			value = value*19 + quantised
+		}
+
+		sb.WriteString(encode83(value, 2))
+	}
+
+	return sb.String()
+}
+
+// encode83 encodes a value with the given number of base83 digits
+func encode83(value, length int) string {
+	buf := make([]byte, length)
+
+	for i := length - 1; i >= 0; i-- {
+		buf[i] = base83[value%83]
+		value /= 83
+	}
+
+	return string(buf)
+}
+
+func sRGBToLinear(value uint8) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+// signPow raises the absolute value to the given power, keeping the sign
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
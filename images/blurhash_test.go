@@ -0,0 +1,58 @@
+package images
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlurHash(t *testing.T) {
+	gradient := image.NewGray(image.Rect(0, 0, 32, 16))
+
+	for x := 0; x < 32; x++ {
+		for y := 0; y < 16; y++ {
+			gradient.SetGray(x, y, color.Gray{Y: uint8(x * 8)})
+		}
+	}
+
+	table := []struct {
+		img      image.Image
+		expected string
+	}{
+		{solidImage(20, 10, color.Black), "L00000fQfQfQfQfQfQfQfQfQfQfQ"},
+		{solidImage(20, 10, color.White), "LWTSUA-;fQ-;~qoffQoffQfQfQfQ"},
+		{solidImage(20, 10, color.RGBA{R: 255, A: 255}), "LWTI:j,YfQ,Y|co1fQo1fQfQfQfQ"},
+		{gradient, "LxH2cr00xuWBt7WBj[ayfQfQfQfQ"},
+	}
+
+	for i, entry := range table {
+		require.Equal(t, entry.expected, blurHash(entry.img, 4, 3), i)
+	}
+
+	// without AC components
+	require.Equal(t, "00TSUA", blurHash(solidImage(5, 5, color.White), 1, 1))
+}
+
+func TestEncode83(t *testing.T) {
+	require.Equal(t, "0", encode83(0, 1))
+	require.Equal(t, "~", encode83(82, 1))
+	require.Equal(t, "10", encode83(83, 2))
+	require.Equal(t, "fQ", encode83(9*19*19+9*19+9, 2))
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+func solidImage(width, height int, c color.Color) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, c)
+		}
+	}
+
+	return img
+}
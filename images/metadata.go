@@ -0,0 +1,115 @@
+package images
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// sampleSize is the maximum size of the thumbnail from which the dominant color
+// and the BlurHash are computed. Bigger images would be slower without being
+// more accurate.
+const sampleSize = 32
+
+// Metadata contains the information extracted from an image, which lets pages
+// reserve the space of an image, and display a placeholder, before it loads.
+type Metadata struct {
+	Width  int
+	Height int
+	// AspectRatio is the width divided by the height, rounded to 4 decimals
+	AspectRatio float64
+	// DominantColor is the most frequent color, as "#rrggbb"
+	DominantColor string
+	// BlurHash is a compact representation of a blurred version of the image,
+	// see https://blurha.sh.
+	BlurHash string
+}
+
+// Analyze extracts the metadata of a decoded image
+func Analyze(img image.Image) Metadata {
+	bounds := img.Bounds()
+
+	sample := img
+	if bounds.Dx() > sampleSize || bounds.Dy() > sampleSize {
+		width, height := sampleSize, sampleSize
+
+		if bounds.Dx() > bounds.Dy() {
+			height = scaledHeight(bounds, width)
+		} else {
+			width = int(math.Round(float64(bounds.Dx()) * float64(height) / float64(bounds.Dy())))
+			if width < 1 {
+				width = 1
+			}
+		}
+
+		sample = scale(img, bounds, width, height)
+	}
+
+	return Metadata{
+		Width:         bounds.Dx(),
+		Height:        bounds.Dy(),
+		AspectRatio:   AspectRatio(bounds.Dx(), bounds.Dy()),
+		DominantColor: dominantColor(sample),
+		BlurHash:      blurHash(sample, 4, 3),
+	}
+}
+
+// AspectRatio returns the width divided by the height, rounded to 4 decimals.
+// It returns 0 if the height is unknown.
+func AspectRatio(width, height int) float64 {
+	if height == 0 {
+		return 0
+	}
+
+	return math.Round(float64(width)/float64(height)*10000) / 10000
+}
+
+// dominantColor returns the most frequent color of an image. Colors are grouped
+// in buckets of similar colors, and the colors of the most frequent bucket are
+// averaged.
+func dominantColor(img image.Image) string {
+	type bucket struct {
+		count   int
+		r, g, b int
+	}
+
+	buckets := map[int]*bucket{}
+
+	var best *bucket
+
+	bestKey := 0
+	bounds := img.Bounds()
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+
+			// 16 levels per channel
+			key := int(c.R>>4)<<8 | int(c.G>>4)<<4 | int(c.B>>4)
+
+			b := buckets[key]
+			if b == nil {
+				b = &bucket{}
+				buckets[key] = b
+			}
+
+			b.count++
+			b.r += int(c.R)
+			b.g += int(c.G)
+			b.b += int(c.B)
+
+			// ties are broken by the key, so that the result is deterministic
+			if best == nil || b.count > best.count || (b.count == best.count && key < bestKey) {
+				best = b
+				bestKey = key
+			}
+		}
+	}
+
+	if best == nil {
+		return ""
+	}
+
+	return fmt.Sprintf("#%02x%02x%02x", best.r/best.count, best.g/best.count, best.b/best.count)
+}
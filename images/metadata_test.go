@@ -0,0 +1,75 @@
+package images
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnalyze(t *testing.T) {
+	// mostly blue, with a red band
+	img := image.NewRGBA(image.Rect(0, 0, 800, 600))
+
+	for x := 0; x < 800; x++ {
+		for y := 0; y < 600; y++ {
+			c := color.RGBA{B: 200, A: 255}
+			if y < 100 {
+				c = color.RGBA{R: 255, A: 255}
+			}
+
+			img.Set(x, y, c)
+		}
+	}
+
+	metadata := Analyze(img)
+
+	require.Equal(t, 800, metadata.Width)
+	require.Equal(t, 600, metadata.Height)
+	require.Equal(t, 1.3333, metadata.AspectRatio)
+	require.Equal(t, "#0000c8", metadata.DominantColor)
+	require.Len(t, metadata.BlurHash, 28)
+
+	// the same image, smaller, has the same placeholder
+	small := scale(img, img.Bounds(), 32, 24)
+	require.Equal(t, blurHash(small, 4, 3), metadata.BlurHash)
+}
+
+func TestAnalyzeSmall(t *testing.T) {
+	metadata := Analyze(solidImage(3, 7, color.White))
+
+	require.Equal(t, Metadata{
+		Width:         3,
+		Height:        7,
+		AspectRatio:   0.4286,
+		DominantColor: "#ffffff",
+		BlurHash:      "L~TSUA~qfQ~q?bxufQxufQfQfQfQ",
+	}, metadata)
+}
+
+func TestAspectRatio(t *testing.T) {
+	require.Equal(t, 1.0, AspectRatio(640, 640))
+	require.Equal(t, 0.8, AspectRatio(1080, 1350))
+	require.Equal(t, 1.7778, AspectRatio(1920, 1080))
+	require.Equal(t, 0.0, AspectRatio(100, 0))
+}
+
+func TestDominantColor(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 1))
+	img.Set(0, 0, color.RGBA{R: 10, G: 10, B: 10, A: 255})
+	img.Set(1, 0, color.RGBA{R: 12, G: 14, B: 10, A: 255})
+	img.Set(2, 0, color.RGBA{R: 200, A: 255})
+	img.Set(3, 0, color.RGBA{G: 200, A: 255})
+
+	// similar colors are averaged
+	require.Equal(t, "#0b0c0a", dominantColor(img))
+
+	// ties are broken deterministically
+	img = image.NewRGBA(image.Rect(0, 0, 2, 1))
+	img.Set(0, 0, color.RGBA{G: 200, A: 255})
+	img.Set(1, 0, color.RGBA{R: 200, A: 255})
+
+	require.Equal(t, "#00c800", dominantColor(img))
+	require.Equal(t, "", dominantColor(image.NewRGBA(image.Rect(0, 0, 0, 0))))
+}
@@ -0,0 +1,245 @@
+package images
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// jpegQuality is the quality of the generated JPEG images
+const jpegQuality = 85
+
+// ErrNotImage is returned when a file can't be decoded as an image, such as a
+// video saved with the ".jpg" extension.
+var ErrNotImage = errors.New("not an image")
+
+// Decode decodes an image file. It returns ErrNotImage if the file is not a
+// JPEG or a PNG image.
+func Decode(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open: %v", err)
+	}
+
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err == image.ErrFormat {
+		return nil, ErrNotImage
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode: %v", err)
+	}
+
+	return img, nil
+}
+
+// Resize resizes an image to the given width, keeping its aspect ratio, and
+// saves it to dst with the given content type, "image/jpeg" or "image/png".
+// Images are not enlarged.
+func Resize(src, dst string, width int, contentType string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open: %v", err)
+	}
+
+	defer f.Close()
+
+	img, format, err := image.Decode(f)
+	if err == image.ErrFormat {
+		return ErrNotImage
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to decode: %v", err)
+	}
+
+	bounds := img.Bounds()
+
+	// the original is already the right size and format
+	if width >= bounds.Dx() && "image/"+format == contentType {
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			return fmt.Errorf("failed to seek: %v", err)
+		}
+
+		return writeFile(dst, func(w io.Writer) error {
+			_, err := io.Copy(w, f)
+			return err
+		})
+	}
+
+	if width < bounds.Dx() {
+		img = scale(img, bounds, width, scaledHeight(bounds, width))
+	}
+
+	return writeFile(dst, func(w io.Writer) error {
+		return encode(w, img, contentType)
+	})
+}
+
+// Rendition defines a resized version of an image. If Height is 0 the aspect
+// ratio is kept, otherwise the image is cropped around its center.
+type Rendition struct {
+	Width  int
+	Height int
+}
+
+// ParseRendition parses a rendition such as "320", for a width, or "640x640",
+// for a crop.
+func ParseRendition(spec string) (Rendition, error) {
+	widthStr, heightStr, cropped := strings.Cut(spec, "x")
+
+	width, err := strconv.Atoi(widthStr)
+	if err != nil || width < 1 {
+		return Rendition{}, fmt.Errorf("bad rendition: %s", spec)
+	}
+
+	if !cropped {
+		return Rendition{Width: width}, nil
+	}
+
+	height, err := strconv.Atoi(heightStr)
+	if err != nil || height < 1 {
+		return Rendition{}, fmt.Errorf("bad rendition: %s", spec)
+	}
+
+	return Rendition{Width: width, Height: height}, nil
+}
+
+// String returns the rendition as parsed by ParseRendition. It is used to name
+// the files of the renditions.
+func (r Rendition) String() string {
+	if r.Height == 0 {
+		return strconv.Itoa(r.Width)
+	}
+
+	return strconv.Itoa(r.Width) + "x" + strconv.Itoa(r.Height)
+}
+
+// Cropped returns true if the rendition doesn't keep the aspect ratio
+func (r Rendition) Cropped() bool {
+	return r.Height != 0
+}
+
+// Render generates the rendition of a decoded image and saves it to dst as a
+// JPEG. It returns the size of the generated image. Images are not enlarged: it
+// returns false, without generating anything, if the original is not bigger
+// than the rendition.
+func (r Rendition) Render(img image.Image, dst string) (image.Point, bool, error) {
+	bounds := img.Bounds()
+
+	// the crop is the biggest area with the ratio of the rendition, centered
+	crop := bounds
+	size := image.Pt(r.Width, scaledHeight(bounds, r.Width))
+
+	if r.Cropped() {
+		size = image.Pt(r.Width, r.Height)
+
+		cropWidth := bounds.Dy() * r.Width / r.Height
+		cropHeight := bounds.Dx() * r.Height / r.Width
+
+		if cropWidth <= bounds.Dx() {
+			crop.Min.X += (bounds.Dx() - cropWidth) / 2
+			crop.Max.X = crop.Min.X + cropWidth
+		} else {
+			crop.Min.Y += (bounds.Dy() - cropHeight) / 2
+			crop.Max.Y = crop.Min.Y + cropHeight
+		}
+
+		if crop.Dx() < size.X {
+			size = crop.Size()
+		}
+	}
+
+	if !r.Cropped() && r.Width >= bounds.Dx() {
+		return image.Point{}, false, nil
+	}
+
+	img = scale(img, crop, size.X, size.Y)
+
+	err := writeFile(dst, func(w io.Writer) error {
+		return encode(w, img, "image/jpeg")
+	})
+
+	if err != nil {
+		return image.Point{}, false, err
+	}
+
+	return size, true, nil
+}
+
+// scaledHeight returns the height of an image scaled to the given width
+func scaledHeight(bounds image.Rectangle, width int) int {
+	height := int(math.Round(float64(bounds.Dy()) * float64(width) / float64(bounds.Dx())))
+	if height < 1 {
+		height = 1
+	}
+
+	return height
+}
+
+// scale scales a part of an image to the given size
+func scale(img image.Image, part image.Rectangle, width, height int) image.Image {
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, part, draw.Src, nil)
+
+	return scaled
+}
+
+// encode encodes an image with the given content type
+func encode(w io.Writer, img image.Image, contentType string) error {
+	switch contentType {
+	case "image/jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: jpegQuality})
+	case "image/png":
+		return png.Encode(w, img)
+	default:
+		return fmt.Errorf("unsupported content type: %s", contentType)
+	}
+}
+
+// writeFile creates a file with the provided content. The file is replaced
+// atomically, so that concurrent readers never read a partial file.
+func writeFile(path string, write func(io.Writer) error) error {
+	err := os.MkdirAll(filepath.Dir(path), 0744)
+	if err != nil {
+		return fmt.Errorf("failed to create dir: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create file: %v", err)
+	}
+
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	err = write(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to write: %v", err)
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close file: %v", err)
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return fmt.Errorf("failed to rename file: %v", err)
+	}
+
+	return nil
+}
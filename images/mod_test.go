@@ -0,0 +1,219 @@
+package images
+
+import (
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResize(t *testing.T) {
+	src := newImage(t, 800, 600)
+	dir := t.TempDir()
+
+	dst := filepath.Join(dir, "sub", "a.jpg")
+
+	err := Resize(src, dst, 320, "image/jpeg")
+	require.NoError(t, err)
+	require.Equal(t, image.Pt(320, 240), imageSize(t, dst))
+
+	dst = filepath.Join(dir, "a.png")
+
+	err = Resize(src, dst, 320, "image/png")
+	require.NoError(t, err)
+
+	f, err := os.Open(dst)
+	require.NoError(t, err)
+
+	defer f.Close()
+
+	_, err = png.Decode(f)
+	require.NoError(t, err)
+
+	// the original is copied if it is not bigger
+	dst = filepath.Join(dir, "b.jpg")
+
+	err = Resize(src, dst, 1080, "image/jpeg")
+	require.NoError(t, err)
+
+	original, err := os.ReadFile(src)
+	require.NoError(t, err)
+
+	copied, err := os.ReadFile(dst)
+	require.NoError(t, err)
+
+	require.Equal(t, original, copied)
+
+	err = Resize(src, dst, 320, "image/webp")
+	require.EqualError(t, err, "failed to write: unsupported content type: image/webp")
+
+	// temporary files are removed
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+}
+
+func TestResizeNotImage(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "a.jpg")
+
+	err := os.WriteFile(src, []byte("fake video"), os.ModePerm)
+	require.NoError(t, err)
+
+	err = Resize(src, src+".resized", 320, "image/jpeg")
+	require.ErrorIs(t, err, ErrNotImage)
+
+	_, err = Decode(src)
+	require.ErrorIs(t, err, ErrNotImage)
+
+	err = Resize("/does/not/exist", src+".resized", 320, "image/jpeg")
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrNotImage)
+
+	_, err = Decode("/does/not/exist")
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrNotImage)
+}
+
+func TestParseRendition(t *testing.T) {
+	table := []struct {
+		spec     string
+		expected Rendition
+	}{
+		{"320", Rendition{Width: 320}},
+		{"640x640", Rendition{Width: 640, Height: 640}},
+		{"400x300", Rendition{Width: 400, Height: 300}},
+	}
+
+	for _, entry := range table {
+		rendition, err := ParseRendition(entry.spec)
+		require.NoError(t, err, entry.spec)
+		require.Equal(t, entry.expected, rendition)
+		require.Equal(t, entry.spec, rendition.String())
+		require.Equal(t, entry.expected.Height != 0, rendition.Cropped())
+	}
+
+	for _, spec := range []string{"", "x", "0", "-1", "abc", "640x", "x640", "640x0", "1x2x3"} {
+		_, err := ParseRendition(spec)
+		require.EqualError(t, err, "bad rendition: "+spec)
+	}
+}
+
+func TestRender(t *testing.T) {
+	landscape := decode(t, newImage(t, 800, 600))
+	portrait := decode(t, newImage(t, 600, 800))
+	dir := t.TempDir()
+
+	table := []struct {
+		src       image.Image
+		rendition Rendition
+		size      image.Point
+	}{
+		{landscape, Rendition{Width: 320}, image.Pt(320, 240)},
+		{portrait, Rendition{Width: 320}, image.Pt(320, 427)},
+		{landscape, Rendition{Width: 300, Height: 300}, image.Pt(300, 300)},
+		{portrait, Rendition{Width: 300, Height: 300}, image.Pt(300, 300)},
+		{landscape, Rendition{Width: 400, Height: 100}, image.Pt(400, 100)},
+		// crops are not enlarged, but keep their ratio
+		{landscape, Rendition{Width: 1080, Height: 1080}, image.Pt(600, 600)},
+	}
+
+	for i, entry := range table {
+		dst := filepath.Join(dir, entry.rendition.String()+".jpg")
+
+		size, ok, err := entry.rendition.Render(entry.src, dst)
+		require.NoError(t, err, i)
+		require.True(t, ok, i)
+		require.Equal(t, entry.size, size, i)
+		require.Equal(t, entry.size, imageSize(t, dst), i)
+	}
+
+	// images are not enlarged
+	dst := filepath.Join(dir, "1080.jpg")
+
+	_, ok, err := Rendition{Width: 1080}.Render(landscape, dst)
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.NoFileExists(t, dst)
+}
+
+// The crop is centered.
+func TestRenderCrop(t *testing.T) {
+	// the left and right thirds are black, the middle one is white
+	img := image.NewRGBA(image.Rect(0, 0, 300, 100))
+
+	for x := 100; x < 200; x++ {
+		for y := 0; y < 100; y++ {
+			img.Set(x, y, color.White)
+		}
+	}
+
+	src := filepath.Join(t.TempDir(), "a.png")
+
+	f, err := os.Create(src)
+	require.NoError(t, err)
+
+	err = png.Encode(f, img)
+	require.NoError(t, err)
+
+	f.Close()
+
+	dst := filepath.Join(t.TempDir(), "a.jpg")
+
+	_, _, err = Rendition{Width: 50, Height: 50}.Render(decode(t, src), dst)
+	require.NoError(t, err)
+
+	f, err = os.Open(dst)
+	require.NoError(t, err)
+
+	defer f.Close()
+
+	rendered, err := jpeg.Decode(f)
+	require.NoError(t, err)
+
+	for _, p := range []image.Point{{0, 0}, {49, 0}, {25, 25}, {0, 49}, {49, 49}} {
+		gray := color.GrayModel.Convert(rendered.At(p.X, p.Y)).(color.Gray)
+		require.Greater(t, gray.Y, uint8(200), p)
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+// newImage saves a JPEG image of the given size and returns its path
+func newImage(t *testing.T, width, height int) string {
+	path := filepath.Join(t.TempDir(), "image.jpg")
+
+	f, err := os.Create(path)
+	require.NoError(t, err)
+
+	defer f.Close()
+
+	err = jpeg.Encode(f, image.NewRGBA(image.Rect(0, 0, width, height)), nil)
+	require.NoError(t, err)
+
+	return path
+}
+
+func imageSize(t *testing.T, path string) image.Point {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+
+	defer f.Close()
+
+	config, _, err := image.DecodeConfig(f)
+	require.NoError(t, err)
+
+	return image.Pt(config.Width, config.Height)
+}
+
+func decode(t *testing.T, path string) image.Image {
+	img, err := Decode(path)
+	require.NoError(t, err)
+
+	return img
+}
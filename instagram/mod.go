@@ -6,6 +6,8 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/nkcr/OSIA/instagram/types"
 )
@@ -135,7 +137,68 @@ func (h *HTTPAPI) RefreshToken() error {
 	return nil
 }
 
+// rateLimitCodes contains the error codes of the Instagram API that mean that
+// a rate limit is reached
+var rateLimitCodes = map[int]bool{4: true, 17: true, 32: true, 613: true}
+
+// RateLimitError is returned when a request is rejected because of a rate
+// limit.
+type RateLimitError struct {
+	Status string
+	Body   string
+	// RetryAfter is the delay requested by the server, 0 if unknown
+	RetryAfter time.Duration
+}
+
+// Error implements error
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("http request rate limited with status %s: %s", e.Status, e.Body)
+}
+
+// NewRateLimitError returns the error of a rate limited response
+func NewRateLimitError(resp *http.Response, body []byte) *RateLimitError {
+	return &RateLimitError{
+		Status:     resp.Status,
+		Body:       string(body),
+		RetryAfter: retryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
 func statusError(resp *http.Response) error {
 	buf, _ := ioutil.ReadAll(resp.Body)
+
+	var apiErr struct {
+		Error struct {
+			Code int `json:"code"`
+		} `json:"error"`
+	}
+
+	// Instagram also uses error codes to report rate limits
+	if resp.StatusCode == http.StatusTooManyRequests ||
+		json.Unmarshal(buf, &apiErr) == nil && rateLimitCodes[apiErr.Error.Code] {
+
+		return NewRateLimitError(resp, buf)
+	}
+
 	return fmt.Errorf("http request failed with status %s: %s", resp.Status, buf)
 }
+
+// retryAfter parses the value of a Retry-After header, which is either a
+// number of seconds or a date. It returns 0 if the value is invalid.
+func retryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	seconds, err := strconv.Atoi(value)
+	if err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	date, err := http.ParseTime(value)
+	if err != nil || date.Before(time.Now()) {
+		return 0
+	}
+
+	return time.Until(date)
+}
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/nkcr/OSIA/instagram/types"
 	"github.com/stretchr/testify/require"
@@ -196,6 +197,56 @@ func TestRefeshTokenSuccess(t *testing.T) {
 	require.Equal(t, expectedURL, client.url)
 }
 
+func TestRateLimited(t *testing.T) {
+	table := []struct {
+		statusCode int
+		header     http.Header
+		body       string
+		retryAfter time.Duration
+	}{
+		{http.StatusTooManyRequests, nil, "slow down", 0},
+		{http.StatusTooManyRequests, http.Header{"Retry-After": []string{"120"}}, "", 2 * time.Minute},
+		{http.StatusTooManyRequests, http.Header{"Retry-After": []string{"soon"}}, "", 0},
+		{http.StatusForbidden, nil, `{"error": {"message": "Application request limit reached", "code": 4}}`, 0},
+		{http.StatusBadRequest, nil, `{"error": {"code": 613}}`, 0},
+	}
+
+	for i, entry := range table {
+		client := fakeHTTPClient{
+			statusCode: entry.statusCode,
+			header:     entry.header,
+			body:       []byte(entry.body),
+		}
+
+		_, err := NewHTTPAPI("fake", &client).GetMedia("aa")
+
+		var rateLimit *RateLimitError
+
+		require.ErrorAs(t, err, &rateLimit, i)
+		require.Equal(t, entry.retryAfter, rateLimit.RetryAfter, i)
+		require.Equal(t, entry.body, rateLimit.Body, i)
+	}
+
+	// other errors are not rate limits
+	client := fakeHTTPClient{
+		statusCode: http.StatusBadRequest,
+		body:       []byte(`{"error": {"code": 190}}`),
+	}
+
+	_, err := NewHTTPAPI("fake", &client).GetMedia("aa")
+	require.EqualError(t, err, `http request failed with status 400: {"error": {"code": 190}}`)
+}
+
+func TestRetryAfter(t *testing.T) {
+	require.Equal(t, time.Duration(0), retryAfter(""))
+	require.Equal(t, time.Duration(0), retryAfter("-1"))
+	require.Equal(t, 5*time.Second, retryAfter("5"))
+	require.Equal(t, time.Duration(0), retryAfter("Wed, 21 Oct 2015 07:28:00 GMT"))
+
+	date := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	require.InDelta(t, time.Hour, retryAfter(date), float64(2*time.Second))
+}
+
 // ----------------------------------------------------------------------------
 // Utility functions
 
@@ -204,6 +255,7 @@ type fakeHTTPClient struct {
 	err        error
 	body       []byte
 	statusCode int
+	header     http.Header
 	url        string
 }
 
@@ -221,5 +273,6 @@ func (h *fakeHTTPClient) Get(url string) (resp *http.Response, err error) {
 		Body:       body,
 		StatusCode: h.statusCode,
 		Status:     strconv.Itoa(h.statusCode),
+		Header:     h.header,
 	}, h.err
 }
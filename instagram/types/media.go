@@ -1,5 +1,14 @@
 package types
 
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// TimeFormat is the format of the timestamps returned by Instagram
+const TimeFormat = "2006-01-02T15:04:05-0700"
+
 // Medias defines a list of Instagram media
 type Medias struct {
 	Data   []Media `json:"data"`
@@ -13,11 +22,142 @@ type Medias struct {
 
 // Media defines an Instagram media
 type Media struct {
-	ID        string `json:"id"`
-	Caption   string `json:"caption"`
-	MediaType string `json:"media_type"`
-	MediaURL  string `json:"media_url"`
-	Permalink string `json:"permalink"`
-	Username  string `json:"username"`
-	Timestamp string `json:"timestamp"`
+	ID        string    `json:"id"`
+	Caption   string    `json:"caption"`
+	MediaType string    `json:"media_type"`
+	MediaURL  string    `json:"media_url"`
+	Permalink string    `json:"permalink"`
+	Username  string    `json:"username"`
+	Timestamp Timestamp `json:"timestamp"`
+
+	// The following fields are set by OSIA's moderation and are not part of
+	// the Instagram API.
+
+	Hidden   bool `json:"hidden,omitempty"`
+	Pinned   bool `json:"pinned,omitempty"`
+	Position int  `json:"position,omitempty"`
+
+	// Renditions are generated by OSIA when the media is added
+	Renditions []Rendition `json:"renditions,omitempty"`
+
+	// Checksum is the SHA-256 of the saved image, hex encoded, computed when
+	// the media is added.
+	Checksum string `json:"checksum,omitempty"`
+
+	// AssetState tracks the download of the image, which happens after the
+	// media is saved. Medias saved before it was tracked have no state, their
+	// image is saved. AssetAttempts counts the downloads attempted, and
+	// AssetError contains the error of the last failed one.
+	AssetState    string `json:"asset_state,omitempty"`
+	AssetAttempts int    `json:"asset_attempts,omitempty"`
+	AssetError    string `json:"asset_error,omitempty"`
+
+	// The following fields are extracted from the image when the media is
+	// added, or by the "backfill" command. They are not set for videos.
+
+	Width         int     `json:"width,omitempty"`
+	Height        int     `json:"height,omitempty"`
+	AspectRatio   float64 `json:"aspect_ratio,omitempty"`
+	DominantColor string  `json:"dominant_color,omitempty"`
+	// BlurHash is a placeholder of the image, see https://blurha.sh
+	BlurHash string `json:"blurhash,omitempty"`
+}
+
+// States of the asset of a media
+const (
+	// AssetPending means the image must be downloaded
+	AssetPending = "pending"
+	// AssetOK means the image is saved
+	AssetOK = "ok"
+	// AssetFailed means the download failed too many times and won't be
+	// attempted again
+	AssetFailed = "failed"
+)
+
+// Rendition defines a resized version of a media's image, saved next to the
+// image.
+type Rendition struct {
+	// Name is the rendition as configured, such as "320" or "640x640"
+	Name    string `json:"name"`
+	File    string `json:"file"`
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	Cropped bool   `json:"cropped,omitempty"`
+}
+
+// ParseTimestamp parses a timestamp returned by Instagram, or in the RFC3339
+// format.
+func ParseTimestamp(timestamp string) (time.Time, bool) {
+	for _, layout := range []string{TimeFormat, time.RFC3339} {
+		t, err := time.Parse(layout, timestamp)
+		if err == nil {
+			return t, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// Timestamp is the time at which a media was published. It is decoded from the
+// format of Instagram or RFC3339, with any offset, and encoded in RFC3339, in
+// UTC, so that timestamps from any source are consistent. The zero value is an
+// unknown time, encoded as an empty string.
+type Timestamp struct {
+	time.Time
+
+	// unparsed is the decoded value, if it couldn't be parsed
+	unparsed string
+}
+
+// NewTimestamp returns the timestamp of a time
+func NewTimestamp(t time.Time) Timestamp {
+	return Timestamp{Time: t.UTC()}
+}
+
+// Unparsed returns the decoded value of an unknown timestamp, if it couldn't
+// be parsed, so that it can be reported.
+func (t Timestamp) Unparsed() string {
+	return t.unparsed
+}
+
+// String returns the timestamp in RFC3339, in UTC, or an empty string if it is
+// unknown.
+func (t Timestamp) String() string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// MarshalJSON implements json.Marshaler
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler. A timestamp that can't be parsed
+// is unknown, with its value kept in Unparsed, so that it doesn't prevent the
+// media from being decoded.
+func (t *Timestamp) UnmarshalJSON(buf []byte) error {
+	var value string
+
+	err := json.Unmarshal(buf, &value)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal timestamp: %v", err)
+	}
+
+	if value == "" {
+		*t = Timestamp{}
+		return nil
+	}
+
+	parsed, ok := ParseTimestamp(value)
+	if !ok {
+		*t = Timestamp{unparsed: value}
+		return nil
+	}
+
+	*t = NewTimestamp(parsed)
+
+	return nil
 }
@@ -0,0 +1,65 @@
+package types
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	expected := time.Date(2022, 1, 3, 10, 0, 0, 0, time.UTC)
+
+	ts, ok := ParseTimestamp("2022-01-03T10:00:00+0000")
+	require.True(t, ok)
+	require.True(t, expected.Equal(ts))
+
+	ts, ok = ParseTimestamp("2022-01-03T11:00:00+01:00")
+	require.True(t, ok)
+	require.True(t, expected.Equal(ts))
+
+	_, ok = ParseTimestamp("garbage")
+	require.False(t, ok)
+}
+
+func TestTimestampJSON(t *testing.T) {
+	var media Media
+
+	err := json.Unmarshal([]byte(`{"timestamp":"2022-01-03T11:00:00+0100"}`), &media)
+	require.NoError(t, err)
+	require.Equal(t, NewTimestamp(time.Date(2022, 1, 3, 10, 0, 0, 0, time.UTC)), media.Timestamp)
+
+	buf, err := json.Marshal(media.Timestamp)
+	require.NoError(t, err)
+	require.Equal(t, `"2022-01-03T10:00:00Z"`, string(buf))
+
+	err = json.Unmarshal([]byte(`{"timestamp":"2022-01-03T10:00:00.5Z"}`), &media)
+	require.NoError(t, err)
+	require.Equal(t, "2022-01-03T10:00:00.5Z", media.Timestamp.String())
+
+	// an unknown timestamp is empty
+	err = json.Unmarshal([]byte(`{"timestamp":""}`), &media)
+	require.NoError(t, err)
+	require.True(t, media.Timestamp.IsZero())
+
+	buf, err = json.Marshal(media.Timestamp)
+	require.NoError(t, err)
+	require.Equal(t, `""`, string(buf))
+
+	// an invalid timestamp is unknown, and kept to be reported
+	media.Timestamp = NewTimestamp(time.Now())
+
+	err = json.Unmarshal([]byte(`{"id":"a","timestamp":"garbage"}`), &media)
+	require.NoError(t, err)
+	require.Equal(t, "a", media.ID)
+	require.True(t, media.Timestamp.IsZero())
+	require.Equal(t, "garbage", media.Timestamp.Unparsed())
+
+	buf, err = json.Marshal(media.Timestamp)
+	require.NoError(t, err)
+	require.Equal(t, `""`, string(buf))
+
+	err = json.Unmarshal([]byte(`{"timestamp":1}`), &media)
+	require.Error(t, err)
+}
@@ -11,10 +11,11 @@ import (
 
 	"github.com/jessevdk/go-flags"
 	"github.com/nkcr/OSIA/aggregator"
+	"github.com/nkcr/OSIA/events"
 	"github.com/nkcr/OSIA/httpapi"
 	"github.com/nkcr/OSIA/instagram"
+	"github.com/nkcr/OSIA/webhooks"
 	"github.com/rs/zerolog"
-	"github.com/tidwall/buntdb"
 )
 
 // Version contains the current or build version. This variable can be changed
@@ -38,18 +39,108 @@ var logout = zerolog.ConsoleWriter{
 
 // args defines the CLI arguments. You can always use -h to see the help.
 type args struct {
-	Interval     time.Duration `short:"i" long:"interval" default:"1h" description:"Refresh interval used by the Aggregator."`
-	DBFilePath   string        `short:"d" long:"dbfilepath" default:"osia.db" description:"File path of the database."`
-	ImagesFolder string        `short:"j" long:"imagesfolder" description:"Folder used to saved images. By default it uses $HOME/.OSIA/images."`
-	HTTPListen   string        `short:"l" long:"listen" default:"0.0.0.0:3333" description:"The listen address of the HTTP server that servers the API."`
-	Version      bool          `short:"v" long:"version" description:"Displays the version."`
+	Interval        time.Duration  `short:"i" long:"interval" default:"1h" description:"Refresh interval used by the Aggregator."`
+	DBFilePath      string         `short:"d" long:"dbfilepath" default:"osia.db" description:"File path of the database."`
+	Store           string         `long:"store" default:"buntdb" choice:"buntdb" choice:"sqlite" description:"Storage of the posts. 'buntdb' stores them in the database, 'sqlite' in the SQLite database. API keys and webhooks are always stored in the database."`
+	SQLitePath      string         `long:"sqlitepath" default:"osia.sqlite" description:"File path of the SQLite database, used with --store=sqlite."`
+	ImagesFolder    string         `short:"j" long:"imagesfolder" description:"Folder used to saved images. By default it uses $HOME/.OSIA/images."`
+	HTTPListen      string         `short:"l" long:"listen" default:"0.0.0.0:3333" description:"The listen address of the HTTP server that servers the API."`
+	Compress        []string       `long:"compress" default:"br" default:"gzip" description:"Encodings used to compress HTTP responses, by order of preference. Supports 'br' and 'gzip'. Use 'none' to disable compression."`
+	CompressMin     int            `long:"compressminsize" default:"1024" description:"Minimum size, in bytes, of an HTTP response to be compressed."`
+	CORSOrigins     []string       `long:"corsorigin" default:"*" description:"Origin allowed to make cross-origin requests. Can be exact, such as 'https://example.com', use a wildcard for subdomains, such as 'https://*.example.com', or be '*' for any origin. Can be repeated."`
+	CORSMethods     []string       `long:"corsmethod" default:"GET" default:"HEAD" description:"Method allowed in cross-origin requests. Can be repeated."`
+	CORSHeaders     []string       `long:"corsheader" description:"Request header allowed in cross-origin requests. Can be repeated."`
+	CORSCredentials bool           `long:"corscredentials" description:"Allows cross-origin requests to include credentials."`
+	CORSMaxAge      time.Duration  `long:"corsmaxage" default:"1h" description:"How long browsers can cache the result of a preflight request."`
+	APIRate         float64        `long:"apirate" default:"5" description:"Number of requests per second a client can make on the API. Use 0 to disable the limit."`
+	APIBurst        int            `long:"apiburst" default:"20" description:"Number of requests a client can make at once on the API."`
+	ImagesRate      float64        `long:"imagesrate" default:"20" description:"Number of requests per second a client can make on the images. Use 0 to disable the limit."`
+	ImagesBurst     int            `long:"imagesburst" default:"60" description:"Number of requests a client can make at once on the images."`
+	AdminRate       float64        `long:"adminrate" default:"2" description:"Number of requests per second a client can make on the admin API. Use 0 to disable the limit."`
+	AdminBurst      int            `long:"adminburst" default:"10" description:"Number of requests a client can make at once on the admin API."`
+	TrustedProxies  []string       `long:"trustedproxy" description:"IP or CIDR of a reverse proxy trusted to set the X-Forwarded-For and X-Forwarded-Proto headers, such as 127.0.0.1. Can be repeated."`
+	PublicURL       string         `long:"publicurl" description:"URL under which OSIA is publicly reachable, such as 'https://osia.example.com'. Used to build absolute links. By default it uses the host of the request if it is allowed, see --allowedhost, and the links can't be built otherwise."`
+	AllowedHosts    []string       `long:"allowedhost" description:"Host of requests, such as 'osia.example.com', from which absolute links can be built when --publicurl is not set. The scheme is taken from the X-Forwarded-Proto header of trusted proxies. Can be repeated."`
+	HashtagURL      string         `long:"hashtagurl" default:"https://www.instagram.com/explore/tags/{hashtag}/" description:"URL template of the hashtag links in parsed captions."`
+	MentionURL      string         `long:"mentionurl" default:"https://www.instagram.com/{username}/" description:"URL template of the mention links in parsed captions."`
+	ImageWidths     []int          `long:"imagewidth" default:"150" default:"320" default:"480" default:"640" default:"750" default:"1080" description:"Width to which images can be resized, with /images/<id>.jpg?w=<width>. Can be repeated."`
+	ImagePresets    map[string]int `long:"imagepreset" default:"thumb:150" default:"small:320" default:"medium:640" default:"large:1080" description:"Named width to which images can be resized, with /images/<id>.jpg?size=<name>, as 'name:width'. Can be repeated."`
+	ImageCache      string         `long:"imagecache" description:"Folder used to cache resized images. By default it uses the images folder followed by '-resized'."`
+	Renditions      []string       `long:"rendition" default:"320" default:"640" default:"640x640" description:"Rendition generated for the image of each new post, as a width, such as '320', or a centered crop, such as '640x640'. Can be repeated. Use 'none' to disable renditions."`
+	FetchWorkers    int            `long:"fetchworkers" default:"4" description:"Number of posts and images fetched at once during a synchronization."`
+	FetchPerHost    int            `long:"fetchperhost" default:"2" description:"Number of posts and images fetched at once from the same host."`
+	Reconcile       time.Duration  `long:"reconcileinterval" default:"24h" description:"Interval at which missing images are downloaded again and orphaned files are removed from the images folder. Use 0 to disable it."`
+	DeleteOrphans   bool           `long:"deleteorphans" description:"Deletes the orphaned files instead of moving them to the images folder followed by '-orphans'."`
+	RetainPosts     int            `long:"retainposts" description:"Number of most recent posts kept after each synchronization, older ones are removed with their images. By default all posts are kept."`
+	RetainAge       time.Duration  `long:"retainage" description:"Age after which posts are removed with their images, such as '720h'. By default all posts are kept."`
+	RetainBytes     int64          `long:"retainbytes" description:"Total size, in bytes, of the images of the kept posts. The oldest posts are removed first. By default all posts are kept."`
+	RetainDryRun    bool           `long:"retaindryrun" description:"Only logs the posts that the retention would remove."`
+	Version         bool           `short:"v" long:"version" description:"Displays the version."`
 }
 
 func main() {
 	var args args
 	parser := flags.NewParser(&args, flags.Default)
 
+	// without command, OSIA starts the aggregator and the HTTP server
+	parser.SubcommandsOptional = true
+
+	_, err := parser.AddCommand("apikey", "Manages the admin API keys",
+		"Manages the API keys of the admin API. Must be run while OSIA is stopped.",
+		newAPIKeyCommand(&args))
+	if err != nil {
+		panic(fmt.Sprintf("failed to add command: %v", err))
+	}
+
+	_, err = parser.AddCommand("backfill", "Extracts the metadata of stored images",
+		"Extracts the dimensions, dominant color and BlurHash of the images of the "+
+			"medias added before OSIA extracted them. Must be run while OSIA is stopped.",
+		&backfillCommand{args: &args})
+	if err != nil {
+		panic(fmt.Sprintf("failed to add command: %v", err))
+	}
+
+	_, err = parser.AddCommand("migrate", "Copies the posts of the database into the SQLite database",
+		"Copies the posts of the buntdb database into the SQLite database, which is "+
+			"created if needed, so that OSIA can be started with --store=sqlite. The "+
+			"database is not modified. Must be run while OSIA is stopped.",
+		&migrateCommand{args: &args})
+	if err != nil {
+		panic(fmt.Sprintf("failed to add command: %v", err))
+	}
+
+	_, err = parser.AddCommand("reconcile", "Downloads missing images and removes orphaned files",
+		"Downloads again the missing images, with fresh URLs from Instagram, and moves "+
+			"the files that belong to no media to the images folder followed by '-orphans'. "+
+			"Must be run while OSIA is stopped.",
+		&reconcileCommand{args: &args})
+	if err != nil {
+		panic(fmt.Sprintf("failed to add command: %v", err))
+	}
+
+	_, err = parser.AddCommand("sync", "Triggers an immediate synchronization",
+		"Asks a running OSIA to synchronize now, using the admin API, and prints the result.",
+		&syncCommand{args: &args})
+	if err != nil {
+		panic(fmt.Sprintf("failed to add command: %v", err))
+	}
+
 	remaining, err := parser.Parse()
+
+	// a command has been executed, its error is already printed
+	if parser.Active != nil {
+		if err != nil {
+			flagsErr, ok := err.(*flags.Error)
+			if ok && flagsErr.Type == flags.ErrHelp {
+				os.Exit(0)
+			}
+
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
 	if err != nil {
 		flagsErr, ok := err.(*flags.Error)
 		if ok && flagsErr.Type == flags.ErrHelp {
@@ -71,14 +162,9 @@ func main() {
 	}
 
 	// set the default value for the imagesFolder argument
-	if args.ImagesFolder == "" {
-		homeDir, err := os.UserHomeDir()
-		if err != nil {
-			panic(fmt.Sprintf("failed to get home dir: %v", err))
-		}
-
-		imagesFolder := filepath.Join(homeDir, ".OSIA", "images")
-		args.ImagesFolder = imagesFolder
+	args.ImagesFolder, err = args.imagesFolder()
+	if err != nil {
+		panic(err.Error())
 	}
 
 	var logger = zerolog.New(logout).Level(zerolog.InfoLevel).
@@ -95,30 +181,42 @@ func main() {
 		"├───────────────────────────────────────────────┤\n"+
 		"│ DBFilePath %s\t│\n"+
 		"├───────────────────────────────────────────────┤\n"+
+		"│ Store %s\t│\n"+
+		"├───────────────────────────────────────────────┤\n"+
 		"│ ImagesFolder %s\t│\n"+
 		"├───────────────────────────────────────────────┤\n"+
 		"│ HTTPListen %s\t│\n"+
 		"└───────────────────────────────────────────────┘\n",
 		Version, BuildTime, args.Interval.String(), args.DBFilePath,
-		args.ImagesFolder, args.HTTPListen)
+		args.Store, args.ImagesFolder, args.HTTPListen)
 
 	err = os.MkdirAll(filepath.Dir(args.DBFilePath), 0744)
 	if err != nil {
 		panic(fmt.Sprintf("failed to create db dir: %v", err))
 	}
 
-	db, err := buntdb.Open(args.DBFilePath)
+	db, migration, err := openDB(args.DBFilePath)
 	if err != nil {
-		panic(err)
+		panic(err.Error())
 	}
 
 	defer db.Close()
 
-	err = db.CreateIndex("timestamp", "*", buntdb.IndexJSON("timestamp"))
+	if migration.From != migration.To {
+		logger.Info().Msgf("database migrated from version %d to %d", migration.From, migration.To)
+	}
+
+	if migration.Backup != "" {
+		logger.Info().Msgf("database saved in %s before the migration", migration.Backup)
+	}
+
+	mediaStore, closeStore, err := args.mediaStore(db)
 	if err != nil {
-		panic(err)
+		panic(err.Error())
 	}
 
+	defer closeStore()
+
 	token := os.Getenv(tokenKey)
 	if token == "" {
 		panic(fmt.Sprintf("please set the %s variable", tokenKey))
@@ -133,8 +231,62 @@ func main() {
 
 	api := instagram.NewHTTPAPI(token, client)
 
-	agg := aggregator.NewInstagramAggregator(db, api, args.ImagesFolder, client, logger)
-	httpserver := httpapi.NewInstagramHTTP(args.HTTPListen, db, args.ImagesFolder, logger)
+	bus := events.NewBus(events.DefaultHistorySize)
+
+	dispatcher := webhooks.NewDispatcher(db, &http.Client{Timeout: 10 * time.Second}, logger)
+
+	renditions, err := args.renditions()
+	if err != nil {
+		panic(err.Error())
+	}
+
+	agg := aggregator.NewInstagramAggregator(mediaStore, api, args.ImagesFolder, client, logger,
+		aggregator.WithPublisher(events.Publishers{bus, dispatcher}),
+		aggregator.WithRenditions(renditions...),
+		aggregator.WithConcurrency(args.FetchWorkers, args.FetchPerHost),
+		aggregator.WithReconcile(args.Reconcile, args.DeleteOrphans),
+		aggregator.WithImageCache(args.ImageCache),
+		aggregator.WithRetention(aggregator.Retention{
+			MaxMedias: args.RetainPosts,
+			MaxAge:    args.RetainAge,
+			MaxBytes:  args.RetainBytes,
+			DryRun:    args.RetainDryRun,
+		}))
+
+	trustedProxies, err := httpapi.ParseTrustedProxies(args.TrustedProxies)
+	if err != nil {
+		panic(fmt.Sprintf("failed to parse trusted proxies: %v", err))
+	}
+
+	compress := []string{}
+	for _, encoding := range args.Compress {
+		if encoding != "none" {
+			compress = append(compress, encoding)
+		}
+	}
+
+	httpserver := httpapi.NewInstagramHTTP(args.HTTPListen, mediaStore, db, args.ImagesFolder, logger,
+		httpapi.WithCompression(args.CompressMin, compress...),
+		httpapi.WithCORS(httpapi.CORSConfig{
+			AllowedOrigins:   args.CORSOrigins,
+			AllowedMethods:   args.CORSMethods,
+			AllowedHeaders:   args.CORSHeaders,
+			AllowCredentials: args.CORSCredentials,
+			MaxAge:           args.CORSMaxAge,
+		}),
+		httpapi.WithRateLimit("api", httpapi.RateLimit{Rate: args.APIRate, Burst: args.APIBurst}),
+		httpapi.WithRateLimit("images", httpapi.RateLimit{Rate: args.ImagesRate, Burst: args.ImagesBurst}),
+		httpapi.WithRateLimit("admin", httpapi.RateLimit{Rate: args.AdminRate, Burst: args.AdminBurst}),
+		httpapi.WithTrustedProxies(trustedProxies...),
+		httpapi.WithSyncer(agg),
+		httpapi.WithEvents(bus, dispatcher),
+		httpapi.WithPublicURL(args.PublicURL),
+		httpapi.WithAllowedHosts(args.AllowedHosts...),
+		httpapi.WithCaptionLinks(args.HashtagURL, args.MentionURL),
+		httpapi.WithImageSizes(httpapi.ImageSizes{
+			Widths:  args.ImageWidths,
+			Presets: args.ImagePresets,
+		}, args.ImageCache))
 
 	wait := sync.WaitGroup{}
 
@@ -149,6 +301,13 @@ func main() {
 		logger.Info().Msg("aggregator done")
 	}()
 
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		dispatcher.Start()
+		logger.Info().Msg("webhooks dispatcher done")
+	}()
+
 	wait.Add(1)
 	go func() {
 		defer wait.Done()
@@ -163,6 +322,8 @@ func main() {
 
 	agg.Stop()
 	httpserver.Stop()
+	dispatcher.Stop()
+	bus.Close()
 
 	wait.Wait()
 
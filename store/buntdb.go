@@ -0,0 +1,372 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nkcr/OSIA/instagram/types"
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/gjson"
+)
+
+// mediaPrefix is the prefix of the keys that store the medias, as
+// "media:<id>".
+const mediaPrefix = "media:"
+
+// deletedPrefix is the prefix of the keys that mark a media as deleted, as
+// "deleted:<id>".
+const deletedPrefix = "deleted:"
+
+// orderIndex is the index of the medias in the order of the store, from the
+// oldest to the most recent.
+const orderIndex = "media-order"
+
+// NewBuntStore returns a new media store backed by buntdb. Medias are stored
+// as JSON under "media:<id>". The database can store other records, such as
+// API keys or webhooks, under their own prefix like "apikey:<hash>". The schema
+// of the database must be up to date, see MigrateBunt. Medias are listed with
+// an index that buntdb keeps in memory, which is created here.
+func NewBuntStore(db *buntdb.DB) MediaStore {
+	err := db.CreateIndex(orderIndex, mediaPrefix+"*", byOrder)
+	if err == buntdb.ErrIndexExists {
+		err = nil
+	}
+
+	if err != nil {
+		err = fmt.Errorf("failed to create index: %v", err)
+	}
+
+	return BuntStore{db: db, indexErr: err}
+}
+
+// BuntStore implements a media store backed by buntdb.
+//
+// - implements store.MediaStore
+type BuntStore struct {
+	db *buntdb.DB
+	// indexErr is returned by List if the order index couldn't be created
+	indexErr error
+}
+
+// Put implements store.MediaStore
+func (s BuntStore) Put(media types.Media) error {
+	return s.db.Update(func(tx *buntdb.Tx) error {
+		return setMedia(tx, media)
+	})
+}
+
+// Get implements store.MediaStore
+func (s BuntStore) Get(id string) (types.Media, error) {
+	var media types.Media
+
+	err := s.db.View(func(tx *buntdb.Tx) error {
+		var err error
+
+		media, err = getMedia(tx, id)
+		return err
+	})
+
+	if err != nil {
+		return types.Media{}, err
+	}
+
+	return media, nil
+}
+
+// Update implements store.MediaStore
+func (s BuntStore) Update(id string, update func(*types.Media) error) (types.Media, error) {
+	var media types.Media
+
+	err := s.db.Update(func(tx *buntdb.Tx) error {
+		var err error
+
+		media, err = getMedia(tx, id)
+		if err != nil {
+			return err
+		}
+
+		err = update(&media)
+		if err != nil {
+			return err
+		}
+
+		return setMedia(tx, media)
+	})
+
+	if err != nil {
+		return types.Media{}, err
+	}
+
+	return media, nil
+}
+
+// Delete implements store.MediaStore
+func (s BuntStore) Delete(id string) (types.Media, error) {
+	return s.delete(id, nil)
+}
+
+// DeleteFor implements store.MediaStore. The deleted mark expires with the TTL
+// of buntdb.
+func (s BuntStore) DeleteFor(id string, ttl time.Duration) (types.Media, error) {
+	return s.delete(id, &buntdb.SetOptions{Expires: true, TTL: ttl})
+}
+
+// delete removes a media and marks it as deleted, with the options of the mark
+func (s BuntStore) delete(id string, opts *buntdb.SetOptions) (types.Media, error) {
+	var media types.Media
+
+	err := s.db.Update(func(tx *buntdb.Tx) error {
+		var err error
+
+		media, err = getMedia(tx, id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Delete(mediaPrefix + id)
+		if err != nil {
+			return fmt.Errorf("failed to delete: %v", err)
+		}
+
+		_, _, err = tx.Set(deletedPrefix+id, "", opts)
+		if err != nil {
+			return fmt.Errorf("failed to set: %v", err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return types.Media{}, err
+	}
+
+	return media, nil
+}
+
+// IsDeleted implements store.MediaStore
+func (s BuntStore) IsDeleted(id string) (bool, error) {
+	deleted := false
+
+	err := s.db.View(func(tx *buntdb.Tx) error {
+		_, err := tx.Get(deletedPrefix + id)
+		if err == buntdb.ErrNotFound {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to get: %v", err)
+		}
+
+		deleted = true
+
+		return nil
+	})
+
+	return deleted, err
+}
+
+// Deleted implements store.MediaStore
+func (s BuntStore) Deleted() ([]string, error) {
+	ids := []string{}
+
+	err := s.db.View(func(tx *buntdb.Tx) error {
+		return tx.AscendKeys(deletedPrefix+"*", func(key, value string) bool {
+			// expired marks are listed until buntdb removes them
+			_, err := tx.TTL(key)
+			if err == nil {
+				ids = append(ids, strings.TrimPrefix(key, deletedPrefix))
+			}
+
+			return true
+		})
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to view the db: %v", err)
+	}
+
+	return ids, nil
+}
+
+// List implements store.MediaStore. It walks the order index from the cursor,
+// and stops once the page is full.
+func (s BuntStore) List(query Query) ([]types.Media, string, error) {
+	if s.indexErr != nil {
+		return nil, "", s.indexErr
+	}
+
+	var after *position
+
+	pivot := ""
+
+	if query.Cursor != "" {
+		p, err := decodeCursor(query.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+
+		after = &p
+
+		buf, err := json.Marshal(map[string]string{"id": p.ID, "timestamp": p.Timestamp})
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to marshal pivot: %v", err)
+		}
+
+		pivot = string(buf)
+	}
+
+	medias := []types.Media{}
+
+	iterator := func(key, value string) bool {
+		media, ok := decodeMedia(value)
+		if !ok || !query.match(media) {
+			return true
+		}
+
+		// the pivot is included
+		if after != nil && !after.before(positionOf(media)) {
+			return true
+		}
+
+		medias = append(medias, media)
+
+		// one more media tells if there is a next page
+		return query.Limit == 0 || len(medias) <= query.Limit
+	}
+
+	err := s.db.View(func(tx *buntdb.Tx) error {
+		if pivot == "" {
+			return tx.Descend(orderIndex, iterator)
+		}
+
+		return tx.DescendLessOrEqual(orderIndex, pivot, iterator)
+	})
+
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to view the db: %v", err)
+	}
+
+	if query.Limit == 0 || len(medias) <= query.Limit {
+		return medias, "", nil
+	}
+
+	medias = medias[:query.Limit]
+
+	cursor, err := encodeCursor(medias[len(medias)-1])
+	if err != nil {
+		return nil, "", err
+	}
+
+	return medias, cursor, nil
+}
+
+// Count implements store.MediaStore
+func (s BuntStore) Count(filter Filter) (int, error) {
+	medias, err := s.all()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+
+	for _, media := range medias {
+		if filter.match(media) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// all returns all the medias
+func (s BuntStore) all() ([]types.Media, error) {
+	medias := []types.Media{}
+
+	err := s.db.View(func(tx *buntdb.Tx) error {
+		return tx.AscendKeys(mediaPrefix+"*", func(key, value string) bool {
+			media, ok := decodeMedia(value)
+			if ok {
+				medias = append(medias, media)
+			}
+
+			return true
+		})
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to view the db: %v", err)
+	}
+
+	return medias, nil
+}
+
+// byOrder orders the medias stored as JSON from the oldest to the most recent,
+// as the reverse of the order of the store. It is the less function of the
+// order index.
+func byOrder(a, b string) bool {
+	return orderOf(b).before(orderOf(a))
+}
+
+// orderOf returns the position of a media stored as JSON, without decoding it
+// entirely. Invalid timestamps are unknown, as when decoding the media.
+func orderOf(value string) position {
+	results := gjson.GetMany(value, "timestamp", "id")
+
+	t, _ := types.ParseTimestamp(results[0].String())
+
+	return position{Timestamp: sortKey(types.NewTimestamp(t)), ID: results[1].String()}
+}
+
+// getMedia returns a media from the db, or ErrNotFound
+func getMedia(tx *buntdb.Tx, id string) (types.Media, error) {
+	value, err := tx.Get(mediaPrefix + id)
+	if err == buntdb.ErrNotFound {
+		return types.Media{}, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+
+	if err != nil {
+		return types.Media{}, fmt.Errorf("failed to get: %v", err)
+	}
+
+	media, ok := decodeMedia(value)
+	if !ok {
+		return types.Media{}, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+
+	return media, nil
+}
+
+// setMedia saves a media in the db
+func setMedia(tx *buntdb.Tx, media types.Media) error {
+	err := checkID(media.ID)
+	if err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(media)
+	if err != nil {
+		return fmt.Errorf("failed to marshal media: %v", err)
+	}
+
+	_, _, err = tx.Set(mediaPrefix+media.ID, string(buf), nil)
+	if err != nil {
+		return fmt.Errorf("failed to set: %v", err)
+	}
+
+	return nil
+}
+
+// decodeMedia decodes a value from the db. It returns false if the value is not
+// a media.
+func decodeMedia(value string) (types.Media, bool) {
+	var media types.Media
+
+	err := json.Unmarshal([]byte(value), &media)
+	if err != nil || media.ID == "" {
+		return types.Media{}, false
+	}
+
+	return media, true
+}
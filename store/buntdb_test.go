@@ -0,0 +1,114 @@
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nkcr/OSIA/instagram/types"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/buntdb"
+)
+
+func TestBuntStore(t *testing.T) {
+	testStore(t, func() MediaStore {
+		return newBuntStore(t)
+	})
+}
+
+// Records other than medias, stored under prefixed keys, must be ignored.
+func TestBuntStoreOtherRecords(t *testing.T) {
+	db, err := buntdb.Open(":memory:")
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set("apikey:a", `{"id":"x"}`, nil)
+		return err
+	})
+	require.NoError(t, err)
+
+	s := NewBuntStore(db)
+
+	err = s.Put(types.Media{ID: "a"})
+	require.NoError(t, err)
+
+	_, err = s.Get("apikey:a")
+	require.True(t, errors.Is(err, ErrNotFound))
+
+	medias, _, err := s.List(Query{})
+	require.NoError(t, err)
+	require.Len(t, medias, 1)
+	require.Equal(t, "a", medias[0].ID)
+
+	_, err = s.Delete("a")
+	require.NoError(t, err)
+
+	count, err := s.Count(Filter{})
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+}
+
+// Medias are listed with an index ordered by time, not by the text of the
+// timestamps, whose fractional seconds have a variable width.
+func TestBuntStoreOrderIndex(t *testing.T) {
+	db, err := buntdb.Open(":memory:")
+	require.NoError(t, err)
+
+	defer db.Close()
+
+	s := NewBuntStore(db)
+
+	base := time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	for id, d := range map[string]time.Duration{
+		"a": 100 * time.Millisecond,
+		"b": 120 * time.Millisecond,
+		"c": 0,
+		"d": 120 * time.Millisecond,
+	} {
+		err = s.Put(types.Media{ID: id, Timestamp: types.NewTimestamp(base.Add(d))})
+		require.NoError(t, err)
+	}
+
+	err = s.Put(types.Media{ID: "e"})
+	require.NoError(t, err)
+
+	// the index already exists
+	s = NewBuntStore(db)
+
+	require.Equal(t, []string{"d", "b", "a", "c", "e"}, listIDs(t, s, Query{}))
+
+	ids := []string{}
+	cursor := ""
+
+	for {
+		medias, next, err := s.List(Query{Limit: 2, Cursor: cursor})
+		require.NoError(t, err)
+
+		for _, media := range medias {
+			ids = append(ids, media.ID)
+		}
+
+		if next == "" {
+			break
+		}
+
+		cursor = next
+	}
+
+	require.Equal(t, []string{"d", "b", "a", "c", "e"}, ids)
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+func newBuntStore(t *testing.T) MediaStore {
+	db, err := buntdb.Open(":memory:")
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		db.Close()
+	})
+
+	return NewBuntStore(db)
+}
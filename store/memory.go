@@ -0,0 +1,190 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nkcr/OSIA/instagram/types"
+)
+
+// NewMemoryStore returns a new empty media store that keeps the medias in
+// memory. It is meant for tests.
+func NewMemoryStore() MediaStore {
+	return &MemoryStore{
+		medias:  map[string]types.Media{},
+		deleted: map[string]time.Time{},
+	}
+}
+
+// MemoryStore implements a media store that keeps the medias in memory.
+//
+// - implements store.MediaStore
+type MemoryStore struct {
+	sync.RWMutex
+	medias map[string]types.Media
+	// deleted contains the expiration of the deleted marks, zero if they don't
+	// expire
+	deleted map[string]time.Time
+}
+
+// Put implements store.MediaStore
+func (s *MemoryStore) Put(media types.Media) error {
+	err := checkID(media.ID)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.medias[media.ID] = copyMedia(media)
+
+	return nil
+}
+
+// Get implements store.MediaStore
+func (s *MemoryStore) Get(id string) (types.Media, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	media, ok := s.medias[id]
+	if !ok {
+		return types.Media{}, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+
+	return copyMedia(media), nil
+}
+
+// Update implements store.MediaStore
+func (s *MemoryStore) Update(id string, update func(*types.Media) error) (types.Media, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	media, ok := s.medias[id]
+	if !ok {
+		return types.Media{}, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+
+	media = copyMedia(media)
+
+	err := update(&media)
+	if err != nil {
+		return types.Media{}, err
+	}
+
+	s.medias[id] = copyMedia(media)
+
+	return media, nil
+}
+
+// Delete implements store.MediaStore
+func (s *MemoryStore) Delete(id string) (types.Media, error) {
+	return s.delete(id, time.Time{})
+}
+
+// DeleteFor implements store.MediaStore
+func (s *MemoryStore) DeleteFor(id string, ttl time.Duration) (types.Media, error) {
+	return s.delete(id, time.Now().Add(ttl))
+}
+
+// delete removes a media and marks it as deleted until the expiration, or
+// forever if it is zero.
+func (s *MemoryStore) delete(id string, expires time.Time) (types.Media, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	media, ok := s.medias[id]
+	if !ok {
+		return types.Media{}, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+
+	delete(s.medias, id)
+	s.deleted[id] = expires
+
+	now := time.Now()
+
+	for id, expires := range s.deleted {
+		if expired(expires, now) {
+			delete(s.deleted, id)
+		}
+	}
+
+	return media, nil
+}
+
+// IsDeleted implements store.MediaStore
+func (s *MemoryStore) IsDeleted(id string) (bool, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	expires, ok := s.deleted[id]
+
+	return ok && !expired(expires, time.Now()), nil
+}
+
+// Deleted implements store.MediaStore
+func (s *MemoryStore) Deleted() ([]string, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	now := time.Now()
+
+	ids := make([]string, 0, len(s.deleted))
+	for id, expires := range s.deleted {
+		if !expired(expires, now) {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+// List implements store.MediaStore
+func (s *MemoryStore) List(query Query) ([]types.Media, string, error) {
+	s.RLock()
+
+	medias := make([]types.Media, 0, len(s.medias))
+	for _, media := range s.medias {
+		medias = append(medias, copyMedia(media))
+	}
+
+	s.RUnlock()
+
+	return page(medias, query)
+}
+
+// Count implements store.MediaStore
+func (s *MemoryStore) Count(filter Filter) (int, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	count := 0
+
+	for _, media := range s.medias {
+		if filter.match(media) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// copyMedia returns a copy of a media that doesn't share its renditions, like
+// a media decoded from a database.
+func copyMedia(media types.Media) types.Media {
+	if media.Renditions != nil {
+		media.Renditions = append([]types.Rendition{}, media.Renditions...)
+	}
+
+	return media
+}
+
+// expired returns true if a deleted mark that expires at the provided time, or
+// never if it is zero, is expired.
+func expired(expires, now time.Time) bool {
+	return !expires.IsZero() && !now.Before(expires)
+}
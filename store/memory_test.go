@@ -0,0 +1,30 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/nkcr/OSIA/instagram/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore)
+}
+
+// Medias returned by the store must not share their renditions with the
+// stored ones.
+func TestMemoryStoreCopy(t *testing.T) {
+	s := NewMemoryStore()
+
+	err := s.Put(types.Media{ID: "a", Renditions: []types.Rendition{{Name: "320"}}})
+	require.NoError(t, err)
+
+	media, err := s.Get("a")
+	require.NoError(t, err)
+
+	media.Renditions[0].Name = "640"
+
+	media, err = s.Get("a")
+	require.NoError(t, err)
+	require.Equal(t, "320", media.Renditions[0].Name)
+}
@@ -0,0 +1,66 @@
+package store
+
+import (
+	"fmt"
+
+	"github.com/nkcr/OSIA/instagram/types"
+)
+
+// CopyReport describes the medias copied from one store to another
+type CopyReport struct {
+	Medias  int
+	Deleted int
+}
+
+// Copy copies all the medias of a store into another, along with the deleted
+// medias, so that they are not added back. Medias with the same ID are
+// replaced in the destination. Deleted marks that expire are copied as marks
+// that don't.
+func Copy(dst, src MediaStore) (CopyReport, error) {
+	report := CopyReport{}
+
+	medias, _, err := src.List(Query{})
+	if err != nil {
+		return report, fmt.Errorf("failed to list medias: %v", err)
+	}
+
+	for _, media := range medias {
+		err = dst.Put(media)
+		if err != nil {
+			return report, fmt.Errorf("failed to put media '%s': %v", media.ID, err)
+		}
+
+		report.Medias++
+	}
+
+	deleted, err := src.Deleted()
+	if err != nil {
+		return report, fmt.Errorf("failed to list deleted medias: %v", err)
+	}
+
+	for _, id := range deleted {
+		isDeleted, err := dst.IsDeleted(id)
+		if err != nil {
+			return report, fmt.Errorf("failed to check media '%s': %v", id, err)
+		}
+
+		if isDeleted {
+			continue
+		}
+
+		// a media can only be marked as deleted by deleting it
+		err = dst.Put(types.Media{ID: id})
+		if err != nil {
+			return report, fmt.Errorf("failed to put media '%s': %v", id, err)
+		}
+
+		_, err = dst.Delete(id)
+		if err != nil {
+			return report, fmt.Errorf("failed to delete media '%s': %v", id, err)
+		}
+
+		report.Deleted++
+	}
+
+	return report, nil
+}
@@ -0,0 +1,44 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/nkcr/OSIA/instagram/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopy(t *testing.T) {
+	src := newBuntStore(t)
+
+	for _, media := range []types.Media{
+		{ID: "a", Timestamp: day(1), Pinned: true},
+		{ID: "b", Timestamp: day(2), Hidden: true},
+		{ID: "c", Timestamp: day(3)},
+	} {
+		err := src.Put(media)
+		require.NoError(t, err)
+	}
+
+	_, err := src.Delete("c")
+	require.NoError(t, err)
+
+	dst := NewMemoryStore()
+
+	report, err := Copy(dst, src)
+	require.NoError(t, err)
+	require.Equal(t, CopyReport{Medias: 2, Deleted: 1}, report)
+
+	require.Equal(t, []string{"b", "a"}, listIDs(t, dst, Query{}))
+	require.Equal(t, []string{"a"}, listIDs(t, dst, Query{Filter: Filter{Pinned: true}}))
+
+	deleted, err := dst.Deleted()
+	require.NoError(t, err)
+	require.Equal(t, []string{"c"}, deleted)
+
+	// copying again replaces the medias
+	report, err = Copy(dst, src)
+	require.NoError(t, err)
+	require.Equal(t, CopyReport{Medias: 2}, report)
+
+	require.Equal(t, []string{"b", "a"}, listIDs(t, dst, Query{}))
+}
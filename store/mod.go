@@ -0,0 +1,246 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nkcr/OSIA/instagram/types"
+)
+
+// ErrNotFound is returned when a media doesn't exist
+var ErrNotFound = errors.New("media not found")
+
+// ErrInvalidCursor is returned when a cursor can't be decoded
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// MediaStore defines the primitives to store medias. Medias are listed by
+// timestamp, the most recent first. Implementations must be safe for concurrent
+// use.
+type MediaStore interface {
+	// Put saves a media, replacing the one with the same ID.
+	Put(media types.Media) error
+
+	// Get returns a media, or ErrNotFound.
+	Get(id string) (types.Media, error)
+
+	// Update applies a function on a media and saves the result atomically.
+	// Nothing is saved if the function returns an error. The function must not
+	// use the store. It returns the updated media, or ErrNotFound.
+	Update(id string, update func(*types.Media) error) (types.Media, error)
+
+	// Delete removes a media and marks it as deleted, see IsDeleted. It
+	// returns the removed media, or ErrNotFound.
+	Delete(id string) (types.Media, error)
+
+	// DeleteFor is like Delete, but the media is marked as deleted only for
+	// the provided duration, after which it can be added back.
+	DeleteFor(id string, ttl time.Duration) (types.Media, error)
+
+	// IsDeleted returns true if the media has been deleted. Deleted medias are
+	// not added back by the aggregator.
+	IsDeleted(id string) (bool, error)
+
+	// Deleted returns the IDs of the deleted medias, sorted.
+	Deleted() ([]string, error)
+
+	// List returns the medias selected by the query, and the cursor of the
+	// next page, which is empty on the last page.
+	List(query Query) ([]types.Media, string, error)
+
+	// Count returns the number of medias selected by the filter.
+	Count(filter Filter) (int, error)
+}
+
+// Filter selects medias. The zero value selects all the medias.
+type Filter struct {
+	// Visible selects the medias that are not hidden
+	Visible bool
+	// Pinned selects the pinned medias, Unpinned the others
+	Pinned   bool
+	Unpinned bool
+	// AssetState selects the medias whose asset is in this state
+	AssetState string
+	// Saved selects the medias whose image is saved, which are the ones in the
+	// AssetOK state and the ones saved before the state was tracked
+	Saved bool
+}
+
+// checkID returns an error if the ID of a media is not valid. IDs can't
+// contain ":", which is used to prefix the other records of a database.
+func checkID(id string) error {
+	if id == "" || strings.Contains(id, ":") {
+		return fmt.Errorf("invalid media ID: '%s'", id)
+	}
+
+	return nil
+}
+
+// normalizeMedia decodes a media saved before timestamps were typed, whose
+// timestamp is in the format returned by Instagram. Invalid timestamps are
+// considered unknown.
+func normalizeMedia(value string) (types.Media, error) {
+	fields := map[string]interface{}{}
+
+	err := json.Unmarshal([]byte(value), &fields)
+	if err != nil {
+		return types.Media{}, fmt.Errorf("failed to unmarshal media: %v", err)
+	}
+
+	timestamp, _ := fields["timestamp"].(string)
+
+	_, ok := types.ParseTimestamp(timestamp)
+	if !ok {
+		fields["timestamp"] = ""
+	}
+
+	buf, err := json.Marshal(fields)
+	if err != nil {
+		return types.Media{}, fmt.Errorf("failed to marshal media: %v", err)
+	}
+
+	var media types.Media
+
+	err = json.Unmarshal(buf, &media)
+	if err != nil {
+		return types.Media{}, fmt.Errorf("failed to unmarshal media: %v", err)
+	}
+
+	return media, nil
+}
+
+// match returns true if the filter selects the media
+func (f Filter) match(media types.Media) bool {
+	switch {
+	case f.Visible && media.Hidden:
+		return false
+	case f.Pinned && !media.Pinned:
+		return false
+	case f.Unpinned && media.Pinned:
+		return false
+	case f.AssetState != "" && media.AssetState != f.AssetState:
+		return false
+	case f.Saved && media.AssetState != types.AssetOK && media.AssetState != "":
+		return false
+	}
+
+	return true
+}
+
+// Query selects a page of medias
+type Query struct {
+	Filter
+	// Limit is the maximum number of medias, 0 for no limit
+	Limit int
+	// Cursor is the cursor returned with the previous page, empty for the
+	// first page
+	Cursor string
+}
+
+// sortFormat is the format of the timestamps stored to sort medias. Timestamps
+// are in UTC with a fixed width, so that they sort as strings. Unknown
+// timestamps are the oldest.
+const sortFormat = "2006-01-02T15:04:05.000000000Z07:00"
+
+// sortKey returns the timestamp of a media in the sortFormat
+func sortKey(timestamp types.Timestamp) string {
+	return timestamp.UTC().Format(sortFormat)
+}
+
+// position is the position of a media in the order of the store, which is
+// encoded in cursors. Timestamp is in the sortFormat.
+type position struct {
+	Timestamp string `json:"t"`
+	ID        string `json:"id"`
+}
+
+// before returns true if p comes before other in the order of the store, which
+// is by timestamp, the most recent first, then by ID, in descending order.
+func (p position) before(other position) bool {
+	if p.Timestamp != other.Timestamp {
+		return p.Timestamp > other.Timestamp
+	}
+
+	return p.ID > other.ID
+}
+
+// positionOf returns the position of a media
+func positionOf(media types.Media) position {
+	return position{Timestamp: sortKey(media.Timestamp), ID: media.ID}
+}
+
+// encodeCursor returns the cursor of the page that follows a media
+func encodeCursor(media types.Media) (string, error) {
+	buf, err := json.Marshal(positionOf(media))
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal cursor: %v", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// decodeCursor returns the position encoded in a cursor, or ErrInvalidCursor
+func decodeCursor(cursor string) (position, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return position{}, ErrInvalidCursor
+	}
+
+	var p position
+
+	err = json.Unmarshal(buf, &p)
+	if err != nil {
+		return position{}, ErrInvalidCursor
+	}
+
+	return p, nil
+}
+
+// page sorts the medias and returns the page selected by the query, and the
+// cursor of the next page.
+func page(medias []types.Media, query Query) ([]types.Media, string, error) {
+	sort.Slice(medias, func(i, j int) bool {
+		return positionOf(medias[i]).before(positionOf(medias[j]))
+	})
+
+	var after *position
+
+	if query.Cursor != "" {
+		p, err := decodeCursor(query.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+
+		after = &p
+	}
+
+	result := []types.Media{}
+
+	for _, media := range medias {
+		if !query.match(media) {
+			continue
+		}
+
+		if after != nil && !after.before(positionOf(media)) {
+			continue
+		}
+
+		// a media beyond the limit means there is a next page
+		if query.Limit > 0 && len(result) == query.Limit {
+			cursor, err := encodeCursor(result[len(result)-1])
+			if err != nil {
+				return nil, "", err
+			}
+
+			return result, cursor, nil
+		}
+
+		result = append(result, media)
+	}
+
+	return result, "", nil
+}
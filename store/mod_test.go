@@ -0,0 +1,237 @@
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nkcr/OSIA/instagram/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterMatch(t *testing.T) {
+	media := types.Media{ID: "a", Pinned: true, AssetState: "ok"}
+
+	require.True(t, Filter{}.match(media))
+	require.True(t, Filter{Visible: true, Pinned: true, AssetState: "ok"}.match(media))
+	require.False(t, Filter{Unpinned: true}.match(media))
+	require.False(t, Filter{AssetState: "pending"}.match(media))
+
+	media.Hidden = true
+	require.False(t, Filter{Visible: true}.match(media))
+
+	require.True(t, Filter{Saved: true}.match(types.Media{AssetState: types.AssetOK}))
+	require.True(t, Filter{Saved: true}.match(types.Media{}))
+	require.False(t, Filter{Saved: true}.match(types.Media{AssetState: types.AssetPending}))
+	require.False(t, Filter{Saved: true}.match(types.Media{AssetState: types.AssetFailed}))
+}
+
+func TestPageInvalidCursor(t *testing.T) {
+	_, _, err := page(nil, Query{Cursor: "!"})
+	require.Equal(t, ErrInvalidCursor, err)
+
+	// valid base64, but not a position
+	_, _, err = page(nil, Query{Cursor: "bm90IGpzb24"})
+	require.Equal(t, ErrInvalidCursor, err)
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+// testStore checks the behavior expected from any implementation of a media
+// store.
+func testStore(t *testing.T, newStore func() MediaStore) {
+	t.Run("get", func(t *testing.T) {
+		s := newStore()
+
+		media := types.Media{ID: "a", Caption: "caption",
+			Renditions: []types.Rendition{{Name: "320", File: "a-320.jpg"}}}
+
+		err := s.Put(media)
+		require.NoError(t, err)
+
+		res, err := s.Get("a")
+		require.NoError(t, err)
+		require.Equal(t, media, res)
+
+		_, err = s.Get("b")
+		require.True(t, errors.Is(err, ErrNotFound))
+
+		// a media is replaced by the one with the same ID
+		err = s.Put(types.Media{ID: "a", Caption: "new"})
+		require.NoError(t, err)
+
+		res, err = s.Get("a")
+		require.NoError(t, err)
+		require.Equal(t, "new", res.Caption)
+	})
+
+	t.Run("invalid id", func(t *testing.T) {
+		s := newStore()
+
+		err := s.Put(types.Media{})
+		require.EqualError(t, err, "invalid media ID: ''")
+
+		err = s.Put(types.Media{ID: "apikey:a"})
+		require.EqualError(t, err, "invalid media ID: 'apikey:a'")
+	})
+
+	t.Run("update", func(t *testing.T) {
+		s := newStore()
+
+		err := s.Put(types.Media{ID: "a"})
+		require.NoError(t, err)
+
+		res, err := s.Update("a", func(media *types.Media) error {
+			media.Hidden = true
+			return nil
+		})
+		require.NoError(t, err)
+		require.True(t, res.Hidden)
+
+		// nothing is saved on error
+		_, err = s.Update("a", func(media *types.Media) error {
+			media.Pinned = true
+			return errors.New("oops")
+		})
+		require.EqualError(t, err, "oops")
+
+		res, err = s.Get("a")
+		require.NoError(t, err)
+		require.True(t, res.Hidden)
+		require.False(t, res.Pinned)
+
+		_, err = s.Update("b", func(media *types.Media) error { return nil })
+		require.True(t, errors.Is(err, ErrNotFound))
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		s := newStore()
+
+		err := s.Put(types.Media{ID: "a", Caption: "caption"})
+		require.NoError(t, err)
+
+		deleted, err := s.IsDeleted("a")
+		require.NoError(t, err)
+		require.False(t, deleted)
+
+		res, err := s.Delete("a")
+		require.NoError(t, err)
+		require.Equal(t, "caption", res.Caption)
+
+		_, err = s.Get("a")
+		require.True(t, errors.Is(err, ErrNotFound))
+
+		deleted, err = s.IsDeleted("a")
+		require.NoError(t, err)
+		require.True(t, deleted)
+
+		ids, err := s.Deleted()
+		require.NoError(t, err)
+		require.Equal(t, []string{"a"}, ids)
+
+		_, err = s.Delete("a")
+		require.True(t, errors.Is(err, ErrNotFound))
+	})
+
+	t.Run("delete for", func(t *testing.T) {
+		s := newStore()
+
+		for _, id := range []string{"a", "b", "c"} {
+			err := s.Put(types.Media{ID: id})
+			require.NoError(t, err)
+		}
+
+		_, err := s.DeleteFor("a", time.Hour)
+		require.NoError(t, err)
+
+		// already expired
+		_, err = s.DeleteFor("b", -time.Second)
+		require.NoError(t, err)
+
+		_, err = s.Delete("c")
+		require.NoError(t, err)
+
+		deleted, err := s.IsDeleted("a")
+		require.NoError(t, err)
+		require.True(t, deleted)
+
+		deleted, err = s.IsDeleted("b")
+		require.NoError(t, err)
+		require.False(t, deleted)
+
+		ids, err := s.Deleted()
+		require.NoError(t, err)
+		require.Equal(t, []string{"a", "c"}, ids)
+
+		_, err = s.Get("b")
+		require.True(t, errors.Is(err, ErrNotFound))
+
+		_, err = s.DeleteFor("b", time.Hour)
+		require.True(t, errors.Is(err, ErrNotFound))
+	})
+
+	t.Run("list", func(t *testing.T) {
+		s := newStore()
+
+		medias := []types.Media{
+			{ID: "a", Timestamp: day(1)},
+			{ID: "b", Timestamp: day(3), Hidden: true},
+			{ID: "c", Timestamp: day(2), Pinned: true},
+			{ID: "d", Timestamp: day(2), AssetState: "pending"},
+		}
+
+		for _, media := range medias {
+			err := s.Put(media)
+			require.NoError(t, err)
+		}
+
+		require.Equal(t, []string{"b", "d", "c", "a"}, listIDs(t, s, Query{}))
+		require.Equal(t, []string{"d", "c", "a"}, listIDs(t, s, Query{Filter: Filter{Visible: true}}))
+		require.Equal(t, []string{"c"}, listIDs(t, s, Query{Filter: Filter{Pinned: true}}))
+		require.Equal(t, []string{"b", "d", "a"}, listIDs(t, s, Query{Filter: Filter{Unpinned: true}}))
+		require.Equal(t, []string{"d"}, listIDs(t, s, Query{Filter: Filter{AssetState: "pending"}}))
+		require.Equal(t, []string{"b", "c", "a"}, listIDs(t, s, Query{Filter: Filter{Saved: true}}))
+
+		count, err := s.Count(Filter{})
+		require.NoError(t, err)
+		require.Equal(t, 4, count)
+
+		count, err = s.Count(Filter{Visible: true, Unpinned: true})
+		require.NoError(t, err)
+		require.Equal(t, 2, count)
+
+		// pages follow each other with the cursor
+		res, cursor, err := s.List(Query{Limit: 2})
+		require.NoError(t, err)
+		require.Len(t, res, 2)
+		require.Equal(t, "b", res[0].ID)
+		require.NotEmpty(t, cursor)
+
+		res, cursor, err = s.List(Query{Limit: 2, Cursor: cursor})
+		require.NoError(t, err)
+		require.Len(t, res, 2)
+		require.Equal(t, "c", res[0].ID)
+		require.Empty(t, cursor)
+
+		_, _, err = s.List(Query{Cursor: "not a cursor"})
+		require.Equal(t, ErrInvalidCursor, err)
+	})
+}
+
+// day returns the timestamp of a day of January 2022
+func day(d int) types.Timestamp {
+	return types.NewTimestamp(time.Date(2022, 1, d, 0, 0, 0, 0, time.UTC))
+}
+
+func listIDs(t *testing.T, s MediaStore, query Query) []string {
+	medias, _, err := s.List(query)
+	require.NoError(t, err)
+
+	ids := make([]string, len(medias))
+	for i, media := range medias {
+		ids[i] = media.ID
+	}
+
+	return ids
+}
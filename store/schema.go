@@ -0,0 +1,231 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/nkcr/OSIA/instagram/types"
+	"github.com/tidwall/buntdb"
+)
+
+// versionKey is the key that stores the version of the schema of a buntdb
+// database. Records that describe the database are prefixed with "meta:".
+const versionKey = "meta:version"
+
+// buntMigrations upgrade the schema of a buntdb database, by version. The
+// version of a database is stored under versionKey, and is 0 if it is missing.
+// Applied migrations must never be changed, new ones are appended.
+var buntMigrations = []func(tx *buntdb.Tx) error{
+	// 1: medias were stored under their bare ID
+	namespaceMedias,
+	// 2: timestamps were stored as returned by Instagram
+	normalizeBuntTimestamps,
+}
+
+// BuntMigration describes the migration of a buntdb database
+type BuntMigration struct {
+	// From and To are the versions of the database before and after the
+	// migration. They are equal if the database was up to date.
+	From int
+	To   int
+	// Backup is the file where the database was saved before the migration,
+	// if any.
+	Backup string
+}
+
+// MigrateBunt upgrades the schema of a buntdb database to the latest version,
+// in place. If the database needs to be migrated and is not empty, it is first
+// saved to "<path>.v<version>.bak", where path is the file of the database.
+// There is no backup if path is empty or ":memory:". Migrations are applied in
+// a single transaction, so that a failed migration leaves the database
+// unchanged.
+func MigrateBunt(db *buntdb.DB, path string) (BuntMigration, error) {
+	latest := len(buntMigrations)
+
+	var version, keys int
+
+	err := db.View(func(tx *buntdb.Tx) error {
+		var err error
+
+		version, err = getVersion(tx)
+		if err != nil {
+			return err
+		}
+
+		keys, err = tx.Len()
+		if err != nil {
+			return fmt.Errorf("failed to count keys: %v", err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return BuntMigration{}, err
+	}
+
+	migration := BuntMigration{From: version, To: latest}
+
+	if version > latest {
+		return migration, fmt.Errorf("unknown version %d, the latest is %d", version, latest)
+	}
+
+	if version == latest {
+		return migration, nil
+	}
+
+	if keys > 0 && path != "" && path != ":memory:" {
+		migration.Backup = fmt.Sprintf("%s.v%d.bak", path, version)
+
+		err = backup(db, migration.Backup)
+		if err != nil {
+			return migration, err
+		}
+	}
+
+	err = db.Update(func(tx *buntdb.Tx) error {
+		for i := version; i < latest; i++ {
+			err := buntMigrations[i](tx)
+			if err != nil {
+				return fmt.Errorf("failed to apply migration %d: %v", i+1, err)
+			}
+		}
+
+		_, _, err := tx.Set(versionKey, strconv.Itoa(latest), nil)
+		if err != nil {
+			return fmt.Errorf("failed to set version: %v", err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return migration, err
+	}
+
+	return migration, nil
+}
+
+// getVersion returns the version of the schema of the database
+func getVersion(tx *buntdb.Tx) (int, error) {
+	value, err := tx.Get(versionKey)
+	if err == buntdb.ErrNotFound {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to get version: %v", err)
+	}
+
+	version, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid version '%s': %v", value, err)
+	}
+
+	return version, nil
+}
+
+// backup saves the database in a file, which is replaced if it exists
+func backup(db *buntdb.DB, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create backup: %v", err)
+	}
+
+	err = db.Save(f)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to save backup: %v", err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close backup: %v", err)
+	}
+
+	return nil
+}
+
+// namespaceMedias moves the medias stored under their bare ID to
+// "media:<id>". Keys with a prefix are other records.
+func namespaceMedias(tx *buntdb.Tx) error {
+	medias := map[string]string{}
+
+	err := tx.Ascend("", func(key, value string) bool {
+		if strings.Contains(key, ":") {
+			return true
+		}
+
+		// the records are checked as they were saved, whatever the current
+		// type of the medias
+		var record struct {
+			ID string `json:"id"`
+		}
+
+		err := json.Unmarshal([]byte(value), &record)
+		if err == nil && record.ID != "" {
+			medias[key] = value
+		}
+
+		return true
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to iterate: %v", err)
+	}
+
+	for key, value := range medias {
+		_, err = tx.Delete(key)
+		if err != nil {
+			return fmt.Errorf("failed to delete: %v", err)
+		}
+
+		_, _, err = tx.Set(mediaPrefix+key, value, nil)
+		if err != nil {
+			return fmt.Errorf("failed to set: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// normalizeBuntTimestamps saves the timestamps of the medias in RFC3339
+func normalizeBuntTimestamps(tx *buntdb.Tx) error {
+	medias := []types.Media{}
+
+	var err error
+
+	iterErr := tx.AscendKeys(mediaPrefix+"*", func(key, value string) bool {
+		var media types.Media
+
+		media, err = normalizeMedia(value)
+		if err != nil {
+			err = fmt.Errorf("failed to normalize '%s': %v", key, err)
+			return false
+		}
+
+		medias = append(medias, media)
+
+		return true
+	})
+
+	if iterErr != nil {
+		return fmt.Errorf("failed to iterate: %v", iterErr)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	for _, media := range medias {
+		err = setMedia(tx, media)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,187 @@
+package store
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/nkcr/OSIA/instagram/types"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/buntdb"
+)
+
+// A database where medias are stored under their bare ID is migrated in place,
+// after a backup.
+func TestMigrateBunt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "osia.db")
+
+	db, err := buntdb.Open(path)
+	require.NoError(t, err)
+
+	defer db.Close()
+
+	err = db.Update(func(tx *buntdb.Tx) error {
+		for key, value := range map[string]string{
+			"a":         `{"id":"a","timestamp":"2022-01-01T10:00:00+0000"}`,
+			"b":         `{"id":"b","timestamp":"2022-01-01T11:00:00+0200"}`,
+			"c":         `{"id":"c","timestamp":"garbage"}`,
+			"deleted:c": "",
+			"apikey:x":  `{"name":"x"}`,
+			"other":     "not a media",
+		} {
+			_, _, err := tx.Set(key, value, nil)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	migration, err := MigrateBunt(db, path)
+	require.NoError(t, err)
+	require.Equal(t, BuntMigration{From: 0, To: len(buntMigrations), Backup: path + ".v0.bak"}, migration)
+
+	s := NewBuntStore(db)
+
+	// "b" is older than "a", despite its offset. Invalid timestamps are
+	// unknown, which is the oldest.
+	require.Equal(t, []string{"a", "b", "c"}, listIDs(t, s, Query{}))
+
+	deleted, err := s.IsDeleted("c")
+	require.NoError(t, err)
+	require.True(t, deleted)
+
+	err = db.View(func(tx *buntdb.Tx) error {
+		_, err := tx.Get("a")
+		require.Equal(t, buntdb.ErrNotFound, err)
+
+		value, err := tx.Get(mediaPrefix + "b")
+		require.NoError(t, err)
+		require.Contains(t, value, `"timestamp":"2022-01-01T09:00:00Z"`)
+
+		value, err = tx.Get("apikey:x")
+		require.NoError(t, err)
+		require.Equal(t, `{"name":"x"}`, value)
+
+		value, err = tx.Get("other")
+		require.NoError(t, err)
+		require.Equal(t, "not a media", value)
+
+		value, err = tx.Get(versionKey)
+		require.NoError(t, err)
+		require.Equal(t, strconv.Itoa(len(buntMigrations)), value)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	// the backup is the database before the migration
+	backup, err := buntdb.Open(migration.Backup)
+	require.NoError(t, err)
+
+	defer backup.Close()
+
+	err = backup.View(func(tx *buntdb.Tx) error {
+		_, err := tx.Get("a")
+		return err
+	})
+	require.NoError(t, err)
+
+	// an up to date database is not migrated again
+	migration, err = MigrateBunt(db, path)
+	require.NoError(t, err)
+	require.Equal(t, BuntMigration{From: len(buntMigrations), To: len(buntMigrations)}, migration)
+}
+
+// The first migration moves the records that have an ID, as they were saved,
+// and leaves their content to the next migrations.
+func TestNamespaceMedias(t *testing.T) {
+	db, err := buntdb.Open(":memory:")
+	require.NoError(t, err)
+
+	defer db.Close()
+
+	records := map[string]string{
+		"a":        `{"id":"a","timestamp":"garbage","width":"unknown"}`,
+		"b":        `{"caption":"no id"}`,
+		"c":        "not a media",
+		"apikey:x": `{"id":"x"}`,
+	}
+
+	err = db.Update(func(tx *buntdb.Tx) error {
+		for key, value := range records {
+			_, _, err := tx.Set(key, value, nil)
+			if err != nil {
+				return err
+			}
+		}
+
+		return namespaceMedias(tx)
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *buntdb.Tx) error {
+		for key, value := range map[string]string{
+			"media:a":  records["a"],
+			"b":        records["b"],
+			"c":        records["c"],
+			"apikey:x": records["apikey:x"],
+		} {
+			res, err := tx.Get(key)
+			require.NoError(t, err, key)
+			require.Equal(t, value, res)
+		}
+
+		_, err := tx.Get("a")
+		require.Equal(t, buntdb.ErrNotFound, err)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// A new database only gets the version, without backup.
+func TestMigrateBuntEmpty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "osia.db")
+
+	db, err := buntdb.Open(path)
+	require.NoError(t, err)
+
+	defer db.Close()
+
+	migration, err := MigrateBunt(db, path)
+	require.NoError(t, err)
+	require.Equal(t, BuntMigration{From: 0, To: len(buntMigrations)}, migration)
+	require.NoFileExists(t, path+".v0.bak")
+
+	err = NewBuntStore(db).Put(types.Media{ID: "a"})
+	require.NoError(t, err)
+}
+
+func TestMigrateBuntVersion(t *testing.T) {
+	db, err := buntdb.Open(":memory:")
+	require.NoError(t, err)
+
+	defer db.Close()
+
+	setVersion := func(version string) {
+		err := db.Update(func(tx *buntdb.Tx) error {
+			_, _, err := tx.Set(versionKey, version, nil)
+			return err
+		})
+		require.NoError(t, err)
+	}
+
+	setVersion("100")
+
+	_, err = MigrateBunt(db, ":memory:")
+	require.EqualError(t, err, fmt.Sprintf("unknown version 100, the latest is %d", len(buntMigrations)))
+
+	setVersion("x")
+
+	_, err = MigrateBunt(db, ":memory:")
+	require.EqualError(t, err, "invalid version 'x': strconv.Atoi: parsing \"x\": invalid syntax")
+}
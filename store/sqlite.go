@@ -0,0 +1,508 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nkcr/OSIA/instagram/types"
+
+	// registers the "sqlite" driver, which is written in pure Go and doesn't
+	// need cgo
+	_ "modernc.org/sqlite"
+)
+
+// migrations upgrade the schema of the SQLite database, by version. The
+// version of a database is stored in its user_version, and the missing
+// migrations are applied when it is opened. Applied migrations must never be
+// changed, new ones are appended.
+var migrations = []func(tx *sql.Tx) error{
+	// 1: medias, with the fields used to select them, and deleted medias
+	execMigration(`CREATE TABLE medias (
+		id TEXT PRIMARY KEY,
+		timestamp TEXT NOT NULL,
+		hidden INTEGER NOT NULL,
+		pinned INTEGER NOT NULL,
+		asset_state TEXT NOT NULL,
+		data TEXT NOT NULL
+	);
+	CREATE INDEX medias_order ON medias (timestamp DESC, id DESC);
+	CREATE TABLE deleted_medias (
+		id TEXT PRIMARY KEY
+	);`),
+	// 2: timestamps were stored as returned by Instagram
+	normalizeSQLiteTimestamps,
+	// 3: deleted marks that expire, in the sortFormat, empty if they don't
+	execMigration(`ALTER TABLE deleted_medias ADD COLUMN expires TEXT NOT NULL DEFAULT ''`),
+}
+
+// NewSQLiteStore opens, or creates, the SQLite database at the provided path
+// and migrates its schema. The store must be closed.
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open db '%s': %v", path, err)
+	}
+
+	// SQLite allows only one writer at a time. A single connection avoids
+	// "database is locked" errors, and keeps a ":memory:" database alive.
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec("PRAGMA journal_mode = WAL")
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to set journal mode: %v", err)
+	}
+
+	s := &SQLiteStore{db: db}
+
+	err = s.migrate()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate db '%s': %v", path, err)
+	}
+
+	return s, nil
+}
+
+// SQLiteStore implements a media store backed by SQLite. Medias are stored as
+// JSON, along with the fields used to select them.
+//
+// - implements store.MediaStore
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// Close closes the database
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// Version returns the version of the schema of the database
+func (s *SQLiteStore) Version() (int, error) {
+	var version int
+
+	err := s.db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get version: %v", err)
+	}
+
+	return version, nil
+}
+
+// migrate applies the migrations that are newer than the version of the
+// database, each in its own transaction.
+func (s *SQLiteStore) migrate() error {
+	version, err := s.Version()
+	if err != nil {
+		return err
+	}
+
+	if version > len(migrations) {
+		return fmt.Errorf("unknown version %d, the latest is %d", version, len(migrations))
+	}
+
+	for i := version; i < len(migrations); i++ {
+		err = s.inTx(func(tx *sql.Tx) error {
+			err := migrations[i](tx)
+			if err != nil {
+				return err
+			}
+
+			// PRAGMA doesn't support placeholders
+			_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1))
+			return err
+		})
+
+		if err != nil {
+			return fmt.Errorf("failed to apply migration %d: %v", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// execMigration returns a migration that executes a statement
+func execMigration(statement string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(statement)
+		return err
+	}
+}
+
+// normalizeSQLiteTimestamps saves the timestamps of the medias in RFC3339 and
+// sorts them by their time rather than by their text.
+func normalizeSQLiteTimestamps(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT data FROM medias")
+	if err != nil {
+		return fmt.Errorf("failed to select: %v", err)
+	}
+
+	medias := []types.Media{}
+
+	for rows.Next() {
+		var data string
+
+		err = rows.Scan(&data)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan: %v", err)
+		}
+
+		media, err := normalizeMedia(data)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		medias = append(medias, media)
+	}
+
+	rows.Close()
+
+	err = rows.Err()
+	if err != nil {
+		return fmt.Errorf("failed to iterate: %v", err)
+	}
+
+	for _, media := range medias {
+		err = putMedia(tx, media)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Put implements store.MediaStore
+func (s *SQLiteStore) Put(media types.Media) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		return putMedia(tx, media)
+	})
+}
+
+// Get implements store.MediaStore
+func (s *SQLiteStore) Get(id string) (types.Media, error) {
+	return selectMedia(s.db.QueryRow("SELECT data FROM medias WHERE id = ?", id), id)
+}
+
+// Update implements store.MediaStore
+func (s *SQLiteStore) Update(id string, update func(*types.Media) error) (types.Media, error) {
+	var media types.Media
+
+	err := s.inTx(func(tx *sql.Tx) error {
+		var err error
+
+		media, err = selectMedia(tx.QueryRow("SELECT data FROM medias WHERE id = ?", id), id)
+		if err != nil {
+			return err
+		}
+
+		err = update(&media)
+		if err != nil {
+			return err
+		}
+
+		return putMedia(tx, media)
+	})
+
+	if err != nil {
+		return types.Media{}, err
+	}
+
+	return media, nil
+}
+
+// Delete implements store.MediaStore
+func (s *SQLiteStore) Delete(id string) (types.Media, error) {
+	return s.delete(id, "")
+}
+
+// DeleteFor implements store.MediaStore. Expired marks are removed at the same
+// time.
+func (s *SQLiteStore) DeleteFor(id string, ttl time.Duration) (types.Media, error) {
+	return s.delete(id, now(ttl))
+}
+
+// delete removes a media and marks it as deleted until the expiration, or
+// forever if it is empty.
+func (s *SQLiteStore) delete(id, expires string) (types.Media, error) {
+	var media types.Media
+
+	err := s.inTx(func(tx *sql.Tx) error {
+		var err error
+
+		media, err = selectMedia(tx.QueryRow("SELECT data FROM medias WHERE id = ?", id), id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("DELETE FROM medias WHERE id = ?", id)
+		if err != nil {
+			return fmt.Errorf("failed to delete: %v", err)
+		}
+
+		_, err = tx.Exec(`INSERT INTO deleted_medias (id, expires) VALUES (?, ?)
+			ON CONFLICT (id) DO UPDATE SET expires = excluded.expires`, id, expires)
+		if err != nil {
+			return fmt.Errorf("failed to insert: %v", err)
+		}
+
+		_, err = tx.Exec("DELETE FROM deleted_medias WHERE expires != '' AND expires <= ?", now(0))
+		if err != nil {
+			return fmt.Errorf("failed to delete expired: %v", err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return types.Media{}, err
+	}
+
+	return media, nil
+}
+
+// IsDeleted implements store.MediaStore
+func (s *SQLiteStore) IsDeleted(id string) (bool, error) {
+	var count int
+
+	err := s.db.QueryRow("SELECT COUNT(*) FROM deleted_medias WHERE id = ? AND "+notExpired,
+		id, now(0)).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to select: %v", err)
+	}
+
+	return count > 0, nil
+}
+
+// Deleted implements store.MediaStore
+func (s *SQLiteStore) Deleted() ([]string, error) {
+	rows, err := s.db.Query("SELECT id FROM deleted_medias WHERE "+notExpired+" ORDER BY id", now(0))
+	if err != nil {
+		return nil, fmt.Errorf("failed to select: %v", err)
+	}
+
+	defer rows.Close()
+
+	ids := []string{}
+
+	for rows.Next() {
+		var id string
+
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan: %v", err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// List implements store.MediaStore
+func (s *SQLiteStore) List(query Query) ([]types.Media, string, error) {
+	where, params := whereClause(query.Filter)
+
+	if query.Cursor != "" {
+		after, err := decodeCursor(query.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+
+		where = append(where, "(timestamp < ? OR (timestamp = ? AND id < ?))")
+		params = append(params, after.Timestamp, after.Timestamp, after.ID)
+	}
+
+	statement := "SELECT data FROM medias" + joinWhere(where) + " ORDER BY timestamp DESC, id DESC"
+
+	// one more media tells if there is a next page
+	if query.Limit > 0 {
+		statement += " LIMIT ?"
+		params = append(params, query.Limit+1)
+	}
+
+	rows, err := s.db.Query(statement, params...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to select: %v", err)
+	}
+
+	defer rows.Close()
+
+	medias := []types.Media{}
+
+	for rows.Next() {
+		var data string
+
+		err = rows.Scan(&data)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to scan: %v", err)
+		}
+
+		var media types.Media
+
+		err = json.Unmarshal([]byte(data), &media)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to unmarshal media: %v", err)
+		}
+
+		medias = append(medias, media)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to iterate: %v", err)
+	}
+
+	if query.Limit == 0 || len(medias) <= query.Limit {
+		return medias, "", nil
+	}
+
+	medias = medias[:query.Limit]
+
+	cursor, err := encodeCursor(medias[len(medias)-1])
+	if err != nil {
+		return nil, "", err
+	}
+
+	return medias, cursor, nil
+}
+
+// Count implements store.MediaStore
+func (s *SQLiteStore) Count(filter Filter) (int, error) {
+	where, params := whereClause(filter)
+
+	var count int
+
+	err := s.db.QueryRow("SELECT COUNT(*) FROM medias"+joinWhere(where), params...).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to select: %v", err)
+	}
+
+	return count, nil
+}
+
+// inTx calls the function in a transaction, which is committed if the function
+// returns no error.
+func (s *SQLiteStore) inTx(f func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+
+	err = f(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit: %v", err)
+	}
+
+	return nil
+}
+
+// selectMedia scans a row that contains the data of a media, or returns
+// ErrNotFound.
+func selectMedia(row *sql.Row, id string) (types.Media, error) {
+	var data string
+
+	err := row.Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return types.Media{}, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+
+	if err != nil {
+		return types.Media{}, fmt.Errorf("failed to select: %v", err)
+	}
+
+	var media types.Media
+
+	err = json.Unmarshal([]byte(data), &media)
+	if err != nil {
+		return types.Media{}, fmt.Errorf("failed to unmarshal media: %v", err)
+	}
+
+	return media, nil
+}
+
+// notExpired is the condition that selects the deleted marks that are not
+// expired, given the current time in the sortFormat
+const notExpired = "(expires = '' OR expires > ?)"
+
+// now returns the current time plus a duration, in the sortFormat
+func now(d time.Duration) string {
+	return sortKey(types.NewTimestamp(time.Now().Add(d)))
+}
+
+// putMedia inserts or replaces a media
+func putMedia(tx *sql.Tx, media types.Media) error {
+	err := checkID(media.ID)
+	if err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(media)
+	if err != nil {
+		return fmt.Errorf("failed to marshal media: %v", err)
+	}
+
+	_, err = tx.Exec(`INSERT INTO medias (id, timestamp, hidden, pinned, asset_state, data)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET timestamp = excluded.timestamp,
+		hidden = excluded.hidden, pinned = excluded.pinned,
+		asset_state = excluded.asset_state, data = excluded.data`,
+		media.ID, sortKey(media.Timestamp), media.Hidden, media.Pinned, media.AssetState, string(buf))
+	if err != nil {
+		return fmt.Errorf("failed to insert: %v", err)
+	}
+
+	return nil
+}
+
+// whereClause returns the conditions and parameters that select the medias of
+// a filter.
+func whereClause(filter Filter) ([]string, []interface{}) {
+	where := []string{}
+	params := []interface{}{}
+
+	if filter.Visible {
+		where = append(where, "hidden = 0")
+	}
+
+	if filter.Pinned {
+		where = append(where, "pinned = 1")
+	}
+
+	if filter.Unpinned {
+		where = append(where, "pinned = 0")
+	}
+
+	if filter.AssetState != "" {
+		where = append(where, "asset_state = ?")
+		params = append(params, filter.AssetState)
+	}
+
+	if filter.Saved {
+		where = append(where, "asset_state IN (?, '')")
+		params = append(params, types.AssetOK)
+	}
+
+	return where, params
+}
+
+// joinWhere returns the WHERE clause of the conditions, if any
+func joinWhere(where []string) string {
+	if len(where) == 0 {
+		return ""
+	}
+
+	return " WHERE " + strings.Join(where, " AND ")
+}
@@ -0,0 +1,132 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/nkcr/OSIA/instagram/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLiteStore(t *testing.T) {
+	testStore(t, func() MediaStore {
+		return newSQLiteStore(t, filepath.Join(t.TempDir(), "osia.sqlite"))
+	})
+}
+
+func TestSQLiteStoreMemory(t *testing.T) {
+	s := newSQLiteStore(t, ":memory:")
+
+	err := s.Put(types.Media{ID: "a"})
+	require.NoError(t, err)
+
+	// the in-memory database must be shared by all the calls
+	_, err = s.Get("a")
+	require.NoError(t, err)
+}
+
+// Medias are kept when the database is opened again, and migrations are only
+// applied once.
+func TestSQLiteStoreReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "osia.sqlite")
+
+	s, err := NewSQLiteStore(path)
+	require.NoError(t, err)
+
+	version, err := s.Version()
+	require.NoError(t, err)
+	require.Equal(t, len(migrations), version)
+
+	err = s.Put(types.Media{ID: "a", Hidden: true})
+	require.NoError(t, err)
+
+	_, err = s.Delete("a")
+	require.NoError(t, err)
+
+	err = s.Put(types.Media{ID: "b", Caption: "caption"})
+	require.NoError(t, err)
+
+	err = s.Close()
+	require.NoError(t, err)
+
+	s = newSQLiteStore(t, path)
+
+	media, err := s.Get("b")
+	require.NoError(t, err)
+	require.Equal(t, "caption", media.Caption)
+
+	deleted, err := s.IsDeleted("a")
+	require.NoError(t, err)
+	require.True(t, deleted)
+}
+
+func TestSQLiteStoreUnknownVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "osia.sqlite")
+
+	s := newSQLiteStore(t, path)
+
+	_, err := s.db.Exec("PRAGMA user_version = 100")
+	require.NoError(t, err)
+
+	_, err = NewSQLiteStore(path)
+	require.EqualError(t, err, fmt.Sprintf("failed to migrate db '%s': unknown version 100, the latest is %d",
+		path, len(migrations)))
+}
+
+// Timestamps saved as returned by Instagram are normalized, so that medias are
+// sorted by time.
+func TestSQLiteStoreTimestamps(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "osia.sqlite")
+
+	// a database in version 1
+	db, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+
+	err = migrations[0](tx)
+	require.NoError(t, err)
+
+	for id, timestamp := range map[string]string{
+		"a": "2022-01-01T10:00:00+0000",
+		"b": "2022-01-01T11:00:00+0200",
+	} {
+		_, err = tx.Exec("INSERT INTO medias VALUES (?, ?, 0, 0, '', ?)", id, timestamp,
+			fmt.Sprintf(`{"id":"%s","timestamp":"%s"}`, id, timestamp))
+		require.NoError(t, err)
+	}
+
+	_, err = tx.Exec("PRAGMA user_version = 1")
+	require.NoError(t, err)
+
+	err = tx.Commit()
+	require.NoError(t, err)
+
+	err = db.Close()
+	require.NoError(t, err)
+
+	s := newSQLiteStore(t, path)
+
+	require.Equal(t, []string{"a", "b"}, listIDs(t, s, Query{}))
+
+	media, err := s.Get("b")
+	require.NoError(t, err)
+	require.Equal(t, "2022-01-01T09:00:00Z", media.Timestamp.String())
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+func newSQLiteStore(t *testing.T, path string) *SQLiteStore {
+	s, err := NewSQLiteStore(path)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		s.Close()
+	})
+
+	return s
+}
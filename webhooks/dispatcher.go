@@ -0,0 +1,383 @@
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/gjson"
+)
+
+// SignatureHeader is the header that contains the signature of a delivery's
+// body, as "sha256=<hex HMAC-SHA256 of the body with the secret>".
+const SignatureHeader = "X-OSIA-Signature"
+
+// pendingIndex is the index of the deliveries that orders the pending ones by
+// their next attempt, before the others.
+const pendingIndex = "webhook-pending"
+
+// HTTPClient defines the primitive needed to deliver webhooks
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// NewDispatcher returns a new initialized dispatcher that delivers the events
+// to the webhooks stored in the database.
+func NewDispatcher(db *buntdb.DB, client HTTPClient, logger zerolog.Logger) *Dispatcher {
+	logger = logger.With().Str("role", "webhooks").Logger()
+
+	err := db.CreateIndex(pendingIndex, deliveryPrefix+"*", byNextAttempt)
+	if err != nil && err != buntdb.ErrIndexExists {
+		logger.Err(err).Msg("failed to create the index of pending deliveries")
+	}
+
+	return &Dispatcher{
+		db:           db,
+		client:       client,
+		logger:       logger,
+		quit:         make(chan struct{}),
+		notify:       make(chan struct{}, 1),
+		pollInterval: time.Second,
+		backoff:      30 * time.Second,
+		maxBackoff:   time.Hour,
+		maxAttempts:  8,
+		retention:    7 * 24 * time.Hour,
+	}
+}
+
+// Dispatcher delivers events to webhooks. Deliveries are queued in the
+// database, so that they survive a restart, and retried with an exponential
+// backoff. A delivery interrupted by a restart is sent again, receivers can use
+// the ID of the payload to detect duplicates.
+//
+// - implements events.Publisher
+type Dispatcher struct {
+	db     *buntdb.DB
+	client HTTPClient
+	logger zerolog.Logger
+	quit   chan struct{}
+	notify chan struct{}
+
+	pollInterval time.Duration
+	backoff      time.Duration
+	maxBackoff   time.Duration
+	maxAttempts  int
+	// retention is the duration during which finished deliveries are kept
+	retention time.Duration
+}
+
+// Publish implements events.Publisher. It queues a delivery for each webhook
+// subscribed to the event.
+func (d *Dispatcher) Publish(eventType string, data interface{}) error {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal data: %v", err)
+	}
+
+	queued := false
+
+	err = d.db.Update(func(tx *buntdb.Tx) error {
+		webhooks, err := listWebhooks(tx)
+		if err != nil {
+			return err
+		}
+
+		for _, webhook := range webhooks {
+			if !contains(webhook.Events, eventType) {
+				continue
+			}
+
+			id, err := randomID(16)
+			if err != nil {
+				return fmt.Errorf("failed to generate id: %v", err)
+			}
+
+			now := time.Now().UTC()
+
+			payload, err := json.Marshal(Payload{
+				ID:      id,
+				Event:   eventType,
+				Created: now,
+				Data:    buf,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to marshal payload: %v", err)
+			}
+
+			delivery := Delivery{
+				ID:          id,
+				Webhook:     webhook.ID,
+				Event:       eventType,
+				Payload:     payload,
+				Status:      StatusPending,
+				NextAttempt: now,
+				Created:     now,
+			}
+
+			err = setJSON(tx, deliveryPrefix+id, delivery, nil)
+			if err != nil {
+				return err
+			}
+
+			queued = true
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to queue deliveries: %v", err)
+	}
+
+	if queued {
+		select {
+		case d.notify <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// Start delivers the queued events until the dispatcher is stopped.
+func (d *Dispatcher) Start() {
+	d.logger.Info().Msg("dispatcher starting")
+
+	ticker := time.NewTicker(d.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		d.deliverDue()
+
+		select {
+		case <-d.quit:
+			d.logger.Info().Msg("dispatcher stopped")
+			return
+		case <-d.notify:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop stops the dispatcher. It should be called only if the dispatcher is
+// started.
+func (d *Dispatcher) Stop() {
+	d.quit <- struct{}{}
+}
+
+// deliverDue delivers the pending deliveries whose next attempt is due. It
+// walks the pending index and stops at the first delivery that is not due.
+func (d *Dispatcher) deliverDue() {
+	due := []Delivery{}
+	webhooks := map[string]Webhook{}
+
+	err := d.db.View(func(tx *buntdb.Tx) error {
+		now := time.Now()
+
+		err := tx.Ascend(pendingIndex, func(key, value string) bool {
+			var delivery Delivery
+
+			err := json.Unmarshal([]byte(value), &delivery)
+			if err != nil {
+				return true
+			}
+
+			if delivery.Status != StatusPending || delivery.NextAttempt.After(now) {
+				return false
+			}
+
+			due = append(due, delivery)
+
+			return true
+		})
+
+		if err != nil {
+			return fmt.Errorf("failed to list pending deliveries: %v", err)
+		}
+
+		list, err := listWebhooks(tx)
+		if err != nil {
+			return err
+		}
+
+		for _, webhook := range list {
+			webhooks[webhook.ID] = webhook
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		d.logger.Err(err).Msg("failed to list deliveries")
+		return
+	}
+
+	for _, delivery := range due {
+		webhook, ok := webhooks[delivery.Webhook]
+		if !ok {
+			err = d.abandon(delivery)
+			if err != nil {
+				d.logger.Err(err).Msgf("failed to abandon delivery '%s'", delivery.ID)
+			}
+
+			continue
+		}
+
+		status, err := d.deliver(webhook, delivery)
+
+		err = d.record(delivery, status, err)
+		if err != nil {
+			d.logger.Err(err).Msgf("failed to record delivery '%s'", delivery.ID)
+		}
+	}
+}
+
+// deliver sends a delivery to its webhook. It returns the status code of the
+// response, if any.
+func (d *Dispatcher) deliver(webhook Webhook, delivery Delivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "OSIA-Webhook")
+	req.Header.Set("X-OSIA-Event", delivery.Event)
+	req.Header.Set("X-OSIA-Delivery", delivery.ID)
+	req.Header.Set(SignatureHeader, Sign(webhook.Secret, delivery.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to post: %v", err)
+	}
+
+	defer resp.Body.Close()
+
+	// the body is read so that the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// record saves the result of an attempt. Finished deliveries expire after the
+// retention duration.
+func (d *Dispatcher) record(delivery Delivery, status int, deliverErr error) error {
+	delivery.Attempts++
+	delivery.LastStatus = status
+	delivery.LastError = ""
+
+	var opts *buntdb.SetOptions
+
+	switch {
+	case deliverErr == nil:
+		delivery.Status = StatusDelivered
+		opts = &buntdb.SetOptions{Expires: true, TTL: d.retention}
+
+		d.logger.Info().Msgf("delivery '%s' of '%s' delivered", delivery.ID, delivery.Event)
+	case delivery.Attempts >= d.maxAttempts:
+		delivery.Status = StatusFailed
+		delivery.LastError = deliverErr.Error()
+		opts = &buntdb.SetOptions{Expires: true, TTL: d.retention}
+
+		d.logger.Warn().Err(deliverErr).Msgf("delivery '%s' failed, giving up", delivery.ID)
+	default:
+		delivery.LastError = deliverErr.Error()
+		delivery.NextAttempt = time.Now().UTC().Add(d.retryDelay(delivery.Attempts))
+
+		d.logger.Warn().Err(deliverErr).Msgf("delivery '%s' failed, retrying at %s",
+			delivery.ID, delivery.NextAttempt)
+	}
+
+	return d.db.Update(func(tx *buntdb.Tx) error {
+		// the delivery is dropped if its webhook was deleted meanwhile
+		_, err := tx.Get(deliveryPrefix + delivery.ID)
+		if err == buntdb.ErrNotFound {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to get: %v", err)
+		}
+
+		return setJSON(tx, deliveryPrefix+delivery.ID, delivery, opts)
+	})
+}
+
+// abandon marks a delivery whose webhook doesn't exist anymore as failed, so
+// that it expires like the finished deliveries instead of staying pending.
+func (d *Dispatcher) abandon(delivery Delivery) error {
+	delivery.Status = StatusFailed
+	delivery.LastError = "webhook deleted"
+
+	d.logger.Warn().Msgf("delivery '%s' failed, its webhook '%s' was deleted",
+		delivery.ID, delivery.Webhook)
+
+	return d.db.Update(func(tx *buntdb.Tx) error {
+		_, err := tx.Get(deliveryPrefix + delivery.ID)
+		if err == buntdb.ErrNotFound {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to get: %v", err)
+		}
+
+		return setJSON(tx, deliveryPrefix+delivery.ID, delivery,
+			&buntdb.SetOptions{Expires: true, TTL: d.retention})
+	})
+}
+
+// retryDelay returns the delay before the next attempt, which doubles after
+// each attempt.
+func (d *Dispatcher) retryDelay(attempts int) time.Duration {
+	delay := d.backoff
+
+	for i := 1; i < attempts && delay < d.maxBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > d.maxBackoff {
+		delay = d.maxBackoff
+	}
+
+	return delay
+}
+
+// byNextAttempt orders the deliveries stored as JSON by their next attempt,
+// pending ones first. It is the less function of the pending index.
+func byNextAttempt(a, b string) bool {
+	pendingA := gjson.Get(a, "status").String() == StatusPending
+	pendingB := gjson.Get(b, "status").String() == StatusPending
+
+	if pendingA != pendingB {
+		return pendingA
+	}
+
+	return nextAttempt(a).Before(nextAttempt(b))
+}
+
+// nextAttempt returns the next attempt of a delivery stored as JSON
+func nextAttempt(value string) time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, gjson.Get(value, "next_attempt").String())
+	return t
+}
+
+// Sign returns the signature of a body, as sent in the signature header.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,368 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nkcr/OSIA/events"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/buntdb"
+)
+
+func TestDispatcherDeliver(t *testing.T) {
+	db := newDB(t)
+	receiver := newReceiver(t, http.StatusOK)
+
+	webhook, err := CreateWebhook(db, receiver.URL, "secret", nil)
+	require.NoError(t, err)
+
+	dispatcher := NewDispatcher(db, http.DefaultClient, zerolog.New(io.Discard))
+
+	go dispatcher.Start()
+	defer dispatcher.Stop()
+
+	err = dispatcher.Publish(events.MediaAdded, events.MediaData{ID: "a"})
+	require.NoError(t, err)
+
+	req := receiver.next(t)
+
+	require.Equal(t, http.MethodPost, req.method)
+	require.Equal(t, "application/json", req.header.Get("Content-Type"))
+	require.Equal(t, events.MediaAdded, req.header.Get("X-OSIA-Event"))
+	require.Equal(t, Sign("secret", req.body), req.header.Get(SignatureHeader))
+
+	var payload Payload
+
+	err = json.Unmarshal(req.body, &payload)
+	require.NoError(t, err)
+
+	require.Equal(t, req.header.Get("X-OSIA-Delivery"), payload.ID)
+	require.Equal(t, events.MediaAdded, payload.Event)
+	require.JSONEq(t, `{"id": "a"}`, string(payload.Data))
+
+	delivery := waitStatus(t, db, webhook.ID, StatusDelivered)
+	require.Equal(t, payload.ID, delivery.ID)
+	require.Equal(t, 1, delivery.Attempts)
+	require.Equal(t, http.StatusOK, delivery.LastStatus)
+	require.Empty(t, delivery.LastError)
+}
+
+func TestDispatcherSubscribedEvents(t *testing.T) {
+	db := newDB(t)
+
+	_, err := CreateWebhook(db, "https://example.com", "", []string{events.MediaDeleted})
+	require.NoError(t, err)
+
+	dispatcher := NewDispatcher(db, nil, zerolog.New(io.Discard))
+
+	err = dispatcher.Publish(events.MediaAdded, events.MediaData{ID: "a"})
+	require.NoError(t, err)
+
+	err = dispatcher.Publish(events.MediaDeleted, events.MediaData{ID: "a"})
+	require.NoError(t, err)
+
+	deliveries, err := ListDeliveries(db, "", 10)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	require.Equal(t, events.MediaDeleted, deliveries[0].Event)
+
+	err = dispatcher.Publish(events.MediaAdded, func() {})
+	require.Error(t, err)
+}
+
+func TestDispatcherRetry(t *testing.T) {
+	db := newDB(t)
+	receiver := newReceiver(t, http.StatusInternalServerError, http.StatusOK)
+
+	webhook, err := CreateWebhook(db, receiver.URL, "", nil)
+	require.NoError(t, err)
+
+	dispatcher := newFastDispatcher(db)
+
+	go dispatcher.Start()
+	defer dispatcher.Stop()
+
+	err = dispatcher.Publish(events.SyncCompleted, nil)
+	require.NoError(t, err)
+
+	first := receiver.next(t)
+	second := receiver.next(t)
+
+	// a retry sends the same delivery
+	require.Equal(t, first.body, second.body)
+	require.Equal(t, first.header.Get("X-OSIA-Delivery"), second.header.Get("X-OSIA-Delivery"))
+
+	delivery := waitStatus(t, db, webhook.ID, StatusDelivered)
+	require.Equal(t, 2, delivery.Attempts)
+	require.Equal(t, http.StatusOK, delivery.LastStatus)
+	require.Empty(t, delivery.LastError)
+}
+
+func TestDispatcherGiveUp(t *testing.T) {
+	db := newDB(t)
+	receiver := newReceiver(t, http.StatusInternalServerError)
+
+	webhook, err := CreateWebhook(db, receiver.URL, "", nil)
+	require.NoError(t, err)
+
+	dispatcher := newFastDispatcher(db)
+	dispatcher.maxAttempts = 3
+
+	go dispatcher.Start()
+	defer dispatcher.Stop()
+
+	err = dispatcher.Publish(events.SyncCompleted, nil)
+	require.NoError(t, err)
+
+	delivery := waitStatus(t, db, webhook.ID, StatusFailed)
+	require.Equal(t, 3, delivery.Attempts)
+	require.Equal(t, http.StatusInternalServerError, delivery.LastStatus)
+	require.Equal(t, "unexpected status: 500 Internal Server Error", delivery.LastError)
+}
+
+func TestDispatcherClientError(t *testing.T) {
+	db := newDB(t)
+
+	webhook, err := CreateWebhook(db, "http://127.0.0.1:1", "", nil)
+	require.NoError(t, err)
+
+	dispatcher := NewDispatcher(db, http.DefaultClient, zerolog.New(io.Discard))
+
+	err = dispatcher.Publish(events.SyncCompleted, nil)
+	require.NoError(t, err)
+
+	dispatcher.deliverDue()
+
+	deliveries, err := ListDeliveries(db, webhook.ID, 10)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+
+	delivery := deliveries[0]
+	require.Equal(t, StatusPending, delivery.Status)
+	require.Equal(t, 1, delivery.Attempts)
+	require.Equal(t, 0, delivery.LastStatus)
+	require.Contains(t, delivery.LastError, "failed to post")
+	require.True(t, delivery.NextAttempt.After(time.Now().Add(20*time.Second)))
+
+	// the delivery is not due yet
+	dispatcher.deliverDue()
+
+	deliveries, err = ListDeliveries(db, webhook.ID, 10)
+	require.NoError(t, err)
+	require.Equal(t, 1, deliveries[0].Attempts)
+}
+
+// Pending deliveries are sent after a restart.
+func TestDispatcherRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	receiver := newReceiver(t, http.StatusOK)
+
+	db, err := buntdb.Open(path)
+	require.NoError(t, err)
+
+	webhook, err := CreateWebhook(db, receiver.URL, "", nil)
+	require.NoError(t, err)
+
+	dispatcher := NewDispatcher(db, http.DefaultClient, zerolog.New(io.Discard))
+
+	err = dispatcher.Publish(events.MediaAdded, events.MediaData{ID: "a"})
+	require.NoError(t, err)
+
+	err = db.Close()
+	require.NoError(t, err)
+
+	db, err = buntdb.Open(path)
+	require.NoError(t, err)
+
+	defer db.Close()
+
+	dispatcher = NewDispatcher(db, http.DefaultClient, zerolog.New(io.Discard))
+
+	go dispatcher.Start()
+	defer dispatcher.Stop()
+
+	req := receiver.next(t)
+	require.Equal(t, events.MediaAdded, req.header.Get("X-OSIA-Event"))
+
+	waitStatus(t, db, webhook.ID, StatusDelivered)
+}
+
+// A pending delivery whose webhook is missing fails, and expires.
+func TestDispatcherMissingWebhook(t *testing.T) {
+	db := newDB(t)
+	dispatcher := newFastDispatcher(db)
+
+	delivery := Delivery{ID: "a", Webhook: "x", Status: StatusPending, NextAttempt: time.Now()}
+
+	err := db.Update(func(tx *buntdb.Tx) error {
+		return setJSON(tx, deliveryPrefix+delivery.ID, delivery, nil)
+	})
+	require.NoError(t, err)
+
+	dispatcher.deliverDue()
+
+	deliveries, err := ListDeliveries(db, "x", 10)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	require.Equal(t, StatusFailed, deliveries[0].Status)
+	require.Equal(t, "webhook deleted", deliveries[0].LastError)
+
+	err = db.View(func(tx *buntdb.Tx) error {
+		ttl, err := tx.TTL(deliveryPrefix + delivery.ID)
+		require.Greater(t, ttl, time.Duration(0))
+
+		return err
+	})
+	require.NoError(t, err)
+}
+
+// Pending deliveries are indexed by their next attempt, before the others.
+func TestPendingIndex(t *testing.T) {
+	db := newDB(t)
+	NewDispatcher(db, nil, zerolog.New(io.Discard))
+
+	now := time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	deliveries := []Delivery{
+		{ID: "a", Status: StatusDelivered, NextAttempt: now},
+		{ID: "b", Status: StatusPending, NextAttempt: now.Add(time.Second)},
+		{ID: "c", Status: StatusPending, NextAttempt: now.Add(100 * time.Millisecond)},
+		{ID: "d", Status: StatusFailed, NextAttempt: now},
+		{ID: "e", Status: StatusPending, NextAttempt: now.Add(120 * time.Millisecond)},
+	}
+
+	err := db.Update(func(tx *buntdb.Tx) error {
+		for _, delivery := range deliveries {
+			err := setJSON(tx, deliveryPrefix+delivery.ID, delivery, nil)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	ids := []string{}
+
+	err = db.View(func(tx *buntdb.Tx) error {
+		return tx.Ascend(pendingIndex, func(key, value string) bool {
+			ids = append(ids, key[len(deliveryPrefix):])
+			return true
+		})
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"c", "e", "b", "a", "d"}, ids)
+}
+
+func TestRetryDelay(t *testing.T) {
+	dispatcher := NewDispatcher(newDB(t), nil, zerolog.New(io.Discard))
+
+	require.Equal(t, 30*time.Second, dispatcher.retryDelay(1))
+	require.Equal(t, time.Minute, dispatcher.retryDelay(2))
+	require.Equal(t, 2*time.Minute, dispatcher.retryDelay(3))
+	require.Equal(t, 32*time.Minute, dispatcher.retryDelay(7))
+	require.Equal(t, time.Hour, dispatcher.retryDelay(8))
+	require.Equal(t, time.Hour, dispatcher.retryDelay(100))
+}
+
+func TestSign(t *testing.T) {
+	// echo -n '{"id":"a"}' | openssl dgst -sha256 -hmac secret
+	require.Equal(t, "sha256=2d51aa3c44d6cdc71b628911fbae9cadc393d199b422d87fd6f207f0330697d2",
+		Sign("secret", []byte(`{"id":"a"}`)))
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+// newFastDispatcher returns a dispatcher that retries without waiting
+func newFastDispatcher(db *buntdb.DB) *Dispatcher {
+	dispatcher := NewDispatcher(db, http.DefaultClient, zerolog.New(io.Discard))
+	dispatcher.pollInterval = 5 * time.Millisecond
+	dispatcher.backoff = time.Millisecond
+	dispatcher.maxBackoff = time.Millisecond
+
+	return dispatcher
+}
+
+// waitStatus waits until the last delivery of a webhook has the given status
+func waitStatus(t *testing.T, db *buntdb.DB, webhookID, status string) Delivery {
+	var delivery Delivery
+
+	require.Eventually(t, func() bool {
+		deliveries, err := ListDeliveries(db, webhookID, 1)
+		require.NoError(t, err)
+
+		if len(deliveries) == 0 {
+			return false
+		}
+
+		delivery = deliveries[0]
+
+		return delivery.Status == status
+	}, 5*time.Second, 5*time.Millisecond)
+
+	return delivery
+}
+
+type receivedRequest struct {
+	method string
+	header http.Header
+	body   []byte
+}
+
+// receiver is a webhook receiver that responds with the given statuses, the
+// last one being repeated.
+type receiver struct {
+	*httptest.Server
+	sync.Mutex
+
+	statuses []int
+	requests chan receivedRequest
+}
+
+func newReceiver(t *testing.T, statuses ...int) *receiver {
+	r := &receiver{
+		statuses: statuses,
+		requests: make(chan receivedRequest, 100),
+	}
+
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+
+		r.requests <- receivedRequest{method: req.Method, header: req.Header, body: body}
+
+		r.Lock()
+		status := r.statuses[0]
+		if len(r.statuses) > 1 {
+			r.statuses = r.statuses[1:]
+		}
+		r.Unlock()
+
+		w.WriteHeader(status)
+	}))
+
+	t.Cleanup(r.Close)
+
+	return r
+}
+
+// next returns the next received request
+func (r *receiver) next(t *testing.T) receivedRequest {
+	select {
+	case req := <-r.requests:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("no request received")
+		return receivedRequest{}
+	}
+}
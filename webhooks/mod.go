@@ -0,0 +1,293 @@
+package webhooks
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/nkcr/OSIA/events"
+	"github.com/tidwall/buntdb"
+)
+
+// webhookPrefix is the prefix of the keys that store the webhooks, as
+// "webhook:<id>".
+const webhookPrefix = "webhook:"
+
+// deliveryPrefix is the prefix of the keys that store the deliveries, as
+// "webhook-delivery:<id>".
+const deliveryPrefix = "webhook-delivery:"
+
+// ErrNotFound is returned when a webhook doesn't exist
+var ErrNotFound = errors.New("webhook not found")
+
+// ErrInvalid is returned when a webhook is not valid
+var ErrInvalid = errors.New("invalid webhook")
+
+// supportedEvents contains the events a webhook can subscribe to
+var supportedEvents = []string{events.MediaAdded, events.MediaUpdated, events.MediaDeleted,
+	events.SyncCompleted}
+
+// Webhook defines a subscription to the events of OSIA. Deliveries are signed
+// with the secret, which is only returned when the webhook is created.
+type Webhook struct {
+	ID      string   `json:"id"`
+	URL     string   `json:"url"`
+	Events  []string `json:"events"`
+	Secret  string   `json:"secret,omitempty"`
+	Created string   `json:"created"`
+}
+
+// Delivery statuses
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusFailed    = "failed"
+)
+
+// Delivery defines the delivery of an event to a webhook
+type Delivery struct {
+	ID          string          `json:"id"`
+	Webhook     string          `json:"webhook"`
+	Event       string          `json:"event"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	LastStatus  int             `json:"last_status,omitempty"`
+	LastError   string          `json:"last_error,omitempty"`
+	Created     time.Time       `json:"created"`
+}
+
+// Payload is the body sent to webhooks
+type Payload struct {
+	ID      string          `json:"id"`
+	Event   string          `json:"event"`
+	Created time.Time       `json:"created"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// CreateWebhook stores a new webhook. It subscribes to all the events if none
+// is provided. A secret is generated if none is provided.
+func CreateWebhook(db *buntdb.DB, rawURL, secret string, eventTypes []string) (Webhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return Webhook{}, fmt.Errorf("%w: bad URL: %s", ErrInvalid, rawURL)
+	}
+
+	if len(eventTypes) == 0 {
+		eventTypes = supportedEvents
+	}
+
+	for _, eventType := range eventTypes {
+		if !contains(supportedEvents, eventType) {
+			return Webhook{}, fmt.Errorf("%w: unknown event: %s", ErrInvalid, eventType)
+		}
+	}
+
+	if secret == "" {
+		secret, err = randomID(32)
+		if err != nil {
+			return Webhook{}, fmt.Errorf("failed to generate secret: %v", err)
+		}
+
+		secret = "whsec_" + secret
+	}
+
+	id, err := randomID(8)
+	if err != nil {
+		return Webhook{}, fmt.Errorf("failed to generate id: %v", err)
+	}
+
+	webhook := Webhook{
+		ID:      id,
+		URL:     rawURL,
+		Events:  eventTypes,
+		Secret:  secret,
+		Created: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	err = db.Update(func(tx *buntdb.Tx) error {
+		return setJSON(tx, webhookPrefix+webhook.ID, webhook, nil)
+	})
+
+	if err != nil {
+		return Webhook{}, err
+	}
+
+	return webhook, nil
+}
+
+// ListWebhooks returns the webhooks, sorted by creation date, without their
+// secret.
+func ListWebhooks(db *buntdb.DB) ([]Webhook, error) {
+	var webhooks []Webhook
+
+	err := db.View(func(tx *buntdb.Tx) error {
+		var err error
+
+		webhooks, err = listWebhooks(tx)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+
+	return webhooks, nil
+}
+
+// DeleteWebhook deletes a webhook. Its pending deliveries are dropped.
+func DeleteWebhook(db *buntdb.DB, id string) error {
+	return db.Update(func(tx *buntdb.Tx) error {
+		_, err := tx.Delete(webhookPrefix + id)
+		if err == buntdb.ErrNotFound {
+			return ErrNotFound
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to delete: %v", err)
+		}
+
+		deliveries, err := listDeliveries(tx)
+		if err != nil {
+			return err
+		}
+
+		for _, delivery := range deliveries {
+			if delivery.Webhook == id && delivery.Status == StatusPending {
+				_, err = tx.Delete(deliveryPrefix + delivery.ID)
+				if err != nil {
+					return fmt.Errorf("failed to delete delivery: %v", err)
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// ListDeliveries returns the most recent deliveries first, at most count. If
+// webhookID is not empty, only the deliveries of that webhook are returned.
+func ListDeliveries(db *buntdb.DB, webhookID string, count int) ([]Delivery, error) {
+	var deliveries []Delivery
+
+	err := db.View(func(tx *buntdb.Tx) error {
+		var err error
+
+		deliveries, err = listDeliveries(tx)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := []Delivery{}
+
+	for i := len(deliveries) - 1; i >= 0 && len(result) < count; i-- {
+		if webhookID == "" || deliveries[i].Webhook == webhookID {
+			result = append(result, deliveries[i])
+		}
+	}
+
+	return result, nil
+}
+
+// listWebhooks returns the webhooks sorted by creation date
+func listWebhooks(tx *buntdb.Tx) ([]Webhook, error) {
+	webhooks := []Webhook{}
+
+	err := tx.AscendKeys(webhookPrefix+"*", func(key, value string) bool {
+		var webhook Webhook
+
+		err := json.Unmarshal([]byte(value), &webhook)
+		if err == nil {
+			webhooks = append(webhooks, webhook)
+		}
+
+		return true
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhooks: %v", err)
+	}
+
+	sort.SliceStable(webhooks, func(i, j int) bool {
+		return webhooks[i].Created < webhooks[j].Created
+	})
+
+	return webhooks, nil
+}
+
+// listDeliveries returns the deliveries sorted by creation date
+func listDeliveries(tx *buntdb.Tx) ([]Delivery, error) {
+	deliveries := []Delivery{}
+
+	err := tx.AscendKeys(deliveryPrefix+"*", func(key, value string) bool {
+		var delivery Delivery
+
+		err := json.Unmarshal([]byte(value), &delivery)
+		if err == nil {
+			deliveries = append(deliveries, delivery)
+		}
+
+		return true
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list deliveries: %v", err)
+	}
+
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		return deliveries[i].Created.Before(deliveries[j].Created)
+	})
+
+	return deliveries, nil
+}
+
+// setJSON stores a value as JSON
+func setJSON(tx *buntdb.Tx, key string, v interface{}, opts *buntdb.SetOptions) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal: %v", err)
+	}
+
+	_, _, err = tx.Set(key, string(buf), opts)
+	if err != nil {
+		return fmt.Errorf("failed to set: %v", err)
+	}
+
+	return nil
+}
+
+// randomID returns a random hex string of n bytes
+func randomID(n int) (string, error) {
+	buf := make([]byte, n)
+
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+// contains returns true if the element is in the slice
+func contains(elements []string, element string) bool {
+	for _, e := range elements {
+		if e == element {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,150 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/nkcr/OSIA/events"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/buntdb"
+)
+
+func TestCreateWebhook(t *testing.T) {
+	db := newDB(t)
+
+	webhook, err := CreateWebhook(db, "https://example.com/hook", "", nil)
+	require.NoError(t, err)
+
+	require.Len(t, webhook.ID, 16)
+	require.Equal(t, "https://example.com/hook", webhook.URL)
+	require.Equal(t, supportedEvents, webhook.Events)
+	require.Regexp(t, "^whsec_[0-9a-f]{64}$", webhook.Secret)
+
+	webhook, err = CreateWebhook(db, "http://example.com", "secret", []string{events.MediaDeleted})
+	require.NoError(t, err)
+
+	require.Equal(t, "secret", webhook.Secret)
+	require.Equal(t, []string{events.MediaDeleted}, webhook.Events)
+
+	// the secrets are not listed
+	list, err := ListWebhooks(db)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+
+	for _, webhook := range list {
+		require.Empty(t, webhook.Secret)
+	}
+}
+
+func TestCreateWebhookInvalid(t *testing.T) {
+	db := newDB(t)
+
+	for _, rawURL := range []string{"", "example.com", "ftp://example.com", "http://", ":"} {
+		_, err := CreateWebhook(db, rawURL, "", nil)
+		require.ErrorIs(t, err, ErrInvalid, rawURL)
+	}
+
+	_, err := CreateWebhook(db, "https://example.com", "", []string{"media.unknown"})
+	require.ErrorIs(t, err, ErrInvalid)
+	require.EqualError(t, err, "invalid webhook: unknown event: media.unknown")
+
+	list, err := ListWebhooks(db)
+	require.NoError(t, err)
+	require.Len(t, list, 0)
+}
+
+func TestDeleteWebhook(t *testing.T) {
+	db := newDB(t)
+
+	kept, err := CreateWebhook(db, "https://example.com/kept", "", nil)
+	require.NoError(t, err)
+
+	deleted, err := CreateWebhook(db, "https://example.com/deleted", "", nil)
+	require.NoError(t, err)
+
+	dispatcher := NewDispatcher(db, nil, zerolog.New(io.Discard))
+
+	err = dispatcher.Publish(events.MediaAdded, events.MediaData{ID: "a"})
+	require.NoError(t, err)
+
+	err = DeleteWebhook(db, deleted.ID)
+	require.NoError(t, err)
+
+	err = DeleteWebhook(db, deleted.ID)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	list, err := ListWebhooks(db)
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	require.Equal(t, kept.ID, list[0].ID)
+
+	// the pending deliveries of the deleted webhook are dropped
+	deliveries, err := ListDeliveries(db, "", 10)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	require.Equal(t, kept.ID, deliveries[0].Webhook)
+}
+
+func TestListDeliveries(t *testing.T) {
+	db := newDB(t)
+
+	first, err := CreateWebhook(db, "https://example.com/first", "", nil)
+	require.NoError(t, err)
+
+	second, err := CreateWebhook(db, "https://example.com/second", "", []string{events.SyncCompleted})
+	require.NoError(t, err)
+
+	dispatcher := NewDispatcher(db, nil, zerolog.New(io.Discard))
+
+	for _, id := range []string{"a", "b", "c"} {
+		err = dispatcher.Publish(events.MediaAdded, events.MediaData{ID: id})
+		require.NoError(t, err)
+
+		// deliveries are sorted by creation date
+		time.Sleep(time.Millisecond)
+	}
+
+	err = dispatcher.Publish(events.SyncCompleted, nil)
+	require.NoError(t, err)
+
+	deliveries, err := ListDeliveries(db, "", 10)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 5)
+
+	deliveries, err = ListDeliveries(db, first.ID, 2)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 2)
+	require.Equal(t, events.SyncCompleted, deliveries[0].Event)
+	require.JSONEq(t, `{"id": "c"}`, string(payloadData(t, deliveries[1])))
+
+	deliveries, err = ListDeliveries(db, second.ID, 10)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	require.Equal(t, StatusPending, deliveries[0].Status)
+	require.Equal(t, 0, deliveries[0].Attempts)
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+func newDB(t *testing.T) *buntdb.DB {
+	db, err := buntdb.Open(":memory:")
+	require.NoError(t, err)
+
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+// payloadData returns the data of a delivery's payload
+func payloadData(t *testing.T, delivery Delivery) json.RawMessage {
+	var payload Payload
+
+	err := json.Unmarshal(delivery.Payload, &payload)
+	require.NoError(t, err)
+
+	return payload.Data
+}